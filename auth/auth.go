@@ -0,0 +1,694 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/logging"
+)
+
+const (
+	sessionCookieName = "scanner_session"
+	csrfCookieName    = "scanner_csrf"
+	oidcCookieName    = "scanner_oidc"
+
+	// CSRFHeader is the header in which clients must send the CSRF token along with
+	// requests that have side effects. The token can be read from the scanner_csrf
+	// cookie.
+	CSRFHeader = "X-CSRF-Token"
+	// CSRFParam is the query parameter in which clients can send the CSRF token instead
+	// of the CSRF header, for requests which headers can't be set, e.g. the ones of an
+	// EventSource.
+	CSRFParam = "csrf_token"
+
+	loginPage = "/login.html"
+
+	// oidcStateLifetime is the amount of time users have to log in with the OpenID
+	// Connect provider.
+	oidcStateLifetime = 10 * time.Minute
+)
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	tokenKey
+)
+
+var (
+	// publicPaths are the paths that can be accessed without being logged in, i.e. the
+	// login page and what it needs.
+	publicPaths = map[string]bool{
+		loginPage:        true,
+		"/js/login.js":   true,
+		"/manifest.json": true,
+		// The description of the API isn't a secret.
+		"/api/openapi.json": true,
+	}
+	// publicPrefixes are the prefixes of the paths that can be accessed without being
+	// logged in.
+	publicPrefixes = []string{"/auth/", "/css/", "/img/", "/misc/"}
+)
+
+// PasswordChecker checks the credentials of a user.
+type PasswordChecker interface {
+	CheckPassword(user string, password string) bool
+}
+
+// Authenticator authenticates the users of the web UI and the API, using either a user
+// name and a password or an OpenID Connect provider, and keeps track of their sessions
+// using signed cookies. Headless clients can authenticate with API tokens instead.
+type Authenticator struct {
+	cfg       *config.AuthConfig
+	signer    *signer
+	passwords PasswordChecker
+	oidc      *oidcProvider
+	tokens    *TokenStore
+	revoked   *revocationList
+	admins    map[string]bool
+}
+
+// NewAuthenticator returns a new Authenticator. It also loads the htpasswd file if one
+// has been configured, the API tokens, and the sessions that have been revoked.
+func NewAuthenticator(cfg *config.AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		cfg:    cfg,
+		admins: make(map[string]bool),
+	}
+
+	for _, user := range cfg.Admins {
+		a.admins[user] = true
+	}
+
+	if !cfg.Enabled() {
+		logrus.Warn("No authentication method configured, anyone can use the scanner")
+		return a, nil
+	}
+
+	key := []byte(cfg.SessionSecret)
+	if len(key) == 0 {
+		logrus.Warn("No session secret configured, sessions won't survive restarts")
+
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	a.signer = &signer{key: key}
+
+	if cfg.HtpasswdFile != "" {
+		htpasswd, err := LoadHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		a.passwords = htpasswd
+	}
+
+	if cfg.OIDC != nil {
+		a.oidc = newOIDCProvider(cfg.OIDC)
+	}
+
+	tokens, err := NewTokenStore(cfg.TokensFile)
+	if err != nil {
+		return nil, err
+	}
+	a.tokens = tokens
+
+	if a.revoked, err = newRevocationList(cfg.RevokedSessionsFile); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// User returns the name of the user who sent the given request, or the user the API
+// token it's authenticated with acts on behalf of. Returns an empty string if
+// authentication is disabled.
+func User(req *http.Request) string {
+	user, _ := req.Context().Value(userKey).(string)
+	return user
+}
+
+// APIToken returns the API token the given request is authenticated with, or nil if it's
+// not authenticated with an API token.
+func APIToken(req *http.Request) *Token {
+	t, _ := req.Context().Value(tokenKey).(*Token)
+	return t
+}
+
+// CheckScan checks that the API token the given request is authenticated with, if any,
+// is allowed to scan with the given options.
+// Returns ErrPresetNotAllowed if the token can't use the requested preset, or
+// ErrDestinationNotAllowed if it can't send files where requested.
+func CheckScan(req *http.Request, options *common.ScanOptions) error {
+	if t := APIToken(req); t != nil && !t.allowsPreset(options.Preset) {
+		return ErrPresetNotAllowed
+	}
+
+	return CheckDestinations(req, options)
+}
+
+// CheckDestinations checks that the API token the given request is authenticated with,
+// if any, is allowed to send files to the destinations from the given options, and to
+// store them in the requested folder.
+// Returns ErrDestinationNotAllowed if it isn't.
+func CheckDestinations(req *http.Request, options *common.ScanOptions) error {
+	t := APIToken(req)
+	if t == nil {
+		return nil
+	}
+
+	for _, d := range options.Destinations {
+		if !t.allowsDestination(d) {
+			return ErrDestinationNotAllowed
+		}
+	}
+
+	return CheckFolder(req, options.Folder)
+}
+
+// CheckFolder checks that the API token the given request is authenticated with, if any,
+// is allowed to store files in the given folder, relative to the upload path.
+// Returns ErrDestinationNotAllowed if it isn't.
+func CheckFolder(req *http.Request, folder string) error {
+	if t := APIToken(req); t != nil && !t.allowsFolder(folder) {
+		return ErrDestinationNotAllowed
+	}
+
+	return nil
+}
+
+// Middleware returns a handler that checks that requests come from logged in users, or
+// are authenticated with a valid API token, before passing them on to the given handler.
+// Requests with side effects (i.e. which method isn't GET, HEAD or OPTIONS) from logged
+// in users must also include the user's CSRF token. Requests from users who aren't
+// logged in are redirected to the login page if they're for a page, and rejected
+// otherwise.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	if !a.cfg.Enabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isPublic(req.URL.Path) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		// API tokens are sent in the Authorization header, which browsers don't add on
+		// their own, so there's no need to check the CSRF token for these requests.
+		if value, ok := bearerToken(req); ok {
+			t, err := a.tokens.Authenticate(value)
+			if err != nil {
+				if err != ErrInvalidToken {
+					logging.Entry(req.Context()).WithError(err).Error("Failed to check API token")
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				deny(w, req, http.StatusUnauthorized, "Invalid API token")
+				return
+			}
+
+			ctx := context.WithValue(req.Context(), userKey, t.User)
+			ctx = context.WithValue(ctx, tokenKey, t)
+			next.ServeHTTP(w, req.WithContext(ctx))
+			return
+		}
+
+		sess := a.session(req)
+		if sess == nil {
+			if req.URL.Path == "/" || strings.HasSuffix(req.URL.Path, ".html") {
+				http.Redirect(w, req, loginPage, http.StatusFound)
+			} else {
+				deny(w, req, http.StatusUnauthorized, "Unauthorized")
+			}
+			return
+		}
+
+		if !isSafeMethod(req.Method) && !validCSRF(req, sess) {
+			deny(w, req, http.StatusForbidden, "Missing or invalid CSRF token")
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), userKey, sess.User)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// RequireCSRF returns a handler that checks that requests include the user's CSRF token,
+// regardless of their method, before passing them on to the given handler. This is
+// meant for endpoints that have side effects despite being accessed with GET requests.
+func (a *Authenticator) RequireCSRF(next http.HandlerFunc) http.HandlerFunc {
+	if !a.cfg.Enabled() {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		// Requests authenticated with an API token can't be forged by other websites.
+		if APIToken(req) != nil {
+			next(w, req)
+			return
+		}
+
+		if sess := a.session(req); sess == nil || !validCSRF(req, sess) {
+			deny(w, req, http.StatusForbidden, "Missing or invalid CSRF token")
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+// RequireScope returns a handler that checks that requests are allowed to use the given
+// scope before passing them on to the given handler. Requests authenticated with an API
+// token must have been granted the scope, and logged in users can use every scope
+// except the admin one, which only the configured admins can use.
+func (a *Authenticator) RequireScope(scope Scope, next http.HandlerFunc) http.HandlerFunc {
+	if !a.cfg.Enabled() {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !a.HasScope(req, scope) {
+			deny(w, req, http.StatusForbidden, "Insufficient permissions")
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+// HasScope returns whether the given request is allowed to use the given scope, which is
+// always the case if authentication is disabled.
+func (a *Authenticator) HasScope(req *http.Request, scope Scope) bool {
+	if !a.cfg.Enabled() {
+		return true
+	}
+
+	if t := APIToken(req); t != nil {
+		return t.HasScope(scope)
+	}
+
+	return scope != ScopeAdmin || a.admins[User(req)]
+}
+
+// RegisterHandlers registers the handlers used to log users in and out, and to manage
+// API tokens, on the given mux.
+func (a *Authenticator) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/auth/methods", a.handleMethods)
+	mux.HandleFunc("/auth/login", a.handleLogin)
+	mux.HandleFunc("/auth/logout", a.handleLogout)
+	mux.HandleFunc("/auth/oidc/login", a.handleOIDCLogin)
+	mux.HandleFunc("/auth/oidc/callback", a.handleOIDCCallback)
+	mux.HandleFunc("/tokens", a.RequireScope(ScopeAdmin, a.handleTokens))
+	mux.HandleFunc("/tokens/", a.RequireScope(ScopeAdmin, a.handleTokens))
+}
+
+// handleMethods tells the login page which methods can be used to log in.
+func (a *Authenticator) handleMethods(w http.ResponseWriter, req *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]bool{
+		"password": a.passwords != nil,
+		"oidc":     a.oidc != nil,
+	})
+	if err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to respond to /auth/methods request")
+	}
+}
+
+// handleLogin checks the user name and password submitted through the login form, and
+// starts a session if they're valid.
+func (a *Authenticator) handleLogin(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if a.passwords == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	user := req.PostFormValue("user")
+	if user == "" || !a.passwords.CheckPassword(user, req.PostFormValue("password")) {
+		logging.Entry(req.Context()).WithField("user", user).Warn("Failed login attempt")
+		http.Redirect(w, req, loginPage+"?error=credentials", http.StatusSeeOther)
+		return
+	}
+
+	a.startSession(w, req, user)
+}
+
+// handleLogout ends the user's session, and revokes it so its cookie can't be used
+// again, e.g. if it's been stolen.
+func (a *Authenticator) handleLogout(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if sess := a.session(req); sess != nil {
+		// Don't let other websites log users out.
+		if !validCSRF(req, sess) {
+			http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		if err := a.revoked.revoke(sess.ID, sess.Expires); err != nil {
+			logging.Entry(req.Context()).WithError(err).Error("Failed to revoke session")
+			http.Error(w, "Something happened", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	a.setCookie(w, sessionCookieName, "", "/", -1, true)
+	a.setCookie(w, csrfCookieName, "", "/", -1, false)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleOIDCLogin redirects the user to the OpenID Connect provider so they can log in.
+func (a *Authenticator) handleOIDCLogin(w http.ResponseWriter, req *http.Request) {
+	if a.oidc == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	st := &oidcState{Expires: time.Now().Add(oidcStateLifetime).Unix()}
+
+	var err error
+	if st.State, err = randomString(16); err == nil {
+		if st.Nonce, err = randomString(16); err == nil {
+			st.Verifier, err = randomString(32)
+		}
+	}
+	if err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to generate OIDC state")
+		http.Error(w, "Something happened", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := a.oidc.authCodeURL(st)
+	if err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to reach the OIDC provider")
+		http.Redirect(w, req, loginPage+"?error=provider", http.StatusFound)
+		return
+	}
+
+	signed, err := a.signer.sign(st)
+	if err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to sign OIDC state")
+		http.Error(w, "Something happened", http.StatusInternalServerError)
+		return
+	}
+
+	a.setCookie(w, oidcCookieName, signed, "/auth/oidc/", int(oidcStateLifetime.Seconds()), true)
+	http.Redirect(w, req, authURL, http.StatusFound)
+}
+
+// handleOIDCCallback handles the user coming back from the OpenID Connect provider, and
+// starts a session if they've successfully logged in.
+func (a *Authenticator) handleOIDCCallback(w http.ResponseWriter, req *http.Request) {
+	if a.oidc == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	// Whatever happens, the state can't be used again.
+	a.setCookie(w, oidcCookieName, "", "/auth/oidc/", -1, true)
+
+	query := req.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		logging.Entry(req.Context()).WithField("error", errCode).Warn("OIDC provider returned an error")
+		http.Redirect(w, req, loginPage+"?error=provider", http.StatusFound)
+		return
+	}
+
+	st := new(oidcState)
+	cookie, err := req.Cookie(oidcCookieName)
+	if err != nil || a.signer.verify(cookie.Value, st) != nil ||
+		time.Now().Unix() > st.Expires ||
+		subtle.ConstantTimeCompare([]byte(st.State), []byte(query.Get("state"))) != 1 {
+		logging.Entry(req.Context()).Warn("Received OIDC callback with a missing or invalid state")
+		http.Redirect(w, req, loginPage+"?error=state", http.StatusFound)
+		return
+	}
+
+	user, err := a.oidc.exchange(query.Get("code"), st)
+	if err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to log in with the OIDC provider")
+		http.Redirect(w, req, loginPage+"?error=provider", http.StatusFound)
+		return
+	}
+
+	a.startSession(w, req, user)
+}
+
+// handleTokens lists the API tokens on GET /tokens, creates one on POST /tokens, and
+// revokes one on DELETE /tokens/{id}. The value of a new token is only ever included in
+// the response to the request that created it.
+func (a *Authenticator) handleTokens(w http.ResponseWriter, req *http.Request) {
+	// Tell browsers not to cache this endpoint.
+	w.Header().Add("Cache-Control", "no-cache")
+
+	if a.tokens == nil {
+		http.Error(w, "Authentication is disabled", http.StatusNotFound)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, "/tokens"), "/")
+
+	var err error
+	switch {
+	case id == "" && req.Method == http.MethodGet:
+		var tokens []*Token
+		if tokens, err = a.tokens.Tokens(); err == nil {
+			w.Header().Add("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(map[string][]*Token{"tokens": tokens})
+			if err != nil {
+				logging.Entry(req.Context()).WithError(err).Error("Failed to respond to /tokens request")
+			}
+			return
+		}
+	case id == "" && req.Method == http.MethodPost:
+		var body struct {
+			Name         string   `json:"name"`
+			User         string   `json:"user"`
+			Scopes       []Scope  `json:"scopes"`
+			Presets      []string `json:"presets"`
+			Destinations []string `json:"destinations"`
+		}
+		if err = json.NewDecoder(req.Body).Decode(&body); err != nil || body.Name == "" {
+			http.Error(w, "Malformed request body", http.StatusBadRequest)
+			return
+		}
+
+		var t *Token
+		var value string
+		t, value, err = a.tokens.Create(
+			body.Name,
+			body.User,
+			body.Scopes,
+			body.Presets,
+			body.Destinations,
+		)
+		if err == nil {
+			logging.Entry(req.Context()).WithFields(logrus.Fields{
+				"token_id": t.ID,
+				"name":     t.Name,
+				"by":       User(req),
+			}).Info("Created API token")
+
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			err = json.NewEncoder(w).Encode(struct {
+				*Token
+				Value string `json:"token"`
+			}{t, value})
+			if err != nil {
+				logging.Entry(req.Context()).WithError(err).Error("Failed to respond to /tokens request")
+			}
+			return
+		}
+	case id != "" && req.Method == http.MethodDelete:
+		if err = a.tokens.Revoke(id); err == nil {
+			logging.Entry(req.Context()).WithFields(logrus.Fields{
+				"token_id": id,
+				"by":       User(req),
+			}).Info("Revoked API token")
+
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Is(err, ErrUnknownScope) {
+		http.Error(w, "Unknown scope", http.StatusBadRequest)
+	} else if err == ErrTokenNotFound {
+		http.Error(w, "Token not found", http.StatusNotFound)
+	} else {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to manage API tokens")
+		http.Error(w, "Something happened", http.StatusInternalServerError)
+	}
+}
+
+// startSession sets the session cookies for the given user, and redirects them to the
+// web UI.
+func (a *Authenticator) startSession(w http.ResponseWriter, req *http.Request, user string) {
+	id, err := randomString(16)
+	if err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to generate session ID")
+		http.Error(w, "Something happened", http.StatusInternalServerError)
+		return
+	}
+
+	csrf, err := randomString(32)
+	if err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to generate CSRF token")
+		http.Error(w, "Something happened", http.StatusInternalServerError)
+		return
+	}
+
+	sess := &session{
+		ID:      id,
+		User:    user,
+		CSRF:    csrf,
+		Expires: time.Now().Add(a.cfg.SessionLifetime).Unix(),
+	}
+
+	signed, err := a.signer.sign(sess)
+	if err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to sign session")
+		http.Error(w, "Something happened", http.StatusInternalServerError)
+		return
+	}
+
+	maxAge := int(a.cfg.SessionLifetime.Seconds())
+	a.setCookie(w, sessionCookieName, signed, "/", maxAge, true)
+	// The front end needs to be able to read the CSRF token.
+	a.setCookie(w, csrfCookieName, csrf, "/", maxAge, false)
+
+	logging.Entry(req.Context()).WithField("user", user).Info("User logged in")
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+// session returns the session the given request belongs to, or nil if there's no valid
+// session, e.g. because it's expired or has been revoked.
+func (a *Authenticator) session(req *http.Request) *session {
+	cookie, err := req.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	sess := new(session)
+	if err = a.signer.verify(cookie.Value, sess); err != nil {
+		return nil
+	}
+
+	// Sessions started before sessions had IDs can't be revoked, so don't accept them.
+	if time.Now().Unix() > sess.Expires || sess.ID == "" || a.revoked.isRevoked(sess.ID) {
+		return nil
+	}
+
+	return sess
+}
+
+// setCookie sets a cookie with the given name, value, path and max age on the response.
+// A negative max age deletes the cookie.
+func (a *Authenticator) setCookie(
+	w http.ResponseWriter,
+	name string,
+	value string,
+	path string,
+	maxAge int,
+	httpOnly bool,
+) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: httpOnly,
+		Secure:   !a.cfg.InsecureCookies,
+		// Lax rather than Strict so the session and OIDC state cookies are sent when the
+		// user is redirected back from the OIDC provider.
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// deny rejects the given request with the given status code and message. Requests to
+// the JSON API get the same kind of JSON error as the API's other errors.
+func deny(w http.ResponseWriter, req *http.Request, status int, message string) {
+	if !strings.HasPrefix(req.URL.Path, "/api/") {
+		http.Error(w, message, status)
+		return
+	}
+
+	code := "forbidden"
+	if status == http.StatusUnauthorized {
+		code = "unauthorized"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(map[string]map[string]string{
+		"error": {"code": code, "message": message},
+	})
+	if err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to send JSON response")
+	}
+}
+
+// bearerToken returns the API token included in the Authorization header of the given
+// request, and whether there's one.
+func bearerToken(req *http.Request) (string, bool) {
+	header := req.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(header[7:]), true
+}
+
+// validCSRF returns whether the given request includes the CSRF token of the given
+// session, either in the CSRF header or in the CSRF query parameter.
+func validCSRF(req *http.Request, sess *session) bool {
+	token := req.Header.Get(CSRFHeader)
+	if token == "" {
+		token = req.URL.Query().Get(CSRFParam)
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRF)) == 1
+}
+
+// isSafeMethod returns whether requests with the given method shouldn't have side
+// effects.
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// isPublic returns whether the given path can be accessed without being logged in.
+func isPublic(path string) bool {
+	if publicPaths[path] {
+		return true
+	}
+
+	for _, prefix := range publicPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+)
+
+// newTestAuthenticator returns an Authenticator with password authentication enabled,
+// storing the revoked sessions in a temporary directory.
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	revoked, err := newRevocationList(filepath.Join(dir, "revoked_sessions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Authenticator{
+		cfg: &config.AuthConfig{
+			HtpasswdFile:        "htpasswd",
+			SessionLifetime:     time.Hour,
+			RevokedSessionsFile: filepath.Join(dir, "revoked_sessions.json"),
+		},
+		signer:  &signer{key: []byte("secret")},
+		revoked: revoked,
+	}
+}
+
+// login starts a session for the given user, and returns its cookies.
+func login(t *testing.T, a *Authenticator, user string) []*http.Cookie {
+	rec := httptest.NewRecorder()
+	a.startSession(rec, httptest.NewRequest(http.MethodPost, "/auth/login", nil), user)
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 2 {
+		t.Fatalf("got %d cookies; want 2", len(cookies))
+	}
+
+	return cookies
+}
+
+// requestWithCookies returns a request with the given method and path, carrying the
+// given cookies and, if csrf is true, the CSRF header.
+func requestWithCookies(method string, path string, cookies []*http.Cookie, csrf bool) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+		if csrf && c.Name == csrfCookieName {
+			req.Header.Set(CSRFHeader, c.Value)
+		}
+	}
+
+	return req
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	a := newTestAuthenticator(t)
+	cookies := login(t, a, "alice")
+
+	if sess := a.session(requestWithCookies(http.MethodGet, "/", cookies, false)); sess == nil || sess.User != "alice" {
+		t.Fatalf("got session %+v; want a session for alice", sess)
+	}
+
+	// Logging out without the CSRF token must not work.
+	rec := httptest.NewRecorder()
+	a.handleLogout(rec, requestWithCookies(http.MethodPost, "/auth/logout", cookies, false))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("logging out without the CSRF token got status %d; want %d", rec.Code, http.StatusForbidden)
+	}
+	if a.session(requestWithCookies(http.MethodGet, "/", cookies, false)) == nil {
+		t.Fatal("session has been revoked by a request without the CSRF token")
+	}
+
+	rec = httptest.NewRecorder()
+	a.handleLogout(rec, requestWithCookies(http.MethodPost, "/auth/logout", cookies, true))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("logging out got status %d; want %d", rec.Code, http.StatusNoContent)
+	}
+
+	// The cookie must not be usable anymore, even if the client kept it.
+	if sess := a.session(requestWithCookies(http.MethodGet, "/", cookies, false)); sess != nil {
+		t.Errorf("got session %+v after logging out; want none", sess)
+	}
+
+	// Other sessions must still be valid.
+	other := login(t, a, "alice")
+	if a.session(requestWithCookies(http.MethodGet, "/", other, false)) == nil {
+		t.Error("a new session isn't valid after logging out of another one")
+	}
+
+	// The revocation must survive restarts.
+	revoked, err := newRevocationList(a.cfg.RevokedSessionsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.revoked = revoked
+	if sess := a.session(requestWithCookies(http.MethodGet, "/", cookies, false)); sess != nil {
+		t.Errorf("got session %+v after restarting; want none", sess)
+	}
+}
+
+func TestSessionWithoutIDIsRejected(t *testing.T) {
+	a := newTestAuthenticator(t)
+
+	signed, err := a.signer.sign(&session{User: "alice", CSRF: "csrf", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: signed})
+	if sess := a.session(req); sess != nil {
+		t.Errorf("got session %+v; want none", sess)
+	}
+}
+
+func TestRequireCSRF(t *testing.T) {
+	a := newTestAuthenticator(t)
+	cookies := login(t, a, "alice")
+
+	called := false
+	handler := a.RequireCSRF(func(w http.ResponseWriter, req *http.Request) { called = true })
+
+	rec := httptest.NewRecorder()
+	handler(rec, requestWithCookies(http.MethodGet, "/preview.jpg", cookies, false))
+	if called || rec.Code != http.StatusForbidden {
+		t.Errorf("request without the CSRF token got status %d; want %d", rec.Code, http.StatusForbidden)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, requestWithCookies(http.MethodGet, "/preview.jpg", cookies, true))
+	if !called {
+		t.Errorf("request with the CSRF token got status %d; want it to go through", rec.Code)
+	}
+
+	// EventSources can't send headers, so they send the token in the query string.
+	for _, c := range cookies {
+		if c.Name != csrfCookieName {
+			continue
+		}
+
+		called = false
+		rec = httptest.NewRecorder()
+		handler(rec, requestWithCookies(http.MethodGet, "/preview.jpg?"+CSRFParam+"="+c.Value, cookies, false))
+		if !called {
+			t.Errorf("request with the CSRF token in the query string got status %d; want it to go through", rec.Code)
+		}
+	}
+}
+
+func TestCheckScan(t *testing.T) {
+	restricted := &Token{Presets: []string{"invoice"}, Destinations: []string{"invoices"}}
+
+	tests := []struct {
+		name    string
+		token   *Token
+		options *common.ScanOptions
+		wantErr error
+	}{
+		{name: "session", options: &common.ScanOptions{Preset: "photo", Destinations: []string{common.DestinationEmail}}},
+		{name: "unrestricted token", token: &Token{}, options: &common.ScanOptions{Destinations: []string{common.DestinationEmail}}},
+		{name: "allowed", token: restricted, options: &common.ScanOptions{Preset: "invoice", Folder: "invoices/2024"}},
+		{
+			name:    "allowed to webdav",
+			token:   restricted,
+			options: &common.ScanOptions{Preset: "invoice", Folder: "invoices", Destinations: []string{common.DestinationWebDAV}},
+		},
+		{name: "preset", token: restricted, options: &common.ScanOptions{Preset: "photo", Folder: "invoices"}, wantErr: ErrPresetNotAllowed},
+		{name: "folder", token: restricted, options: &common.ScanOptions{Preset: "invoice", Folder: "receipts"}, wantErr: ErrDestinationNotAllowed},
+		{
+			name:  "email",
+			token: restricted,
+			options: &common.ScanOptions{
+				Preset:       "invoice",
+				Folder:       "invoices",
+				Destinations: []string{common.DestinationWebDAV, common.DestinationEmail},
+				Email:        &common.EmailOptions{To: []string{"mallory@example.com"}},
+			},
+			wantErr: ErrDestinationNotAllowed,
+		},
+		{
+			name:    "download",
+			token:   restricted,
+			options: &common.ScanOptions{Preset: "invoice", Folder: "invoices", Destinations: []string{common.DestinationDownload}},
+			wantErr: ErrDestinationNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/scans", nil)
+			if tt.token != nil {
+				req = req.WithContext(context.WithValue(req.Context(), tokenKey, tt.token))
+			}
+
+			if err := CheckScan(req, tt.options); err != tt.wantErr {
+				t.Errorf("CheckScan returned %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
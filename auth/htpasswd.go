@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// dummyHash is compared against passwords for unknown users, so that checking the
+	// password of a user that doesn't exist takes as long as for one that does.
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+)
+
+// Htpasswd checks user credentials against an htpasswd file. Only bcrypt hashes are
+// supported, i.e. files generated with `htpasswd -B`.
+type Htpasswd struct {
+	hashes map[string][]byte
+}
+
+// LoadHtpasswd parses the htpasswd file at the given path. Lines with a hash in an
+// unsupported format are ignored.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := &Htpasswd{hashes: make(map[string][]byte)}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		user, hash := parts[0], parts[1]
+		if !strings.HasPrefix(hash, "$2a$") &&
+			!strings.HasPrefix(hash, "$2b$") &&
+			!strings.HasPrefix(hash, "$2y$") {
+			logrus.WithField("user", user).Warn("Ignoring htpasswd entry with a non-bcrypt hash")
+			continue
+		}
+
+		h.hashes[user] = []byte(hash)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	logrus.WithField("users", len(h.hashes)).Info("Loaded htpasswd file")
+
+	return h, nil
+}
+
+// CheckPassword returns whether the given password is the right one for the given user.
+func (h *Htpasswd) CheckPassword(user string, password string) bool {
+	hash, ok := h.hashes[user]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
@@ -0,0 +1,461 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/babolivier/scanner/config"
+)
+
+const (
+	// clockSkew is the leeway we allow when checking the expiration of an ID token, to
+	// account for clock differences between us and the provider.
+	clockSkew = time.Minute
+	// jwksRefreshInterval is the minimum amount of time between two fetches of the
+	// provider's keys, so a token with an unknown key ID can't make us hammer the
+	// provider.
+	jwksRefreshInterval = time.Minute
+)
+
+var (
+	// errInvalidIDToken is the error returned if an ID token can't be verified.
+	errInvalidIDToken = errors.New("invalid ID token")
+
+	// ecdsaAlgorithms maps the names of the supported elliptic curves to the JWS
+	// algorithm using them. See RFC7518 section 3.4.
+	ecdsaAlgorithms = map[string]string{
+		"P-256": "ES256",
+		"P-384": "ES384",
+	}
+)
+
+// oidcProvider logs users in using the authorization code flow of an OpenID Connect
+// provider, as defined by https://openid.net/specs/openid-connect-core-1_0.html.
+type oidcProvider struct {
+	cfg    *config.OIDCConfig
+	client *http.Client
+
+	// The provider's metadata is fetched on first use, so the server can start even if
+	// the provider is down.
+	metadata   *oidcMetadata
+	keys       map[string]crypto.PublicKey
+	keysExpiry time.Time
+	mu         sync.Mutex
+}
+
+// oidcMetadata is the subset of the provider's metadata we need, as served by its
+// discovery endpoint.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcState is stored in a signed cookie while the user is logging in with the provider,
+// so we can check the provider's response is for a request we've made.
+type oidcState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Expires  int64  `json:"e"`
+}
+
+// jwk is a JSON Web Key, as defined by RFC7517. Only RSA and EC keys are supported.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// newOIDCProvider returns a new oidcProvider.
+func newOIDCProvider(cfg *config.OIDCConfig) *oidcProvider {
+	return &oidcProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// authCodeURL returns the URL to redirect the user to so they can log in with the
+// provider, given the state to include in the request.
+func (p *oidcProvider) authCodeURL(st *oidcState) (string, error) {
+	md, err := p.getMetadata()
+	if err != nil {
+		return "", err
+	}
+
+	// Use PKCE (RFC7636) on top of the state, since it doesn't cost much.
+	challenge := sha256.Sum256([]byte(st.Verifier))
+
+	u, err := url.Parse(md.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", st.State)
+	q.Set("nonce", st.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// exchange exchanges the given authorization code for an ID token, verifies this token,
+// and returns the name of the user it identifies.
+func (p *oidcProvider) exchange(code string, st *oidcState) (string, error) {
+	md, err := p.getMetadata()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", st.Verifier)
+
+	req, err := http.NewRequest(http.MethodPost, md.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// RFC6749 requires the client ID and secret to be form-encoded before being used as
+	// basic auth credentials.
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint responded with status %d", resp.StatusCode)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+
+	claims, err := p.verifyIDToken(tokens.IDToken, st.Nonce)
+	if err != nil {
+		return "", err
+	}
+
+	user, ok := claims[p.cfg.UserClaim].(string)
+	if !ok || user == "" {
+		return "", fmt.Errorf("ID token is missing the %s claim", p.cfg.UserClaim)
+	}
+
+	return user, nil
+}
+
+// verifyIDToken checks the signature and the claims of the given ID token, and returns
+// its claims.
+func (p *oidcProvider) verifyIDToken(token string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidIDToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidIDToken
+	}
+
+	key, err := p.getKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	md, err := p.getMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != md.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", errInvalidIDToken, iss)
+	}
+
+	if !hasAudience(claims["aud"], p.cfg.ClientID) {
+		return nil, fmt.Errorf("%w: not issued for this client", errInvalidIDToken)
+	}
+
+	exp, _ := claims["exp"].(float64)
+	if time.Unix(int64(exp), 0).Add(clockSkew).Before(time.Now()) {
+		return nil, fmt.Errorf("%w: expired", errInvalidIDToken)
+	}
+
+	tokenNonce, _ := claims["nonce"].(string)
+	if subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%w: nonce mismatch", errInvalidIDToken)
+	}
+
+	return claims, nil
+}
+
+// getMetadata returns the provider's metadata, fetching it from its discovery endpoint
+// if we don't already have it.
+func (p *oidcProvider) getMetadata() (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	md := new(oidcMetadata)
+	discoveryURL := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(discoveryURL, md); err != nil {
+		return nil, err
+	}
+
+	// The issuer in the metadata must match the configured one, see
+	// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfigurationValidation
+	if strings.TrimSuffix(md.Issuer, "/") != strings.TrimSuffix(p.cfg.Issuer, "/") {
+		return nil, fmt.Errorf("provider advertises issuer %q instead of %q", md.Issuer, p.cfg.Issuer)
+	}
+
+	p.metadata = md
+
+	return md, nil
+}
+
+// getKey returns the provider's key with the given ID. If we don't know of any key with
+// this ID, it fetches the provider's keys again, since the provider might have rotated
+// them.
+func (p *oidcProvider) getKey(kid string) (crypto.PublicKey, error) {
+	md, err := p.getMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Now().Before(p.keysExpiry) {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidIDToken, kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = p.getJSON(md.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	p.keys = make(map[string]crypto.PublicKey)
+	p.keysExpiry = time.Now().Add(jwksRefreshInterval)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		if key, err := k.publicKey(); err == nil {
+			p.keys[k.Kid] = key
+		}
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidIDToken, kid)
+	}
+
+	return key, nil
+}
+
+// getJSON sends a GET request to the given URL, and decodes the JSON response into v.
+func (p *oidcProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with status %d", u, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// publicKey returns the public key described by the JWK.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verifySignature checks the given signature of the given signed content, using the
+// given JWS algorithm and key.
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var h hash.Hash
+	var cryptoHash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h, cryptoHash = sha256.New(), crypto.SHA256
+	case "RS384", "ES384":
+		h, cryptoHash = sha512.New384(), crypto.SHA384
+	case "RS512":
+		h, cryptoHash = sha512.New(), crypto.SHA512
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", errInvalidIDToken, alg)
+	}
+
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("%w: algorithm doesn't match key", errInvalidIDToken)
+		}
+		if err := rsa.VerifyPKCS1v15(k, cryptoHash, digest, sig); err != nil {
+			return fmt.Errorf("%w: %s", errInvalidIDToken, err)
+		}
+	case *ecdsa.PublicKey:
+		// Each algorithm uses a specific curve, see RFC7518 section 3.4.
+		if alg != ecdsaAlgorithms[k.Curve.Params().Name] {
+			return fmt.Errorf("%w: algorithm doesn't match key", errInvalidIDToken)
+		}
+		// ECDSA signatures are the concatenation of R and S, each padded to the size of
+		// the curve.
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("%w: bad signature length", errInvalidIDToken)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("%w: bad signature", errInvalidIDToken)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported key", errInvalidIDToken)
+	}
+
+	return nil
+}
+
+// hasAudience returns whether the given "aud" claim, which can either be a string or an
+// array of strings, contains the given client ID.
+func hasAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// decodeSegment decodes the given unpadded base64-encoded JSON segment of a JWT into v.
+func decodeSegment(seg string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errInvalidIDToken
+	}
+
+	if err = json.Unmarshal(raw, v); err != nil {
+		return errInvalidIDToken
+	}
+
+	return nil
+}
+
+// decodeBigInt decodes the given unpadded base64-encoded big-endian integer.
+func decodeBigInt(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(raw), nil
+}
@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/babolivier/scanner/config"
+)
+
+const (
+	testClientID = "scanner"
+	testNonce    = "nonce"
+)
+
+// mockIdP is a stand-in OpenID Connect provider serving its metadata and keys, and
+// signing ID tokens with them.
+type mockIdP struct {
+	*httptest.Server
+
+	rsaKey  *rsa.PrivateKey
+	ec256   *ecdsa.PrivateKey
+	ec384   *ecdsa.PrivateKey
+	keysSet map[string]interface{}
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	idp := &mockIdP{}
+
+	var err error
+	if idp.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if idp.ec256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if idp.ec384, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	idp.keysSet = map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kid": "rsa",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   encodeBigInt(idp.rsaKey.N),
+				"e":   encodeBigInt(big.NewInt(int64(idp.rsaKey.E))),
+			},
+			ecJWK("ec256", "P-256", &idp.ec256.PublicKey),
+			ecJWK("ec384", "P-384", &idp.ec384.PublicKey),
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(idp.keysSet)
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+// provider returns an oidcProvider for the mock provider.
+func (idp *mockIdP) provider() *oidcProvider {
+	return newOIDCProvider(&config.OIDCConfig{
+		Issuer:    idp.URL,
+		ClientID:  testClientID,
+		UserClaim: "preferred_username",
+	})
+}
+
+// claims returns valid claims for an ID token.
+func (idp *mockIdP) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                idp.URL,
+		"aud":                testClientID,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"nonce":              testNonce,
+		"preferred_username": "alice",
+	}
+}
+
+// sign returns an ID token with the given header and claims, signed with the key of
+// the given ID using the given algorithm. The signature is altered by tamper if it's
+// not nil.
+func (idp *mockIdP) sign(
+	t *testing.T,
+	alg string,
+	kid string,
+	claims map[string]interface{},
+	tamper func([]byte) []byte,
+) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	var err error
+	switch kid {
+	case "rsa":
+		digest, hash := digestFor(alg, signed)
+		sig, err = rsa.SignPKCS1v15(rand.Reader, idp.rsaKey, hash, digest)
+	case "ec256":
+		sig, err = signECDSA(idp.ec256, alg, signed)
+	case "ec384":
+		sig, err = signECDSA(idp.ec384, alg, signed)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tamper != nil {
+		sig = tamper(sig)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newMockIdP(t)
+
+	with := func(k string, v interface{}) map[string]interface{} {
+		claims := idp.claims()
+		claims[k] = v
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		token   func() string
+		wantErr bool
+	}{
+		{name: "RS256", token: func() string { return idp.sign(t, "RS256", "rsa", idp.claims(), nil) }},
+		{name: "RS512", token: func() string { return idp.sign(t, "RS512", "rsa", idp.claims(), nil) }},
+		{name: "ES256", token: func() string { return idp.sign(t, "ES256", "ec256", idp.claims(), nil) }},
+		{name: "ES384", token: func() string { return idp.sign(t, "ES384", "ec384", idp.claims(), nil) }},
+		{name: "audience in a list", token: func() string {
+			return idp.sign(t, "RS256", "rsa", with("aud", []string{"other", testClientID}), nil)
+		}},
+		{name: "expired within the clock skew", token: func() string {
+			return idp.sign(t, "RS256", "rsa", with("exp", time.Now().Add(-clockSkew/2).Unix()), nil)
+		}},
+
+		{name: "bad RSA signature", wantErr: true, token: func() string {
+			return idp.sign(t, "RS256", "rsa", idp.claims(), flipLastBit)
+		}},
+		{name: "bad ECDSA signature", wantErr: true, token: func() string {
+			return idp.sign(t, "ES256", "ec256", idp.claims(), flipLastBit)
+		}},
+		{name: "tampered claims", wantErr: true, token: func() string {
+			token := idp.sign(t, "RS256", "rsa", idp.claims(), nil)
+			other := idp.sign(t, "RS256", "rsa", with("preferred_username", "mallory"), nil)
+			return replaceSegment(token, 1, other)
+		}},
+		{name: "ECDSA signature too short", wantErr: true, token: func() string {
+			return idp.sign(t, "ES256", "ec256", idp.claims(), func(sig []byte) []byte { return sig[1:] })
+		}},
+		{name: "ECDSA signature too long", wantErr: true, token: func() string {
+			return idp.sign(t, "ES256", "ec256", idp.claims(), func(sig []byte) []byte {
+				return append([]byte{0}, append(sig[:32], append([]byte{0}, sig[32:]...)...)...)
+			})
+		}},
+		{name: "RSA key with an ECDSA algorithm", wantErr: true, token: func() string {
+			return replaceHeader(t, idp.sign(t, "RS256", "rsa", idp.claims(), nil), "ES256", "rsa")
+		}},
+		{name: "ECDSA key with an RSA algorithm", wantErr: true, token: func() string {
+			return replaceHeader(t, idp.sign(t, "ES256", "ec256", idp.claims(), nil), "RS256", "ec256")
+		}},
+		{name: "P-256 key with ES384", wantErr: true, token: func() string {
+			return idp.sign(t, "ES384", "ec256", idp.claims(), nil)
+		}},
+		{name: "P-384 key with ES256", wantErr: true, token: func() string {
+			return idp.sign(t, "ES256", "ec384", idp.claims(), nil)
+		}},
+		{name: "HMAC algorithm", wantErr: true, token: func() string {
+			return replaceHeader(t, idp.sign(t, "RS256", "rsa", idp.claims(), nil), "HS256", "rsa")
+		}},
+		{name: "none algorithm", wantErr: true, token: func() string {
+			token := replaceHeader(t, idp.sign(t, "RS256", "rsa", idp.claims(), nil), "none", "rsa")
+			return replaceSegment(token, 2, "..")
+		}},
+		{name: "unknown key", wantErr: true, token: func() string {
+			return replaceHeader(t, idp.sign(t, "RS256", "rsa", idp.claims(), nil), "RS256", "unknown")
+		}},
+		{name: "expired", wantErr: true, token: func() string {
+			return idp.sign(t, "RS256", "rsa", with("exp", time.Now().Add(-2*clockSkew).Unix()), nil)
+		}},
+		{name: "no expiration", wantErr: true, token: func() string {
+			claims := idp.claims()
+			delete(claims, "exp")
+			return idp.sign(t, "RS256", "rsa", claims, nil)
+		}},
+		{name: "wrong audience", wantErr: true, token: func() string {
+			return idp.sign(t, "RS256", "rsa", with("aud", "other"), nil)
+		}},
+		{name: "wrong audience in a list", wantErr: true, token: func() string {
+			return idp.sign(t, "RS256", "rsa", with("aud", []string{"other"}), nil)
+		}},
+		{name: "wrong issuer", wantErr: true, token: func() string {
+			return idp.sign(t, "RS256", "rsa", with("iss", "https://evil.example.com"), nil)
+		}},
+		{name: "wrong nonce", wantErr: true, token: func() string {
+			return idp.sign(t, "RS256", "rsa", with("nonce", "other"), nil)
+		}},
+		{name: "no nonce", wantErr: true, token: func() string {
+			claims := idp.claims()
+			delete(claims, "nonce")
+			return idp.sign(t, "RS256", "rsa", claims, nil)
+		}},
+		{name: "malformed", wantErr: true, token: func() string { return "not.a-token" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := idp.provider().verifyIDToken(tt.token(), testNonce)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidIDToken) {
+					t.Fatalf("verifyIDToken returned %v; want an error wrapping errInvalidIDToken", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("verifyIDToken returned an error: %v", err)
+			}
+			if claims["preferred_username"] != "alice" {
+				t.Errorf("got claims %v; want the user to be alice", claims)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureRejectsWrongECDSALength(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := signECDSA(key, "ES256", "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = verifySignature("ES256", &key.PublicKey, "content", sig); err != nil {
+		t.Fatalf("verifySignature returned an error for a valid signature: %v", err)
+	}
+
+	// Signatures which R and S are split differently can't be valid for this curve.
+	for _, bad := range [][]byte{sig[:len(sig)-2], append(sig, 0, 0), append(make([]byte, 2), sig...)} {
+		if err = verifySignature("ES256", &key.PublicKey, "content", bad); !errors.Is(err, errInvalidIDToken) {
+			t.Errorf("verifySignature accepted a %d bytes signature", len(bad))
+		}
+	}
+}
+
+// digestFor returns the digest of the given content for the given algorithm, along
+// with the hash function used.
+func digestFor(alg string, content string) ([]byte, crypto.Hash) {
+	switch alg[2:] {
+	case "384":
+		sum := sha512.Sum384([]byte(content))
+		return sum[:], crypto.SHA384
+	case "512":
+		sum := sha512.Sum512([]byte(content))
+		return sum[:], crypto.SHA512
+	default:
+		sum := sha256.Sum256([]byte(content))
+		return sum[:], crypto.SHA256
+	}
+}
+
+// signECDSA signs the given content with the given key, using the hash function of the
+// given algorithm, and returns the signature in the JWS format, i.e. R and S padded to
+// the size of the key's curve.
+func signECDSA(key *ecdsa.PrivateKey, alg string, content string) ([]byte, error) {
+	digest, _ := digestFor(alg, content)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+
+	return sig, nil
+}
+
+// ecJWK returns the JWK describing the given public key.
+func ecJWK(kid string, crv string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kid": kid,
+		"kty": "EC",
+		"crv": crv,
+		"x":   encodeBigInt(key.X),
+		"y":   encodeBigInt(key.Y),
+	}
+}
+
+// encodeBigInt encodes the given integer as unpadded base64.
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// flipLastBit flips the last bit of the given signature.
+func flipLastBit(sig []byte) []byte {
+	sig[len(sig)-1] ^= 1
+	return sig
+}
+
+// replaceHeader replaces the header of the given token with one with the given algorithm
+// and key ID, keeping its signature.
+func replaceHeader(t *testing.T, token string, alg string, kid string) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return replaceSegment(token, 0, base64.RawURLEncoding.EncodeToString(header)+"..")
+}
+
+// replaceSegment replaces the segment with the given index of the given token with the
+// segment with the same index of the other one.
+func replaceSegment(token string, i int, other string) string {
+	parts := strings.Split(token, ".")
+	parts[i] = strings.Split(other, ".")[i]
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// revocationList keeps track of the sessions users have logged out of until they
+// expire, so a session cookie that's been stolen can't be used anymore once its user has
+// logged out. It's stored in a JSON file, so it survives restarts.
+type revocationList struct {
+	path string
+	// revoked maps the IDs of the revoked sessions to the Unix time they expire at.
+	revoked map[string]int64
+	mu      sync.Mutex
+}
+
+// newRevocationList returns a new revocationList stored in the file at the given path,
+// and loads the sessions that have already been revoked from it. The file is created
+// when the first session is revoked.
+func newRevocationList(path string) (*revocationList, error) {
+	l := &revocationList{
+		path:    path,
+		revoked: make(map[string]int64),
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(raw, &l.revoked); err != nil {
+		return nil, fmt.Errorf("invalid revoked sessions file %s: %w", path, err)
+	}
+
+	return l, nil
+}
+
+// revoke adds the session with the given ID, which expires at the given Unix time, to
+// the list, and forgets about the sessions that have expired.
+func (l *revocationList) revoke(id string, expires int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().Unix()
+	for revokedID, revokedExpires := range l.revoked {
+		if now > revokedExpires {
+			delete(l.revoked, revokedID)
+		}
+	}
+
+	l.revoked[id] = expires
+	if err := l.save(); err != nil {
+		delete(l.revoked, id)
+		return err
+	}
+
+	return nil
+}
+
+// isRevoked returns whether the session with the given ID has been revoked.
+func (l *revocationList) isRevoked(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.revoked[id]
+	return ok
+}
+
+// save writes the list to the file. It must be called with the lock held.
+func (l *revocationList) save() error {
+	raw, err := json.Marshal(l.revoked)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first and then move it, so we never leave a partially
+	// written file behind.
+	tmpPath := l.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, raw, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, l.path)
+}
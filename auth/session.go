@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var (
+	// errInvalidSignature is the error returned when a signed value has been tampered
+	// with or is malformed.
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+// session is the content of the session cookie.
+type session struct {
+	// ID identifies the session, so it can be revoked when the user logs out.
+	ID   string `json:"i"`
+	User string `json:"u"`
+	// CSRF is the token clients must send in the CSRF header along with requests that
+	// have side effects. It's also sent to the client in a cookie that's readable by the
+	// front end.
+	CSRF    string `json:"c"`
+	Expires int64  `json:"e"`
+}
+
+// signer signs values so they can be stored client side (e.g. in cookies) without the
+// client being able to alter them.
+type signer struct {
+	key []byte
+}
+
+// sign serialises the given value as JSON, and returns it along with its HMAC-SHA256
+// signature, both encoded as unpadded base64, and separated with a dot.
+func (s *signer) sign(v interface{}) (string, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload)), nil
+}
+
+// verify checks the signature of the given value, generated by sign, and deserialises
+// it into v.
+// Returns errInvalidSignature if the signature doesn't match the value.
+func (s *signer) verify(signed string, v interface{}) error {
+	parts := strings.SplitN(signed, ".", 2)
+	if len(parts) != 2 {
+		return errInvalidSignature
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, s.mac(parts[0])) {
+		return errInvalidSignature
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errInvalidSignature
+	}
+
+	return json.Unmarshal(raw, v)
+}
+
+// mac computes the HMAC-SHA256 of the given payload.
+func (s *signer) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// randomString returns a random string made of the given number of random bytes,
+// encoded as unpadded base64.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,381 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/babolivier/scanner/common"
+)
+
+const (
+	// tokenPrefix is the prefix of every API token, which makes them easy to recognise
+	// (e.g. by secret scanners).
+	tokenPrefix = "scanner_"
+
+	// lastUsedGranularity is how precisely we record when tokens were last used. Saving
+	// the tokens file on every request would be wasteful.
+	lastUsedGranularity = time.Minute
+)
+
+// Scope is a permission that can be granted to an API token.
+type Scope string
+
+const (
+	// ScopePreview allows getting previews.
+	ScopePreview Scope = "preview"
+	// ScopeScan allows scanning documents, and browsing and creating the folders to store
+	// them in.
+	ScopeScan Scope = "scan"
+	// ScopeAdmin allows managing API tokens and the spool.
+	ScopeAdmin Scope = "admin"
+	// ScopeMetrics allows scraping the Prometheus metrics.
+	ScopeMetrics Scope = "metrics"
+)
+
+var (
+	// ErrInvalidToken is the error returned by TokenStore.Authenticate if the token
+	// doesn't exist or has been revoked.
+	ErrInvalidToken = errors.New("invalid API token")
+	// ErrTokenNotFound is the error returned by TokenStore.Revoke if there's no token
+	// with the given ID.
+	ErrTokenNotFound = errors.New("API token not found")
+	// ErrUnknownScope is the error returned by TokenStore.Create if one of the scopes
+	// isn't a known one.
+	ErrUnknownScope = errors.New("unknown scope")
+	// ErrPresetNotAllowed is the error returned by CheckScan if the request is
+	// authenticated with an API token that isn't allowed to use the requested preset.
+	ErrPresetNotAllowed = errors.New("preset not allowed for this API token")
+	// ErrDestinationNotAllowed is the error returned by CheckScan, CheckDestinations and
+	// CheckFolder if the request is authenticated with an API token that isn't allowed to
+	// send files to the requested destination, or to store them in the requested folder.
+	ErrDestinationNotAllowed = errors.New("destination not allowed for this API token")
+)
+
+// Token is an API token headless clients can authenticate with. Only a hash of the
+// secret part of the token is stored.
+type Token struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Hash is the hex-encoded SHA-256 hash of the token's secret. It is omitted when
+	// listing tokens.
+	Hash string `json:"hash,omitempty"`
+	// User is the user the token acts on behalf of, which determines the WebDAV account
+	// files are uploaded to.
+	User   string  `json:"user"`
+	Scopes []Scope `json:"scopes"`
+	// Presets is the list of the presets the token can use. If empty, the token can
+	// use any preset, or none.
+	Presets []string `json:"presets,omitempty"`
+	// Destinations is the list of the folders, relative to the upload path, the token
+	// can store files in, along with their subfolders. If not empty, files can't be sent
+	// anywhere else, e.g. by email or back to the client. If empty, the token can store
+	// files anywhere.
+	Destinations []string   `json:"destinations,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// HasScope returns whether the token has been granted the given scope.
+func (t *Token) HasScope(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsPreset returns whether the token can use the given preset.
+func (t *Token) allowsPreset(preset string) bool {
+	if len(t.Presets) == 0 {
+		return true
+	}
+
+	for _, p := range t.Presets {
+		if p == preset {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsDestination returns whether the token can send files to the given destination,
+// as a common.Destination* constant. Tokens restricted to some folders can only store
+// files in these folders, so they can't have them sent by email or downloaded.
+func (t *Token) allowsDestination(destination string) bool {
+	return len(t.Destinations) == 0 || destination == common.DestinationWebDAV
+}
+
+// allowsFolder returns whether the token can store files in the given folder, relative
+// to the upload path.
+func (t *Token) allowsFolder(folder string) bool {
+	if len(t.Destinations) == 0 {
+		return true
+	}
+
+	folder = strings.Trim(path.Clean("/"+folder), "/")
+	for _, d := range t.Destinations {
+		d = strings.Trim(path.Clean("/"+d), "/")
+		if d == "" || folder == d || strings.HasPrefix(folder, d+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withoutHash returns a copy of the token without its hash.
+func (t *Token) withoutHash() *Token {
+	c := *t
+	c.Hash = ""
+	return &c
+}
+
+// TokenStore manages the API tokens, which are stored in a JSON file. The file is read
+// again if it's been changed by another process (e.g. the tokens subcommand), so tokens
+// can be managed while the server is running.
+type TokenStore struct {
+	path   string
+	tokens map[string]*Token
+	// info describes the file as it was when we last read or wrote it. Since the file is
+	// always replaced rather than written in place, comparing it with the current file
+	// tells us whether another process has changed it.
+	info os.FileInfo
+	mu   sync.Mutex
+}
+
+// NewTokenStore returns a new TokenStore that stores the tokens in the file at the given
+// path. The file is created when the first token is.
+func NewTokenStore(path string) (*TokenStore, error) {
+	s := &TokenStore{path: path}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Create creates a new token with the given properties, and returns it along with its
+// secret value, which clients must send in the Authorization header. The secret value
+// can't be retrieved later.
+// Returns ErrUnknownScope if one of the scopes isn't a known one.
+func (s *TokenStore) Create(
+	name string,
+	user string,
+	scopes []Scope,
+	presets []string,
+	destinations []string,
+) (*Token, string, error) {
+	for _, scope := range scopes {
+		switch scope {
+		case ScopePreview, ScopeScan, ScopeAdmin, ScopeMetrics:
+		default:
+			return nil, "", fmt.Errorf("%w: %s", ErrUnknownScope, scope)
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := randomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	t := &Token{
+		ID:           id,
+		Name:         name,
+		Hash:         hashSecret(secret),
+		User:         user,
+		Scopes:       scopes,
+		Presets:      presets,
+		Destinations: destinations,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = s.load(); err != nil {
+		return nil, "", err
+	}
+
+	s.tokens[id] = t
+	if err = s.save(); err != nil {
+		delete(s.tokens, id)
+		return nil, "", err
+	}
+
+	return t.withoutHash(), tokenPrefix + id + "_" + secret, nil
+}
+
+// Tokens returns all of the tokens, without their hashes, sorted by creation date.
+func (s *TokenStore) Tokens() ([]*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	tokens := make([]*Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, t.withoutHash())
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+
+	return tokens, nil
+}
+
+// Revoke deletes the token with the given ID.
+// Returns ErrTokenNotFound if there's no such token.
+func (s *TokenStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	t, ok := s.tokens[id]
+	if !ok {
+		return ErrTokenNotFound
+	}
+
+	delete(s.tokens, id)
+	if err := s.save(); err != nil {
+		s.tokens[id] = t
+		return err
+	}
+
+	return nil
+}
+
+// Authenticate returns the token matching the given value, as sent by a client, and
+// records that it's been used.
+// Returns ErrInvalidToken if there's no such token.
+func (s *TokenStore) Authenticate(value string) (*Token, error) {
+	// The ID is hex-encoded, so the first underscore after the prefix is always the
+	// separator, even if the secret contains some.
+	parts := strings.SplitN(strings.TrimPrefix(value, tokenPrefix), "_", 2)
+	if !strings.HasPrefix(value, tokenPrefix) || len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	t, ok := s.tokens[parts[0]]
+	if !ok || subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(t.Hash)) != 1 {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now().UTC()
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= lastUsedGranularity {
+		t.LastUsedAt = &now
+		// Failing to record the last use isn't a good enough reason to reject the
+		// request.
+		_ = s.save()
+	}
+
+	return t.withoutHash(), nil
+}
+
+// load reads the tokens from the file if it has changed since it was last read. It
+// must be called with the lock held.
+func (s *TokenStore) load() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.tokens = make(map[string]*Token)
+		s.info = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if s.info != nil && os.SameFile(info, s.info) && info.ModTime().Equal(s.info.ModTime()) {
+		return nil
+	}
+
+	raw, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	tokens := make(map[string]*Token)
+	if err = json.Unmarshal(raw, &tokens); err != nil {
+		return fmt.Errorf("invalid tokens file %s: %w", s.path, err)
+	}
+
+	s.tokens = tokens
+	s.info = info
+
+	return nil
+}
+
+// save writes the tokens to the file. It must be called with the lock held.
+func (s *TokenStore) save() error {
+	raw, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first and then move it, so we never leave a partially
+	// written file behind.
+	tmpPath := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, raw, 0600); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	s.info, err = os.Stat(s.path)
+
+	return err
+}
+
+// hashSecret returns the hex-encoded SHA-256 hash of the given secret. Secrets are long
+// random strings, so there's no need for a slow, salted hash.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns the hex encoding of n random bytes.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
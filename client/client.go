@@ -0,0 +1,883 @@
+// Package client implements a client for the scanner's JSON API, which other programs can
+// use to get previews and scan documents. The API is described by the OpenAPI document
+// served at /api/openapi.json.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// apiPrefix is the prefix of the paths of the JSON API.
+	apiPrefix = "/api/v1"
+
+	// requestIDHeader is the header in which the server sends the ID of each request.
+	requestIDHeader = "X-Request-ID"
+
+	// maxErrorBodySize is the maximum number of bytes read from the body of an error
+	// response.
+	maxErrorBodySize = 64 << 10
+
+	// maxEventSize is the maximum size of a line of a stream of server-sent events.
+	maxEventSize = 16 << 20
+)
+
+var (
+	// errStopEvents is returned by the functions passed to readEvents to stop reading
+	// events without failing.
+	errStopEvents = errors.New("stop reading events")
+)
+
+// Error codes the API can respond with.
+const (
+	CodeBadRequest         = "bad_request"
+	CodeInvalidName        = "invalid_name"
+	CodeUnknownPreset      = "unknown_preset"
+	CodeMissingFormat      = "missing_format"
+	CodeUnsupportedFormat  = "unsupported_format"
+	CodeBadRect            = "bad_rect"
+	CodeNameConflict       = "name_conflict"
+	CodeDeviceBusy         = "device_busy"
+	CodeTimeout            = "timeout"
+	CodeCancelled          = "cancelled"
+	CodeNoPreview          = "no_preview"
+	CodeStorageFailed      = "storage_failed"
+	CodeNoStorage          = "no_storage"
+	CodeNoEmail            = "no_email"
+	CodeInvalidEmail       = "invalid_email"
+	CodeAttachmentTooLarge = "attachment_too_large"
+	CodeFolderForbidden    = "folder_forbidden"
+	CodeFolderExists       = "folder_exists"
+	CodeEntryBusy          = "entry_busy"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeInternal           = "internal"
+)
+
+// Statuses of a scan.
+const (
+	// StatusUploaded means the file has been uploaded to the storage.
+	StatusUploaded = "uploaded"
+	// StatusQueued means the file has been scanned, but couldn't be uploaded to the
+	// storage yet. The server will keep trying to upload it.
+	StatusQueued = "queued"
+	// StatusFailed means the file couldn't be uploaded to the storage. It's only reported
+	// for scans which file is also downloaded, and for individual uploads.
+	StatusFailed = "failed"
+	// StatusPartial means the file couldn't be uploaded to some of its destinations, but
+	// has been, or will be, uploaded to others. See ScanResult.Uploads for the details.
+	StatusPartial = "partial"
+)
+
+// Destinations the file of a scan can be sent to.
+const (
+	// DestinationWebDAV uploads the file to the storage.
+	DestinationWebDAV = "webdav"
+	// DestinationEmail sends the file as an attachment to the recipients from the
+	// request's Email.
+	DestinationEmail = "email"
+	// DestinationDownload sends the file back in the response. Use ScanAndDownload to
+	// get it.
+	DestinationDownload = "download"
+)
+
+// Phases of a scan, as reported by progress events.
+const (
+	PhaseWaiting   = "waiting"
+	PhaseScanning  = "scanning"
+	PhaseEncoding  = "encoding"
+	PhaseUploading = "uploading"
+	// PhaseUploaded, PhaseQueued and PhaseFailed end a scan. PhaseReady ends it too if
+	// the file isn't uploaded.
+	PhaseUploaded = "uploaded"
+	PhaseQueued   = "queued"
+	PhaseReady    = "ready"
+	PhaseFailed   = "failed"
+)
+
+// Outcomes of the scans recorded in the history.
+const (
+	OutcomeUploaded = "uploaded"
+	OutcomeQueued   = "queued"
+	OutcomeFailed   = "failed"
+	// OutcomeDownloaded means the file has only been sent back to the requester.
+	OutcomeDownloaded = "downloaded"
+	// OutcomePartial means the file couldn't be sent to some of its destinations.
+	OutcomePartial = "partial"
+)
+
+// Statuses of the notifications sent to webhooks.
+const (
+	// DeliveryPending means the notification hasn't been delivered yet, and the server
+	// will try again.
+	DeliveryPending = "pending"
+	// DeliveryDelivered means the webhook accepted the notification.
+	DeliveryDelivered = "delivered"
+	// DeliveryFailed means the server gave up on delivering the notification.
+	DeliveryFailed = "failed"
+)
+
+// Error is the error returned by the client's methods if the server responded with an
+// error.
+type Error struct {
+	// StatusCode is the HTTP status code of the response. It's 0 if the error has been
+	// sent as an event in a stream, or if it describes why a single upload failed.
+	StatusCode int
+	// RequestID identifies the request in the server's logs.
+	RequestID string
+	// Code is the error code, which is one of the Code* constants.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf(
+		"scanner API responded with status %d: %s (%s)",
+		e.StatusCode, e.Message, e.Code,
+	)
+}
+
+// ScanRequest describes the document to scan, and where to store it.
+type ScanRequest struct {
+	// Format is the format of the file, either "jpeg" or "pdf". It can be omitted if the
+	// preset defines one.
+	Format string `json:"format,omitempty"`
+	Preset string `json:"preset,omitempty"`
+	// Folder is the path of the folder to store the file in, relative to the upload
+	// path.
+	Folder string `json:"folder,omitempty"`
+	// Name is the name of the file, without its extension. If empty, the server
+	// generates one.
+	Name string `json:"name,omitempty"`
+	// Rect is the area to scan, in pixels on a preview. If nil, the whole surface is
+	// scanned.
+	Rect *Rect `json:"rect,omitempty"`
+	// Job identifies the scan in progress events. If empty, the server generates one.
+	Job string `json:"job,omitempty"`
+	// Quick makes the server use the last preview taken by the same user, cropped to
+	// Rect, instead of scanning the document again, for when a low resolution is good
+	// enough.
+	Quick bool `json:"quick,omitempty"`
+	// Destinations lists where to send the file, as Destination* constants. If empty, the
+	// file is uploaded to the storage.
+	Destinations []string `json:"destinations,omitempty"`
+	// Email is the email to send the file in if Destinations includes DestinationEmail.
+	Email *EmailOptions `json:"email,omitempty"`
+}
+
+// EmailOptions describes the email to send the file of a scan in.
+type EmailOptions struct {
+	// To lists the addresses to send the file to.
+	To []string `json:"to"`
+	// Subject is the subject of the email. If empty, the server uses the configured
+	// one.
+	Subject string `json:"subject,omitempty"`
+	Body    string `json:"body,omitempty"`
+}
+
+// Download is a file sent back by the server.
+type Download struct {
+	// Body is the content of the file. It must be closed.
+	Body io.ReadCloser
+	// Name is the name the server suggests saving the file under.
+	Name string
+	// UploadStatus is one of the Status* constants if the file has also been sent to the
+	// storage, and empty otherwise.
+	UploadStatus string
+	// FileName is the path the file has been uploaded to, relative to the upload path,
+	// if it has.
+	FileName string
+}
+
+// Rect is a rectangle drawn on a preview, in pixels.
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// ScanResult is the result of a scan.
+type ScanResult struct {
+	// Status is either StatusUploaded, StatusQueued or StatusPartial.
+	Status string `json:"status"`
+	// FileName is the path of the uploaded file, relative to the upload path. It's only
+	// set if the file has been uploaded. If the file has several destinations, it's the
+	// name from the first one it's been uploaded to.
+	FileName string `json:"file_name,omitempty"`
+	// Uploads describes how uploading the file to each of its destinations went.
+	Uploads []*UploadResult `json:"uploads,omitempty"`
+}
+
+// UploadResult describes how uploading the file of a scan to one of its destinations
+// went.
+type UploadResult struct {
+	// Destination is one of the Destination* constants.
+	Destination string `json:"destination"`
+	// Status is either StatusUploaded, StatusQueued or StatusFailed.
+	Status string `json:"status"`
+	// FileName is the name the file has been uploaded under, if it has.
+	FileName string `json:"file_name,omitempty"`
+	// Error describes why the upload failed, if it did.
+	Error *Error `json:"error,omitempty"`
+}
+
+// RetryUploadRequest describes where to upload the file of a scan again. Fields left
+// empty keep the value the scan was requested with.
+type RetryUploadRequest struct {
+	// Folder is the path of the folder to store the file in, relative to the upload path.
+	// Use a pointer to an empty string for the upload path itself.
+	Folder *string `json:"folder,omitempty"`
+	// Name is the name of the file, without its extension.
+	Name string `json:"name,omitempty"`
+	// Destination is the destination to upload the file to again, if it couldn't be
+	// uploaded to several of them. If empty, the upload that failed last is retried.
+	Destination string `json:"destination,omitempty"`
+	// SendTo is the destination to send the file to instead, as a Destination* constant.
+	// If empty, the file is sent to the destination it failed to go to. Use RetryDownload
+	// to get the file back rather than setting it to DestinationDownload.
+	SendTo string `json:"send_to,omitempty"`
+	// Email is the email to send the file in, if SendTo is DestinationEmail and the file
+	// wasn't sent by email before.
+	Email *EmailOptions `json:"email,omitempty"`
+}
+
+// Event describes the progress of a scan.
+type Event struct {
+	Job string `json:"job"`
+	// Phase is one of the Phase* constants.
+	Phase string `json:"phase"`
+	// Destination is the destination the file is being uploaded to, when uploading.
+	Destination string `json:"destination,omitempty"`
+	// Percent is the progress of the current phase, when scanning or uploading.
+	Percent    int   `json:"percent"`
+	BytesSent  int64 `json:"bytes_sent,omitempty"`
+	BytesTotal int64 `json:"bytes_total,omitempty"`
+	// FileName is the path of the uploaded file, relative to the upload path. It's only
+	// set once the file has been uploaded.
+	FileName string `json:"file_name,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// LastPreview is the last preview taken by the server.
+type LastPreview struct {
+	Image image.Image
+	// Resolution is the resolution the preview was taken with, in DPI.
+	Resolution int
+	TakenAt    time.Time
+}
+
+// HistoryFilter selects the scans to list from the history. Fields with a zero value
+// don't filter anything.
+type HistoryFilter struct {
+	// User only keeps the scans of this user. Listing the scans of other users requires
+	// the admin scope.
+	User string
+	// Outcome is one of the Outcome* constants.
+	Outcome string
+	Format  string
+	Since   time.Time
+	Until   time.Time
+	// Before is the cursor returned with the previous page, to get the next one.
+	Before string
+	Limit  int
+}
+
+// HistoryPage is a page of the history of scans.
+type HistoryPage struct {
+	Records []*HistoryRecord `json:"records"`
+	// Next is the cursor to set as the filter's Before field to get the next page. It's
+	// empty if there's no page left.
+	Next string `json:"next,omitempty"`
+}
+
+// HistoryRecord describes a past scan.
+type HistoryRecord struct {
+	ID string `json:"id"`
+	// Options are the options the scan was made with, as stored by the server.
+	Options json.RawMessage `json:"options"`
+	// FileName is the path of the uploaded file, relative to the upload path, and URL its
+	// URL on the storage. They're only set if the file has been uploaded.
+	FileName string `json:"file_name,omitempty"`
+	URL      string `json:"url,omitempty"`
+	// ThumbnailURL is the path of the scan's thumbnail on the server, if it still has one.
+	// Use Client.Thumbnail to get it.
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	// DownloadURL is the path to download the file from on the server, if its upload
+	// failed and it's still kept. Use Client.DownloadJobFile to get it.
+	DownloadURL string    `json:"download_url,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Destination string    `json:"destination"`
+	StartedAt   time.Time `json:"started_at"`
+	// Duration is the time it took to scan the document and upload the file, in seconds.
+	Duration float64 `json:"duration"`
+	// Outcome is one of the Outcome* constants.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+	// Uploads describes how sending the file to each of its destinations went.
+	Uploads []*HistoryUpload `json:"uploads,omitempty"`
+}
+
+// HistoryUpload describes how sending the file of a past scan to one of its
+// destinations went.
+type HistoryUpload struct {
+	Destination string `json:"destination"`
+	FileName    string `json:"file_name,omitempty"`
+	// Outcome is either OutcomeUploaded, OutcomeQueued or OutcomeFailed.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// WebhookFilter selects the webhook deliveries to list. Fields with a zero value don't
+// filter anything.
+type WebhookFilter struct {
+	// Webhook is the name of the webhook.
+	Webhook string
+	Job     string
+	// Status is one of the Delivery* constants.
+	Status string
+}
+
+// WebhookDelivery describes a notification sent to a webhook.
+type WebhookDelivery struct {
+	// ID is the ID of the delivery, sent to the webhook in the X-Scanner-Delivery header.
+	ID      string `json:"id"`
+	Webhook string `json:"webhook"`
+	// Event is either "scan.completed" or "scan.failed".
+	Event string `json:"event"`
+	Job   string `json:"job,omitempty"`
+	// Status is one of the Delivery* constants.
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	// ResponseStatus is the HTTP status the webhook responded to the last attempt with,
+	// or 0 if it couldn't be reached.
+	ResponseStatus int       `json:"response_status,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Client is a client for the scanner's JSON API.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewClient returns a new Client for the server at the given base URL (e.g.
+// https://scanner.example.com), authenticating with the given API token. The token can
+// be empty if the server doesn't require authentication. If httpClient is nil,
+// http.DefaultClient is used.
+func NewClient(baseURL string, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+// Preview gets a low resolution preview of what's currently on the scanner's plate.
+// The coordinates of a Rect passed to Scan are expected to be in pixels on such a
+// preview.
+func (c *Client) Preview(ctx context.Context) (image.Image, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/preview", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return jpeg.Decode(resp.Body)
+}
+
+// Scan scans a document and uploads it to its destinations, the storage by default. If
+// a destination can't be reached, the returned result's status is StatusQueued, and the
+// server uploads the file later. If the file couldn't be uploaded to some destinations
+// but could to others, its status is StatusPartial.
+// The request mustn't include DestinationDownload, use ScanAndDownload for that.
+func (c *Client) Scan(ctx context.Context, req *ScanRequest) (*ScanResult, error) {
+	result := new(ScanResult)
+	if err := c.doJSON(ctx, http.MethodPost, "/scans", nil, req, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ScanAndDownload scans a document and returns the resulting file, after uploading it to
+// the storage if the request's destinations include DestinationWebDAV. DestinationDownload
+// is added to the request's destinations if it's missing.
+func (c *Client) ScanAndDownload(ctx context.Context, req *ScanRequest) (*Download, error) {
+	r := *req
+	hasDownload := false
+	for _, d := range r.Destinations {
+		hasDownload = hasDownload || d == DestinationDownload
+	}
+	if !hasDownload {
+		r.Destinations = append(append([]string(nil), r.Destinations...), DestinationDownload)
+	}
+
+	raw, err := json.Marshal(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/scans", nil, bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+
+	return &Download{
+		Body:         resp.Body,
+		Name:         params["filename"],
+		UploadStatus: resp.Header.Get("X-Upload-Status"),
+		FileName:     resp.Header.Get("X-Upload-File-Name"),
+	}, nil
+}
+
+// Events calls fn with the progress events of the scans requested with the client's
+// token, or only of the scan with the given job ID if it isn't empty, until the context
+// is done or the connection is closed. To follow a scan, pick a job ID, run Events with
+// it in a goroutine, and then call Scan with this job ID in the request.
+func (c *Client) Events(ctx context.Context, job string, fn func(*Event)) error {
+	var query url.Values
+	if job != "" {
+		query = url.Values{"job": {job}}
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, "/events", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = readEvents(resp.Body, func(_ string, data []byte) error {
+		e := new(Event)
+		if err := json.Unmarshal(data, e); err != nil {
+			return err
+		}
+
+		fn(e)
+		return nil
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// LastPreview gets the last preview the server has taken for the client's user, without
+// scanning again.
+func (c *Client) LastPreview(ctx context.Context) (*LastPreview, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/preview/last", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	preview := new(LastPreview)
+	if preview.Image, err = jpeg.Decode(resp.Body); err != nil {
+		return nil, err
+	}
+
+	// Neither header is critical, so don't fail if they're missing or malformed.
+	preview.Resolution, _ = strconv.Atoi(resp.Header.Get("X-Preview-Resolution"))
+	preview.TakenAt, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return preview, nil
+}
+
+// PreviewProgressively gets a preview like Preview, but also calls partial with the part
+// of the preview that has been scanned so far, regularly while it's being scanned. The
+// parts that haven't been scanned yet are white.
+func (c *Client) PreviewProgressively(
+	ctx context.Context,
+	partial func(img image.Image),
+) (image.Image, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/preview/stream", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var img image.Image
+	err = readEvents(resp.Body, func(event string, data []byte) error {
+		if event == "error" {
+			var errBody struct {
+				Error *Error `json:"error"`
+			}
+			if err := json.Unmarshal(data, &errBody); err != nil {
+				return err
+			} else if errBody.Error == nil {
+				return fmt.Errorf("malformed error event")
+			}
+
+			return errBody.Error
+		}
+
+		var update struct {
+			Image string `json:"image"`
+		}
+		if err := json.Unmarshal(data, &update); err != nil {
+			return err
+		}
+
+		decoded, err := decodeDataURL(update.Image)
+		if err != nil {
+			return err
+		}
+
+		if event == "done" {
+			img = decoded
+			return errStopEvents
+		}
+
+		partial(decoded)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if img == nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return img, nil
+}
+
+// ListFolders returns the names of the folders within the folder at the given path,
+// relative to the upload path.
+func (c *Client) ListFolders(ctx context.Context, p string) ([]string, error) {
+	var result struct {
+		Folders []string `json:"folders"`
+	}
+
+	query := url.Values{"path": {p}}
+	if err := c.doJSON(ctx, http.MethodGet, "/folders", query, nil, &result); err != nil {
+		return nil, err
+	}
+
+	return result.Folders, nil
+}
+
+// CreateFolder creates a folder at the given path, relative to the upload path. The
+// parent folder must already exist.
+func (c *Client) CreateFolder(ctx context.Context, p string) error {
+	body := map[string]string{"path": p}
+	return c.doJSON(ctx, http.MethodPost, "/folders", nil, body, nil)
+}
+
+// History lists the past scans matching the given filter, from the most recent one to
+// the oldest one. Only the scans of the user the token acts on behalf of are listed,
+// unless the token has the admin scope.
+func (c *Client) History(ctx context.Context, f *HistoryFilter) (*HistoryPage, error) {
+	query := make(url.Values)
+	if f != nil {
+		for k, v := range map[string]string{
+			"user":    f.User,
+			"outcome": f.Outcome,
+			"format":  f.Format,
+			"before":  f.Before,
+		} {
+			if v != "" {
+				query.Set(k, v)
+			}
+		}
+		if !f.Since.IsZero() {
+			query.Set("since", f.Since.Format(time.RFC3339))
+		}
+		if !f.Until.IsZero() {
+			query.Set("until", f.Until.Format(time.RFC3339))
+		}
+		if f.Limit > 0 {
+			query.Set("limit", strconv.Itoa(f.Limit))
+		}
+	}
+
+	page := new(HistoryPage)
+	if err := c.doJSON(ctx, http.MethodGet, "/history", query, nil, page); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// Thumbnail returns the thumbnail of the past scan with the given ID. Returns an *Error
+// with CodeNotFound if there's no such scan, or if its thumbnail has been removed.
+func (c *Client) Thumbnail(ctx context.Context, id string) (image.Image, error) {
+	p := "/history/" + url.PathEscape(id) + "/thumb.jpg"
+	resp, err := c.do(ctx, http.MethodGet, p, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return jpeg.Decode(resp.Body)
+}
+
+// RetryUpload uploads the file of the scan with the given job ID again, after its upload
+// failed, to the destination described by the given request, or to the same destination
+// if it's nil. The request's SendTo mustn't be DestinationDownload, use RetryDownload for
+// that. Like with Scan, the returned result's status is StatusQueued if the storage
+// can't be reached. Returns an *Error with CodeNotFound if the server doesn't keep the
+// file anymore.
+func (c *Client) RetryUpload(
+	ctx context.Context,
+	job string,
+	req *RetryUploadRequest,
+) (*ScanResult, error) {
+	if req == nil {
+		req = new(RetryUploadRequest)
+	}
+
+	result := new(ScanResult)
+	p := "/jobs/" + url.PathEscape(job) + "/retry-upload"
+	if err := c.doJSON(ctx, http.MethodPost, p, nil, req, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// RetryDownload returns the file of the scan with the given job ID, after its upload
+// failed, named after the given request if it includes a name. Unlike with
+// DownloadJobFile, the server doesn't keep the file anymore once it's been sent. The
+// caller must close the returned download's body. Returns an *Error with CodeNotFound if
+// the server doesn't keep the file anymore.
+func (c *Client) RetryDownload(
+	ctx context.Context,
+	job string,
+	req *RetryUploadRequest,
+) (*Download, error) {
+	r := RetryUploadRequest{SendTo: DestinationDownload}
+	if req != nil {
+		r = *req
+		r.SendTo = DestinationDownload
+	}
+
+	raw, err := json.Marshal(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := "/jobs/" + url.PathEscape(job) + "/retry-upload"
+	resp, err := c.do(ctx, http.MethodPost, p, nil, bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+
+	return &Download{Body: resp.Body, Name: params["filename"]}, nil
+}
+
+// DownloadJobFile returns the content of the file of the scan with the given job ID,
+// after its upload failed, along with its name. The caller must close the returned
+// reader. Returns an *Error with CodeNotFound if the server doesn't keep the file anymore.
+func (c *Client) DownloadJobFile(ctx context.Context, job string) (io.ReadCloser, string, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(job)+"/file", nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+
+	return resp.Body, params["filename"], nil
+}
+
+// WebhookDeliveries lists the most recent notifications sent to webhooks matching the
+// given filter, from the most recent one to the oldest one. Requires the admin scope.
+func (c *Client) WebhookDeliveries(
+	ctx context.Context,
+	f *WebhookFilter,
+) ([]*WebhookDelivery, error) {
+	query := make(url.Values)
+	if f != nil {
+		for k, v := range map[string]string{
+			"webhook": f.Webhook,
+			"job":     f.Job,
+			"status":  f.Status,
+		} {
+			if v != "" {
+				query.Set(k, v)
+			}
+		}
+	}
+
+	var resp struct {
+		Deliveries []*WebhookDelivery `json:"deliveries"`
+	}
+	if err := c.doJSON(ctx, http.MethodGet, "/webhooks/deliveries", query, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Deliveries, nil
+}
+
+// doJSON sends a request to the given path of the API, relative to the API prefix, with
+// the given query parameters and the given value serialised as JSON as its body (unless
+// it's nil), and deserialises the JSON response into out (unless it's nil).
+func (c *Client) doJSON(
+	ctx context.Context,
+	method string,
+	p string,
+	query url.Values,
+	in interface{},
+	out interface{},
+) error {
+	var body io.Reader
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	resp, err := c.do(ctx, method, p, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// do sends a request to the given path of the API, relative to the API prefix, with the
+// given query parameters and JSON body. Returns an *Error if the server responded with
+// an error status.
+func (c *Client) do(
+	ctx context.Context,
+	method string,
+	p string,
+	query url.Values,
+	body io.Reader,
+) (*http.Response, error) {
+	u := c.baseURL + apiPrefix + p
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+
+	apiErr := &Error{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get(requestIDHeader),
+	}
+
+	// Errors are wrapped in an object, but fall back to the raw body if it's not what we
+	// got (e.g. if a proxy responded instead of the server).
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	var errBody struct {
+		Error *Error `json:"error"`
+	}
+	if json.Unmarshal(raw, &errBody) == nil && errBody.Error != nil {
+		apiErr.Code = errBody.Error.Code
+		apiErr.Message = errBody.Error.Message
+	} else {
+		apiErr.Message = strings.TrimSpace(string(raw))
+	}
+
+	return nil, apiErr
+}
+
+// readEvents reads server-sent events from the given body, and calls fn with the type
+// and the data of each of them, until the body ends or fn returns an error. The type is
+// empty for events that don't specify one.
+func readEvents(body io.Reader, fn func(event string, data []byte) error) error {
+	scanner := bufio.NewScanner(body)
+	// Previews are sent as data URLs, which can be longer than the default limit.
+	scanner.Buffer(nil, maxEventSize)
+
+	event := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			err := fn(event, []byte(strings.TrimPrefix(line, "data: ")))
+			if err == errStopEvents {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		case line == "":
+			// An empty line ends an event. Lines starting with a colon are comments
+			// that keep the connection alive.
+			event = ""
+		}
+	}
+
+	return scanner.Err()
+}
+
+// decodeDataURL decodes the image in the given base64 data URL.
+func decodeDataURL(dataURL string) (image.Image, error) {
+	i := strings.Index(dataURL, ";base64,")
+	if !strings.HasPrefix(dataURL, "data:") || i < 0 {
+		return nil, fmt.Errorf("malformed data URL")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(dataURL[i+len(";base64,"):])
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	return img, err
+}
@@ -1,36 +1,199 @@
 package common
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"net/mail"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/naming"
 )
 
 var (
 	ErrMissingFormat = errors.New("missing format")
 	ErrMalformedRect = errors.New("malformed rect")
+	ErrUnknownPreset = errors.New("unknown preset")
+	ErrInvalidJob    = errors.New("invalid job ID")
+	// ErrUnknownDestination is the error returned by NewOptions if a destination isn't one
+	// of the supported ones.
+	ErrUnknownDestination = errors.New("unknown destination")
+	// ErrInvalidEmail is the error returned by NewOptions if the file must be sent by
+	// email but there's no valid recipient, or if the subject spans several lines.
+	ErrInvalidEmail = errors.New("invalid email options")
+)
+
+const (
+	// maxJobLen is the maximum length of a job ID picked by a client.
+	maxJobLen = 64
+)
+
+// Destinations the file resulting from a scan can be sent to.
+const (
+	// DestinationWebDAV means the file is uploaded to the user's WebDAV server.
+	DestinationWebDAV = "webdav"
+	// DestinationDownload means the file is sent back in the response to the request
+	// that triggered the scan.
+	DestinationDownload = "download"
+	// DestinationEmail means the file is sent by email, as an attachment.
+	DestinationEmail = "email"
 )
 
 // ScanOptions stores the parameters to use when scanning an image and processing the
 // result.
 type ScanOptions struct {
-	Format     string
-	ScanArea   *ScanArea
-	FileName   string
+	Format   string
+	ScanArea *ScanArea
+	FileName naming.FileName
+	// Folder is the path of the folder to store the file in, relative to the root of the
+	// storage. An empty string means the root itself.
+	Folder     string
 	Resolution int
+	// Preset is the name of the preset the user picked, if any.
+	Preset string
+	// User is the name of the user who triggered the scan, if known.
+	User string
+	// Device is the name of the device the document has been scanned with.
+	Device string
+	// ScannedAt is the time the document has been scanned at, which files are named
+	// after, so a file uploaded later from the spool gets the same name it would have
+	// gotten right away.
+	ScannedAt time.Time
+	// Job identifies the scan in the progress events published while processing it.
+	Job string
+	// Quick is true if the file should be made from the last preview, cropped to the
+	// scan area, rather than from a new scan.
+	Quick bool
+	// Destinations lists where to send the file, as Destination* constants. An empty list
+	// means DestinationWebDAV.
+	Destinations []string
+	// Email describes the email to send the file in, if it's sent by email.
+	Email *EmailOptions `json:",omitempty"`
+	// UploadProgress, if not nil, is called with the number of bytes sent and the total
+	// size of the file while the file is being uploaded. The total is -1 if it's unknown.
+	UploadProgress func(sent int64, total int64) `json:"-"`
 }
 
-// NewOptionsFromQuery instantiates a new ScanOptions and fills it with the provided
-// URL query parameters.
-// Returns ErrMissingFormat if the format is missing from the query parameters, or
-// ErrMalformedRect if a rectangle is defined in the query parameters but one of its
-// parameters is missing or malformed.
-func NewOptionsFromQuery(query url.Values) (*ScanOptions, error) {
+// ScanRequest is the body of a request to scan a document, as sent to the JSON API.
+type ScanRequest struct {
+	Format string `json:"format,omitempty"`
+	Preset string `json:"preset,omitempty"`
+	// Folder is the path of the folder to store the file in, relative to the root of the
+	// storage.
+	Folder string `json:"folder,omitempty"`
+	// Name is the name to give to the file, without its extension. If empty, the name is
+	// generated from the relevant template.
+	Name string `json:"name,omitempty"`
+	// Rect is the area to scan, in pixels on a preview. If nil, the whole surface is
+	// scanned.
+	Rect *Rect `json:"rect,omitempty"`
+	// Job is an identifier for the scan, which clients can use to follow its progress.
+	// If empty, a random one is generated.
+	Job string `json:"job,omitempty"`
+	// Quick asks for the file to be made from the last preview, cropped to the rectangle,
+	// rather than from a new scan, for when a low resolution is good enough.
+	Quick bool `json:"quick,omitempty"`
+	// Destinations lists where to send the file, as Destination* constants. If empty, the
+	// file is uploaded to the WebDAV server.
+	Destinations []string `json:"destinations,omitempty"`
+	// Email describes the email to send the file in. It's required if the destinations
+	// include DestinationEmail.
+	Email *EmailOptions `json:"email,omitempty"`
+}
+
+// EmailOptions describes the email a scanned file is sent in.
+type EmailOptions struct {
+	// To lists the addresses to send the email to.
+	To []string `json:"to"`
+	// Subject is the subject of the email. If empty, the configured default is used.
+	Subject string `json:"subject,omitempty"`
+	// Body is the plain text content of the email, which can be empty.
+	Body string `json:"body,omitempty"`
+}
+
+// Rect is a rectangle drawn on a preview, in pixels.
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// NewOptions instantiates a new ScanOptions and fills it with the provided request. If a
+// preset is provided, its format, destinations and email recipients are used if none
+// were given.
+// Returns an error wrapping naming.ErrInvalidFileName if the file name or the folder
+// isn't valid, ErrUnknownPreset if the preset isn't one of the given ones,
+// ErrMissingFormat if the format is missing from the request, or ErrMalformedRect if the
+// rectangle has a negative origin or isn't at least one pixel wide and high, or
+// ErrInvalidJob if the job ID is too long or contains characters other than ASCII
+// letters, digits, dashes and underscores, ErrUnknownDestination if a destination isn't
+// supported, or ErrInvalidEmail if the email to send the file in is invalid.
+func NewOptions(
+	req *ScanRequest,
+	presets map[string]*config.PresetConfig,
+) (*ScanOptions, error) {
 	options := &ScanOptions{
-		Format:   query.Get("format"),
-		FileName: query.Get("name"),
+		Format: req.Format,
+		Preset: req.Preset,
+		Quick:  req.Quick,
+		Folder: strings.Trim(req.Folder, "/"),
+	}
+
+	// Make sure the folder can't escape the root of the storage.
+	if err := naming.CheckPath(options.Folder); err != nil {
+		return nil, err
+	}
+
+	// Make sure the job ID is sensible, or pick one if the client didn't.
+	var err error
+	if options.Job, err = checkJob(req.Job); err != nil {
+		return nil, err
+	}
+
+	// Don't let the user-provided file name contain path separators or other characters
+	// that could cause it to end up somewhere it shouldn't.
+	if req.Name != "" {
+		if options.FileName, err = naming.NewFileName(req.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	// Fill in the format, destinations and recipients from the preset if there's one.
+	destinations, email := req.Destinations, req.Email
+	if options.Preset != "" {
+		preset, ok := presets[options.Preset]
+		if !ok {
+			return nil, ErrUnknownPreset
+		}
+
+		if options.Format == "" {
+			options.Format = preset.Format
+		}
+
+		if len(destinations) == 0 {
+			destinations = preset.Destinations
+		}
+
+		if email == nil && len(preset.EmailTo) > 0 {
+			email = &EmailOptions{To: preset.EmailTo, Subject: preset.EmailSubject}
+		}
+	}
+
+	if options.Destinations, err = checkDestinations(destinations); err != nil {
+		return nil, err
+	}
+
+	if options.HasDestination(DestinationEmail) {
+		if options.Email, err = CheckEmail(email); err != nil {
+			return nil, err
+		}
 	}
 
 	// Make sure a format has been provided, and return an error if not.
@@ -38,6 +201,51 @@ func NewOptionsFromQuery(query url.Values) (*ScanOptions, error) {
 		return nil, ErrMissingFormat
 	}
 
+	// Don't do anything more if no rectangle was provided.
+	if req.Rect == nil {
+		return options, nil
+	}
+
+	if req.Rect.X < 0 || req.Rect.Y < 0 || req.Rect.Width <= 0 || req.Rect.Height <= 0 {
+		return nil, ErrMalformedRect
+	}
+
+	options.ScanArea = &ScanArea{
+		TLX: req.Rect.X,
+		TLY: req.Rect.Y,
+		BRX: req.Rect.X + req.Rect.Width,
+		BRY: req.Rect.Y + req.Rect.Height,
+	}
+
+	return options, nil
+}
+
+// NewOptionsFromQuery instantiates a new ScanOptions and fills it with the provided
+// URL query parameters. See NewOptions for the errors it can return.
+func NewOptionsFromQuery(
+	query url.Values,
+	presets map[string]*config.PresetConfig,
+) (*ScanOptions, error) {
+	req := &ScanRequest{
+		Format: query.Get("format"),
+		Preset: query.Get("preset"),
+		Folder: query.Get("folder"),
+		Name:   query.Get("name"),
+		Job:    query.Get("job"),
+		Quick:  query.Get("quick") == "true",
+		// The destination parameter can be repeated to send the file to several places.
+		Destinations: query["destination"],
+	}
+
+	// The to parameter can be repeated to send the email to several recipients.
+	if to := query["to"]; len(to) > 0 {
+		req.Email = &EmailOptions{
+			To:      to,
+			Subject: query.Get("subject"),
+			Body:    query.Get("body"),
+		}
+	}
+
 	x := query.Get("x")
 	y := query.Get("y")
 	rawWidth := query.Get("width")
@@ -45,11 +253,9 @@ func NewOptionsFromQuery(query url.Values) (*ScanOptions, error) {
 
 	// Don't do anything more if no rectangle was provided.
 	if x == "" && y == "" && rawWidth == "" && rawHeight == "" {
-		return options, nil
+		return NewOptions(req, presets)
 	}
 
-	options.ScanArea = new(ScanArea)
-
 	// Check if any of the rectangle parameters is missing.
 	if x == "" || y == "" || rawWidth == "" || rawHeight == "" {
 		return nil, ErrMalformedRect
@@ -58,8 +264,10 @@ func NewOptionsFromQuery(query url.Values) (*ScanOptions, error) {
 	// Parse the parameters into integers. This is probably not required, and SANE can
 	// probably deal with them just as well if they're strings, but this at least
 	// provides an extra layer of input validation
+	req.Rect = new(Rect)
+
 	var err error
-	if options.ScanArea.TLX, err = strconv.Atoi(x); err != nil {
+	if req.Rect.X, err = strconv.Atoi(x); err != nil {
 		logrus.
 			WithError(err).
 			Error("Failed to parse x value for rectangle")
@@ -67,7 +275,7 @@ func NewOptionsFromQuery(query url.Values) (*ScanOptions, error) {
 		return nil, ErrMalformedRect
 	}
 
-	if options.ScanArea.TLY, err = strconv.Atoi(y); err != nil {
+	if req.Rect.Y, err = strconv.Atoi(y); err != nil {
 		logrus.
 			WithError(err).
 			Error("Failed to parse y value for rectangle")
@@ -75,8 +283,7 @@ func NewOptionsFromQuery(query url.Values) (*ScanOptions, error) {
 		return nil, ErrMalformedRect
 	}
 
-	var width, height int
-	if width, err = strconv.Atoi(rawWidth); err != nil {
+	if req.Rect.Width, err = strconv.Atoi(rawWidth); err != nil {
 		logrus.
 			WithError(err).
 			Error("Failed to parse width value for rectangle")
@@ -84,7 +291,7 @@ func NewOptionsFromQuery(query url.Values) (*ScanOptions, error) {
 		return nil, ErrMalformedRect
 	}
 
-	if height, err = strconv.Atoi(rawHeight); err != nil {
+	if req.Rect.Height, err = strconv.Atoi(rawHeight); err != nil {
 		logrus.
 			WithError(err).
 			Error("Failed to parse height value for rectangle")
@@ -92,8 +299,138 @@ func NewOptionsFromQuery(query url.Values) (*ScanOptions, error) {
 		return nil, ErrMalformedRect
 	}
 
-	options.ScanArea.BRX = options.ScanArea.TLX.(int) + width
-	options.ScanArea.BRY = options.ScanArea.TLY.(int) + height
+	return NewOptions(req, presets)
+}
+
+// HasDestination returns whether the file must be sent to the given destination.
+func (o *ScanOptions) HasDestination(destination string) bool {
+	if len(o.Destinations) == 0 {
+		return destination == DestinationWebDAV
+	}
 
-	return options, nil
+	for _, d := range o.Destinations {
+		if d == destination {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkDestinations checks the given list of destinations, and returns it without
+// duplicates, or a list containing only DestinationWebDAV if it's empty.
+// Returns ErrUnknownDestination if a destination isn't supported.
+func checkDestinations(destinations []string) ([]string, error) {
+	if len(destinations) == 0 {
+		return []string{DestinationWebDAV}, nil
+	}
+
+	checked := make([]string, 0, len(destinations))
+	seen := make(map[string]bool)
+	for _, d := range destinations {
+		switch d {
+		case DestinationWebDAV, DestinationEmail, DestinationDownload:
+		default:
+			return nil, ErrUnknownDestination
+		}
+
+		if !seen[d] {
+			seen[d] = true
+			checked = append(checked, d)
+		}
+	}
+
+	return checked, nil
+}
+
+// UploadDestinations returns the destinations the file must be uploaded to, i.e. all of
+// them except DestinationDownload.
+func (o *ScanOptions) UploadDestinations() []string {
+	if len(o.Destinations) == 0 {
+		return []string{DestinationWebDAV}
+	}
+
+	uploads := make([]string, 0, len(o.Destinations))
+	for _, d := range o.Destinations {
+		if d != DestinationDownload {
+			uploads = append(uploads, d)
+		}
+	}
+
+	return uploads
+}
+
+// UploadDestination returns the destination the file must be uploaded to, i.e. the
+// first one other than DestinationDownload, or an empty string if there's none. This is
+// the destination of the file of a spool entry, since there's one entry per destination.
+func (o *ScanOptions) UploadDestination() string {
+	if uploads := o.UploadDestinations(); len(uploads) > 0 {
+		return uploads[0]
+	}
+
+	return ""
+}
+
+// NamingTime returns the time to name files made from the scan after, i.e. the time the
+// document has been scanned at, or the current time if it's unknown.
+func (o *ScanOptions) NamingTime() time.Time {
+	if o.ScannedAt.IsZero() {
+		return time.Now()
+	}
+
+	return o.ScannedAt
+}
+
+// CheckEmail checks the given email options, and returns them with the recipients'
+// addresses normalised.
+// Returns ErrInvalidEmail if there's no recipient, if one of them isn't a valid address,
+// or if the subject contains line breaks.
+func CheckEmail(e *EmailOptions) (*EmailOptions, error) {
+	if e == nil || len(e.To) == 0 || strings.ContainsAny(e.Subject, "\r\n") {
+		return nil, ErrInvalidEmail
+	}
+
+	checked := &EmailOptions{
+		To:      make([]string, 0, len(e.To)),
+		Subject: e.Subject,
+		Body:    e.Body,
+	}
+	for _, to := range e.To {
+		addr, err := mail.ParseAddress(to)
+		if err != nil {
+			return nil, ErrInvalidEmail
+		}
+
+		checked.To = append(checked.To, addr.Address)
+	}
+
+	return checked, nil
+}
+
+// checkJob checks the given job ID picked by a client, and returns it, or a random one
+// if it's empty.
+// Returns ErrInvalidJob if the ID is too long or contains unexpected characters.
+func checkJob(job string) (string, error) {
+	if job == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+
+		return hex.EncodeToString(b), nil
+	}
+
+	if len(job) > maxJobLen {
+		return "", ErrInvalidJob
+	}
+
+	for _, c := range job {
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !isDigit && c != '-' && c != '_' {
+			return "", ErrInvalidJob
+		}
+	}
+
+	return job, nil
 }
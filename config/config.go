@@ -1,16 +1,56 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	// ConflictReject rejects a scan if its file name is already in use.
+	ConflictReject = "reject"
+	// ConflictSuffix appends a numbered suffix (e.g. "name (2)") to the file's name if
+	// it's already in use.
+	ConflictSuffix = "suffix"
+)
+
+const (
+	// LogFormatText logs human-readable lines.
+	LogFormatText = "text"
+	// LogFormatJSON logs one JSON object per line.
+	LogFormatJSON = "json"
+)
+
+const (
+	// SMTPSecurityStartTLS upgrades the connection to the SMTP server with STARTTLS, and
+	// fails if the server doesn't support it.
+	SMTPSecurityStartTLS = "starttls"
+	// SMTPSecurityTLS connects to the SMTP server over TLS right away.
+	SMTPSecurityTLS = "tls"
+	// SMTPSecurityNone doesn't encrypt the connection to the SMTP server. It should only
+	// be used with a server on the same host or network.
+	SMTPSecurityNone = "none"
+)
+
 // Config represents the top-level structure of the configuration file.
 type Config struct {
-	Scanner *ScannerConfig `yaml:"scanner"`
-	HTTP    *HTTPConfig    `yaml:"http"`
-	WebDAV  *WebDAVConfig  `yaml:"webdav"`
+	Scanner *ScannerConfig           `yaml:"scanner"`
+	HTTP    *HTTPConfig              `yaml:"http"`
+	WebDAV  *WebDAVConfig            `yaml:"webdav"`
+	Presets map[string]*PresetConfig `yaml:"presets"`
+	Spool   *SpoolConfig             `yaml:"spool"`
+	Auth    *AuthConfig              `yaml:"auth"`
+	Log     *LogConfig               `yaml:"log"`
+	History *HistoryConfig           `yaml:"history"`
+	// SMTP is the configuration for sending scans by email. Scans can't be sent by email
+	// if it's nil.
+	SMTP *SMTPConfig `yaml:"smtp"`
+	// Webhooks is the configuration for the webhooks notified when scans complete or fail.
+	Webhooks *WebhooksConfig `yaml:"webhooks"`
 }
 
 // ScannerConfig represents the configuration for the scanner, i.e. the device that's
@@ -20,6 +60,9 @@ type ScannerConfig struct {
 	Mode       string `yaml:"mode"`
 	PreviewRes int    `yaml:"preview_res"`
 	ScanRes    int    `yaml:"scan_res"`
+	// ScanTimeout is the maximum amount of time reading an image from the device can
+	// take, after which the scan is cancelled. Zero means no limit.
+	ScanTimeout time.Duration `yaml:"scan_timeout"`
 }
 
 // HTTPConfig represents the configuration for the HTTP server used to preview scans and
@@ -34,21 +77,282 @@ type HTTPConfig struct {
 // WebDAVConfig represents the configuration required to connect to the WebDAV server and
 // upload scanned documents there.
 type WebDAVConfig struct {
+	// WebDAVAccount is the account files are uploaded to when the user who requested the
+	// scan doesn't have an account of their own. It can be left empty if every user has
+	// their own account.
+	WebDAVAccount `yaml:",inline"`
+	// PasswordFile is the path to a file containing the password of the default account,
+	// so it doesn't need to be included in the configuration file. It takes precedence
+	// over Password.
+	PasswordFile string `yaml:"password_file"`
+	// AccountsFile is the path to a YAML file mapping user names to their own WebDAV
+	// account, using the same keys as the default account.
+	AccountsFile string `yaml:"accounts_file"`
+	// Accounts maps user names to their own WebDAV account. It is populated from
+	// AccountsFile.
+	Accounts map[string]*WebDAVAccount `yaml:"-"`
+	// FileNameTemplate is the template used to name files that haven't been given a name
+	// by the user. See naming.Template for the supported placeholders.
+	FileNameTemplate string `yaml:"file_name_template"`
+	// OnConflict defines what to do when a file with the same name already exists on the
+	// WebDAV server. It can be either "reject" or "suffix".
+	OnConflict string `yaml:"on_conflict"`
+	// ConnectTimeout is the maximum amount of time to wait for a connection to the WebDAV
+	// server to be established.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// ResponseTimeout is the maximum amount of time to wait for the WebDAV server to
+	// respond once a request has been fully sent.
+	ResponseTimeout time.Duration `yaml:"response_timeout"`
+	// RequestTimeout is the maximum amount of time a whole request can take, including
+	// sending its body. Zero means no limit, which is the default since uploading large
+	// files can take a long time.
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// MaxRetries is the maximum number of times a request is retried after a network
+	// error or a 5xx response.
+	MaxRetries int `yaml:"max_retries"`
+	// RetryBackoff is the amount of time to wait before the first retry. This amount is
+	// doubled with each retry.
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// ChunkedUploadThreshold is the size, in bytes, above which files are uploaded in
+	// chunks using Nextcloud's chunked upload protocol, if the server supports it. Zero
+	// disables chunked uploads.
+	ChunkedUploadThreshold int64 `yaml:"chunked_upload_threshold"`
+	// ChunkSize is the size, in bytes, of each chunk when uploading a file in chunks.
+	// Nextcloud requires chunks to be at least 5MiB, except for the last one, so it can't
+	// be lower than that if chunked uploads are enabled.
+	ChunkSize int64 `yaml:"chunk_size"`
+}
+
+// WebDAVAccount represents the location of, and the credentials for, a WebDAV account to
+// upload scanned documents to.
+type WebDAVAccount struct {
 	RootURL    string `yaml:"root_url"`
 	User       string `yaml:"user"`
 	Password   string `yaml:"password"`
 	UploadPath string `yaml:"upload_path"`
+	// ChunkedUploadsURL is the URL of the collection to upload chunks into. If empty, it
+	// is derived from the root URL if the root URL looks like a Nextcloud WebDAV URL.
+	ChunkedUploadsURL string `yaml:"chunked_uploads_url"`
+}
+
+// SMTPConfig represents the configuration required to connect to the SMTP server scanned
+// documents are sent by email through.
+type SMTPConfig struct {
+	// Host is the host name or IP address of the SMTP server.
+	Host string `yaml:"host"`
+	// Port is the port of the SMTP server. Defaults to 587 with STARTTLS, 465 with TLS and
+	// 25 without encryption.
+	Port int `yaml:"port"`
+	// Security is how the connection to the server is encrypted, as one of the
+	// SMTPSecurity* constants. Defaults to STARTTLS.
+	Security string `yaml:"security"`
+	// Username and Password are the credentials to authenticate with. No authentication
+	// is attempted if Username is empty.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// PasswordFile is the path to a file containing the password, so it doesn't need to be
+	// included in the configuration file. It takes precedence over Password.
+	PasswordFile string `yaml:"password_file"`
+	// From is the address emails are sent from, optionally with a display name (e.g.
+	// "Scanner <scanner@example.com>").
+	From string `yaml:"from"`
+	// AllowedRecipients lists the addresses, and the domains (starting with "@"), scans
+	// can be sent to. Any address is allowed if it's empty.
+	AllowedRecipients []string `yaml:"allowed_recipients"`
+	// MaxAttachmentSize is the maximum size, in bytes, of a file sent by email. Larger
+	// files are rejected, since most servers would refuse them anyway.
+	MaxAttachmentSize int64 `yaml:"max_attachment_size"`
+	// Timeout is the maximum amount of time sending an email can take.
+	Timeout time.Duration `yaml:"timeout"`
+	// DefaultSubject is the subject of emails which sender didn't provide one.
+	DefaultSubject string `yaml:"default_subject"`
+}
+
+// SpoolConfig represents the configuration for the spool, i.e. the on-disk queue scanned
+// documents go through before being uploaded.
+type SpoolConfig struct {
+	// Dir is the directory to store spooled files in.
+	Dir string `yaml:"dir"`
+	// MaxAttempts is the number of times the upload of a file is attempted before giving
+	// up on it.
+	MaxAttempts int `yaml:"max_attempts"`
+	// RetryBackoff is the amount of time to wait before the first retry. This amount is
+	// doubled with each retry.
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// MaxBackoff is the maximum amount of time to wait between two attempts.
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// FailedRetention is the amount of time files which upload failed are kept for, so
+	// they can be downloaded or uploaded again. Zero means they're kept until they're
+	// discarded.
+	FailedRetention time.Duration `yaml:"failed_retention"`
+}
+
+// AuthConfig represents the configuration for authenticating users of the web UI and the
+// API. Authentication is enabled if at least one way of authenticating is configured.
+type AuthConfig struct {
+	// HtpasswdFile is the path to a file containing user names and bcrypt-hashed
+	// passwords, in the format generated by `htpasswd -B`.
+	HtpasswdFile string `yaml:"htpasswd_file"`
+	// OIDC is the configuration of an OpenID Connect provider to log users in with.
+	OIDC *OIDCConfig `yaml:"oidc"`
+	// SessionSecret is the secret used to sign session cookies. If empty, a random secret
+	// is generated on startup, which means sessions don't survive restarts.
+	SessionSecret string `yaml:"session_secret"`
+	// SessionLifetime is the amount of time after which users need to log in again.
+	SessionLifetime time.Duration `yaml:"session_lifetime"`
+	// Admins is the list of the users who can manage API tokens and the spool.
+	Admins []string `yaml:"admins"`
+	// TokensFile is the path to the file API tokens are stored in.
+	TokensFile string `yaml:"tokens_file"`
+	// RevokedSessionsFile is the path to the file the sessions users have logged out of
+	// are stored in until they expire, so they can't be used again.
+	RevokedSessionsFile string `yaml:"revoked_sessions_file"`
+	// InsecureCookies allows session cookies to be sent over plain HTTP. This should only
+	// be enabled if the server isn't behind a HTTPS reverse proxy and doesn't use TLS
+	// itself.
+	InsecureCookies bool `yaml:"insecure_cookies"`
+}
+
+// Enabled returns whether authentication is enabled.
+func (c *AuthConfig) Enabled() bool {
+	return c.HtpasswdFile != "" || c.OIDC != nil
+}
+
+// OIDCConfig represents the configuration for logging users in with an OpenID Connect
+// provider.
+type OIDCConfig struct {
+	// Issuer is the URL of the provider, which is used to discover its endpoints.
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL is the URL of the callback endpoint, i.e. the public URL of the server
+	// followed by /auth/oidc/callback.
+	RedirectURL string   `yaml:"redirect_url"`
+	Scopes      []string `yaml:"scopes"`
+	// UserClaim is the claim of the ID token to use as the user's name.
+	UserClaim string `yaml:"user_claim"`
+}
+
+// WebhooksConfig represents the configuration for the webhooks notified when scans
+// complete or fail.
+type WebhooksConfig struct {
+	Hooks []*WebhookConfig `yaml:"hooks"`
+	// MaxAttempts is the number of times the delivery of a notification is attempted
+	// before giving up on it.
+	MaxAttempts int `yaml:"max_attempts"`
+	// RetryBackoff is the amount of time to wait before the first retry. This amount is
+	// doubled with each retry.
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// Timeout is the maximum amount of time a single delivery attempt can take.
+	Timeout time.Duration `yaml:"timeout"`
+	// LogSize is the number of deliveries kept in the delivery log, beyond which the
+	// oldest ones are forgotten.
+	LogSize int `yaml:"log_size"`
+}
+
+// WebhookConfig represents the configuration for a single webhook.
+type WebhookConfig struct {
+	// Name identifies the webhook in the delivery log. Defaults to its URL.
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Secret is the key the payloads are signed with, using HMAC-SHA256, so the receiver
+	// can check they come from us.
+	Secret string `yaml:"secret"`
+	// SecretFile is the path to a file containing the secret, so it doesn't need to be
+	// included in the configuration file. It takes precedence over Secret.
+	SecretFile string `yaml:"secret_file"`
+	// Events lists the events to notify the webhook of (e.g. ["scan.failed"]). The
+	// webhook is notified of all events if it's empty.
+	Events []string `yaml:"events"`
+}
+
+// HistoryConfig represents the configuration for the history of scans.
+type HistoryConfig struct {
+	// Path is the path to the database file the history is stored in.
+	Path string `yaml:"path"`
+	// ThumbnailSize is the maximum width and height of the thumbnails of the scans, in
+	// pixels.
+	ThumbnailSize int `yaml:"thumbnail_size"`
+	// ThumbnailMaxAge is the amount of time after which the thumbnail of a scan is
+	// removed. Zero means thumbnails aren't removed because of their age.
+	ThumbnailMaxAge time.Duration `yaml:"thumbnail_max_age"`
+	// MaxThumbnails is the number of thumbnails to keep, beyond which the oldest ones are
+	// removed. Zero means there's no limit.
+	MaxThumbnails int `yaml:"max_thumbnails"`
+}
+
+// LogConfig represents the configuration for the logs.
+type LogConfig struct {
+	// Level is the minimum level of the messages to log, e.g. "debug", "info" or
+	// "warning".
+	Level string `yaml:"level"`
+	// Format is the format of the logs. It can be either "text" or "json".
+	Format string `yaml:"format"`
+}
+
+// PresetConfig represents a named set of settings users can pick from when scanning a
+// document.
+type PresetConfig struct {
+	Format           string `yaml:"format"`
+	FileNameTemplate string `yaml:"file_name_template"`
+	// Destinations lists where to send the files scanned with this preset, unless the
+	// request says otherwise (e.g. ["webdav", "email"]).
+	Destinations []string `yaml:"destinations"`
+	// EmailTo and EmailSubject are the recipients and subject of the email to send the
+	// files in if the destinations include email and the request doesn't provide one.
+	EmailTo      []string `yaml:"email_to"`
+	EmailSubject string   `yaml:"email_subject"`
 }
 
 // NewConfig parses the configuration file at the given path.
 func NewConfig(path string) (*Config, error) {
 	configWithDefaults := &Config{
-		Scanner: &ScannerConfig{},
+		Scanner: &ScannerConfig{
+			// Scans at very high resolutions can take several minutes.
+			ScanTimeout: 10 * time.Minute,
+		},
 		HTTP: &HTTPConfig{
 			Address: "127.0.0.1",
 			Port:    "8080",
 		},
-		WebDAV: &WebDAVConfig{},
+		WebDAV: &WebDAVConfig{
+			OnConflict:      ConflictReject,
+			ConnectTimeout:  10 * time.Second,
+			ResponseTimeout: time.Minute,
+			MaxRetries:      3,
+			RetryBackoff:    time.Second,
+			// Files scanned at very high resolutions can easily weigh tens of megabytes.
+			ChunkedUploadThreshold: 20 << 20,
+			ChunkSize:              10 << 20,
+		},
+		Spool: &SpoolConfig{
+			Dir:          "spool",
+			MaxAttempts:  10,
+			RetryBackoff: 30 * time.Second,
+			MaxBackoff:   time.Hour,
+			// Give users a week to notice the upload failed and do something about it.
+			FailedRetention: 7 * 24 * time.Hour,
+		},
+		Auth: &AuthConfig{
+			SessionLifetime:     30 * 24 * time.Hour,
+			TokensFile:          "tokens.json",
+			RevokedSessionsFile: "revoked_sessions.json",
+		},
+		Log: &LogConfig{
+			Level:  "info",
+			Format: LogFormatText,
+		},
+		History: &HistoryConfig{
+			Path:          "history.db",
+			ThumbnailSize: 256,
+			MaxThumbnails: 1000,
+		},
+		Webhooks: &WebhooksConfig{
+			MaxAttempts:  5,
+			RetryBackoff: 10 * time.Second,
+			Timeout:      10 * time.Second,
+			LogSize:      500,
+		},
 	}
 
 	raw, err := ioutil.ReadFile(path)
@@ -60,5 +364,152 @@ func NewConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	// Load the WebDAV secrets that live outside of the configuration file.
+	if err = configWithDefaults.WebDAV.loadSecrets(); err != nil {
+		return nil, err
+	}
+
+	// Same for the SMTP configuration.
+	if smtp := configWithDefaults.SMTP; smtp != nil {
+		if err = smtp.setDefaults(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Same for the webhooks.
+	if err = configWithDefaults.Webhooks.loadSecrets(); err != nil {
+		return nil, err
+	}
+
+	// Fill in the defaults for the OIDC configuration if it's been provided, since we
+	// can't do that before parsing the file.
+	if oidc := configWithDefaults.Auth.OIDC; oidc != nil {
+		if len(oidc.Scopes) == 0 {
+			oidc.Scopes = []string{"openid", "profile", "email"}
+		}
+		if oidc.UserClaim == "" {
+			oidc.UserClaim = "preferred_username"
+		}
+	}
+
 	return configWithDefaults, nil
 }
+
+// setDefaults fills in the settings of the SMTP configuration which haven't been
+// provided, reads the password from its file if any, and checks the security setting.
+func (c *SMTPConfig) setDefaults() error {
+	if c.Security == "" {
+		c.Security = SMTPSecurityStartTLS
+	}
+
+	if c.Port == 0 {
+		switch c.Security {
+		case SMTPSecurityStartTLS:
+			c.Port = 587
+		case SMTPSecurityTLS:
+			c.Port = 465
+		case SMTPSecurityNone:
+			c.Port = 25
+		}
+	}
+
+	switch c.Security {
+	case SMTPSecurityStartTLS, SMTPSecurityTLS, SMTPSecurityNone:
+	default:
+		return fmt.Errorf("invalid SMTP security %q", c.Security)
+	}
+
+	if c.Host == "" || c.From == "" {
+		return errors.New("the SMTP host and sender address are required")
+	}
+
+	if c.MaxAttachmentSize == 0 {
+		// Most providers reject messages over 25MB, and base64 makes files a third larger.
+		c.MaxAttachmentSize = 18 << 20
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 2 * time.Minute
+	}
+	if c.DefaultSubject == "" {
+		c.DefaultSubject = "Document numérisé"
+	}
+
+	if c.PasswordFile != "" {
+		password, err := readSecretFile(c.PasswordFile)
+		if err != nil {
+			return err
+		}
+
+		c.Password = password
+	}
+
+	return nil
+}
+
+// loadSecrets reads the secrets of the webhooks from their respective files, if any, and
+// checks that every webhook has a URL and a secret.
+func (c *WebhooksConfig) loadSecrets() error {
+	for _, hook := range c.Hooks {
+		if hook.SecretFile != "" {
+			secret, err := readSecretFile(hook.SecretFile)
+			if err != nil {
+				return err
+			}
+
+			hook.Secret = secret
+		}
+
+		if hook.URL == "" || hook.Secret == "" {
+			return errors.New("webhooks require a URL and a secret")
+		}
+
+		if hook.Name == "" {
+			hook.Name = hook.URL
+		}
+	}
+
+	return nil
+}
+
+// loadSecrets reads the password of the default account and the accounts of the users
+// from their respective files, if any.
+func (c *WebDAVConfig) loadSecrets() error {
+	if c.PasswordFile != "" {
+		password, err := readSecretFile(c.PasswordFile)
+		if err != nil {
+			return err
+		}
+
+		c.Password = password
+	}
+
+	if c.AccountsFile != "" {
+		raw, err := ioutil.ReadFile(c.AccountsFile)
+		if err != nil {
+			return err
+		}
+
+		if err = yaml.Unmarshal(raw, &c.Accounts); err != nil {
+			return fmt.Errorf("invalid accounts file %s: %w", c.AccountsFile, err)
+		}
+
+		for user, account := range c.Accounts {
+			if account == nil || account.RootURL == "" {
+				return fmt.Errorf("missing root URL for the account of %s", user)
+			}
+		}
+	}
+
+	return nil
+}
+
+// readSecretFile returns the secret stored in the file at the given path.
+func readSecretFile(path string) (string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Editors tend to add a new line at the end of files.
+	return strings.TrimRight(string(raw), "\r\n"), nil
+}
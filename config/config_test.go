@@ -0,0 +1,41 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSecretFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for content, want := range map[string]string{
+		"secret":         "secret",
+		"secret\n":       "secret",
+		"secret\r\n":     "secret",
+		"sec ret \n\n":   "sec ret ",
+		"secret\nmore\n": "secret\nmore",
+	} {
+		path := filepath.Join(dir, "secret")
+		if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := readSecretFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %q from %q; want %q", got, content, want)
+		}
+	}
+
+	if _, err = readSecretFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
@@ -0,0 +1,363 @@
+// Package email sends scanned documents by email, as attachments, through an SMTP server.
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/logging"
+)
+
+const (
+	// base64LineLength is the maximum length of the lines of a base64-encoded attachment,
+	// as required by RFC 2045.
+	base64LineLength = 76
+	// writeChunkSize is the size of the chunks the message is sent in, so its progress
+	// can be reported.
+	writeChunkSize = 32 << 10
+)
+
+var (
+	// ErrAttachmentTooLarge is the error returned by Upload if the file is larger than the
+	// configured maximum attachment size.
+	ErrAttachmentTooLarge = errors.New("file too large to be sent by email")
+	// ErrRecipientNotAllowed is the error returned if a recipient isn't one of the
+	// configured allowed recipients.
+	ErrRecipientNotAllowed = errors.New("recipient not allowed")
+	// ErrNoRecipient is the error returned by Upload if the options don't say who to send
+	// the file to.
+	ErrNoRecipient = errors.New("no recipient")
+	// ErrStartTLSUnsupported is the error returned by Upload if the client is configured
+	// to use STARTTLS but the server doesn't support it.
+	ErrStartTLSUnsupported = errors.New("SMTP server doesn't support STARTTLS")
+)
+
+// Client sends scanned documents by email.
+type Client struct {
+	cfg  *config.SMTPConfig
+	from *mail.Address
+	// name returns the name to give to the attachment for the given options.
+	name func(options *common.ScanOptions, t time.Time) string
+}
+
+// NewClient returns a new Client sending emails through the configured SMTP server, and
+// naming attachments with the given function.
+// Returns an error if the sender address isn't valid.
+func NewClient(
+	cfg *config.SMTPConfig,
+	name func(options *common.ScanOptions, t time.Time) string,
+) (*Client, error) {
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", cfg.From, err)
+	}
+
+	return &Client{
+		cfg:  cfg,
+		from: from,
+		name: name,
+	}, nil
+}
+
+// CheckRecipients checks that the given addresses are allowed to receive scans.
+// Returns ErrRecipientNotAllowed if one of them isn't.
+func (c *Client) CheckRecipients(to []string) error {
+	if len(c.cfg.AllowedRecipients) == 0 {
+		return nil
+	}
+
+	for _, addr := range to {
+		if !c.allowed(addr) {
+			return ErrRecipientNotAllowed
+		}
+	}
+
+	return nil
+}
+
+// allowed returns whether the given address matches one of the allowed addresses or
+// domains.
+func (c *Client) allowed(addr string) bool {
+	addr = strings.ToLower(addr)
+	for _, allowed := range c.cfg.AllowedRecipients {
+		allowed = strings.ToLower(allowed)
+		if addr == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(addr, allowed)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsPermanent returns whether the given error, returned by Upload, is caused by something
+// retrying later won't fix on its own, e.g. a file that's too large or a recipient the
+// server rejects.
+func (c *Client) IsPermanent(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		// 5xx replies are permanent negative completion replies (see RFC 5321).
+		return protoErr.Code >= 500
+	}
+
+	return err == ErrAttachmentTooLarge ||
+		err == ErrRecipientNotAllowed ||
+		err == ErrNoRecipient ||
+		err == ErrStartTLSUnsupported
+}
+
+// Upload sends the content read from the given reader by email, as an attachment, to the
+// recipients and with the subject and body from the options, and returns the name of the
+// attachment. The sending is aborted if the given context is done.
+// Returns ErrNoRecipient if the options don't include an email, ErrRecipientNotAllowed if
+// a recipient isn't allowed, ErrAttachmentTooLarge if the file is larger than the
+// configured maximum, or the error returned by the server if it refused the email.
+func (c *Client) Upload(
+	ctx context.Context,
+	options *common.ScanOptions,
+	body io.Reader,
+) (string, error) {
+	if options.Email == nil || len(options.Email.To) == 0 {
+		return "", ErrNoRecipient
+	}
+
+	if err := c.CheckRecipients(options.Email.To); err != nil {
+		return "", err
+	}
+
+	// Read one more byte than allowed so we can tell whether the file is too large
+	// without reading all of it.
+	content, err := ioutil.ReadAll(io.LimitReader(body, c.cfg.MaxAttachmentSize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(content)) > c.cfg.MaxAttachmentSize {
+		return "", ErrAttachmentTooLarge
+	}
+
+	name := c.name(options, options.NamingTime())
+	msg, err := c.message(options, name, content)
+	if err != nil {
+		return "", err
+	}
+
+	logging.Entry(ctx).
+		WithField("filename", name).
+		WithField("recipients", len(options.Email.To)).
+		Info("Sending file by email")
+
+	if err = c.send(ctx, options, msg); err != nil {
+		return "", err
+	}
+
+	logging.Entry(ctx).Info("Email sent")
+
+	return name, nil
+}
+
+// send sends the given message to the recipients from the given options through the
+// SMTP server.
+func (c *Client) send(ctx context.Context, options *common.ScanOptions, msg []byte) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(c.cfg.Host, strconv.Itoa(c.cfg.Port))
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	// net/smtp doesn't know about contexts, so abort whatever it's doing by closing the
+	// connection if the context is done.
+	deadline, _ := ctx.Deadline()
+	if err = conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	tlsConfig := &tls.Config{ServerName: c.cfg.Host}
+	if c.cfg.Security == config.SMTPSecurityTLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	sc, err := smtp.NewClient(conn, c.cfg.Host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer sc.Close()
+
+	if c.cfg.Security == config.SMTPSecurityStartTLS {
+		if ok, _ := sc.Extension("STARTTLS"); !ok {
+			return ErrStartTLSUnsupported
+		}
+		if err = sc.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if c.cfg.Username != "" {
+		if err = sc.Auth(smtp.PlainAuth("", c.cfg.Username, c.cfg.Password, c.cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err = sc.Mail(c.from.Address); err != nil {
+		return err
+	}
+	for _, to := range options.Email.To {
+		if err = sc.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := sc.Data()
+	if err != nil {
+		return err
+	}
+
+	// Report how much of the message has been sent, if the caller wants to know.
+	var dst io.Writer = w
+	if options.UploadProgress != nil {
+		dst = &progressWriter{w: w, total: int64(len(msg)), fn: options.UploadProgress}
+	}
+	for sent := 0; sent < len(msg); {
+		n := writeChunkSize
+		if n > len(msg)-sent {
+			n = len(msg) - sent
+		}
+		if _, err = dst.Write(msg[sent : sent+n]); err != nil {
+			return err
+		}
+		sent += n
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return sc.Quit()
+}
+
+// message builds the email to send the given content in, as an attachment with the
+// given name.
+func (c *Client) message(options *common.ScanOptions, name string, content []byte) ([]byte, error) {
+	subject := options.Email.Subject
+	if subject == "" {
+		subject = c.cfg.DefaultSubject
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := c.from.Address[strings.LastIndex(c.from.Address, "@")+1:]
+
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+
+	headers := [][2]string{
+		{"From", c.from.String()},
+		{"To", strings.Join(options.Email.To, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()})},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+
+	// Add the body of the email as the first part.
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err = qp.Write([]byte(options.Email.Body)); err != nil {
+		return nil, err
+	}
+	if err = qp.Close(); err != nil {
+		return nil, err
+	}
+
+	// Then the file itself.
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.TypeByExtension("." + options.Format)},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 0 {
+		n := base64LineLength
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		if _, err = io.WriteString(part, encoded[:n]+"\r\n"); err != nil {
+			return nil, err
+		}
+		encoded = encoded[n:]
+	}
+
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// progressWriter is a writer calling a function with the number of bytes written so far
+// after each write.
+type progressWriter struct {
+	w     io.Writer
+	sent  int64
+	total int64
+	fn    func(sent int64, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.sent += int64(n)
+	p.fn(p.sent, p.total)
+	return n, err
+}
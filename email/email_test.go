@@ -0,0 +1,340 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+)
+
+// fakeSMTPServer is a minimal SMTP server without any extension, accepting any message
+// but the ones sent to a given recipient.
+type fakeSMTPServer struct {
+	ln net.Listener
+	// rejected is the recipient the server rejects, with rejectReply as its reply.
+	rejected    string
+	rejectReply string
+
+	mu       sync.Mutex
+	messages [][]byte
+	conns    int
+}
+
+// newFakeSMTPServer starts a new fakeSMTPServer on a random port of the loopback
+// interface, which is stopped at the end of the test.
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &fakeSMTPServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+// serve handles an SMTP session on the given connection.
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conns++
+	s.mu.Unlock()
+
+	tc := textproto.NewConn(conn)
+	_ = tc.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "RCPT":
+			if s.rejected != "" && strings.Contains(line, "<"+s.rejected+">") {
+				_ = tc.PrintfLine("%s", s.rejectReply)
+			} else {
+				_ = tc.PrintfLine("250 OK")
+			}
+		case "DATA":
+			_ = tc.PrintfLine("354 Go ahead")
+			msg, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			_ = tc.PrintfLine("250 Queued")
+		case "QUIT":
+			_ = tc.PrintfLine("221 Bye")
+			return
+		case "EHLO", "MAIL", "RSET", "NOOP":
+			_ = tc.PrintfLine("250 OK")
+		default:
+			_ = tc.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+// received returns the messages the server accepted, and the number of connections it
+// got.
+func (s *fakeSMTPServer) received() ([][]byte, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.messages, s.conns
+}
+
+// newTestClient returns a new Client sending emails through the given server, with the
+// given security and maximum attachment size, and naming attachments scan.pdf.
+func newTestClient(t *testing.T, s *fakeSMTPServer, security string, maxSize int64) *Client {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	c, err := NewClient(&config.SMTPConfig{
+		Host:              "127.0.0.1",
+		Port:              addr.Port,
+		Security:          security,
+		From:              "Scanner <scanner@example.com>",
+		MaxAttachmentSize: maxSize,
+		Timeout:           5 * time.Second,
+		DefaultSubject:    "Document numérisé",
+	}, func(options *common.ScanOptions, t time.Time) string {
+		return "scan." + options.Format
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// testOptions returns options to send a PDF file by email to the given recipients.
+func testOptions(to ...string) *common.ScanOptions {
+	return &common.ScanOptions{
+		Format:       "pdf",
+		Destinations: []string{common.DestinationEmail},
+		Email:        &common.EmailOptions{To: to},
+	}
+}
+
+func TestUploadFailsWithoutStartTLS(t *testing.T) {
+	s := newFakeSMTPServer(t)
+	c := newTestClient(t, s, config.SMTPSecurityStartTLS, 1024)
+
+	_, err := c.Upload(context.Background(), testOptions("alice@example.com"), strings.NewReader("%PDF-1.4\n"))
+	if err != ErrStartTLSUnsupported {
+		t.Fatalf("Upload returned %v; want ErrStartTLSUnsupported", err)
+	}
+	if !c.IsPermanent(err) {
+		t.Error("the missing STARTTLS support isn't considered permanent")
+	}
+
+	if messages, _ := s.received(); len(messages) != 0 {
+		t.Errorf("the message has been sent in clear text")
+	}
+}
+
+func TestUploadRejectedRecipient(t *testing.T) {
+	tests := []struct {
+		name          string
+		reply         string
+		wantCode      int
+		wantPermanent bool
+	}{
+		{name: "permanent", reply: "550 5.1.1 No such user", wantCode: 550, wantPermanent: true},
+		{name: "transient", reply: "450 4.2.1 Mailbox busy, try again later", wantCode: 450, wantPermanent: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeSMTPServer(t)
+			s.rejected = "bob@example.com"
+			s.rejectReply = tt.reply
+			c := newTestClient(t, s, config.SMTPSecurityNone, 1024)
+
+			options := testOptions("alice@example.com", "bob@example.com")
+			_, err := c.Upload(context.Background(), options, strings.NewReader("%PDF-1.4\n"))
+
+			var protoErr *textproto.Error
+			if !errors.As(err, &protoErr) || protoErr.Code != tt.wantCode {
+				t.Fatalf("Upload returned %v; want a %d reply", err, tt.wantCode)
+			}
+			if c.IsPermanent(err) != tt.wantPermanent {
+				t.Errorf("IsPermanent returned %v; want %v", !tt.wantPermanent, tt.wantPermanent)
+			}
+
+			if messages, _ := s.received(); len(messages) != 0 {
+				t.Errorf("the message has been sent despite the rejected recipient")
+			}
+		})
+	}
+}
+
+func TestUploadRejectsLargeAttachments(t *testing.T) {
+	const maxSize = 16
+
+	s := newFakeSMTPServer(t)
+	c := newTestClient(t, s, config.SMTPSecurityNone, maxSize)
+
+	_, err := c.Upload(
+		context.Background(),
+		testOptions("alice@example.com"),
+		bytes.NewReader(make([]byte, maxSize+1)),
+	)
+	if err != ErrAttachmentTooLarge {
+		t.Fatalf("Upload returned %v; want ErrAttachmentTooLarge", err)
+	}
+	if !c.IsPermanent(err) {
+		t.Error("the attachment size isn't considered permanent")
+	}
+	if _, conns := s.received(); conns != 0 {
+		t.Error("the server has been contacted about a file that's too large")
+	}
+
+	if _, err = c.Upload(
+		context.Background(),
+		testOptions("alice@example.com"),
+		bytes.NewReader(make([]byte, maxSize)),
+	); err != nil {
+		t.Fatalf("Upload returned %v for a file of the maximum size", err)
+	}
+}
+
+func TestUploadMessageLayout(t *testing.T) {
+	s := newFakeSMTPServer(t)
+	c := newTestClient(t, s, config.SMTPSecurityNone, 1024)
+
+	// Make the file span several base64 lines.
+	content := bytes.Repeat([]byte("%PDF-1.4\n"), 20)
+	options := testOptions("alice@example.com", "bob@example.com")
+	options.Email.Subject = "Facture d'électricité"
+	options.Email.Body = "Voilà la facture, avec une très longue ligne qui doit être coupée en plusieurs morceaux pour respecter la limite."
+
+	name, err := c.Upload(context.Background(), options, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "scan.pdf" {
+		t.Errorf("got attachment name %q; want scan.pdf", name)
+	}
+
+	messages, _ := s.received()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages; want 1", len(messages))
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(messages[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if to := msg.Header.Get("To"); to != "alice@example.com, bob@example.com" {
+		t.Errorf("got To %q", to)
+	}
+	if from := msg.Header.Get("From"); from != `"Scanner" <scanner@example.com>` {
+		t.Errorf("got From %q", from)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != options.Email.Subject {
+		t.Errorf("got Subject %q (%v); want %q", subject, err, options.Email.Subject)
+	}
+	if msg.Header.Get("MIME-Version") != "1.0" || msg.Header.Get("Message-ID") == "" || msg.Header.Get("Date") == "" {
+		t.Errorf("missing headers in %v", msg.Header)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("got Content-Type %q (%v); want multipart/mixed", mediaType, err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+
+	// The body of the email comes first, encoded as quoted-printable.
+	part, err := mr.NextRawPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := part.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("got body Content-Type %q", ct)
+	}
+	if cte := part.Header.Get("Content-Transfer-Encoding"); cte != "quoted-printable" {
+		t.Errorf("got body Content-Transfer-Encoding %q", cte)
+	}
+	raw, err := ioutil.ReadAll(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLineLength(t, raw)
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+	if err != nil || string(body) != options.Email.Body {
+		t.Errorf("got body %q (%v); want %q", body, err, options.Email.Body)
+	}
+
+	// Then the file, encoded as base64.
+	part, err = mr.NextRawPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := part.Header.Get("Content-Type"); ct != "application/pdf" {
+		t.Errorf("got attachment Content-Type %q", ct)
+	}
+	if cte := part.Header.Get("Content-Transfer-Encoding"); cte != "base64" {
+		t.Errorf("got attachment Content-Transfer-Encoding %q", cte)
+	}
+	disposition, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil || disposition != "attachment" || params["filename"] != "scan.pdf" {
+		t.Errorf("got Content-Disposition %q", part.Header.Get("Content-Disposition"))
+	}
+	raw, err = ioutil.ReadAll(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLineLength(t, raw)
+	attachment, err := base64.StdEncoding.DecodeString(strings.NewReplacer("\r", "", "\n", "").Replace(string(raw)))
+	if err != nil || !bytes.Equal(attachment, content) {
+		t.Errorf("got attachment %q (%v); want %q", attachment, err, content)
+	}
+
+	if _, err = mr.NextRawPart(); err == nil {
+		t.Error("got more than two parts")
+	}
+}
+
+// checkLineLength checks that the lines of the given encoded content aren't longer than
+// RFC 2045 allows.
+func checkLineLength(t *testing.T, raw []byte) {
+	t.Helper()
+
+	sc := bufio.NewScanner(bytes.NewReader(raw))
+	for sc.Scan() {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if len(line) > base64LineLength {
+			t.Errorf("line %q is longer than %d characters", line, base64LineLength)
+		}
+	}
+}
@@ -4,8 +4,11 @@ go 1.15
 
 require (
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	github.com/prometheus/client_golang v1.14.0
 	github.com/signintech/gopdf v0.9.15
 	github.com/sirupsen/logrus v1.8.1
 	github.com/tjgq/sane v0.0.0-20180903025858-a697b47bd07c
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.10.0
 	gopkg.in/yaml.v2 v2.4.0
 )
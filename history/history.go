@@ -0,0 +1,391 @@
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+)
+
+const (
+	// DefaultLimit is the number of records returned by List if the filter doesn't set a
+	// limit.
+	DefaultLimit = 50
+	// MaxLimit is the maximum number of records List returns at once.
+	MaxLimit = 200
+)
+
+var (
+	// scansBucket is the name of the bucket the records are stored in, keyed by their ID
+	// as a big endian integer so they're sorted chronologically.
+	scansBucket = []byte("scans")
+	// thumbnailsBucket is the name of the bucket the thumbnails of the scans are stored
+	// in, as JPEG images, with the same keys as their records.
+	thumbnailsBucket = []byte("thumbnails")
+
+	// ErrInvalidCursor is the error returned by List if the cursor to start from isn't
+	// a valid record ID.
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrNotFound is the error returned if there's no record or thumbnail with the given
+	// ID.
+	ErrNotFound = errors.New("not found")
+)
+
+// Outcome is how a scan ended.
+type Outcome string
+
+const (
+	// OutcomeUploaded means the file has been uploaded.
+	OutcomeUploaded Outcome = "uploaded"
+	// OutcomeQueued means the file couldn't be uploaded right away, and has been queued
+	// to be uploaded later.
+	OutcomeQueued Outcome = "queued"
+	// OutcomeFailed means the document couldn't be scanned, or the file couldn't be
+	// encoded or uploaded.
+	OutcomeFailed Outcome = "failed"
+	// OutcomeDownloaded means the file has been sent back to the requester, and wasn't
+	// meant to be uploaded.
+	OutcomeDownloaded Outcome = "downloaded"
+	// OutcomePartial means the file has been sent to some of its destinations, but
+	// couldn't be sent to others.
+	OutcomePartial Outcome = "partial"
+)
+
+// Upload describes how sending the file of a scan to one of its destinations went.
+type Upload struct {
+	Destination string `json:"destination"`
+	// FileName is the name the file has been uploaded under, if it has.
+	FileName string `json:"file_name,omitempty"`
+	// Outcome is either OutcomeUploaded, OutcomeQueued or OutcomeFailed.
+	Outcome Outcome `json:"outcome"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Record describes a scan.
+type Record struct {
+	ID      string              `json:"id"`
+	Options *common.ScanOptions `json:"options"`
+	// FileName is the path of the uploaded file, relative to the upload path. It's only
+	// known once the file has been uploaded. If the file has been sent to several
+	// destinations, it's the name from the first one it's been sent to.
+	FileName string `json:"file_name,omitempty"`
+	// Uploads describes how sending the file to each of its destinations other than
+	// common.DestinationDownload went. It's empty for scans that failed before any upload
+	// was attempted, and for records from before it was introduced.
+	Uploads []*Upload `json:"uploads,omitempty"`
+	// Size is the size of the encoded file in bytes, or 0 if the scan failed before the
+	// file was encoded.
+	Size int64 `json:"size,omitempty"`
+	// Destination lists the destinations the file has been sent to, as the
+	// common.Destination* constants separated by commas.
+	Destination string    `json:"destination"`
+	StartedAt   time.Time `json:"started_at"`
+	// Duration is the time it took to scan the document and upload the file, in seconds.
+	Duration float64 `json:"duration"`
+	Outcome  Outcome `json:"outcome"`
+	Error    string  `json:"error,omitempty"`
+	// HasThumbnail is true if the scan has a thumbnail that hasn't been removed by the
+	// retention policy yet. It's set by Get and List, and isn't stored.
+	HasThumbnail bool `json:"-"`
+}
+
+// Filter selects the records to return from the history. Fields with a zero value don't
+// filter anything.
+type Filter struct {
+	User    string
+	Outcome Outcome
+	Format  string
+	// Since and Until only keep the records of the scans started in this time range.
+	Since time.Time
+	Until time.Time
+	// Before is the ID of the record to start after, as returned by List, to get the
+	// next page.
+	Before string
+	// Limit is the maximum number of records to return, which is capped to MaxLimit.
+	Limit int
+}
+
+// Store stores the history of scans, and their thumbnails, in a bbolt database.
+type Store struct {
+	cfg *config.HistoryConfig
+	db  *bolt.DB
+}
+
+// NewStore opens the database at the configured path, and creates it if it doesn't
+// exist. It also removes the thumbnails that the retention policy doesn't allow keeping
+// anymore.
+func NewStore(cfg *config.HistoryConfig) (*Store, error) {
+	if cfg.ThumbnailSize <= 0 {
+		return nil, fmt.Errorf("invalid thumbnail size %d, must be positive", cfg.ThumbnailSize)
+	}
+
+	// Don't wait forever if another process holds the database.
+	db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{cfg: cfg, db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{scansBucket, thumbnailsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return s.pruneThumbnails(tx)
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Add stores the given record along with its thumbnail, which can be nil, and sets its
+// ID. It also removes the thumbnails that the retention policy doesn't allow keeping
+// anymore.
+func (s *Store) Add(r *Record, thumbnail []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(scansBucket)
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		r.ID = strconv.FormatUint(seq, 10)
+		r.HasThumbnail = thumbnail != nil
+
+		raw, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		if err = b.Put(key(seq), raw); err != nil {
+			return err
+		}
+
+		if thumbnail != nil {
+			if err = tx.Bucket(thumbnailsBucket).Put(key(seq), thumbnail); err != nil {
+				return err
+			}
+		}
+
+		return s.pruneThumbnails(tx)
+	})
+}
+
+// ThumbnailSize returns the maximum width and height of thumbnails, in pixels.
+func (s *Store) ThumbnailSize() int {
+	return s.cfg.ThumbnailSize
+}
+
+// Get returns the record with the given ID.
+// Returns ErrNotFound if there's no such record.
+func (s *Store) Get(id string) (*Record, error) {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	r := new(Record)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(scansBucket).Get(key(seq))
+		if raw == nil {
+			return ErrNotFound
+		}
+
+		if err := json.Unmarshal(raw, r); err != nil {
+			return err
+		}
+
+		r.HasThumbnail = tx.Bucket(thumbnailsBucket).Get(key(seq)) != nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Thumbnail returns the thumbnail of the scan with the given ID, as a JPEG image.
+// Returns ErrNotFound if there's no such scan, or if it doesn't have a thumbnail.
+func (s *Store) Thumbnail(id string) ([]byte, error) {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var thumbnail []byte
+	err = s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(thumbnailsBucket).Get(key(seq))
+		if raw == nil {
+			return ErrNotFound
+		}
+
+		// The value is only valid for the duration of the transaction.
+		thumbnail = append([]byte(nil), raw...)
+		return nil
+	})
+
+	return thumbnail, err
+}
+
+// List returns the records matching the given filter, from the most recent one to the
+// oldest one, along with the cursor to set as the filter's Before field to get the next
+// page. The cursor is empty if there's no record left.
+// Returns ErrInvalidCursor if the filter's Before field isn't a valid record ID.
+func (s *Store) List(f *Filter) (records []*Record, next string, err error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	} else if limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	var before uint64
+	if f.Before != "" {
+		if before, err = strconv.ParseUint(f.Before, 10, 64); err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+
+	records = make([]*Record, 0, limit)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(scansBucket).Cursor()
+		thumbnails := tx.Bucket(thumbnailsBucket)
+
+		// Start from the most recent record, or from the one before the cursor.
+		k, v := c.Last()
+		if before > 0 {
+			if k, v = c.Seek(key(before)); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+
+		for ; k != nil; k, v = c.Prev() {
+			r := new(Record)
+			if err := json.Unmarshal(v, r); err != nil {
+				return err
+			}
+
+			// Records are sorted chronologically, so the ones left are all too old.
+			if !f.Since.IsZero() && r.StartedAt.Before(f.Since) {
+				break
+			}
+
+			if !f.matches(r) {
+				continue
+			}
+
+			// We found one more record than requested, so there's at least another page.
+			if len(records) == limit {
+				next = records[len(records)-1].ID
+				break
+			}
+
+			r.HasThumbnail = thumbnails.Get(k) != nil
+			records = append(records, r)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return records, next, nil
+}
+
+// pruneThumbnails removes the thumbnails of the scans started longer ago than the
+// configured maximum age, and the oldest thumbnails beyond the configured maximum
+// number, within the given transaction.
+func (s *Store) pruneThumbnails(tx *bolt.Tx) error {
+	b := tx.Bucket(thumbnailsBucket)
+	scans := tx.Bucket(scansBucket)
+
+	c := b.Cursor()
+
+	// The stats of the bucket don't include changes that haven't been committed yet, so
+	// count the thumbnails ourselves.
+	excess := 0
+	if s.cfg.MaxThumbnails > 0 {
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			excess++
+		}
+		excess -= s.cfg.MaxThumbnails
+	}
+	cutoff := time.Now().Add(-s.cfg.ThumbnailMaxAge)
+
+	// Thumbnails are sorted chronologically, so we can stop at the first one we're
+	// allowed to keep. Keys can't be deleted while iterating, so collect them first.
+	var expired [][]byte
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if len(expired) >= excess {
+			if s.cfg.ThumbnailMaxAge <= 0 {
+				break
+			}
+
+			r := new(Record)
+			if raw := scans.Get(k); raw != nil {
+				if err := json.Unmarshal(raw, r); err != nil {
+					return err
+				}
+			}
+			if !r.StartedAt.Before(cutoff) {
+				break
+			}
+		}
+
+		expired = append(expired, append([]byte(nil), k...))
+	}
+
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matches returns whether the given record matches the filter, except for the Since
+// field, which List takes care of.
+func (f *Filter) matches(r *Record) bool {
+	switch {
+	case f.User != "" && r.Options.User != f.User:
+		return false
+	case f.Outcome != "" && r.Outcome != f.Outcome:
+		return false
+	case f.Format != "" && r.Options.Format != f.Format:
+		return false
+	case !f.Until.IsZero() && r.StartedAt.After(f.Until):
+		return false
+	default:
+		return true
+	}
+}
+
+// key returns the key of the record with the given ID.
+func key(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
@@ -0,0 +1,281 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+)
+
+func TestNewStoreRejectsInvalidThumbnailSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for _, size := range []int{0, -1} {
+		cfg := &config.HistoryConfig{Path: filepath.Join(dir, "history.db"), ThumbnailSize: size}
+		if s, err := NewStore(cfg); err == nil {
+			s.Close()
+			t.Errorf("NewStore accepted a thumbnail size of %d", size)
+		}
+	}
+
+	s, err := NewStore(&config.HistoryConfig{Path: filepath.Join(dir, "history.db"), ThumbnailSize: 1})
+	if err != nil {
+		t.Fatalf("NewStore returned an error: %v", err)
+	}
+	s.Close()
+}
+
+// newTestStore returns a new Store with the given configuration, storing its database in
+// a temporary directory unless the configuration has a path already.
+func newTestStore(t *testing.T, cfg *config.HistoryConfig) *Store {
+	if cfg.Path == "" {
+		dir, err := ioutil.TempDir("", "history")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		cfg.Path = filepath.Join(dir, "history.db")
+	}
+	if cfg.ThumbnailSize == 0 {
+		cfg.ThumbnailSize = 100
+	}
+
+	s, err := NewStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+// testRecord describes a record to add to a Store.
+type testRecord struct {
+	user string
+	// age is how long ago the scan was started.
+	age       time.Duration
+	thumbnail bool
+}
+
+// addRecords adds records described by the given testRecords to the given Store, in
+// order, and returns their IDs.
+func addRecords(t *testing.T, s *Store, records ...testRecord) []string {
+	now := time.Now()
+	ids := make([]string, len(records))
+	for i, tr := range records {
+		r := &Record{
+			Options:   &common.ScanOptions{Format: "pdf", User: tr.user},
+			StartedAt: now.Add(-tr.age),
+			Outcome:   OutcomeUploaded,
+		}
+
+		var thumbnail []byte
+		if tr.thumbnail {
+			thumbnail = []byte("thumbnail")
+		}
+		if err := s.Add(r, thumbnail); err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = r.ID
+	}
+
+	return ids
+}
+
+// recordIDs returns the IDs of the given records.
+func recordIDs(records []*Record) []string {
+	ids := make([]string, len(records))
+	for i, r := range records {
+		ids[i] = r.ID
+	}
+
+	return ids
+}
+
+func TestList(t *testing.T) {
+	// Records 1 to 5, from the oldest to the most recent, and record 3 is gone.
+	s := newTestStore(t, &config.HistoryConfig{})
+	addRecords(t, s,
+		testRecord{user: "alice", age: 5 * time.Hour},
+		testRecord{user: "bob", age: 4 * time.Hour},
+		testRecord{user: "alice", age: 3 * time.Hour},
+		testRecord{user: "alice", age: 2 * time.Hour},
+		testRecord{user: "bob", age: time.Hour},
+	)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(scansBucket).Delete(key(3))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		wantIDs  []string
+		wantNext string
+		wantErr  error
+	}{
+		{name: "all", wantIDs: []string{"5", "4", "2", "1"}},
+		{name: "first page", filter: Filter{Limit: 2}, wantIDs: []string{"5", "4"}, wantNext: "4"},
+		{name: "next page", filter: Filter{Limit: 2, Before: "4"}, wantIDs: []string{"2", "1"}},
+		{name: "exactly the limit", filter: Filter{Limit: 4}, wantIDs: []string{"5", "4", "2", "1"}},
+		{name: "filtered page", filter: Filter{User: "alice", Limit: 1}, wantIDs: []string{"4"}, wantNext: "4"},
+		{name: "filtered last page", filter: Filter{User: "alice", Limit: 1, Before: "4"}, wantIDs: []string{"1"}},
+		{name: "before a gone record", filter: Filter{Before: "3"}, wantIDs: []string{"2", "1"}},
+		{name: "before the oldest record", filter: Filter{Before: "1"}, wantIDs: []string{}},
+		{name: "before an unknown record", filter: Filter{Before: "99"}, wantIDs: []string{"5", "4", "2", "1"}},
+		{name: "invalid cursor", filter: Filter{Before: "nope"}, wantErr: ErrInvalidCursor},
+		{name: "since", filter: Filter{Since: time.Now().Add(-150 * time.Minute)}, wantIDs: []string{"5", "4"}},
+		{name: "until", filter: Filter{Until: time.Now().Add(-150 * time.Minute)}, wantIDs: []string{"2", "1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, next, err := s.List(&tt.filter)
+			if err != tt.wantErr {
+				t.Fatalf("List returned %v; want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if ids := recordIDs(records); !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("got records %q; want %q", ids, tt.wantIDs)
+			}
+			if next != tt.wantNext {
+				t.Errorf("got next cursor %q; want %q", next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestListStopsAtTheFirstRecordBeforeSince(t *testing.T) {
+	// Records are expected to be sorted chronologically, so List doesn't look past the
+	// first record that's too old, even if older records have been added later on.
+	s := newTestStore(t, &config.HistoryConfig{})
+	addRecords(t, s,
+		testRecord{age: time.Hour},
+		testRecord{age: 3 * time.Hour},
+		testRecord{age: 0},
+	)
+
+	records, _, err := s.List(&Filter{Since: time.Now().Add(-2 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := recordIDs(records); !reflect.DeepEqual(ids, []string{"3"}) {
+		t.Errorf("got records %q; want only the one after the first that's too old", ids)
+	}
+}
+
+func TestPruneThumbnails(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.HistoryConfig
+		records []testRecord
+		// wantThumbnails are the IDs of the records which thumbnails must be kept.
+		wantThumbnails []string
+	}{
+		{
+			name: "no limit",
+			records: []testRecord{
+				{age: 48 * time.Hour, thumbnail: true},
+				{age: time.Hour, thumbnail: true},
+			},
+			wantThumbnails: []string{"1", "2"},
+		},
+		{
+			name: "max thumbnails",
+			cfg:  config.HistoryConfig{MaxThumbnails: 2},
+			records: []testRecord{
+				{thumbnail: true},
+				{thumbnail: true},
+				{},
+				{thumbnail: true},
+			},
+			wantThumbnails: []string{"2", "4"},
+		},
+		{
+			name: "max age",
+			cfg:  config.HistoryConfig{ThumbnailMaxAge: 24 * time.Hour},
+			records: []testRecord{
+				{age: 72 * time.Hour, thumbnail: true},
+				{age: 48 * time.Hour, thumbnail: true},
+				{age: time.Hour, thumbnail: true},
+				{thumbnail: true},
+			},
+			wantThumbnails: []string{"3", "4"},
+		},
+		{
+			name: "max thumbnails and max age",
+			cfg:  config.HistoryConfig{MaxThumbnails: 4, ThumbnailMaxAge: 24 * time.Hour},
+			records: []testRecord{
+				{age: 72 * time.Hour, thumbnail: true},
+				{age: 48 * time.Hour, thumbnail: true},
+				{age: 3 * time.Hour, thumbnail: true},
+				{age: 2 * time.Hour, thumbnail: true},
+				{age: time.Hour, thumbnail: true},
+			},
+			wantThumbnails: []string{"3", "4", "5"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, &tt.cfg)
+			ids := addRecords(t, s, tt.records...)
+
+			var kept []string
+			for _, id := range ids {
+				r, err := s.Get(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = s.Thumbnail(id)
+				if (err == nil) != r.HasThumbnail {
+					t.Errorf("record %s has HasThumbnail %v, but Thumbnail returned %v", id, r.HasThumbnail, err)
+				}
+				if r.HasThumbnail {
+					kept = append(kept, id)
+				}
+			}
+
+			if !reflect.DeepEqual(kept, tt.wantThumbnails) {
+				t.Errorf("kept the thumbnails of %q; want %q", kept, tt.wantThumbnails)
+			}
+		})
+	}
+}
+
+func TestNewStorePrunesThumbnails(t *testing.T) {
+	cfg := &config.HistoryConfig{}
+	s := newTestStore(t, cfg)
+	addRecords(t, s,
+		testRecord{thumbnail: true},
+		testRecord{thumbnail: true},
+		testRecord{thumbnail: true},
+	)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lowering the limit must apply to the thumbnails already stored.
+	s = newTestStore(t, &config.HistoryConfig{Path: cfg.Path, MaxThumbnails: 1})
+	for id, want := range map[string]bool{"1": false, "2": false, "3": true} {
+		if _, err := s.Thumbnail(id); (err == nil) != want {
+			t.Errorf("Thumbnail(%s) returned %v; want the thumbnail kept: %v", id, err, want)
+		}
+	}
+}
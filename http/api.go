@@ -0,0 +1,904 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/babolivier/scanner/auth"
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/email"
+	"github.com/babolivier/scanner/logging"
+	"github.com/babolivier/scanner/naming"
+	"github.com/babolivier/scanner/scanner"
+	"github.com/babolivier/scanner/spool"
+	"github.com/babolivier/scanner/webdav"
+)
+
+const (
+	// apiPrefix is the prefix of the paths of the JSON API.
+	apiPrefix = "/api/v1"
+
+	// eventsKeepAlive is how often a comment is sent on event streams when there's no
+	// event to send, so proxies don't consider the connection idle and close it.
+	eventsKeepAlive = 30 * time.Second
+
+	// previewResolutionHeader is the header holding the resolution of the last preview,
+	// in DPI.
+	previewResolutionHeader = "X-Preview-Resolution"
+
+	// statusClientClosedRequest is the status nginx uses for requests which client went
+	// away before the response was sent, which we reuse for requests cancelled this way.
+	statusClientClosedRequest = 499
+)
+
+// Error codes sent by the JSON API, which clients can rely on.
+const (
+	codeBadRequest         = "bad_request"
+	codeInvalidName        = "invalid_name"
+	codeUnknownPreset      = "unknown_preset"
+	codeMissingFormat      = "missing_format"
+	codeUnsupportedFormat  = "unsupported_format"
+	codeBadRect            = "bad_rect"
+	codeNameConflict       = "name_conflict"
+	codeDeviceBusy         = "device_busy"
+	codeTimeout            = "timeout"
+	codeCancelled          = "cancelled"
+	codeNoPreview          = "no_preview"
+	codeStorageFailed      = "storage_failed"
+	codeNoStorage          = "no_storage"
+	codeNoEmail            = "no_email"
+	codeInvalidEmail       = "invalid_email"
+	codeAttachmentTooLarge = "attachment_too_large"
+	codeFolderForbidden    = "folder_forbidden"
+	codeFolderExists       = "folder_exists"
+	codeEntryBusy          = "entry_busy"
+	codeForbidden          = "forbidden"
+	codeNotFound           = "not_found"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeInternal           = "internal"
+	// codeUnauthorized is sent by the auth package, which can't use these constants, to
+	// requests that aren't authenticated.
+	codeUnauthorized = "unauthorized"
+)
+
+// Statuses of a scan, as sent by the JSON API.
+const (
+	scanStatusUploaded = "uploaded"
+	scanStatusQueued   = "queued"
+	// scanStatusPartial means the file couldn't be uploaded to some of its destinations,
+	// but has been, or will be, uploaded to others.
+	scanStatusPartial = "partial"
+	// scanStatusFailed is only sent in the uploadStatusHeader header, since the file is
+	// sent back anyway, and for individual uploads.
+	scanStatusFailed = "failed"
+)
+
+const (
+	// uploadStatusHeader is the header telling requesters who asked for the file to be
+	// sent back what happened to its upload, as a scan status.
+	uploadStatusHeader = "X-Upload-Status"
+	// uploadFileNameHeader is the header telling requesters who asked for the file to be
+	// sent back the path it's been uploaded to, relative to the upload path.
+	uploadFileNameHeader = "X-Upload-File-Name"
+)
+
+// apiError is an error that can be sent back to clients, either as JSON by the JSON API,
+// or as plain text by the endpoints predating it.
+type apiError struct {
+	status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// newAPIError returns a new apiError with the given HTTP status, code and message.
+func newAPIError(status int, code string, message string) *apiError {
+	return &apiError{
+		status:  status,
+		Code:    code,
+		Message: message,
+	}
+}
+
+// writeJSON sends the error as a JSON object.
+func (e *apiError) writeJSON(w http.ResponseWriter) {
+	writeJSON(w, e.status, map[string]*apiError{"error": e})
+}
+
+// writeText sends the error's message as plain text.
+func (e *apiError) writeText(w http.ResponseWriter) {
+	http.Error(w, e.Message, e.status)
+}
+
+// scanResult is the result of a scan, as sent by the JSON API.
+type scanResult struct {
+	// Status is either "uploaded" if the file has been uploaded to all of its
+	// destinations, "queued" if it will be uploaded to some of them later, or "partial"
+	// if it couldn't be uploaded to some of them.
+	Status string `json:"status"`
+	// FileName is the path of the file, relative to the upload path. It's only known once
+	// the file has been uploaded. If the file has several destinations, it's the name from
+	// the first one it's been uploaded to.
+	FileName string `json:"file_name,omitempty"`
+	// Uploads describes how uploading the file to each of its destinations went.
+	Uploads []*uploadResult `json:"uploads,omitempty"`
+
+	// file is the encoded file, if it must be sent back to the requester instead of the
+	// result, in which case Status is empty if it wasn't meant to be uploaded. The file
+	// must be closed once it's been sent.
+	file *os.File
+	// fileFormat is the format of the file to send back.
+	fileFormat string
+	// downloadName is the name to give to the file to send back.
+	downloadName string
+}
+
+// uploadResult describes how uploading the file of a scan to one of its destinations
+// went, as sent by the JSON API.
+type uploadResult struct {
+	Destination string `json:"destination"`
+	// Status is either "uploaded", "queued" or "failed".
+	Status string `json:"status"`
+	// FileName is the name the file has been uploaded under, if it has.
+	FileName string `json:"file_name,omitempty"`
+	// Error describes why the upload failed, if it did.
+	Error *apiError `json:"error,omitempty"`
+}
+
+// newScanResult returns the scanResult describing the uploads of the given result of a
+// scan, given the error ScanAndUpload returned along with it. Its status is "failed" if
+// the file couldn't be uploaded to any of its destinations, and empty if it didn't have
+// any destination to upload it to.
+func newScanResult(result *scanner.Result, err error) *scanResult {
+	sr := &scanResult{
+		FileName: result.FileName,
+		Uploads:  make([]*uploadResult, 0, len(result.Uploads)),
+	}
+
+	delivered := false
+	for _, u := range result.Uploads {
+		ur := &uploadResult{
+			Destination: u.Destination,
+			Status:      scanStatusUploaded,
+			FileName:    u.FileName,
+		}
+		switch {
+		case errors.Is(u.Err, spool.ErrQueued):
+			ur.Status = scanStatusQueued
+		case u.Err != nil:
+			ur.Status = scanStatusFailed
+			ur.Error = uploadError(u.Err)
+		}
+		delivered = delivered || ur.Status != scanStatusFailed
+		sr.Uploads = append(sr.Uploads, ur)
+	}
+
+	switch {
+	case len(sr.Uploads) == 0:
+	case err == nil:
+		sr.Status = scanStatusUploaded
+	case errors.Is(err, spool.ErrQueued):
+		sr.Status = scanStatusQueued
+	case delivered:
+		sr.Status = scanStatusPartial
+	default:
+		sr.Status = scanStatusFailed
+	}
+
+	return sr
+}
+
+// partialText describes the given result as plain text, for a scan which file couldn't
+// be sent to some of its destinations: the name the file has been uploaded under if it
+// has, and then a line for each of the uploads that failed.
+func (r *scanResult) partialText() string {
+	var lines []string
+	if r.FileName != "" {
+		lines = append(lines, r.FileName)
+	}
+	for _, u := range r.Uploads {
+		if u.Status == scanStatusFailed {
+			lines = append(lines, "Failed to send to "+u.Destination+": "+u.Error.Message)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// writeFile sends the file of the given result as an attachment, along with what
+// happened to its upload.
+// Returns an error if the file couldn't be sent entirely.
+func (r *scanResult) writeFile(w http.ResponseWriter, req *http.Request) error {
+	defer r.file.Close()
+
+	if r.Status != "" {
+		w.Header().Set(uploadStatusHeader, r.Status)
+	}
+	if r.FileName != "" {
+		w.Header().Set(uploadFileNameHeader, r.FileName)
+	}
+	if info, err := r.file.Stat(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	setAttachmentHeaders(w, r.downloadName, r.fileFormat)
+
+	w.WriteHeader(http.StatusOK)
+	_, err := io.Copy(w, r.file)
+	if err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to send the file")
+	}
+
+	return err
+}
+
+// scan triggers a scan with the given options on behalf of the user who sent the given
+// request, and uploads the resulting file.
+func (h *handlers) scan(
+	req *http.Request,
+	options *common.ScanOptions,
+) (*scanResult, *apiError) {
+	ctx := req.Context()
+
+	// Record who requested the scan, so it can be used in the file name and to figure
+	// out which WebDAV account to upload the file to.
+	options.User = auth.User(req)
+
+	// Make sure API tokens stick to the presets and folders they're restricted to.
+	if err := auth.CheckScan(req, options); err == auth.ErrPresetNotAllowed {
+		return nil, newAPIError(http.StatusForbidden, codeForbidden, "Preset not allowed")
+	} else if err == auth.ErrDestinationNotAllowed {
+		return nil, newAPIError(http.StatusForbidden, codeForbidden, "Destination not allowed")
+	}
+
+	// Quick exports reuse the last preview of the requester, which is shared by requests
+	// that aren't made on behalf of a user.
+	if options.Quick && !h.canAccess(req, options.User) {
+		return nil, newAPIError(http.StatusForbidden, codeForbidden, "Not allowed to export previews without a user")
+	}
+
+	// Don't bother scanning if there's nowhere to upload the file to.
+	toWebDAV := options.HasDestination(common.DestinationWebDAV)
+	if toWebDAV && !h.webdav.HasAccount(options.User) {
+		logging.Entry(ctx).WithField("user", options.User).Warn("No WebDAV account for user")
+		return nil, newAPIError(
+			http.StatusForbidden,
+			codeNoStorage,
+			"No storage configured for this user",
+		)
+	}
+
+	// Same if the file should be sent by email but we can't send emails, or not to these
+	// recipients.
+	if options.HasDestination(common.DestinationEmail) {
+		if h.email == nil {
+			return nil, newAPIError(
+				http.StatusForbidden,
+				codeNoEmail,
+				"Sending scans by email isn't configured",
+			)
+		}
+
+		if err := h.email.CheckRecipients(options.Email.To); err != nil {
+			logging.Entry(ctx).WithError(err).Warn("Rejected email recipients")
+			return nil, newAPIError(http.StatusForbidden, codeForbidden, "Recipient not allowed")
+		}
+	}
+
+	// If a file name has been provided, and we're not allowed to find another name for
+	// the file in case of a conflict, check that it's not already used by another file.
+	if toWebDAV && options.FileName != "" && h.webdav.RejectsConflicts() {
+		exists, err := h.webdav.FileExists(ctx, options)
+		if err != nil {
+			logging.Entry(ctx).WithError(err).Error("Failed to check whether the file exists")
+			return nil, newAPIError(
+				http.StatusBadGateway,
+				codeStorageFailed,
+				"Failed to reach the storage",
+			)
+		}
+
+		if exists {
+			return nil, newAPIError(
+				http.StatusConflict,
+				codeNameConflict,
+				"File name already in use",
+			)
+		}
+	}
+
+	// Scan the file and upload it to its destinations, and get how each upload went.
+	result, err := h.scanner.ScanAndUpload(ctx, options)
+
+	// If the file must be sent back, do it whatever happened to its upload, so the
+	// requester gets it anyway.
+	if result != nil && result.File != nil {
+		sr := newScanResult(result, err)
+		sr.file = result.File
+		sr.fileFormat = options.Format
+		sr.downloadName = h.webdav.LocalName(options, options.NamingTime())
+		if sr.FileName != "" {
+			sr.downloadName = path.Base(sr.FileName)
+		}
+		return sr, nil
+	}
+
+	// Tell the client where the file went, unless it couldn't go anywhere.
+	if result != nil {
+		if sr := newScanResult(result, err); sr.Status != scanStatusFailed {
+			return sr, nil
+		}
+	}
+
+	if apiErr := cancelledError(ctx, err); apiErr != nil {
+		return nil, apiErr
+	}
+
+	logging.Entry(ctx).
+		WithError(err).
+		Error("Failed to scan or to upload the file")
+
+	var uploadErr *scanner.UploadError
+	switch {
+	case err == scanner.ErrUnsupportedFormat:
+		return nil, newAPIError(
+			http.StatusBadRequest,
+			codeUnsupportedFormat,
+			"Unsupported format",
+		)
+	case err == scanner.ErrDeviceBusy:
+		return nil, newAPIError(http.StatusServiceUnavailable, codeDeviceBusy, "Device busy")
+	case err == scanner.ErrNoPreview:
+		return nil, newAPIError(http.StatusConflict, codeNoPreview, "No preview to export")
+	case err == scanner.ErrOutsidePreview:
+		return nil, newAPIError(http.StatusBadRequest, codeBadRect, "Rect outside of the preview")
+	case errors.As(err, &uploadErr):
+		return nil, uploadError(uploadErr.Err)
+	default:
+		return nil, newAPIError(http.StatusInternalServerError, codeInternal, internalErrorMsg)
+	}
+}
+
+// uploadError returns the apiError to send back to the client for the given error,
+// returned when uploading a file from the spool.
+func uploadError(err error) *apiError {
+	switch {
+	case errors.Is(err, webdav.ErrNoAvailableName):
+		return newAPIError(http.StatusConflict, codeNameConflict, "No available file name")
+	case errors.Is(err, webdav.ErrFolderForbidden):
+		return newAPIError(
+			http.StatusForbidden,
+			codeFolderForbidden,
+			"Not allowed to create the destination folder, check the permissions of the WebDAV user",
+		)
+	case err == email.ErrAttachmentTooLarge:
+		return newAPIError(
+			http.StatusRequestEntityTooLarge,
+			codeAttachmentTooLarge,
+			"File too large to be sent by email",
+		)
+	case err == email.ErrRecipientNotAllowed:
+		return newAPIError(http.StatusForbidden, codeForbidden, "Recipient not allowed")
+	default:
+		return newAPIError(
+			http.StatusBadGateway,
+			codeStorageFailed,
+			"Failed to upload the file",
+		)
+	}
+}
+
+// optionsError returns the apiError to send back to the client for the given error,
+// returned when parsing the options of a scan.
+func optionsError(ctx context.Context, err error) *apiError {
+	switch {
+	case errors.Is(err, naming.ErrInvalidFileName):
+		logging.Entry(ctx).WithError(err).Warn("Rejected file name or folder")
+		return newAPIError(http.StatusBadRequest, codeInvalidName, "Invalid file name or folder")
+	case err == common.ErrUnknownPreset:
+		return newAPIError(http.StatusBadRequest, codeUnknownPreset, "Unknown preset")
+	case err == common.ErrMissingFormat:
+		return newAPIError(http.StatusBadRequest, codeMissingFormat, "Missing format")
+	case err == common.ErrMalformedRect:
+		return newAPIError(http.StatusBadRequest, codeBadRect, "Missing or malformed rect arguments")
+	case err == common.ErrInvalidJob:
+		return newAPIError(http.StatusBadRequest, codeBadRequest, "Invalid job ID")
+	case err == common.ErrUnknownDestination:
+		return newAPIError(http.StatusBadRequest, codeBadRequest, "Unknown destination")
+	case errors.Is(err, common.ErrInvalidEmail):
+		return newAPIError(http.StatusBadRequest, codeInvalidEmail, "Invalid email recipient or subject")
+	default:
+		logging.Entry(ctx).WithError(err).Error("Failed to parse scan options")
+		return newAPIError(http.StatusBadRequest, codeBadRequest, "Malformed scan options")
+	}
+}
+
+// preview gets a preview from the scanner, on behalf of the user who sent the given
+// request.
+func (h *handlers) preview(req *http.Request) (image.Image, *apiError) {
+	img, err := h.scanner.Preview(req.Context(), auth.User(req))
+	return img, previewError(req.Context(), err)
+}
+
+// previewError returns the apiError to send back to the client for the given error,
+// returned when getting a preview, or nil if the error is nil.
+func previewError(ctx context.Context, err error) *apiError {
+	switch {
+	case err == nil:
+		return nil
+	case err == scanner.ErrDeviceBusy:
+		return newAPIError(http.StatusServiceUnavailable, codeDeviceBusy, "Device busy")
+	}
+
+	if apiErr := cancelledError(ctx, err); apiErr != nil {
+		return apiErr
+	}
+
+	logging.Entry(ctx).WithError(err).Error("Failed to get preview from scanner")
+	return newAPIError(http.StatusInternalServerError, codeInternal, internalErrorMsg)
+}
+
+// cancelledError returns the apiError to send back to the client if the given error
+// means the scan has been cancelled, either because the client went away or because it
+// took too long, or nil otherwise.
+func cancelledError(ctx context.Context, err error) *apiError {
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client is gone, so it will most likely never see this response.
+		logging.Entry(ctx).Info("Scan cancelled by the client")
+		return newAPIError(statusClientClosedRequest, codeCancelled, "Scan cancelled")
+	case errors.Is(err, context.DeadlineExceeded):
+		logging.Entry(ctx).WithError(err).Warn("Scan timed out")
+		return newAPIError(http.StatusGatewayTimeout, codeTimeout, "Scan took too long")
+	default:
+		return nil
+	}
+}
+
+// previewProgressively gets a preview from the scanner on behalf of the user who sent the
+// given request, calling partial with the part of it scanned so far while it's being
+// scanned.
+func (h *handlers) previewProgressively(
+	req *http.Request,
+	partial func(img image.Image),
+) (image.Image, *apiError) {
+	img, err := h.scanner.PreviewProgressively(req.Context(), auth.User(req), partial)
+	return img, previewError(req.Context(), err)
+}
+
+// lastPreview returns the last preview taken by the user who sent the given request.
+// Requests that aren't made on behalf of a user share their previews, so they can't see
+// them unless they're allowed to use the admin scope.
+func (h *handlers) lastPreview(req *http.Request) (*scanner.LastPreview, *apiError) {
+	user := auth.User(req)
+	if !h.canAccess(req, user) {
+		return nil, newAPIError(http.StatusForbidden, codeForbidden, "Not allowed to see previews without a user")
+	}
+
+	preview := h.scanner.LastPreview(user)
+	if preview == nil {
+		return nil, newAPIError(http.StatusNotFound, codeNoPreview, "No preview taken yet")
+	}
+
+	return preview, nil
+}
+
+// canAccess returns whether the requester is allowed to access the scans and previews of
+// the given user. Only requests made on behalf of this user can, unless they're allowed
+// to use the admin scope. This means requests that aren't made on behalf of a user (e.g.
+// with an API token without a user) can't access anything unless they are.
+func (h *handlers) canAccess(req *http.Request, user string) bool {
+	if h.auth.HasScope(req, auth.ScopeAdmin) {
+		return true
+	}
+
+	requester := auth.User(req)
+	return requester != "" && requester == user
+}
+
+// listFolders lists the folders within the folder at the given path, on the storage of
+// the user who sent the given request.
+func (h *handlers) listFolders(req *http.Request, p string) ([]string, *apiError) {
+	if err := auth.CheckFolder(req, p); err == auth.ErrDestinationNotAllowed {
+		return nil, newAPIError(http.StatusForbidden, codeForbidden, "Destination not allowed")
+	}
+
+	folders, err := h.webdav.ListFolders(req.Context(), auth.User(req), p)
+	if err != nil {
+		return nil, folderError(req.Context(), err, p)
+	}
+
+	return folders, nil
+}
+
+// createFolder creates a folder at the given path, on the storage of the user who sent
+// the given request.
+func (h *handlers) createFolder(req *http.Request, p string) *apiError {
+	if err := auth.CheckFolder(req, p); err == auth.ErrDestinationNotAllowed {
+		return newAPIError(http.StatusForbidden, codeForbidden, "Destination not allowed")
+	}
+
+	if err := h.webdav.CreateFolder(req.Context(), auth.User(req), p); err != nil {
+		return folderError(req.Context(), err, p)
+	}
+
+	return nil
+}
+
+// folderError returns the apiError to send back to the client for the given error,
+// returned when listing or creating the folder at the given path.
+func folderError(ctx context.Context, err error, p string) *apiError {
+	logging.Entry(ctx).WithError(err).WithField("path", p).Error("Failed to list or create folder")
+
+	switch {
+	case errors.Is(err, naming.ErrInvalidFileName):
+		return newAPIError(http.StatusBadRequest, codeInvalidName, "Invalid path")
+	case err == webdav.ErrFolderNotFound:
+		return newAPIError(http.StatusNotFound, codeNotFound, "Folder not found")
+	case err == webdav.ErrFolderExists:
+		return newAPIError(http.StatusConflict, codeFolderExists, "Folder already exists")
+	case errors.Is(err, webdav.ErrFolderForbidden):
+		return newAPIError(
+			http.StatusForbidden,
+			codeFolderForbidden,
+			"Not allowed to create the folder",
+		)
+	case err == webdav.ErrNoAccount:
+		return newAPIError(
+			http.StatusForbidden,
+			codeNoStorage,
+			"No storage configured for this user",
+		)
+	default:
+		return newAPIError(http.StatusBadGateway, codeStorageFailed, "Failed to reach the storage")
+	}
+}
+
+// spoolError returns the apiError to send back to the client for the given error,
+// returned when updating the spool entry with the given ID.
+func spoolError(ctx context.Context, err error, id string) *apiError {
+	switch err {
+	case spool.ErrNotFound:
+		return newAPIError(http.StatusNotFound, codeNotFound, "Spool entry not found")
+	case spool.ErrBusy:
+		return newAPIError(http.StatusConflict, codeEntryBusy, "Spool entry is being uploaded")
+	default:
+		logging.Entry(ctx).WithError(err).WithField("spool_id", id).Error("Failed to update spool entry")
+		return newAPIError(http.StatusInternalServerError, codeInternal, internalErrorMsg)
+	}
+}
+
+// handleAPIScans scans a document with the options provided as a JSON object in the
+// body of a POST request, uploads it, and responds with a scanResult.
+func (h *handlers) handleAPIScans(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	if req.Method != http.MethodPost {
+		methodNotAllowed().writeJSON(w)
+		return
+	}
+
+	var body common.ScanRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		newAPIError(http.StatusBadRequest, codeBadRequest, "Malformed request body").writeJSON(w)
+		return
+	}
+
+	options, err := common.NewOptions(&body, h.presets)
+	if err != nil {
+		optionsError(req.Context(), err).writeJSON(w)
+		return
+	}
+
+	result, apiErr := h.scan(req, options)
+	if apiErr != nil {
+		apiErr.writeJSON(w)
+		return
+	}
+
+	if result.file != nil {
+		result.writeFile(w, req)
+		return
+	}
+
+	status := http.StatusCreated
+	switch result.Status {
+	case scanStatusQueued:
+		status = http.StatusAccepted
+	case scanStatusPartial:
+		status = http.StatusMultiStatus
+	}
+
+	writeJSON(w, status, result)
+}
+
+// handleAPIPreview generates a JPEG preview of what's currently on the scanner's plate.
+func (h *handlers) handleAPIPreview(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	if req.Method != http.MethodGet {
+		methodNotAllowed().writeJSON(w)
+		return
+	}
+
+	img, apiErr := h.preview(req)
+	if apiErr != nil {
+		apiErr.writeJSON(w)
+		return
+	}
+
+	writeJPEG(w, img)
+}
+
+// handleAPILastPreview sends the last preview taken by the requester as a JPEG image,
+// without triggering a new scan.
+func (h *handlers) handleAPILastPreview(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	if req.Method != http.MethodGet {
+		methodNotAllowed().writeJSON(w)
+		return
+	}
+
+	preview, apiErr := h.lastPreview(req)
+	if apiErr != nil {
+		apiErr.writeJSON(w)
+		return
+	}
+
+	writeLastPreview(w, preview)
+}
+
+// handleAPIFolders lists the folders within the folder at the path provided in the query
+// parameters on GET requests, and creates the folder at the path provided as a JSON
+// object in the body of POST requests.
+func (h *handlers) handleAPIFolders(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	switch req.Method {
+	case http.MethodGet:
+		p := strings.Trim(req.URL.Query().Get("path"), "/")
+
+		folders, apiErr := h.listFolders(req, p)
+		if apiErr != nil {
+			apiErr.writeJSON(w)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string][]string{"folders": folders})
+	case http.MethodPost:
+		var body struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			newAPIError(http.StatusBadRequest, codeBadRequest, "Malformed request body").writeJSON(w)
+			return
+		}
+
+		p := strings.Trim(body.Path, "/")
+		if apiErr := h.createFolder(req, p); apiErr != nil {
+			apiErr.writeJSON(w)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, map[string]string{"path": p})
+	default:
+		methodNotAllowed().writeJSON(w)
+	}
+}
+
+// handleAPISpool lists the entries in the spool on GET /api/v1/spool, retries the upload
+// of an entry's file on POST /api/v1/spool/{id}/retry, and discards an entry on
+// DELETE /api/v1/spool/{id}.
+func (h *handlers) handleAPISpool(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	id, action := parseSpoolPath(strings.TrimPrefix(req.URL.Path, apiPrefix))
+
+	var err error
+	switch {
+	case id == "" && action == "" && req.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string][]spool.Entry{"entries": h.spool.Entries()})
+		return
+	case id != "" && action == "retry" && req.Method == http.MethodPost:
+		if err = h.spool.Retry(id); err == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	case id != "" && action == "" && req.Method == http.MethodDelete:
+		if err = h.spool.Discard(id); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		apiNotFound(w, req)
+		return
+	}
+
+	spoolError(req.Context(), err, id).writeJSON(w)
+}
+
+// handleAPIEvents streams the progress events of the scans requested by the user who
+// sent the request as server-sent events, until the client goes away. If the job query
+// parameter is provided, only the events of the scan with this job ID are sent.
+func (h *handlers) handleAPIEvents(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	if req.Method != http.MethodGet {
+		methodNotAllowed().writeJSON(w)
+		return
+	}
+
+	job := req.URL.Query().Get("job")
+
+	events, unsubscribe := h.progress.Subscribe(auth.User(req))
+	defer unsubscribe()
+
+	stream, ok := newEventStream(w)
+	if !ok {
+		logging.Entry(req.Context()).Error("Response writer doesn't support streaming events")
+		newAPIError(http.StatusInternalServerError, codeInternal, internalErrorMsg).writeJSON(w)
+		return
+	}
+
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+			err = stream.keepAlive()
+		case e := <-events:
+			if job != "" && e.Job != job {
+				continue
+			}
+
+			err = stream.send("", e)
+		}
+
+		if err != nil {
+			logging.Entry(req.Context()).WithError(err).Error("Failed to send progress event")
+			return
+		}
+	}
+}
+
+// previewUpdate is the data of the events sent while streaming a progressive preview.
+type previewUpdate struct {
+	// Image is the preview, or the part of it that has been scanned so far, as a JPEG
+	// data URL.
+	Image string `json:"image"`
+}
+
+// handleAPIPreviewStream streams a preview as server-sent events while it's being
+// scanned. A "partial" event is sent regularly with the part of the preview scanned so
+// far, and either a "done" event with the whole preview or an "error" event with an
+// error object ends the stream.
+func (h *handlers) handleAPIPreviewStream(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	if req.Method != http.MethodGet {
+		methodNotAllowed().writeJSON(w)
+		return
+	}
+
+	stream, ok := newEventStream(w)
+	if !ok {
+		logging.Entry(req.Context()).Error("Response writer doesn't support streaming events")
+		newAPIError(http.StatusInternalServerError, codeInternal, internalErrorMsg).writeJSON(w)
+		return
+	}
+
+	// If the client goes away, there's no point in encoding partial previews anymore,
+	// but we still need to let the scan finish.
+	gone := false
+	sendImage := func(event string, img image.Image) {
+		if gone {
+			return
+		}
+
+		dataURL, err := jpegDataURL(img)
+		if err == nil {
+			err = stream.send(event, &previewUpdate{Image: dataURL})
+		}
+		if err != nil {
+			logging.Entry(req.Context()).WithError(err).Error("Failed to send preview")
+			gone = true
+		}
+	}
+
+	img, apiErr := h.previewProgressively(req, func(partial image.Image) {
+		sendImage("partial", partial)
+	})
+	if apiErr != nil {
+		if err := stream.send("error", map[string]*apiError{"error": apiErr}); err != nil {
+			logging.Entry(req.Context()).WithError(err).Error("Failed to send preview error")
+		}
+		return
+	}
+
+	sendImage("done", img)
+}
+
+// apiNotFound responds to requests to the JSON API that don't match any endpoint.
+func apiNotFound(w http.ResponseWriter, _ *http.Request) {
+	newAPIError(http.StatusNotFound, codeNotFound, "Not found").writeJSON(w)
+}
+
+// methodNotAllowed returns the apiError to send back to clients using the wrong method.
+func methodNotAllowed() *apiError {
+	return newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+}
+
+// writeJSON sends the given value as JSON with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	// Tell browsers not to cache API responses.
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Error("Failed to send JSON response")
+	}
+}
+
+// jpegDataURL encodes the given image as JPEG, and returns it as a data URL.
+func jpegDataURL(img image.Image) (string, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		return "", err
+	}
+
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// writeLastPreview sends the given preview as a JPEG image, along with when it was taken
+// and its resolution.
+func writeLastPreview(w http.ResponseWriter, preview *scanner.LastPreview) {
+	w.Header().Set("Last-Modified", preview.TakenAt.UTC().Format(http.TimeFormat))
+	w.Header().Set(previewResolutionHeader, strconv.Itoa(preview.Resolution))
+	writeJPEG(w, preview.Image)
+}
+
+// writeJPEG encodes the given image as JPEG and sends it.
+func writeJPEG(w http.ResponseWriter, img image.Image) {
+	// Given the endpoint looks like a static image, browsers might try to cache it, but
+	// we don't want that.
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "image/jpeg")
+
+	if err := jpeg.Encode(w, img, nil); err != nil {
+		// The headers have most likely already been sent, so all we can do is log the
+		// error.
+		logrus.WithError(err).Error("Failed to encode into JPEG")
+	}
+}
+
+// setAttachmentHeaders sets the headers telling the client that the response is a file
+// in the given format, to be saved under the given name.
+func setAttachmentHeaders(w http.ResponseWriter, name string, format string) {
+	w.Header().Set("Content-Type", mime.TypeByExtension("."+format))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": name,
+	}))
+}
@@ -0,0 +1,166 @@
+package http
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/email"
+	"github.com/babolivier/scanner/scanner"
+	"github.com/babolivier/scanner/spool"
+)
+
+// stringConstants returns the string constants declared in the Go file at the given
+// path which names start with the given prefix, by the rest of their name.
+func stringConstants(t *testing.T, path string, prefix string) map[string]string {
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	constants := make(map[string]string)
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+
+		for _, spec := range gen.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, name := range vs.Names {
+				if !strings.HasPrefix(name.Name, prefix) || i >= len(vs.Values) {
+					continue
+				}
+
+				lit, ok := vs.Values[i].(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					continue
+				}
+
+				if constants[strings.TrimPrefix(name.Name, prefix)], err = strconv.Unquote(lit.Value); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	return constants
+}
+
+// compareConstants checks that the given sets of constants, from the server and from
+// the client, have the same names and values.
+func compareConstants(t *testing.T, server map[string]string, client map[string]string) {
+	if len(server) == 0 {
+		t.Fatal("no constants found in the server")
+	}
+
+	for name, value := range server {
+		if clientValue, ok := client[name]; !ok {
+			t.Errorf("%s (%q) is missing from the client", name, value)
+		} else if clientValue != value {
+			t.Errorf("%s is %q in the server but %q in the client", name, value, clientValue)
+		}
+	}
+	for name, value := range client {
+		if _, ok := server[name]; !ok {
+			t.Errorf("%s (%q) is missing from the server", name, value)
+		}
+	}
+}
+
+// schemaEnum returns the enum of the property at the given path of properties in the
+// schema with the given name.
+func schemaEnum(t *testing.T, name string, properties ...string) map[string]bool {
+	schema := openAPISchemas[name].(map[string]interface{})
+	for _, p := range properties {
+		schema = schema["properties"].(map[string]interface{})[p].(map[string]interface{})
+	}
+
+	enum := make(map[string]bool)
+	for _, value := range schema["enum"].([]string) {
+		enum[value] = true
+	}
+
+	return enum
+}
+
+func TestErrorCodesMatchClient(t *testing.T) {
+	server := stringConstants(t, "api.go", "code")
+	compareConstants(t, server, stringConstants(t, "../client/client.go", "Code"))
+
+	documented := schemaEnum(t, "Error", "error", "code")
+	for name, code := range server {
+		if !documented[code] {
+			t.Errorf("code%s (%q) isn't documented", name, code)
+		}
+		delete(documented, code)
+	}
+	for code := range documented {
+		t.Errorf("%q is documented but isn't declared", code)
+	}
+}
+
+func TestScanStatusesMatchClient(t *testing.T) {
+	server := stringConstants(t, "api.go", "scanStatus")
+	compareConstants(t, server, stringConstants(t, "../client/client.go", "Status"))
+
+	documented := schemaEnum(t, "ScanResult", "status")
+	for status := range schemaEnum(t, "UploadResult", "status") {
+		documented[status] = true
+	}
+	for name, status := range server {
+		if !documented[status] {
+			t.Errorf("scanStatus%s (%q) isn't documented", name, status)
+		}
+	}
+}
+
+func TestPartialScanResultTellsWhatFailed(t *testing.T) {
+	queued := fmt.Errorf("%w: connection refused", spool.ErrQueued)
+	tests := []struct {
+		name    string
+		uploads []*scanner.Upload
+		want    string
+	}{
+		{
+			name: "uploaded",
+			uploads: []*scanner.Upload{
+				{Destination: common.DestinationWebDAV, FileName: "scans/scan.pdf"},
+				{Destination: common.DestinationEmail, Err: email.ErrAttachmentTooLarge},
+			},
+			want: "scans/scan.pdf\nFailed to send to email: File too large to be sent by email",
+		},
+		{
+			name: "queued",
+			uploads: []*scanner.Upload{
+				{Destination: common.DestinationWebDAV, Err: queued},
+				{Destination: common.DestinationEmail, Err: email.ErrRecipientNotAllowed},
+			},
+			want: "Failed to send to email: Recipient not allowed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &scanner.Result{Uploads: tt.uploads}
+			for _, u := range tt.uploads {
+				if result.FileName == "" {
+					result.FileName = u.FileName
+				}
+			}
+
+			sr := newScanResult(result, &scanner.UploadError{Err: email.ErrAttachmentTooLarge})
+			if sr.Status != scanStatusPartial {
+				t.Fatalf("got status %q; want %q", sr.Status, scanStatusPartial)
+			}
+			if got := sr.partialText(); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/babolivier/scanner/auth"
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/history"
+	"github.com/babolivier/scanner/logging"
+)
+
+var (
+	// errInvalidFilter is the error returned by historyFilter if a query parameter has an
+	// invalid value.
+	errInvalidFilter = errors.New("invalid history filter")
+)
+
+const (
+	// thumbnailFileName is the last segment of the path the thumbnail of a scan is
+	// served at.
+	thumbnailFileName = "thumb.jpg"
+)
+
+// historyPage is a page of the history of scans, as sent by the JSON API.
+type historyPage struct {
+	Records []*historyRecord `json:"records"`
+	// Next is the cursor to send as the "before" query parameter to get the next page.
+	// It's empty if there's no page left.
+	Next string `json:"next,omitempty"`
+}
+
+// historyRecord is a record of the history, along with the URL of the uploaded file if
+// it's known, the URL of its thumbnail if it has one, and the URL to download the file
+// from if it's still in the spool.
+type historyRecord struct {
+	*history.Record
+	URL          string `json:"url,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	DownloadURL  string `json:"download_url,omitempty"`
+}
+
+// scanHistory returns the page of the history of scans matching the given filter, which
+// only includes the requester's scans unless they can access the ones of every user (see
+// canAccess).
+func (h *handlers) scanHistory(req *http.Request, f *history.Filter) (*historyPage, *apiError) {
+	if f.User == "" && !h.auth.HasScope(req, auth.ScopeAdmin) {
+		f.User = auth.User(req)
+	}
+	if !h.canAccess(req, f.User) {
+		return nil, newAPIError(
+			http.StatusForbidden,
+			codeForbidden,
+			"Not allowed to see the scans of this user",
+		)
+	}
+
+	records, next, err := h.history.List(f)
+	if err == history.ErrInvalidCursor {
+		return nil, newAPIError(http.StatusBadRequest, codeBadRequest, "Invalid cursor")
+	} else if err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to read the history")
+		return nil, newAPIError(http.StatusInternalServerError, codeInternal, internalErrorMsg)
+	}
+
+	page := &historyPage{
+		Records: make([]*historyRecord, 0, len(records)),
+		Next:    next,
+	}
+	for _, r := range records {
+		hr := &historyRecord{Record: r}
+		if name := webDAVFileName(r); name != "" {
+			// The account might have been removed since, in which case there's no link.
+			hr.URL, _ = h.webdav.FileURL(r.Options.User, name)
+		}
+		if r.HasThumbnail {
+			hr.ThumbnailURL = apiPrefix + "/history/" + r.ID + "/" + thumbnailFileName
+		}
+		if r.Outcome != history.OutcomeUploaded && r.Options.Job != "" {
+			if _, err := h.spool.EntryForJob(r.Options.Job, ""); err == nil {
+				hr.DownloadURL = apiPrefix + "/jobs/" + r.Options.Job + "/file"
+			}
+		}
+		page.Records = append(page.Records, hr)
+	}
+
+	return page, nil
+}
+
+// historyFilter parses the filter of a request to the history from the given query
+// parameters.
+// Returns errInvalidFilter if a parameter has an invalid value.
+func historyFilter(query url.Values) (*history.Filter, error) {
+	f := &history.Filter{
+		User:    query.Get("user"),
+		Outcome: history.Outcome(query.Get("outcome")),
+		Format:  query.Get("format"),
+		Before:  query.Get("before"),
+	}
+
+	switch f.Outcome {
+	case "",
+		history.OutcomeUploaded,
+		history.OutcomeQueued,
+		history.OutcomeFailed,
+		history.OutcomeDownloaded,
+		history.OutcomePartial:
+	default:
+		return nil, errInvalidFilter
+	}
+
+	var err error
+	if v := query.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errInvalidFilter
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errInvalidFilter
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 {
+			return nil, errInvalidFilter
+		}
+	}
+
+	return f, nil
+}
+
+// handleAPIHistory lists the scans matching the filter provided in the query parameters
+// on GET /api/v1/history, from the most recent one to the oldest one.
+func (h *handlers) handleAPIHistory(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	if req.Method != http.MethodGet {
+		methodNotAllowed().writeJSON(w)
+		return
+	}
+
+	f, err := historyFilter(req.URL.Query())
+	if err != nil {
+		newAPIError(http.StatusBadRequest, codeBadRequest, "Invalid filter").writeJSON(w)
+		return
+	}
+
+	page, apiErr := h.scanHistory(req, f)
+	if apiErr != nil {
+		apiErr.writeJSON(w)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// handleAPIHistoryThumbnail serves the thumbnail of a scan on
+// GET /api/v1/history/{id}/thumb.jpg, if the requester can access the scans of the user
+// who requested the scan (see canAccess).
+func (h *handlers) handleAPIHistoryThumbnail(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, apiPrefix+"/history/"), "/")
+	if len(parts) != 2 || parts[1] != thumbnailFileName {
+		apiNotFound(w, req)
+		return
+	}
+
+	if req.Method != http.MethodGet {
+		methodNotAllowed().writeJSON(w)
+		return
+	}
+
+	// Don't tell users whether scans they're not allowed to see exist.
+	r, err := h.history.Get(parts[0])
+	if err == nil && !h.canAccess(req, r.Options.User) {
+		err = history.ErrNotFound
+	}
+
+	var thumbnail []byte
+	if err == nil {
+		thumbnail, err = h.history.Thumbnail(r.ID)
+	}
+	if err == history.ErrNotFound {
+		newAPIError(http.StatusNotFound, codeNotFound, "Thumbnail not found").writeJSON(w)
+		return
+	} else if err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to read the thumbnail")
+		newAPIError(http.StatusInternalServerError, codeInternal, internalErrorMsg).writeJSON(w)
+		return
+	}
+
+	// Thumbnails never change once generated, but they're only for the eyes of the user
+	// who requested the scan.
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(thumbnail)))
+	if _, err = w.Write(thumbnail); err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to send the thumbnail")
+	}
+}
+
+// webDAVFileName returns the path the file of the given record has been uploaded to on
+// the WebDAV server, relative to the upload path, or an empty string if it hasn't.
+func webDAVFileName(r *history.Record) string {
+	// Records from before files could be sent to several destinations don't list their
+	// uploads, and could only have been uploaded to a single one.
+	if len(r.Uploads) == 0 {
+		if r.Options.HasDestination(common.DestinationWebDAV) {
+			return r.FileName
+		}
+		return ""
+	}
+
+	for _, u := range r.Uploads {
+		if u.Destination == common.DestinationWebDAV {
+			return u.FileName
+		}
+	}
+
+	return ""
+}
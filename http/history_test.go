@@ -0,0 +1,134 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/babolivier/scanner/auth"
+)
+
+func TestHistoryOnlyShowsTheRequestersScans(t *testing.T) {
+	env, tokens := newAuthTestEnv(t)
+	env.addRecord(t, "alice")
+	env.addRecord(t, "bob")
+	env.addRecord(t, "")
+
+	tests := []struct {
+		name   string
+		user   string
+		scopes []auth.Scope
+		query  string
+		// wantUsers are the users which scans must be listed, or nil if the request must
+		// be rejected.
+		wantUsers []string
+	}{
+		{name: "own scans", user: "alice", scopes: []auth.Scope{auth.ScopeScan}, wantUsers: []string{"alice"}},
+		{name: "scans of another user", user: "alice", scopes: []auth.Scope{auth.ScopeScan}, query: "?user=bob"},
+		{name: "no user", scopes: []auth.Scope{auth.ScopeScan}},
+		{name: "no user filtering on a user", scopes: []auth.Scope{auth.ScopeScan}, query: "?user=bob"},
+		{name: "admin", scopes: []auth.Scope{auth.ScopeScan, auth.ScopeAdmin}, wantUsers: []string{"", "bob", "alice"}},
+		{name: "admin filtering on a user", scopes: []auth.Scope{auth.ScopeScan, auth.ScopeAdmin}, query: "?user=bob", wantUsers: []string{"bob"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, value, err := tokens.Create(tt.name, tt.user, tt.scopes, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest(http.MethodGet, env.server.URL+apiPrefix+"/history"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+value)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if tt.wantUsers == nil {
+				if resp.StatusCode != http.StatusForbidden {
+					t.Errorf("got status %d; want %d", resp.StatusCode, http.StatusForbidden)
+				}
+				return
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d; want %d", resp.StatusCode, http.StatusOK)
+			}
+
+			var page historyPage
+			if err = json.NewDecoder(resp.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+
+			var users []string
+			for _, r := range page.Records {
+				users = append(users, r.Options.User)
+			}
+			if len(users) != len(tt.wantUsers) {
+				t.Fatalf("got the scans of %q; want the ones of %q", users, tt.wantUsers)
+			}
+			for i := range users {
+				if users[i] != tt.wantUsers[i] {
+					t.Fatalf("got the scans of %q; want the ones of %q", users, tt.wantUsers)
+				}
+			}
+		})
+	}
+}
+
+func TestScansAreOnlyAccessibleToTheirUser(t *testing.T) {
+	env, tokens := newAuthTestEnv(t)
+	own := env.addRecord(t, "alice")
+	anonymous := env.addRecord(t, "")
+	// Spool entries are added without a user.
+	env.addFailedEntry(t, "anonymous")
+
+	requesters := map[string]string{}
+	for name, token := range map[string]struct {
+		user   string
+		scopes []auth.Scope
+	}{
+		"alice":   {user: "alice", scopes: []auth.Scope{auth.ScopePreview, auth.ScopeScan}},
+		"no user": {scopes: []auth.Scope{auth.ScopePreview, auth.ScopeScan}},
+		"admin":   {scopes: []auth.Scope{auth.ScopePreview, auth.ScopeScan, auth.ScopeAdmin}},
+	} {
+		_, value, err := tokens.Create(name, token.user, token.scopes, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requesters[name] = value
+	}
+
+	tests := []struct {
+		requester  string
+		path       string
+		wantStatus int
+	}{
+		{requester: "alice", path: "/history/" + own.ID + "/thumb.jpg", wantStatus: http.StatusOK},
+		{requester: "alice", path: "/history/" + anonymous.ID + "/thumb.jpg", wantStatus: http.StatusNotFound},
+		{requester: "no user", path: "/history/" + own.ID + "/thumb.jpg", wantStatus: http.StatusNotFound},
+		{requester: "no user", path: "/history/" + anonymous.ID + "/thumb.jpg", wantStatus: http.StatusNotFound},
+		{requester: "admin", path: "/history/" + own.ID + "/thumb.jpg", wantStatus: http.StatusOK},
+		{requester: "admin", path: "/history/" + anonymous.ID + "/thumb.jpg", wantStatus: http.StatusOK},
+		{requester: "alice", path: "/jobs/anonymous/file", wantStatus: http.StatusNotFound},
+		{requester: "no user", path: "/jobs/anonymous/file", wantStatus: http.StatusNotFound},
+		{requester: "admin", path: "/jobs/anonymous/file", wantStatus: http.StatusOK},
+		{requester: "alice", path: "/preview/last", wantStatus: http.StatusNotFound},
+		{requester: "no user", path: "/preview/last", wantStatus: http.StatusForbidden},
+		{requester: "admin", path: "/preview/last", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.requester+" "+tt.path, func(t *testing.T) {
+			if status := env.getWithToken(t, tt.path, requesters[tt.requester]); status != tt.wantStatus {
+				t.Errorf("got status %d; want %d", status, tt.wantStatus)
+			}
+		})
+	}
+}
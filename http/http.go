@@ -1,18 +1,26 @@
 package http
 
 import (
+	"encoding/json"
 	"fmt"
-	"image/jpeg"
 	"net/http"
 	"runtime/debug"
+	"strings"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
-	"github.com/tjgq/sane"
 
+	"github.com/babolivier/scanner/auth"
 	"github.com/babolivier/scanner/common"
 	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/email"
+	"github.com/babolivier/scanner/history"
+	"github.com/babolivier/scanner/logging"
+	"github.com/babolivier/scanner/progress"
 	"github.com/babolivier/scanner/scanner"
+	"github.com/babolivier/scanner/spool"
 	"github.com/babolivier/scanner/webdav"
+	"github.com/babolivier/scanner/webhook"
 )
 
 const (
@@ -23,6 +31,14 @@ const (
 type handlers struct {
 	scanner *scanner.Scanner
 	webdav  *webdav.Client
+	// email is nil if sending scans by email hasn't been configured.
+	email    *email.Client
+	spool    *spool.Spool
+	progress *progress.Broker
+	history  *history.Store
+	webhooks *webhook.Notifier
+	auth     *auth.Authenticator
+	presets  map[string]*config.PresetConfig
 }
 
 // handlePanics recovers from a panic that occurred when processing a request, sends a
@@ -44,28 +60,35 @@ func (h *handlers) handlePreview(w http.ResponseWriter, req *http.Request) {
 	w.Header().Add("Cache-Control", "no-cache")
 
 	// Generate the preview.
-	img, err := h.scanner.Preview()
-	if err != nil {
-		logrus.WithError(err).Error("Failed to get preview from scanner")
-		if err == sane.ErrBusy {
-			http.Error(w, "Device busy", http.StatusServiceUnavailable)
-			return
-		}
-		http.Error(w, internalErrorMsg, http.StatusInternalServerError)
+	img, apiErr := h.preview(req)
+	if apiErr != nil {
+		apiErr.writeText(w)
 		return
 	}
 
-	// Encode the image as JPEG and send it in the response.
-	w.Header().Add("Content-Type", "image/jpeg")
-	if err = jpeg.Encode(w, img, nil); err != nil {
-		logrus.WithError(err).Error("Failed to encode into JPEG")
-		http.Error(w, internalErrorMsg, http.StatusInternalServerError)
+	writeJPEG(w, img)
+}
+
+// handleLastPreview sends the last preview taken by the requester as a JPEG image,
+// without triggering a new scan.
+func (h *handlers) handleLastPreview(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	preview, apiErr := h.lastPreview(req)
+	if apiErr != nil {
+		w.Header().Add("Cache-Control", "no-cache")
+		apiErr.writeText(w)
 		return
 	}
+
+	writeLastPreview(w, preview)
 }
 
 // handleScan generates a scan of what's currently on the scanner's plate and uploads it
-// to the WebDAV server.
+// to the WebDAV server, using the options provided in the URL query parameters. It
+// responds with the name of the uploaded file as plain text. If the file couldn't be sent
+// to some of its destinations, it responds with a 207 status, and the name of the file
+// (if it's been uploaded somewhere) followed by a line for each of these destinations.
 func (h *handlers) handleScan(w http.ResponseWriter, req *http.Request) {
 	defer handlePanics(w)
 
@@ -73,67 +96,164 @@ func (h *handlers) handleScan(w http.ResponseWriter, req *http.Request) {
 	w.Header().Add("Cache-Control", "no-cache")
 
 	// Try to parse the URL query parameters.
-	options, err := common.NewOptionsFromQuery(req.URL.Query())
-	if err == common.ErrMissingFormat {
-		http.Error(w, "Missing format", http.StatusBadRequest)
+	options, err := common.NewOptionsFromQuery(req.URL.Query(), h.presets)
+	if err != nil {
+		optionsError(req.Context(), err).writeText(w)
+		return
+	}
+
+	result, apiErr := h.scan(req, options)
+	if apiErr != nil {
+		apiErr.writeText(w)
 		return
-	} else if err == common.ErrMalformedRect {
-		http.Error(w, "Missing or malformed rect arguments", http.StatusBadRequest)
+	}
+
+	if result.file != nil {
+		result.writeFile(w, req)
 		return
-	} else if err != nil {
-		logrus.WithError(err).Error("Failed to parse URL query")
 	}
 
-	// If a file name has been provided, check that it's not already used by another file.
-	if options.FileName != "" {
-		exists, err := h.webdav.FileExists(options)
-		if err != nil {
-			http.Error(w, internalErrorMsg, http.StatusInternalServerError)
+	// Don't let a failed upload go unnoticed because the file went somewhere else.
+	if result.Status == scanStatusPartial {
+		w.WriteHeader(http.StatusMultiStatus)
+		if _, err = w.Write([]byte(result.partialText())); err != nil {
+			logging.Entry(req.Context()).WithError(err).Error("Failed to respond to /scan request")
+		}
+		return
+	}
+
+	// Only tell the file name if the file has been uploaded somewhere already.
+	if result.Status == scanStatusQueued || result.FileName == "" {
+		w.WriteHeader(http.StatusAccepted)
+		if _, err = w.Write([]byte("Upload queued")); err != nil {
+			logging.Entry(req.Context()).WithError(err).Error("Failed to respond to /scan request")
+		}
+		return
+	}
+
+	// Send the file name back to the client.
+	w.WriteHeader(200)
+	if _, err = w.Write([]byte(result.FileName)); err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to respond to /scan request")
+	}
+}
+
+// handleFolders lists the folders within the folder at the path provided in the query
+// parameters if the request is a GET request, or creates a folder at this path if the
+// request is a POST request.
+func (h *handlers) handleFolders(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	// Tell browsers not to cache this endpoint.
+	w.Header().Add("Cache-Control", "no-cache")
+
+	p := strings.Trim(req.URL.Query().Get("path"), "/")
+
+	switch req.Method {
+	case http.MethodGet:
+		folders, apiErr := h.listFolders(req, p)
+		if apiErr != nil {
+			apiErr.writeText(w)
 			return
 		}
 
-		if exists {
-			http.Error(w, "File name already in use", http.StatusConflict)
+		w.Header().Add("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string][]string{"folders": folders})
+		if err != nil {
+			logging.Entry(req.Context()).WithError(err).Error("Failed to respond to /folders request")
+		}
+	case http.MethodPost:
+		if apiErr := h.createFolder(req, p); apiErr != nil {
+			apiErr.writeText(w)
 			return
 		}
+
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
+}
 
-	// Scan the file and upload it, and get the name of the file that's been uploaded to
-	// the WebDAV server.
-	fileName, err := h.scanner.ScanAndUpload(options)
-	if err != nil {
-		logrus.
-			WithError(err).
-			Error("Failed to scan or to upload to the WebDAV server")
-
-		if err == scanner.ErrUnsupportedFormat {
-			http.Error(w, "Unsupported format", http.StatusBadRequest)
-		} else {
-			http.Error(w, internalErrorMsg, http.StatusInternalServerError)
+// handleSpool lists the entries in the spool if the request is a GET request on /spool.
+// It also retries the upload of an entry's file on POST /spool/{id}/retry, and discards
+// an entry on DELETE /spool/{id}.
+func (h *handlers) handleSpool(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	// Tell browsers not to cache this endpoint.
+	w.Header().Add("Cache-Control", "no-cache")
+
+	// Figure out the ID of the entry and the action to perform on it from the path.
+	id, action := parseSpoolPath(req.URL.Path)
+
+	var err error
+	switch {
+	case id == "" && action == "" && req.Method == http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string][]spool.Entry{"entries": h.spool.Entries()})
+		if err != nil {
+			logging.Entry(req.Context()).WithError(err).Error("Failed to respond to /spool request")
 		}
 		return
+	case id != "" && action == "retry" && req.Method == http.MethodPost:
+		if err = h.spool.Retry(id); err == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	case id != "" && action == "" && req.Method == http.MethodDelete:
+		if err = h.spool.Discard(id); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
 	}
 
-	// Send the file name back to the client.
-	w.WriteHeader(200)
-	if _, err = w.Write([]byte(fileName)); err != nil {
-		logrus.WithError(err).Error("Failed to respond to /scan request")
+	spoolError(req.Context(), err, id).writeText(w)
+}
+
+// parseSpoolPath extracts the ID of the spool entry and the action to perform on it
+// from the given path, which starts with /spool. The action is "invalid" if the path
+// has too many segments.
+func parseSpoolPath(p string) (id string, action string) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(p, "/spool"), "/"), "/")
+	switch len(parts) {
+	case 1:
+		return parts[0], ""
+	case 2:
+		return parts[0], parts[1]
+	default:
+		return parts[0], "invalid"
 	}
 }
 
 // ListenAndServe registers the HTTP handlers and starts the HTTP server.
-func ListenAndServe(cfg *config.HTTPConfig, s *scanner.Scanner, c *webdav.Client) error {
+func ListenAndServe(
+	cfg *config.HTTPConfig,
+	presets map[string]*config.PresetConfig,
+	s *scanner.Scanner,
+	c *webdav.Client,
+	e *email.Client,
+	sp *spool.Spool,
+	broker *progress.Broker,
+	hist *history.Store,
+	notifier *webhook.Notifier,
+	a *auth.Authenticator,
+) error {
 	h := &handlers{
-		scanner: s,
-		webdav:  c,
+		scanner:  s,
+		webdav:   c,
+		email:    e,
+		spool:    sp,
+		progress: broker,
+		history:  hist,
+		webhooks: notifier,
+		auth:     a,
+		presets:  presets,
 	}
 
-	// Register a file server to serve the front end.
-	fs := http.FileServer(http.Dir("./public"))
-	http.Handle("/", fs)
-	// Register the handlers to preview and scan documents.
-	http.HandleFunc("/preview.jpg", h.handlePreview)
-	http.HandleFunc("/scan", h.handleScan)
+	handler := h.handler()
 
 	// Figure out which address to listen on, and whether to enable TLS.
 	addr := fmt.Sprintf("%s:%s", cfg.Address, cfg.Port)
@@ -147,8 +267,48 @@ func ListenAndServe(cfg *config.HTTPConfig, s *scanner.Scanner, c *webdav.Client
 	// If TLS credentials have been provided, start a HTTPS server, otherwise start a
 	// plain text HTTP server.
 	if useTLS {
-		return http.ListenAndServeTLS(addr, cfg.TLSCert, cfg.TLSKey, nil)
+		return http.ListenAndServeTLS(addr, cfg.TLSCert, cfg.TLSKey, handler)
 	} else {
-		return http.ListenAndServe(addr, nil)
+		return http.ListenAndServe(addr, handler)
 	}
 }
+
+// handler registers the HTTP handlers on a new mux, and returns the handler serving
+// requests with it.
+func (h *handlers) handler() http.Handler {
+	a := h.auth
+
+	// Register a file server to serve the front end.
+	mux := http.NewServeMux()
+	fs := http.FileServer(http.Dir("./public"))
+	mux.Handle("/", fs)
+	// Register the handlers to log in and out, and to manage API tokens.
+	a.RegisterHandlers(mux)
+	// Register the handlers to preview and scan documents. Previews and scans are
+	// triggered with GET requests, so make sure they include the CSRF token.
+	mux.HandleFunc("/preview.jpg", a.RequireScope(auth.ScopePreview, a.RequireCSRF(h.handlePreview)))
+	mux.HandleFunc("/preview/last.jpg", a.RequireScope(auth.ScopePreview, h.handleLastPreview))
+	mux.HandleFunc("/scan", a.RequireScope(auth.ScopeScan, a.RequireCSRF(h.handleScan)))
+	// Register the handler to browse and create folders.
+	mux.HandleFunc("/folders", a.RequireScope(auth.ScopeScan, h.handleFolders))
+	// Register the handler to manage the files waiting to be uploaded.
+	mux.HandleFunc("/spool", a.RequireScope(auth.ScopeAdmin, h.handleSpool))
+	mux.HandleFunc("/spool/", a.RequireScope(auth.ScopeAdmin, h.handleSpool))
+	// Register the handlers of the JSON API, and the document describing it.
+	for _, route := range apiRoutes {
+		handler := route.handler
+		handle := func(w http.ResponseWriter, req *http.Request) { handler(h, w, req) }
+		if route.csrf {
+			handle = a.RequireCSRF(handle)
+		}
+		mux.HandleFunc(apiPrefix+route.pattern, a.RequireScope(route.scope, handle))
+	}
+	mux.HandleFunc(openAPIPath, handleOpenAPI)
+	mux.HandleFunc("/api/", apiNotFound)
+	// Register the handler exposing the Prometheus metrics.
+	mux.HandleFunc("/metrics", a.RequireScope(auth.ScopeMetrics, promhttp.Handler().ServeHTTP))
+
+	// Give an ID to each request so its logs can be correlated, only let authenticated
+	// users access the handlers, and measure how long it takes to respond to requests.
+	return instrument(mux, logging.Middleware(a.Middleware(mux)))
+}
@@ -0,0 +1,146 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/babolivier/scanner/auth"
+	"github.com/babolivier/scanner/config"
+)
+
+// newAuthTestEnv returns a new apiTestEnv authenticating requests with API tokens, and
+// with the password "password" for the user alice, along with the store to create API
+// tokens in.
+func newAuthTestEnv(t *testing.T) (*apiTestEnv, *auth.TokenStore) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCfg := &config.AuthConfig{
+		HtpasswdFile:        filepath.Join(dir, "htpasswd"),
+		TokensFile:          filepath.Join(dir, "tokens.json"),
+		RevokedSessionsFile: filepath.Join(dir, "revoked_sessions.json"),
+	}
+	if err = ioutil.WriteFile(authCfg.HtpasswdFile, []byte("alice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	env := newAPITestEnv(t, authCfg)
+
+	tokens, err := auth.NewTokenStore(authCfg.TokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return env, tokens
+}
+
+// getWithToken sends a GET request to the given path of the JSON API, authenticated with
+// the given API token, and returns the status of the response.
+func (env *apiTestEnv) getWithToken(t *testing.T, path string, token string) int {
+	req, err := http.NewRequest(http.MethodGet, env.server.URL+apiPrefix+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestPreviewsRequireCSRFToken(t *testing.T) {
+	env, _ := newAuthTestEnv(t)
+
+	// Log in, without following the redirection so the cookies can be read.
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.PostForm(env.server.URL+"/auth/login", url.Values{"user": {"alice"}, "password": {"password"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var token string
+	cookies := resp.Cookies()
+	for _, c := range cookies {
+		if c.Name == "scanner_csrf" {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		t.Fatalf("got cookies %v; want a session", cookies)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		header   bool
+		query    bool
+		wantCSRF bool
+	}{
+		{name: "preview without token", path: "/preview", wantCSRF: true},
+		{name: "preview with header", path: "/preview", header: true},
+		{name: "preview with query parameter", path: "/preview", query: true},
+		{name: "stream without token", path: "/preview/stream", wantCSRF: true},
+		{name: "stream with query parameter", path: "/preview/stream", query: true},
+		{name: "last preview without token", path: "/preview/last"},
+		{name: "legacy preview without token", path: "/preview.jpg", wantCSRF: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := env.server.URL + tt.path
+			if !strings.HasSuffix(tt.path, ".jpg") {
+				u = env.server.URL + apiPrefix + tt.path
+			}
+			if tt.query {
+				u += fmt.Sprintf("?%s=%s", auth.CSRFParam, url.QueryEscape(token))
+			}
+
+			req, err := http.NewRequest(http.MethodGet, u, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+			if tt.header {
+				req.Header.Set(auth.CSRFHeader, token)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			// Previews can't be taken as there's no device, but the ones with the token must
+			// go past the authentication.
+			rejected := resp.StatusCode == http.StatusForbidden && strings.Contains(string(body), "CSRF")
+			if rejected != tt.wantCSRF {
+				t.Errorf("got status %d (%s); want rejected because of the CSRF token: %v", resp.StatusCode, body, tt.wantCSRF)
+			}
+		})
+	}
+}
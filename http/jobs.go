@@ -0,0 +1,367 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/babolivier/scanner/auth"
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/history"
+	"github.com/babolivier/scanner/logging"
+	"github.com/babolivier/scanner/naming"
+	"github.com/babolivier/scanner/spool"
+	"github.com/babolivier/scanner/webhook"
+)
+
+// retryUploadRequest is the body of a request to upload the file of a scan again. Fields
+// that are omitted keep the value the scan was requested with.
+type retryUploadRequest struct {
+	// Folder is the path of the folder to store the file in, relative to the root of the
+	// storage.
+	Folder *string `json:"folder,omitempty"`
+	// Name is the name to give to the file, without its extension.
+	Name string `json:"name,omitempty"`
+	// Destination is the destination to upload the file to again, if it couldn't be
+	// uploaded to several of them. If empty, the upload that failed last is retried.
+	Destination string `json:"destination,omitempty"`
+	// SendTo is where to send the file instead, as a common.Destination* constant. If
+	// it's common.DestinationDownload, the file is sent back in the response, and isn't
+	// kept anymore. If empty, the file is sent to the destination it failed to go to.
+	SendTo string `json:"send_to,omitempty"`
+	// Email describes the email to send the file in. It's required if the file is sent
+	// by email but wasn't before.
+	Email *common.EmailOptions `json:"email,omitempty"`
+}
+
+// jobEntry returns the spool entry holding the file of the scan with the given job ID,
+// to upload to the given destination, or to any destination if it's empty, if the
+// requester can access the scans of the user who requested it (see canAccess).
+func (h *handlers) jobEntry(
+	req *http.Request,
+	job string,
+	destination string,
+) (*spool.Entry, *apiError) {
+	e, err := h.spool.EntryForJob(job, destination)
+	// Don't tell users whether scans they're not allowed to see exist.
+	if err == nil && !h.canAccess(req, e.Options.User) {
+		err = spool.ErrNotFound
+	}
+	if err != nil {
+		return nil, newAPIError(
+			http.StatusNotFound,
+			codeNotFound,
+			"No file kept for this job, it's either been uploaded or expired",
+		)
+	}
+
+	return &e, nil
+}
+
+// retryUpload uploads the file of the scan with the given job ID again, to the
+// destination described by the given request.
+func (h *handlers) retryUpload(
+	req *http.Request,
+	job string,
+	body *retryUploadRequest,
+) (*scanResult, *apiError) {
+	ctx := req.Context()
+
+	e, apiErr := h.jobEntry(req, job, body.Destination)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	// Figure out where the file should go, and make sure it's somewhere sensible that the
+	// requester is allowed to store files in.
+	options := *e.Options
+	if body.SendTo != "" {
+		options.Destinations = []string{body.SendTo}
+	}
+	if body.Folder != nil {
+		options.Folder = strings.Trim(*body.Folder, "/")
+	}
+
+	err := naming.CheckPath(options.Folder)
+	if err == nil && body.Name != "" {
+		options.FileName, err = naming.NewFileName(body.Name)
+	}
+	if err == nil && body.Email != nil {
+		options.Email, err = common.CheckEmail(body.Email)
+	}
+	if err != nil {
+		return nil, optionsError(ctx, err)
+	}
+	if auth.CheckDestinations(req, &options) == auth.ErrDestinationNotAllowed {
+		return nil, newAPIError(http.StatusForbidden, codeForbidden, "Destination not allowed")
+	}
+
+	destination := options.UploadDestination()
+	switch destination {
+	case common.DestinationWebDAV:
+		if apiErr = h.checkRetryToWebDAV(ctx, &options, body.Name != ""); apiErr != nil {
+			return nil, apiErr
+		}
+	case common.DestinationEmail:
+		if apiErr = h.checkRetryToEmail(ctx, &options); apiErr != nil {
+			return nil, apiErr
+		}
+	default:
+		return nil, optionsError(ctx, common.ErrUnknownDestination)
+	}
+
+	startedAt := time.Now()
+	fileName, err := h.spool.RetryNow(ctx, e.ID, func(o *common.ScanOptions) {
+		o.Destinations = options.Destinations
+		o.Folder = options.Folder
+		o.FileName = options.FileName
+		o.Email = options.Email
+	})
+	h.recordRetry(ctx, e, &options, startedAt, fileName, err)
+	if err == nil {
+		return &scanResult{Status: scanStatusUploaded, FileName: fileName}, nil
+	}
+
+	if errors.Is(err, spool.ErrQueued) {
+		logging.Entry(ctx).WithError(err).Warn("Upload failed again, file has been queued")
+		return &scanResult{Status: scanStatusQueued}, nil
+	}
+
+	if err == spool.ErrNotFound || err == spool.ErrBusy {
+		return nil, spoolError(ctx, err, e.ID)
+	}
+
+	logging.Entry(ctx).WithError(err).WithField("spool_id", e.ID).Error("Failed to upload the file again")
+	return nil, uploadError(err)
+}
+
+// checkRetryToWebDAV checks that the file described by the given options can be uploaded
+// to the WebDAV server of the user who requested the scan. If the file has been given a
+// new name, and we're not allowed to find another name for it in case of a conflict, it
+// also checks that the name isn't already used by another file.
+func (h *handlers) checkRetryToWebDAV(
+	ctx context.Context,
+	options *common.ScanOptions,
+	renamed bool,
+) *apiError {
+	if !h.webdav.HasAccount(options.User) {
+		logging.Entry(ctx).WithField("user", options.User).Warn("No WebDAV account for user")
+		return newAPIError(http.StatusForbidden, codeNoStorage, "No storage configured for this user")
+	}
+
+	if !renamed || !h.webdav.RejectsConflicts() {
+		return nil
+	}
+
+	exists, err := h.webdav.FileExists(ctx, options)
+	if err != nil {
+		logging.Entry(ctx).WithError(err).Error("Failed to check whether the file exists")
+		return newAPIError(http.StatusBadGateway, codeStorageFailed, "Failed to reach the storage")
+	}
+
+	if exists {
+		return newAPIError(http.StatusConflict, codeNameConflict, "File name already in use")
+	}
+
+	return nil
+}
+
+// checkRetryToEmail checks that the file described by the given options can be sent by
+// email to its recipients.
+func (h *handlers) checkRetryToEmail(ctx context.Context, options *common.ScanOptions) *apiError {
+	// The file was sent somewhere else before, so there's nobody to send it to unless the
+	// request says who.
+	if options.Email == nil {
+		return optionsError(ctx, common.ErrInvalidEmail)
+	}
+
+	if h.email == nil {
+		return newAPIError(http.StatusForbidden, codeNoEmail, "Sending scans by email isn't configured")
+	}
+
+	if err := h.email.CheckRecipients(options.Email.To); err != nil {
+		logging.Entry(ctx).WithError(err).Warn("Rejected email recipients")
+		return newAPIError(http.StatusForbidden, codeForbidden, "Recipient not allowed")
+	}
+
+	return nil
+}
+
+// retryDownload sends the file of the scan with the given job ID back as an attachment,
+// named after the given request if it includes a name, and stops keeping it once it's
+// been sent.
+func (h *handlers) retryDownload(
+	w http.ResponseWriter,
+	req *http.Request,
+	job string,
+	body *retryUploadRequest,
+) {
+	ctx := req.Context()
+
+	e, apiErr := h.jobEntry(req, job, body.Destination)
+	if apiErr != nil {
+		apiErr.writeJSON(w)
+		return
+	}
+
+	options := *e.Options
+	options.Destinations = []string{common.DestinationDownload}
+	if body.Name != "" {
+		var err error
+		if options.FileName, err = naming.NewFileName(body.Name); err != nil {
+			optionsError(ctx, err).writeJSON(w)
+			return
+		}
+	}
+
+	f, err := h.spool.Open(e.ID)
+	if err != nil {
+		spoolError(ctx, err, e.ID).writeJSON(w)
+		return
+	}
+
+	startedAt := time.Now()
+	result := &scanResult{
+		file:         f,
+		fileFormat:   options.Format,
+		downloadName: h.webdav.LocalName(&options, e.CreatedAt),
+	}
+	if err = result.writeFile(w, req); err != nil {
+		// Keep the file, so the requester can try again.
+		return
+	}
+
+	if err = h.spool.Discard(e.ID); err != nil {
+		logging.Entry(ctx).WithError(err).WithField("spool_id", e.ID).Warn("Failed to discard downloaded file")
+	}
+	h.recordRetry(ctx, e, &options, startedAt, "", nil)
+}
+
+// recordRetry adds the outcome of sending the file of the given spool entry again with
+// the given options, which started at the given time, to the history, and notifies the
+// webhooks of it.
+func (h *handlers) recordRetry(
+	ctx context.Context,
+	e *spool.Entry,
+	options *common.ScanOptions,
+	startedAt time.Time,
+	fileName string,
+	err error,
+) {
+	record := &history.Record{
+		Options:     options,
+		FileName:    fileName,
+		Size:        e.Size,
+		Destination: options.UploadDestination(),
+		StartedAt:   startedAt,
+		Duration:    time.Since(startedAt).Seconds(),
+		Outcome:     history.OutcomeUploaded,
+	}
+	switch {
+	case record.Destination == "":
+		// The file has been sent back to the requester, there's no upload to describe.
+		record.Destination = common.DestinationDownload
+		record.Outcome = history.OutcomeDownloaded
+	case errors.Is(err, spool.ErrQueued):
+		record.Outcome = history.OutcomeQueued
+		record.Error = err.Error()
+	case err == spool.ErrNotFound || err == spool.ErrBusy:
+		// Nothing has been attempted.
+		return
+	case err != nil:
+		record.Outcome = history.OutcomeFailed
+		record.Error = err.Error()
+	}
+
+	if record.Outcome != history.OutcomeDownloaded {
+		record.Uploads = []*history.Upload{{
+			Destination: record.Destination,
+			FileName:    fileName,
+			Outcome:     record.Outcome,
+			Error:       record.Error,
+		}}
+	}
+
+	if histErr := h.history.Add(record, nil); histErr != nil {
+		logging.Entry(ctx).WithError(histErr).Error("Failed to add upload to the history")
+	}
+	h.webhooks.Notify(ctx, webhook.NewPayload(record))
+}
+
+// handleAPIJobs handles the requests to the files kept for scans which upload failed,
+// i.e. uploading them again on POST /api/v1/jobs/{id}/retry-upload, and downloading them
+// on GET /api/v1/jobs/{id}/file.
+func (h *handlers) handleAPIJobs(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, apiPrefix+"/jobs/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		apiNotFound(w, req)
+		return
+	}
+
+	switch {
+	case parts[1] == "retry-upload" && req.Method == http.MethodPost:
+		h.handleAPIRetryUpload(w, req, parts[0])
+	case parts[1] == "file" && req.Method == http.MethodGet:
+		h.handleAPIJobFile(w, req, parts[0])
+	case parts[1] == "retry-upload" || parts[1] == "file":
+		methodNotAllowed().writeJSON(w)
+	default:
+		apiNotFound(w, req)
+	}
+}
+
+// handleAPIRetryUpload uploads the file of the scan with the given job ID again, to the
+// destination provided as a JSON object in the body of the request, if any, and responds
+// with a scanResult, or with the file itself if it must be downloaded.
+func (h *handlers) handleAPIRetryUpload(w http.ResponseWriter, req *http.Request, job string) {
+	var body retryUploadRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+		newAPIError(http.StatusBadRequest, codeBadRequest, "Malformed request body").writeJSON(w)
+		return
+	}
+
+	if body.SendTo == common.DestinationDownload {
+		h.retryDownload(w, req, job, &body)
+		return
+	}
+
+	result, apiErr := h.retryUpload(req, job, &body)
+	if apiErr != nil {
+		apiErr.writeJSON(w)
+		return
+	}
+
+	status := http.StatusCreated
+	if result.Status == scanStatusQueued {
+		status = http.StatusAccepted
+	}
+
+	writeJSON(w, status, result)
+}
+
+// handleAPIJobFile sends the file of the scan with the given job ID as an attachment.
+func (h *handlers) handleAPIJobFile(w http.ResponseWriter, req *http.Request, job string) {
+	e, apiErr := h.jobEntry(req, job, "")
+	if apiErr != nil {
+		apiErr.writeJSON(w)
+		return
+	}
+
+	f, err := h.spool.Open(e.ID)
+	if err != nil {
+		spoolError(req.Context(), err, e.ID).writeJSON(w)
+		return
+	}
+	defer f.Close()
+
+	name := h.webdav.LocalName(e.Options, e.CreatedAt)
+	setAttachmentHeaders(w, name, e.Options.Format)
+
+	http.ServeContent(w, req, name, e.CreatedAt, f)
+}
@@ -0,0 +1,54 @@
+package http
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/history"
+)
+
+func TestRetryDownloadSendsTheFileAndStopsKeepingIt(t *testing.T) {
+	env := newAPITestEnv(t, &config.AuthConfig{})
+	e := env.addFailedEntry(t, "job")
+
+	resp, err := http.Post(
+		env.server.URL+apiPrefix+"/jobs/job/retry-upload",
+		"application/json",
+		strings.NewReader(`{"send_to":"download","name":"invoice"}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d; want %d", resp.StatusCode, http.StatusOK)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "%PDF-1.4\n" {
+		t.Errorf("got file %q; want the one from the spool", body)
+	}
+	if _, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); params["filename"] != "invoice.pdf" {
+		t.Errorf("got file name %q; want invoice.pdf", params["filename"])
+	}
+
+	if _, err = env.spool.Open(e.ID); err == nil {
+		t.Error("the file is still kept once it's been downloaded")
+	}
+
+	records, _, err := env.history.List(&history.Filter{Outcome: history.OutcomeDownloaded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Destination != common.DestinationDownload || len(records[0].Uploads) != 0 {
+		t.Errorf("got records %+v; want a single download without any upload", records)
+	}
+}
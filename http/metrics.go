@@ -0,0 +1,81 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/babolivier/scanner/metrics"
+)
+
+// standardMethods are the HTTP methods requests are labelled with in metrics. Other
+// methods are labelled with metrics.MethodOther.
+var standardMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// statusRecorder records the status code of the response it's used to send.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush sends the data buffered so far to the client, if the underlying response writer
+// supports it, so streams of events keep working.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// instrument returns a handler that measures how long the given handler takes to handle
+// requests, labelled with the pattern of the mux which the requests match.
+func instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Label requests with the pattern rather than the path, so the number of label
+		// values stays bounded.
+		_, pattern := mux.Handler(req)
+		if pattern == "" {
+			pattern = "none"
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, req)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		method := req.Method
+		if !standardMethods[method] {
+			method = metrics.MethodOther
+		}
+
+		metrics.HTTPRequestDuration.
+			WithLabelValues(pattern, method, strconv.Itoa(recorder.status)).
+			Observe(time.Since(start).Seconds())
+	})
+}
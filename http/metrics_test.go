@@ -0,0 +1,56 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/babolivier/scanner/metrics"
+)
+
+// requestMethods returns the values of the method label of the HTTP request metrics.
+func requestMethods(t *testing.T) map[string]bool {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	methods := make(map[string]bool)
+	for _, family := range families {
+		if family.GetName() != "scanner_http_request_duration_seconds" {
+			continue
+		}
+
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "method" {
+					methods[label.GetValue()] = true
+				}
+			}
+		}
+	}
+
+	return methods
+}
+
+func TestInstrumentLabelsUnknownMethodsAsOther(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {})
+	handler := instrument(mux, mux)
+
+	for _, method := range []string{http.MethodGet, "PROPFIND", "NOT-A-METHOD"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/", nil))
+	}
+
+	methods := requestMethods(t)
+	if !methods[http.MethodGet] || !methods[metrics.MethodOther] {
+		t.Errorf("got methods %v; want %s and %s", methods, http.MethodGet, metrics.MethodOther)
+	}
+	for _, method := range []string{"PROPFIND", "NOT-A-METHOD"} {
+		if methods[method] {
+			t.Errorf("requests are labelled with the %s method", method)
+		}
+	}
+}
@@ -0,0 +1,1059 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/babolivier/scanner/auth"
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/history"
+	"github.com/babolivier/scanner/logging"
+	"github.com/babolivier/scanner/progress"
+)
+
+const (
+	// openAPIPath is the path the OpenAPI document describing the JSON API is served at.
+	openAPIPath = "/api/openapi.json"
+)
+
+// openAPIOperation describes an operation (i.e. a method on a path) of the JSON API, as
+// defined by the OpenAPI 3 specification.
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary"`
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+// openAPIParameter describes a path or query parameter of an operation.
+type openAPIParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required"`
+	Schema      interface{} `json:"schema"`
+}
+
+// openAPIBody describes the body of a request.
+type openAPIBody struct {
+	Required bool                   `json:"required"`
+	Content  map[string]interface{} `json:"content"`
+}
+
+// openAPIResponse describes a response to an operation.
+type openAPIResponse struct {
+	Description string                 `json:"description"`
+	Content     map[string]interface{} `json:"content,omitempty"`
+}
+
+// apiRoute is a route of the JSON API, along with the description of its operations.
+type apiRoute struct {
+	// pattern is the pattern the route is registered with on the mux, relative to
+	// apiPrefix.
+	pattern string
+	// scope is the scope requests to this route must be allowed to use.
+	scope auth.Scope
+	// csrf is whether requests from logged in users must include their CSRF token
+	// regardless of their method, because the route has side effects (e.g. scanning)
+	// despite being accessed with GET requests.
+	csrf    bool
+	handler func(h *handlers, w http.ResponseWriter, req *http.Request)
+	// operations maps the paths served by the route, relative to apiPrefix and in the
+	// OpenAPI syntax, to their operations, by lower case method.
+	operations map[string]map[string]*openAPIOperation
+}
+
+var (
+	// apiRoutes lists the routes of the JSON API. Both the mux and the OpenAPI document
+	// are built from this list, so a route can't be served without being documented.
+	apiRoutes = []*apiRoute{
+		{
+			pattern: "/scans",
+			scope:   auth.ScopeScan,
+			handler: (*handlers).handleAPIScans,
+			operations: map[string]map[string]*openAPIOperation{
+				"/scans": {
+					"post": {
+						OperationID: "scan",
+						Summary:     "Scan a document and upload it to the storage, and/or send it back",
+						RequestBody: jsonBody("ScanRequest"),
+						Responses: map[string]*openAPIResponse{
+							"200": {
+								Description: "The document has been scanned, and the file is sent back as an attachment " +
+									"because the destinations include download. If they also include webdav, the " +
+									uploadStatusHeader + " header tells whether the file has been uploaded, queued or " +
+									"failed to upload, and the " + uploadFileNameHeader + " header the path it's " +
+									"been uploaded to.",
+								Content: fileContent,
+							},
+							"201": jsonResponse("The document has been scanned and uploaded", "ScanResult"),
+							"202": jsonResponse("The document has been scanned, and will be uploaded later", "ScanResult"),
+							"207": jsonResponse(
+								"The document has been scanned, but couldn't be uploaded to some of its destinations",
+								"ScanResult",
+							),
+							"400": errorResponse("The request body or the scan options are invalid"),
+							"403": errorResponse("The scan isn't allowed, or there's nowhere to upload the file"),
+							"409": errorResponse("The file name is already in use, or the requester has no preview for a quick export"),
+							"413": errorResponse("The file is too large to be sent by email"),
+							"502": errorResponse("The storage or the SMTP server couldn't be reached"),
+							"503": errorResponse("The scanner is busy"),
+							"504": errorResponse("The scan took longer than the configured timeout"),
+						},
+					},
+				},
+			},
+		},
+		{
+			pattern: "/preview",
+			scope:   auth.ScopePreview,
+			csrf:    true,
+			handler: (*handlers).handleAPIPreview,
+			operations: map[string]map[string]*openAPIOperation{
+				"/preview": {
+					"get": {
+						OperationID: "preview",
+						Summary:     "Get a low resolution preview of what's on the scanner's plate",
+						Parameters:  []*openAPIParameter{csrfParameter()},
+						Responses: map[string]*openAPIResponse{
+							"200": {
+								Description: "The preview, as a JPEG image",
+								Content: map[string]interface{}{
+									"image/jpeg": map[string]interface{}{
+										"schema": map[string]string{"type": "string", "format": "binary"},
+									},
+								},
+							},
+							"403": errorResponse("The request comes from a logged in user, and lacks their CSRF token"),
+							"503": errorResponse("The scanner is busy"),
+							"504": errorResponse("The scan took longer than the configured timeout"),
+						},
+					},
+				},
+			},
+		},
+		{
+			pattern: "/preview/last",
+			scope:   auth.ScopePreview,
+			handler: (*handlers).handleAPILastPreview,
+			operations: map[string]map[string]*openAPIOperation{
+				"/preview/last": {
+					"get": {
+						OperationID: "lastPreview",
+						Summary:     "Get the last preview the requester took, without scanning again",
+						Responses: map[string]*openAPIResponse{
+							"200": {
+								Description: "The preview, as a JPEG image. The Last-Modified header tells when it was taken, " +
+									"and the X-Preview-Resolution header its resolution in DPI.",
+								Content: map[string]interface{}{
+									"image/jpeg": map[string]interface{}{
+										"schema": map[string]string{"type": "string", "format": "binary"},
+									},
+								},
+							},
+							"403": errorResponse("The request isn't made on behalf of a user, and isn't allowed to use the admin scope"),
+							"404": errorResponse("The requester hasn't taken any preview yet"),
+						},
+					},
+				},
+			},
+		},
+		{
+			pattern: "/preview/stream",
+			scope:   auth.ScopePreview,
+			csrf:    true,
+			handler: (*handlers).handleAPIPreviewStream,
+			operations: map[string]map[string]*openAPIOperation{
+				"/preview/stream": {
+					"get": {
+						OperationID: "previewStream",
+						Summary:     "Stream a preview as server-sent events while it's being scanned",
+						Parameters:  []*openAPIParameter{csrfParameter()},
+						Responses: map[string]*openAPIResponse{
+							"200": {
+								Description: "A stream of server-sent events: \"partial\" events with the part of the preview scanned so far, " +
+									"then either a \"done\" event with the whole preview, or an \"error\" event which data is an Error",
+								Content: map[string]interface{}{
+									"text/event-stream": map[string]interface{}{
+										"schema": schemaRef("PreviewUpdate"),
+									},
+								},
+							},
+							"403": errorResponse("The request comes from a logged in user, and lacks their CSRF token"),
+						},
+					},
+				},
+			},
+		},
+		{
+			pattern: "/folders",
+			scope:   auth.ScopeScan,
+			handler: (*handlers).handleAPIFolders,
+			operations: map[string]map[string]*openAPIOperation{
+				"/folders": {
+					"get": {
+						OperationID: "listFolders",
+						Summary:     "List the folders within a folder of the storage",
+						Parameters: []*openAPIParameter{
+							{
+								Name:        "path",
+								In:          "query",
+								Description: "Path of the folder, relative to the upload path",
+								Schema:      map[string]string{"type": "string"},
+							},
+						},
+						Responses: map[string]*openAPIResponse{
+							"200": jsonResponse("The names of the folders", "Folders"),
+							"400": errorResponse("The path is invalid"),
+							"403": errorResponse("The folder can't be listed"),
+							"404": errorResponse("The folder doesn't exist"),
+							"502": errorResponse("The storage couldn't be reached"),
+						},
+					},
+					"post": {
+						OperationID: "createFolder",
+						Summary:     "Create a folder on the storage",
+						RequestBody: jsonBody("CreateFolderRequest"),
+						Responses: map[string]*openAPIResponse{
+							"201": jsonResponse("The folder has been created", "CreateFolderRequest"),
+							"400": errorResponse("The path is invalid"),
+							"403": errorResponse("The folder can't be created there"),
+							"404": errorResponse("The parent folder doesn't exist"),
+							"409": errorResponse("The folder already exists"),
+							"502": errorResponse("The storage couldn't be reached"),
+						},
+					},
+				},
+			},
+		},
+		{
+			pattern: "/events",
+			scope:   auth.ScopeScan,
+			handler: (*handlers).handleAPIEvents,
+			operations: map[string]map[string]*openAPIOperation{
+				"/events": {
+					"get": {
+						OperationID: "events",
+						Summary:     "Stream the progress of scans as server-sent events",
+						Parameters: []*openAPIParameter{
+							{
+								Name:        "job",
+								In:          "query",
+								Description: "Only send the events of the scan with this job ID",
+								Schema:      map[string]string{"type": "string"},
+							},
+						},
+						Responses: map[string]*openAPIResponse{
+							"200": {
+								Description: "A stream of server-sent events, which data is a ProgressEvent",
+								Content: map[string]interface{}{
+									"text/event-stream": map[string]interface{}{
+										"schema": schemaRef("ProgressEvent"),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			pattern: "/history",
+			scope:   auth.ScopeScan,
+			handler: (*handlers).handleAPIHistory,
+			operations: map[string]map[string]*openAPIOperation{
+				"/history": {
+					"get": {
+						OperationID: "history",
+						Summary:     "List past scans, from the most recent one to the oldest one",
+						Parameters: []*openAPIParameter{
+							{
+								Name:        "user",
+								In:          "query",
+								Description: "Only list the scans of this user. Requires the admin scope unless it's the requester.",
+								Schema:      map[string]string{"type": "string"},
+							},
+							{
+								Name:        "outcome",
+								In:          "query",
+								Description: "Only list the scans with this outcome",
+								Schema: map[string]interface{}{
+									"type": "string",
+									"enum": []string{"uploaded", "queued", "failed", "downloaded", "partial"},
+								},
+							},
+							{
+								Name:        "format",
+								In:          "query",
+								Description: "Only list the scans in this format",
+								Schema:      map[string]string{"type": "string"},
+							},
+							{
+								Name:        "since",
+								In:          "query",
+								Description: "Only list the scans started at or after this time",
+								Schema:      map[string]string{"type": "string", "format": "date-time"},
+							},
+							{
+								Name:        "until",
+								In:          "query",
+								Description: "Only list the scans started at or before this time",
+								Schema:      map[string]string{"type": "string", "format": "date-time"},
+							},
+							{
+								Name:        "before",
+								In:          "query",
+								Description: "Cursor returned with the previous page, to get the next one",
+								Schema:      map[string]string{"type": "string"},
+							},
+							{
+								Name:        "limit",
+								In:          "query",
+								Description: "Maximum number of scans to list",
+								Schema: map[string]interface{}{
+									"type":    "integer",
+									"minimum": 1,
+									"maximum": history.MaxLimit,
+									"default": history.DefaultLimit,
+								},
+							},
+						},
+						Responses: map[string]*openAPIResponse{
+							"200": jsonResponse("A page of the history", "HistoryPage"),
+							"400": errorResponse("A filter is invalid"),
+							"403": errorResponse(
+								"The scans of other users, or any scan if the request isn't made on behalf of a user, " +
+									"can't be listed without the admin scope",
+							),
+						},
+					},
+				},
+			},
+		},
+		{
+			pattern: "/history/",
+			scope:   auth.ScopeScan,
+			handler: (*handlers).handleAPIHistoryThumbnail,
+			operations: map[string]map[string]*openAPIOperation{
+				"/history/{id}/thumb.jpg": {
+					"get": {
+						OperationID: "historyThumbnail",
+						Summary:     "Get the thumbnail of a past scan",
+						Parameters: []*openAPIParameter{
+							{
+								Name:     "id",
+								In:       "path",
+								Required: true,
+								Schema:   map[string]string{"type": "string"},
+							},
+						},
+						Responses: map[string]*openAPIResponse{
+							"200": {
+								Description: "The thumbnail, as a JPEG image",
+								Content: map[string]interface{}{
+									"image/jpeg": map[string]interface{}{
+										"schema": map[string]string{"type": "string", "format": "binary"},
+									},
+								},
+							},
+							"404": errorResponse("There's no such scan, or its thumbnail has been removed"),
+						},
+					},
+				},
+			},
+		},
+		{
+			pattern: "/jobs/",
+			scope:   auth.ScopeScan,
+			handler: (*handlers).handleAPIJobs,
+			operations: map[string]map[string]*openAPIOperation{
+				"/jobs/{id}/retry-upload": {
+					"post": {
+						OperationID: "retryUpload",
+						Summary:     "Upload the file of a scan which upload failed again, to the same or another destination",
+						Parameters:  []*openAPIParameter{jobIDParameter},
+						RequestBody: &openAPIBody{
+							Required: false,
+							Content: map[string]interface{}{
+								"application/json": map[string]interface{}{"schema": schemaRef("RetryUploadRequest")},
+							},
+						},
+						Responses: map[string]*openAPIResponse{
+							"200": {
+								Description: "The file, as an attachment, because it's sent to download. It isn't " +
+									"kept anymore once it's been sent.",
+								Content: fileContent,
+							},
+							"201": jsonResponse("The file has been uploaded", "ScanResult"),
+							"202": jsonResponse("The file couldn't be uploaded, and will be uploaded later", "ScanResult"),
+							"400": errorResponse("The request body or the destination is invalid"),
+							"403": errorResponse("The destination isn't allowed, or there's nowhere to send the file"),
+							"404": errorResponse("No file is kept for this job"),
+							"409": errorResponse("The file is being uploaded, or its name is already in use"),
+							"413": errorResponse("The file is too large to be sent by email"),
+							"502": errorResponse("The storage or the SMTP server couldn't be reached"),
+						},
+					},
+				},
+				"/jobs/{id}/file": {
+					"get": {
+						OperationID: "downloadJobFile",
+						Summary:     "Download the file of a scan which upload failed",
+						Parameters:  []*openAPIParameter{jobIDParameter},
+						Responses: map[string]*openAPIResponse{
+							"200": {
+								Description: "The file, as an attachment",
+								Content:     fileContent,
+							},
+							"404": errorResponse("No file is kept for this job"),
+						},
+					},
+				},
+			},
+		},
+		{
+			pattern: "/spool",
+			scope:   auth.ScopeAdmin,
+			handler: (*handlers).handleAPISpool,
+			operations: map[string]map[string]*openAPIOperation{
+				"/spool": {
+					"get": {
+						OperationID: "listSpoolEntries",
+						Summary:     "List the files waiting to be uploaded",
+						Responses: map[string]*openAPIResponse{
+							"200": jsonResponse("The entries of the spool", "SpoolEntries"),
+						},
+					},
+				},
+			},
+		},
+		{
+			pattern: "/spool/",
+			scope:   auth.ScopeAdmin,
+			handler: (*handlers).handleAPISpool,
+			operations: map[string]map[string]*openAPIOperation{
+				"/spool/{id}": {
+					"delete": {
+						OperationID: "discardSpoolEntry",
+						Summary:     "Discard a file waiting to be uploaded",
+						Parameters:  []*openAPIParameter{spoolIDParameter},
+						Responses: map[string]*openAPIResponse{
+							"204": {Description: "The file has been discarded"},
+							"404": errorResponse("There's no such entry"),
+							"409": errorResponse("The file is being uploaded"),
+						},
+					},
+				},
+				"/spool/{id}/retry": {
+					"post": {
+						OperationID: "retrySpoolEntry",
+						Summary:     "Retry uploading a file now",
+						Parameters:  []*openAPIParameter{spoolIDParameter},
+						Responses: map[string]*openAPIResponse{
+							"202": {Description: "The upload will be retried shortly"},
+							"404": errorResponse("There's no such entry"),
+							"409": errorResponse("The file is being uploaded"),
+						},
+					},
+				},
+			},
+		},
+		{
+			pattern: "/webhooks/deliveries",
+			scope:   auth.ScopeAdmin,
+			handler: (*handlers).handleAPIWebhookDeliveries,
+			operations: map[string]map[string]*openAPIOperation{
+				"/webhooks/deliveries": {
+					"get": {
+						OperationID: "webhookDeliveries",
+						Summary:     "List the most recent notifications sent to webhooks, from the most recent one to the oldest one",
+						Parameters: []*openAPIParameter{
+							{
+								Name:        "webhook",
+								In:          "query",
+								Description: "Only list the deliveries to the webhook with this name",
+								Schema:      map[string]string{"type": "string"},
+							},
+							{
+								Name:        "job",
+								In:          "query",
+								Description: "Only list the deliveries about this job",
+								Schema:      map[string]string{"type": "string"},
+							},
+							{
+								Name:        "status",
+								In:          "query",
+								Description: "Only list the deliveries with this status",
+								Schema: map[string]interface{}{
+									"type": "string",
+									"enum": []string{"pending", "delivered", "failed"},
+								},
+							},
+						},
+						Responses: map[string]*openAPIResponse{
+							"200": jsonResponse("The deliveries", "WebhookDeliveries"),
+							"400": errorResponse("The filter is invalid"),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// spoolIDParameter is the path parameter for the ID of a spool entry.
+	spoolIDParameter = &openAPIParameter{
+		Name:     "id",
+		In:       "path",
+		Required: true,
+		Schema:   map[string]string{"type": "string"},
+	}
+
+	// fileContent describes the content of a response sending a scanned file back.
+	fileContent = map[string]interface{}{
+		"application/pdf": map[string]interface{}{
+			"schema": map[string]string{"type": "string", "format": "binary"},
+		},
+		"image/jpeg": map[string]interface{}{
+			"schema": map[string]string{"type": "string", "format": "binary"},
+		},
+	}
+
+	// jobIDParameter is the path parameter for the job ID of a scan.
+	jobIDParameter = &openAPIParameter{
+		Name:        "id",
+		In:          "path",
+		Description: "Job ID of the scan",
+		Required:    true,
+		Schema:      map[string]string{"type": "string"},
+	}
+
+	// openAPISchemas are the schemas of the JSON objects exchanged through the JSON API.
+	openAPISchemas = map[string]interface{}{
+		"ScanRequest": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"format": map[string]interface{}{
+					"type":        "string",
+					"enum":        []string{"jpeg", "pdf"},
+					"description": "Format of the file. Required unless the preset defines one.",
+				},
+				"preset": map[string]string{"type": "string"},
+				"folder": map[string]string{
+					"type":        "string",
+					"description": "Folder to store the file in, relative to the upload path",
+				},
+				"name": map[string]string{
+					"type":        "string",
+					"description": "Name of the file, without its extension. Generated if omitted.",
+				},
+				"rect": schemaRef("Rect"),
+				"job": map[string]interface{}{
+					"type":        "string",
+					"pattern":     "^[A-Za-z0-9_-]{1,64}$",
+					"description": "Identifier of the scan in progress events. Generated if omitted.",
+				},
+				"quick": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Make the file from the requester's last preview, cropped to the rect, instead of scanning again",
+				},
+				"destinations": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "string",
+						"enum": []string{
+							common.DestinationWebDAV,
+							common.DestinationEmail,
+							common.DestinationDownload,
+						},
+					},
+					"description": "Where to send the file. Defaults to the preset's destinations if there " +
+						"are some, and to webdav otherwise, which uploads it to the storage. email sends it as " +
+						"an attachment to the recipients from email, and download sends it back in the " +
+						"response. The file is uploaded to all of the destinations at once.",
+				},
+				"email": schemaRef("EmailOptions"),
+			},
+		},
+		"EmailOptions": map[string]interface{}{
+			"type":        "object",
+			"description": "Email to send the file in, if the destinations include email",
+			"required":    []string{"to"},
+			"properties": map[string]interface{}{
+				"to": map[string]interface{}{
+					"type":        "array",
+					"minItems":    1,
+					"items":       map[string]string{"type": "string", "format": "email"},
+					"description": "Addresses to send the file to",
+				},
+				"subject": map[string]string{
+					"type":        "string",
+					"description": "Subject of the email. Defaults to the configured subject.",
+				},
+				"body": map[string]string{"type": "string"},
+			},
+		},
+		"RetryUploadRequest": map[string]interface{}{
+			"type":        "object",
+			"description": "Destination to upload the file to. Omitted fields keep the value the scan was requested with.",
+			"properties": map[string]interface{}{
+				"folder": map[string]string{
+					"type":        "string",
+					"description": "Folder to store the file in, relative to the upload path",
+				},
+				"name": map[string]string{
+					"type":        "string",
+					"description": "Name of the file, without its extension",
+				},
+				"destination": map[string]interface{}{
+					"type": "string",
+					"enum": []string{common.DestinationWebDAV, common.DestinationEmail},
+					"description": "Destination to upload the file to again, if it couldn't be uploaded to " +
+						"several of them. Defaults to the one which upload failed last.",
+				},
+				"send_to": map[string]interface{}{
+					"type": "string",
+					"enum": []string{common.DestinationWebDAV, common.DestinationEmail, common.DestinationDownload},
+					"description": "Destination to send the file to instead of the one it failed to go to. " +
+						"If download, the file is sent back in the response, and isn't kept anymore.",
+				},
+				"email": schemaRef("EmailOptions"),
+			},
+		},
+		"Rect": map[string]interface{}{
+			"type":        "object",
+			"description": "Area to scan, in pixels on a preview",
+			"required":    []string{"x", "y", "width", "height"},
+			"properties": map[string]interface{}{
+				"x":      map[string]interface{}{"type": "integer", "minimum": 0},
+				"y":      map[string]interface{}{"type": "integer", "minimum": 0},
+				"width":  map[string]interface{}{"type": "integer", "minimum": 1},
+				"height": map[string]interface{}{"type": "integer", "minimum": 1},
+			},
+		},
+		"ScanResult": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"status"},
+			"properties": map[string]interface{}{
+				"status": map[string]interface{}{
+					"type": "string",
+					"enum": []string{scanStatusUploaded, scanStatusQueued, scanStatusPartial},
+				},
+				"file_name": map[string]string{
+					"type": "string",
+					"description": "Path of the uploaded file, relative to the upload path, or name of " +
+						"the attachment if the file has been sent by email. If the file has several " +
+						"destinations, name from the first one it's been uploaded to.",
+				},
+				"uploads": map[string]interface{}{
+					"type":        "array",
+					"items":       schemaRef("UploadResult"),
+					"description": "How uploading the file to each of its destinations went",
+				},
+			},
+		},
+		"UploadResult": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"destination", "status"},
+			"properties": map[string]interface{}{
+				"destination": map[string]string{"type": "string"},
+				"status": map[string]interface{}{
+					"type": "string",
+					"enum": []string{scanStatusUploaded, scanStatusQueued, scanStatusFailed},
+				},
+				"file_name": map[string]string{"type": "string"},
+				"error": map[string]interface{}{
+					"type":        "object",
+					"description": "Why the upload failed, with the same code and message as errors",
+					"properties": map[string]interface{}{
+						"code":    map[string]string{"type": "string"},
+						"message": map[string]string{"type": "string"},
+					},
+				},
+			},
+		},
+		"ProgressEvent": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"job", "phase", "percent"},
+			"properties": map[string]interface{}{
+				"job": map[string]string{"type": "string"},
+				"phase": map[string]interface{}{
+					"type": "string",
+					"enum": []progress.Phase{
+						progress.PhaseWaiting,
+						progress.PhaseScanning,
+						progress.PhaseEncoding,
+						progress.PhaseUploading,
+						progress.PhaseUploaded,
+						progress.PhaseQueued,
+						progress.PhaseReady,
+						progress.PhaseFailed,
+					},
+				},
+				"percent": map[string]interface{}{
+					"type":        "integer",
+					"minimum":     0,
+					"maximum":     100,
+					"description": "Progress of the current phase, when scanning or uploading",
+				},
+				"destination": map[string]string{
+					"type":        "string",
+					"description": "Destination the file is being uploaded to, when uploading",
+				},
+				"bytes_sent":  map[string]string{"type": "integer"},
+				"bytes_total": map[string]string{"type": "integer"},
+				"file_name": map[string]string{
+					"type":        "string",
+					"description": "Path of the uploaded file, relative to the upload path",
+				},
+				"error": map[string]string{"type": "string"},
+			},
+		},
+		"PreviewUpdate": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"image"},
+			"properties": map[string]interface{}{
+				"image": map[string]string{
+					"type":        "string",
+					"description": "The preview, or the part of it scanned so far, as a JPEG data URL",
+				},
+			},
+		},
+		"Folders": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"folders"},
+			"properties": map[string]interface{}{
+				"folders": map[string]interface{}{
+					"type":  "array",
+					"items": map[string]string{"type": "string"},
+				},
+			},
+		},
+		"CreateFolderRequest": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"path"},
+			"properties": map[string]interface{}{
+				"path": map[string]string{
+					"type":        "string",
+					"description": "Path of the folder, relative to the upload path",
+				},
+			},
+		},
+		"SpoolEntries": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"entries"},
+			"properties": map[string]interface{}{
+				"entries": map[string]interface{}{
+					"type":  "array",
+					"items": schemaRef("SpoolEntry"),
+				},
+			},
+		},
+		"SpoolEntry": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"id":      map[string]string{"type": "string"},
+				"options": map[string]string{"type": "object"},
+				"status": map[string]interface{}{
+					"type": "string",
+					"enum": []string{"pending", "failed"},
+				},
+				"attempts":     map[string]string{"type": "integer"},
+				"last_error":   map[string]string{"type": "string"},
+				"created_at":   map[string]string{"type": "string", "format": "date-time"},
+				"next_attempt": map[string]string{"type": "string", "format": "date-time"},
+				"failed_at": map[string]string{
+					"type":        "string",
+					"format":      "date-time",
+					"description": "Time the upload was given up on, from which the retention period of the file starts",
+				},
+				"request_id": map[string]string{"type": "string"},
+				"size": map[string]string{
+					"type":        "integer",
+					"description": "Size of the file in bytes",
+				},
+			},
+		},
+		"WebhookDeliveries": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"deliveries"},
+			"properties": map[string]interface{}{
+				"deliveries": map[string]interface{}{
+					"type":  "array",
+					"items": schemaRef("WebhookDelivery"),
+				},
+			},
+		},
+		"WebhookDelivery": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"id": map[string]string{
+					"type":        "string",
+					"description": "ID of the delivery, sent in the X-Scanner-Delivery header",
+				},
+				"webhook": map[string]string{"type": "string"},
+				"event": map[string]interface{}{
+					"type": "string",
+					"enum": []string{"scan.completed", "scan.failed"},
+				},
+				"job": map[string]string{"type": "string"},
+				"status": map[string]interface{}{
+					"type": "string",
+					"enum": []string{"pending", "delivered", "failed"},
+				},
+				"attempts": map[string]string{"type": "integer"},
+				"response_status": map[string]string{
+					"type":        "integer",
+					"description": "HTTP status the webhook responded to the last attempt with",
+				},
+				"last_error": map[string]string{"type": "string"},
+				"created_at": map[string]string{"type": "string", "format": "date-time"},
+				"updated_at": map[string]string{
+					"type":        "string",
+					"format":      "date-time",
+					"description": "Time of the last attempt",
+				},
+			},
+		},
+		"HistoryPage": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"records"},
+			"properties": map[string]interface{}{
+				"records": map[string]interface{}{
+					"type":  "array",
+					"items": schemaRef("HistoryRecord"),
+				},
+				"next": map[string]string{
+					"type":        "string",
+					"description": "Cursor to send as the before parameter to get the next page, if there's one",
+				},
+			},
+		},
+		"HistoryRecord": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"id":      map[string]string{"type": "string"},
+				"options": map[string]string{"type": "object"},
+				"file_name": map[string]string{
+					"type":        "string",
+					"description": "Path of the uploaded file, relative to the upload path",
+				},
+				"url": map[string]string{
+					"type":        "string",
+					"description": "URL of the uploaded file on the storage",
+				},
+				"thumbnail_url": map[string]string{
+					"type":        "string",
+					"description": "Path of the thumbnail of the scan, if it's still kept",
+				},
+				"download_url": map[string]string{
+					"type":        "string",
+					"description": "Path to download the file from, if the upload failed and the file is still kept",
+				},
+				"size": map[string]string{
+					"type":        "integer",
+					"description": "Size of the file in bytes",
+				},
+				"destination": map[string]string{"type": "string"},
+				"started_at":  map[string]string{"type": "string", "format": "date-time"},
+				"duration": map[string]string{
+					"type":        "number",
+					"description": "Time it took to scan the document and upload the file, in seconds",
+				},
+				"outcome": map[string]interface{}{
+					"type": "string",
+					"enum": []string{"uploaded", "queued", "failed", "downloaded", "partial"},
+				},
+				"error": map[string]string{"type": "string"},
+				"uploads": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"destination": map[string]string{"type": "string"},
+							"file_name":   map[string]string{"type": "string"},
+							"outcome": map[string]interface{}{
+								"type": "string",
+								"enum": []string{"uploaded", "queued", "failed"},
+							},
+							"error": map[string]string{"type": "string"},
+						},
+					},
+					"description": "How sending the file to each of its destinations went",
+				},
+			},
+		},
+		"Error": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"error"},
+			"properties": map[string]interface{}{
+				"error": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"code", "message"},
+					"properties": map[string]interface{}{
+						"code": map[string]interface{}{
+							"type": "string",
+							"enum": []string{
+								codeBadRequest,
+								codeInvalidName,
+								codeUnknownPreset,
+								codeMissingFormat,
+								codeUnsupportedFormat,
+								codeBadRect,
+								codeNameConflict,
+								codeDeviceBusy,
+								codeTimeout,
+								codeCancelled,
+								codeNoPreview,
+								codeStorageFailed,
+								codeNoStorage,
+								codeNoEmail,
+								codeInvalidEmail,
+								codeAttachmentTooLarge,
+								codeFolderForbidden,
+								codeFolderExists,
+								codeEntryBusy,
+								codeForbidden,
+								codeNotFound,
+								codeMethodNotAllowed,
+								codeInternal,
+								codeUnauthorized,
+							},
+						},
+						"message": map[string]string{"type": "string"},
+					},
+				},
+			},
+		},
+	}
+
+	// openAPIDoc is the serialised OpenAPI document, which is generated on first use.
+	openAPIDoc     []byte
+	openAPIDocErr  error
+	openAPIDocOnce sync.Once
+)
+
+// handleOpenAPI serves the OpenAPI document describing the JSON API.
+func handleOpenAPI(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	openAPIDocOnce.Do(func() {
+		openAPIDoc, openAPIDocErr = json.Marshal(openAPIDocument())
+	})
+
+	if openAPIDocErr != nil {
+		logging.Entry(req.Context()).WithError(openAPIDocErr).Error("Failed to generate OpenAPI document")
+		http.Error(w, internalErrorMsg, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if _, err := w.Write(openAPIDoc); err != nil {
+		logging.Entry(req.Context()).WithError(err).Error("Failed to respond to /api/openapi.json request")
+	}
+}
+
+// openAPIDocument builds the OpenAPI document describing the JSON API from apiRoutes.
+func openAPIDocument() map[string]interface{} {
+	paths := make(map[string]map[string]*openAPIOperation)
+	for _, route := range apiRoutes {
+		for p, operations := range route.operations {
+			if paths[p] == nil {
+				paths[p] = make(map[string]*openAPIOperation)
+			}
+
+			for method, operation := range operations {
+				// Every operation can fail because of authentication or because of an
+				// unexpected error.
+				responses := map[string]*openAPIResponse{
+					"401": errorResponse("The request isn't authenticated"),
+					"500": errorResponse("Something unexpected happened"),
+				}
+				if _, ok := operation.Responses["403"]; !ok {
+					responses["403"] = errorResponse("The request isn't allowed to use this operation")
+				}
+				for status, response := range operation.Responses {
+					responses[status] = response
+				}
+
+				op := *operation
+				op.Responses = responses
+				paths[p][method] = &op
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "Scanner API",
+			"version": "1",
+			"description": "Every response carries an X-Request-ID header identifying the request in the " +
+				"server's logs. Clients can provide their own ID in the same header.",
+		},
+		"servers": []map[string]string{{"url": apiPrefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": openAPISchemas,
+			"securitySchemes": map[string]interface{}{
+				"token": map[string]string{
+					"type":         "http",
+					"scheme":       "bearer",
+					"description":  "API token, which grants a set of scopes among preview, scan, admin and metrics",
+					"bearerFormat": "scanner_<id>_<secret>",
+				},
+				"session": map[string]string{
+					"type":        "apiKey",
+					"in":          "cookie",
+					"name":        "scanner_session",
+					"description": "Session of a logged in user, which also requires the X-CSRF-Token header (or the csrf_token query parameter) on requests other than GET, and on previews",
+				},
+			},
+		},
+		"security": []map[string][]string{{"token": {}}, {"session": {}}},
+	}
+}
+
+// schemaRef returns a reference to the schema with the given name.
+func schemaRef(name string) map[string]string {
+	return map[string]string{"$ref": "#/components/schemas/" + name}
+}
+
+// jsonBody returns the description of a request body which is a JSON object matching
+// the schema with the given name.
+func jsonBody(schema string) *openAPIBody {
+	return &openAPIBody{
+		Required: true,
+		Content: map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemaRef(schema)},
+		},
+	}
+}
+
+// jsonResponse returns the description of a response which body is a JSON object
+// matching the schema with the given name.
+func jsonResponse(description string, schema string) *openAPIResponse {
+	return &openAPIResponse{
+		Description: description,
+		Content: map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemaRef(schema)},
+		},
+	}
+}
+
+// csrfParameter returns the description of the query parameter logged in users can send
+// their CSRF token in, for requests which headers can't be set.
+func csrfParameter() *openAPIParameter {
+	return &openAPIParameter{
+		Name:        auth.CSRFParam,
+		In:          "query",
+		Description: "CSRF token of the logged in user, if it isn't sent in the " + auth.CSRFHeader + " header",
+		Schema:      map[string]string{"type": "string"},
+	}
+}
+
+// errorResponse returns the description of an error response.
+func errorResponse(description string) *openAPIResponse {
+	return jsonResponse(description, "Error")
+}
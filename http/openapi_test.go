@@ -0,0 +1,682 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/babolivier/scanner/auth"
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/history"
+	"github.com/babolivier/scanner/progress"
+	"github.com/babolivier/scanner/scanner"
+	"github.com/babolivier/scanner/spool"
+	"github.com/babolivier/scanner/webdav"
+	"github.com/babolivier/scanner/webhook"
+)
+
+// errUploadFailed is the error returned by fakeUploader when it's been told to fail.
+var errUploadFailed = errors.New("upload failed")
+
+// fakeUploader is a spool.Uploader which uploads succeed unless it's been told to fail,
+// in which case they fail permanently.
+type fakeUploader struct {
+	fail bool
+	mu   sync.Mutex
+}
+
+func (u *fakeUploader) setFail(fail bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.fail = fail
+}
+
+func (u *fakeUploader) Upload(
+	_ context.Context,
+	options *common.ScanOptions,
+	body io.Reader,
+) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return "", err
+	}
+
+	if u.fail {
+		return "", errUploadFailed
+	}
+
+	return path.Join(options.Folder, "scan."+options.Format), nil
+}
+
+func (u *fakeUploader) IsPermanent(err error) bool {
+	return err == errUploadFailed
+}
+
+// fakeWebDAVHandler is a stand-in WebDAV server with a single folder and a single file,
+// scan.pdf, in the upload path, in which folders can be created.
+func fakeWebDAVHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "PROPFIND":
+		self := strings.TrimSuffix(req.URL.Path, "/")
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:">
+<d:response><d:href>%[1]s/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>
+<d:response><d:href>%[1]s/invoices/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>
+<d:response><d:href>%[1]s/scan.pdf</d:href><d:propstat><d:prop><d:resourcetype/></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>
+</d:multistatus>`, self)
+	case "MKCOL":
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodHead:
+		if req.URL.Path != "/scans/scan.pdf" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// apiTestEnv is the JSON API served with fake storages and a scanner without any device,
+// along with some data to query it about.
+type apiTestEnv struct {
+	server   *httptest.Server
+	uploader *fakeUploader
+	spool    *spool.Spool
+	history  *history.Store
+}
+
+// newAPITestEnv returns a new apiTestEnv, authenticating requests with the given
+// configuration.
+func newAPITestEnv(t *testing.T, authCfg *config.AuthConfig) *apiTestEnv {
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	webDAVServer := httptest.NewServer(http.HandlerFunc(fakeWebDAVHandler))
+	t.Cleanup(webDAVServer.Close)
+	webDAVClient, err := webdav.NewClient(&config.WebDAVConfig{
+		WebDAVAccount: config.WebDAVAccount{RootURL: webDAVServer.URL, UploadPath: "scans"},
+		OnConflict:    config.ConflictReject,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := &apiTestEnv{uploader: new(fakeUploader)}
+
+	env.spool, err = spool.NewSpool(&config.SpoolConfig{
+		Dir:         filepath.Join(dir, "spool"),
+		MaxAttempts: 3,
+	}, env.uploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.history, err = history.NewStore(&config.HistoryConfig{
+		Path:          filepath.Join(dir, "history.db"),
+		ThumbnailSize: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { env.history.Close() })
+
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(webhookServer.Close)
+	notifier, err := webhook.NewNotifier(&config.WebhooksConfig{
+		Hooks: []*config.WebhookConfig{{
+			Name:   "test",
+			URL:    webhookServer.URL,
+			Events: []string{webhook.EventCompleted, webhook.EventFailed},
+		}},
+		MaxAttempts: 1,
+		Timeout:     time.Second,
+		LogSize:     10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker := progress.NewBroker()
+
+	// There's no such device, so previews and scans fail without touching any hardware.
+	s, err := scanner.NewScanner(
+		&config.ScannerConfig{DeviceName: "scanner-test:none", ScanTimeout: time.Second},
+		env.spool,
+		broker,
+		env.history,
+		notifier,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := auth.NewAuthenticator(authCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &handlers{
+		scanner:  s,
+		webdav:   webDAVClient,
+		spool:    env.spool,
+		progress: broker,
+		history:  env.history,
+		webhooks: notifier,
+		auth:     a,
+		presets:  map[string]*config.PresetConfig{},
+	}
+	env.server = httptest.NewServer(h.handler())
+	t.Cleanup(env.server.Close)
+
+	return env
+}
+
+// addFailedEntry adds an entry to the spool for the scan with the given job ID, which
+// upload failed.
+func (env *apiTestEnv) addFailedEntry(t *testing.T, job string) *spool.Entry {
+	env.uploader.setFail(true)
+	defer env.uploader.setFail(false)
+
+	e, f, err := env.spool.Create(&common.ScanOptions{
+		Format:       "pdf",
+		Job:          job,
+		Destinations: []string{common.DestinationWebDAV},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString("%PDF-1.4\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = env.spool.Submit(context.Background(), e); err != errUploadFailed {
+		t.Fatalf("Submit returned %v; want %v", err, errUploadFailed)
+	}
+
+	return e
+}
+
+// addRecord adds a scan requested by the given user, with a thumbnail, to the history,
+// and returns its record.
+func (env *apiTestEnv) addRecord(t *testing.T, user string) *history.Record {
+	var thumbnail bytes.Buffer
+	if err := jpeg.Encode(&thumbnail, image.NewGray(image.Rect(0, 0, 10, 10)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &history.Record{
+		Options: &common.ScanOptions{
+			Format:       "pdf",
+			Job:          "recorded",
+			Destinations: []string{common.DestinationWebDAV},
+			User:         user,
+		},
+		FileName:    "scan.pdf",
+		Uploads:     []*history.Upload{{Destination: common.DestinationWebDAV, FileName: "scan.pdf", Outcome: history.OutcomeUploaded}},
+		Size:        9,
+		Destination: common.DestinationWebDAV,
+		StartedAt:   time.Now(),
+		Duration:    1.5,
+		Outcome:     history.OutcomeUploaded,
+	}
+	if err := env.history.Add(r, thumbnail.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// openAPIDocument fetches the OpenAPI document served by the environment, and decodes it.
+func (env *apiTestEnv) openAPIDocument(t *testing.T) map[string]interface{} {
+	resp, err := http.Get(env.server.URL + openAPIPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var doc map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("Failed to decode the OpenAPI document: %v", err)
+	}
+
+	return doc
+}
+
+// apiTestCase is a request to an operation of the JSON API.
+type apiTestCase struct {
+	// operation is the path of the operation, as written in the OpenAPI document.
+	operation string
+	method    string
+	// path is the path to send the request to, relative to apiPrefix.
+	path       string
+	body       string
+	wantStatus int
+	// stream is true if the response is a stream of events which doesn't end on its own.
+	stream bool
+}
+
+func TestAPIMatchesOpenAPIDocument(t *testing.T) {
+	env := newAPITestEnv(t, &config.AuthConfig{})
+
+	record := env.addRecord(t, "")
+	env.addFailedEntry(t, "download")
+	env.addFailedEntry(t, "retry")
+	env.addFailedEntry(t, "retry-download")
+	discarded := env.addFailedEntry(t, "discard")
+	retried := env.addFailedEntry(t, "retry-spool")
+
+	tests := []apiTestCase{
+		{operation: "/scans", method: http.MethodPost, path: "/scans", body: `{`, wantStatus: http.StatusBadRequest},
+		{operation: "/scans", method: http.MethodPost, path: "/scans", body: `{"preset":"unknown"}`, wantStatus: http.StatusBadRequest},
+		{operation: "/scans", method: http.MethodPost, path: "/scans", body: `{"format":"pdf","quick":true}`, wantStatus: http.StatusConflict},
+		{
+			operation:  "/scans",
+			method:     http.MethodPost,
+			path:       "/scans",
+			body:       `{"format":"pdf","destinations":["email"],"email":{"to":["alice@example.com"]}}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{operation: "/scans", method: http.MethodGet, path: "/scans", wantStatus: http.StatusMethodNotAllowed},
+		{operation: "/preview", method: http.MethodGet, path: "/preview", wantStatus: http.StatusInternalServerError},
+		{operation: "/preview/last", method: http.MethodGet, path: "/preview/last", wantStatus: http.StatusNotFound},
+		{operation: "/preview/stream", method: http.MethodGet, path: "/preview/stream", wantStatus: http.StatusOK},
+		{operation: "/folders", method: http.MethodGet, path: "/folders", wantStatus: http.StatusOK},
+		{operation: "/folders", method: http.MethodGet, path: "/folders?path=invoices", wantStatus: http.StatusOK},
+		{operation: "/folders", method: http.MethodGet, path: "/folders?path=../etc", wantStatus: http.StatusBadRequest},
+		{operation: "/folders", method: http.MethodPost, path: "/folders", body: `{"path":"receipts"}`, wantStatus: http.StatusCreated},
+		{operation: "/folders", method: http.MethodPost, path: "/folders", body: `{"path":""}`, wantStatus: http.StatusConflict},
+		{operation: "/events", method: http.MethodGet, path: "/events", wantStatus: http.StatusOK, stream: true},
+		{operation: "/history", method: http.MethodGet, path: "/history", wantStatus: http.StatusOK},
+		{operation: "/history", method: http.MethodGet, path: "/history?outcome=partial", wantStatus: http.StatusOK},
+		{operation: "/history", method: http.MethodGet, path: "/history?limit=1&format=pdf", wantStatus: http.StatusOK},
+		{operation: "/history", method: http.MethodGet, path: "/history?outcome=lost", wantStatus: http.StatusBadRequest},
+		{operation: "/history", method: http.MethodGet, path: "/history?before=nope", wantStatus: http.StatusBadRequest},
+		{
+			operation:  "/history/{id}/thumb.jpg",
+			method:     http.MethodGet,
+			path:       "/history/" + record.ID + "/thumb.jpg",
+			wantStatus: http.StatusOK,
+		},
+		{operation: "/history/{id}/thumb.jpg", method: http.MethodGet, path: "/history/999/thumb.jpg", wantStatus: http.StatusNotFound},
+		{operation: "/jobs/{id}/file", method: http.MethodGet, path: "/jobs/download/file", wantStatus: http.StatusOK},
+		{operation: "/jobs/{id}/file", method: http.MethodGet, path: "/jobs/unknown/file", wantStatus: http.StatusNotFound},
+		{
+			operation:  "/jobs/{id}/retry-upload",
+			method:     http.MethodPost,
+			path:       "/jobs/retry/retry-upload",
+			body:       `{"folder":"../etc"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{operation: "/jobs/{id}/retry-upload", method: http.MethodPost, path: "/jobs/unknown/retry-upload", wantStatus: http.StatusNotFound},
+		{
+			operation:  "/jobs/{id}/retry-upload",
+			method:     http.MethodPost,
+			path:       "/jobs/retry/retry-upload",
+			body:       `{"folder":"","name":"scan"}`,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			operation:  "/jobs/{id}/retry-upload",
+			method:     http.MethodPost,
+			path:       "/jobs/retry/retry-upload",
+			body:       `{"send_to":"email"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			operation:  "/jobs/{id}/retry-upload",
+			method:     http.MethodPost,
+			path:       "/jobs/retry/retry-upload",
+			body:       `{"send_to":"email","email":{"to":["alice@example.com"]}}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			operation:  "/jobs/{id}/retry-upload",
+			method:     http.MethodPost,
+			path:       "/jobs/retry-download/retry-upload",
+			body:       `{"send_to":"download","name":"invoice"}`,
+			wantStatus: http.StatusOK,
+		},
+		{operation: "/jobs/{id}/file", method: http.MethodGet, path: "/jobs/retry-download/file", wantStatus: http.StatusNotFound},
+		{
+			operation:  "/jobs/{id}/retry-upload",
+			method:     http.MethodPost,
+			path:       "/jobs/retry/retry-upload",
+			body:       `{"folder":"invoices"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{operation: "/spool", method: http.MethodGet, path: "/spool", wantStatus: http.StatusOK},
+		{operation: "/spool/{id}", method: http.MethodDelete, path: "/spool/" + discarded.ID, wantStatus: http.StatusNoContent},
+		{operation: "/spool/{id}", method: http.MethodDelete, path: "/spool/unknown", wantStatus: http.StatusNotFound},
+		{operation: "/spool/{id}/retry", method: http.MethodPost, path: "/spool/" + retried.ID + "/retry", wantStatus: http.StatusAccepted},
+		{operation: "/spool/{id}/retry", method: http.MethodPost, path: "/spool/unknown/retry", wantStatus: http.StatusNotFound},
+		{operation: "/webhooks/deliveries", method: http.MethodGet, path: "/webhooks/deliveries", wantStatus: http.StatusOK},
+		{operation: "/webhooks/deliveries", method: http.MethodGet, path: "/webhooks/deliveries?status=delivered", wantStatus: http.StatusOK},
+		{operation: "/webhooks/deliveries", method: http.MethodGet, path: "/webhooks/deliveries?status=lost", wantStatus: http.StatusBadRequest},
+	}
+
+	doc := env.openAPIDocument(t)
+	v := &schemaValidator{schemas: doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})}
+	paths := doc["paths"].(map[string]interface{})
+
+	tested := make(map[string]bool)
+	for _, tt := range tests {
+		name := tt.method + " " + tt.path
+		t.Run(name, func(t *testing.T) {
+			operations, ok := paths[tt.operation].(map[string]interface{})
+			if !ok {
+				t.Fatalf("%s isn't documented", tt.operation)
+			}
+			op, ok := operations[strings.ToLower(tt.method)].(map[string]interface{})
+
+			status, header, body := env.do(t, tt)
+			if status != tt.wantStatus {
+				t.Errorf("got status %d; want %d (body: %s)", status, tt.wantStatus, body)
+			}
+
+			if !ok {
+				// Undocumented operations must be rejected.
+				if status != http.StatusMethodNotAllowed && status != http.StatusNotFound {
+					t.Errorf("undocumented operation got status %d", status)
+				}
+				return
+			}
+			tested[strings.ToLower(tt.method)+" "+tt.operation] = true
+
+			if err := v.validateResponse(op, status, header, body); err != nil {
+				t.Errorf("response doesn't match the OpenAPI document: %v", err)
+			}
+		})
+	}
+
+	// Every documented operation must have been exercised.
+	for p, operations := range paths {
+		for method := range operations.(map[string]interface{}) {
+			if !tested[method+" "+p] {
+				t.Errorf("%s %s isn't tested", strings.ToUpper(method), p)
+			}
+		}
+	}
+}
+
+// do sends the request described by the given test case, and returns the status, the
+// headers and the body of the response. The body of streams is what's been received in
+// a short amount of time.
+func (env *apiTestEnv) do(t *testing.T, tt apiTestCase) (int, http.Header, []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if tt.stream {
+		ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	}
+	defer cancel()
+
+	var body io.Reader
+	if tt.body != "" {
+		body = strings.NewReader(tt.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, tt.method, env.server.URL+apiPrefix+tt.path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tt.body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil && !(tt.stream && errors.Is(err, context.DeadlineExceeded)) {
+		t.Fatalf("Failed to read the response: %v", err)
+	}
+
+	return resp.StatusCode, resp.Header, raw
+}
+
+// schemaValidator checks that values decoded from JSON match schemas from an OpenAPI
+// document. It only supports the parts of the specification that the document uses.
+// Objects with a list of properties can't have properties that aren't in the list, so
+// fields that are added to responses without being documented are caught.
+type schemaValidator struct {
+	// schemas are the schemas from the components of the document, by name.
+	schemas map[string]interface{}
+}
+
+// validateResponse checks that the response with the given status, headers and body is
+// one the given operation can respond with.
+func (v *schemaValidator) validateResponse(
+	op map[string]interface{},
+	status int,
+	header http.Header,
+	body []byte,
+) error {
+	response, ok := op["responses"].(map[string]interface{})[strconv.Itoa(status)].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("undocumented status %d", status)
+	}
+
+	content, ok := response["content"].(map[string]interface{})
+	if !ok {
+		if len(body) != 0 {
+			return fmt.Errorf("got a body for a response without content: %s", body)
+		}
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("invalid content type %q: %v", header.Get("Content-Type"), err)
+	}
+	media, ok := content[mediaType].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("undocumented content type %s", mediaType)
+	}
+	schema := media["schema"]
+
+	switch mediaType {
+	case "application/json":
+		return v.validateJSON(schema, body)
+	case "text/event-stream":
+		return v.validateEvents(schema, body)
+	case "image/jpeg":
+		_, err = jpeg.Decode(bytes.NewReader(body))
+		return err
+	default:
+		if len(body) == 0 {
+			return errors.New("empty file")
+		}
+		return nil
+	}
+}
+
+// validateJSON checks that the given JSON document matches the given schema.
+func (v *schemaValidator) validateJSON(schema interface{}, raw []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return fmt.Errorf("invalid JSON %s: %v", raw, err)
+	}
+
+	return v.validate(schema, value, "body")
+}
+
+// validateEvents checks that the data of the server-sent events in the given stream
+// matches the given schema, or the Error schema for "error" events.
+func (v *schemaValidator) validateEvents(schema interface{}, raw []byte) error {
+	for _, block := range strings.Split(string(raw), "\n\n") {
+		event := ""
+		var data string
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		if data == "" {
+			continue
+		}
+
+		eventSchema := schema
+		if event == "error" {
+			eventSchema = map[string]interface{}{"$ref": "#/components/schemas/Error"}
+		}
+		if err := v.validateJSON(eventSchema, []byte(data)); err != nil {
+			return fmt.Errorf("%q event: %v", event, err)
+		}
+	}
+
+	return nil
+}
+
+// validate checks that the given value, found at the given location, matches the given
+// schema.
+func (v *schemaValidator) validate(schema interface{}, value interface{}, at string) error {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: invalid schema %v", at, schema)
+	}
+
+	if ref, ok := s["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		refSchema, ok := v.schemas[name]
+		if !ok {
+			return fmt.Errorf("%s: unknown schema %s", at, ref)
+		}
+		return v.validate(refSchema, value, at)
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v isn't one of %v", at, value, enum)
+		}
+	}
+
+	switch s["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v isn't an object", at, value)
+		}
+
+		if required, ok := s["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := obj[name.(string)]; !ok {
+					return fmt.Errorf("%s: missing required property %s", at, name)
+				}
+			}
+		}
+
+		properties, ok := s["properties"].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for name, propValue := range obj {
+			propSchema, ok := properties[name]
+			if !ok {
+				return fmt.Errorf("%s: undocumented property %s", at, name)
+			}
+			if err := v.validate(propSchema, propValue, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v isn't an array", at, value)
+		}
+
+		if minItems, ok := s["minItems"].(float64); ok && len(arr) < int(minItems) {
+			return fmt.Errorf("%s: got %d items; want at least %v", at, len(arr), minItems)
+		}
+
+		for i, item := range arr {
+			if err := v.validate(s["items"], item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: %v isn't a string", at, value)
+		}
+
+		if s["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return fmt.Errorf("%s: %q isn't a date-time", at, str)
+			}
+		}
+
+		if pattern, ok := s["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(str) {
+			return fmt.Errorf("%s: %q doesn't match %s", at, str, pattern)
+		}
+	case "integer", "number":
+		n, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: %v isn't a number", at, value)
+		}
+
+		f, err := n.Float64()
+		if err != nil {
+			return fmt.Errorf("%s: %v isn't a number", at, value)
+		}
+		if _, err = n.Int64(); s["type"] == "integer" && err != nil {
+			return fmt.Errorf("%s: %v isn't an integer", at, value)
+		}
+
+		if minimum, ok := s["minimum"].(float64); ok && f < minimum {
+			return fmt.Errorf("%s: %v is lower than %v", at, value, minimum)
+		}
+		if maximum, ok := s["maximum"].(float64); ok && f > maximum {
+			return fmt.Errorf("%s: %v is greater than %v", at, value, maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: %v isn't a boolean", at, value)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// eventStream sends server-sent events to a client.
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// newEventStream sends the headers of a stream of server-sent events with a 200 status,
+// and returns an eventStream to send events on it.
+// Returns false if the response writer doesn't support streaming.
+func newEventStream(w http.ResponseWriter) (*eventStream, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Tell nginx not to buffer the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return &eventStream{w: w, flusher: flusher}, true
+}
+
+// send sends an event of the given type, which data is the given value serialised as
+// JSON. If the type is empty, clients see it as a "message" event.
+func (s *eventStream) send(event string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if event != "" {
+		if _, err = fmt.Fprintf(s.w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+
+	if _, err = fmt.Fprintf(s.w, "data: %s\n\n", raw); err != nil {
+		return err
+	}
+
+	s.flusher.Flush()
+	return nil
+}
+
+// keepAlive sends a comment, which clients ignore, so proxies don't consider the
+// connection idle and close it.
+func (s *eventStream) keepAlive() error {
+	if _, err := fmt.Fprint(s.w, ": keep-alive\n\n"); err != nil {
+		return err
+	}
+
+	s.flusher.Flush()
+	return nil
+}
@@ -0,0 +1,34 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/babolivier/scanner/webhook"
+)
+
+// handleAPIWebhookDeliveries lists the most recent notifications sent to webhooks on
+// GET /api/v1/webhooks/deliveries, optionally filtered by webhook, job and status.
+func (h *handlers) handleAPIWebhookDeliveries(w http.ResponseWriter, req *http.Request) {
+	defer handlePanics(w)
+
+	if req.Method != http.MethodGet {
+		methodNotAllowed().writeJSON(w)
+		return
+	}
+
+	query := req.URL.Query()
+	f := &webhook.Filter{
+		Webhook: query.Get("webhook"),
+		Job:     query.Get("job"),
+		Status:  webhook.Status(query.Get("status")),
+	}
+
+	switch f.Status {
+	case "", webhook.StatusPending, webhook.StatusDelivered, webhook.StatusFailed:
+	default:
+		newAPIError(http.StatusBadRequest, codeBadRequest, "Invalid filter").writeJSON(w)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]webhook.Delivery{"deliveries": h.webhooks.Deliveries(f)})
+}
@@ -0,0 +1,116 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/babolivier/scanner/config"
+)
+
+const (
+	// RequestIDHeader is the header carrying the ID of a request, both in the requests
+	// clients send us, and in our responses and the requests we send to the WebDAV
+	// server.
+	RequestIDHeader = "X-Request-ID"
+
+	// timestampFormat is the format of the timestamps in the logs.
+	timestampFormat = "2006-01-02 15:04:05.999"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+)
+
+var (
+	// validRequestID matches the request IDs we accept from clients (or the reverse proxy
+	// in front of us), so they can't inject anything weird into the logs.
+	validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// Configure sets the level and format of the logs according to the given configuration.
+func Configure(cfg *config.LogConfig) error {
+	level, err := logrus.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+
+	logrus.SetLevel(level)
+
+	switch cfg.Format {
+	case config.LogFormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{
+			TimestampFormat: timestampFormat,
+			FullTimestamp:   true,
+		})
+	case config.LogFormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: timestampFormat,
+		})
+	default:
+		return fmt.Errorf("invalid log format %q", cfg.Format)
+	}
+
+	return nil
+}
+
+// WithRequestID returns a copy of the given context carrying the given request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the ID of the request the given context belongs to, or an empty
+// string if there's none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Entry returns a log entry for the given context, which includes the ID of the request
+// it belongs to, if any.
+func Entry(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	if id := RequestID(ctx); id != "" {
+		entry = entry.WithField("request_id", id)
+	}
+
+	return entry
+}
+
+// NewRequestID generates a random request ID.
+func NewRequestID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Middleware gives an ID to every request, which is made available to the next handler
+// through the request's context and sent back to the client in the response's headers.
+// The ID provided by the client is used if there's one and it looks sensible, so the
+// logs of a reverse proxy can be correlated with ours.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			var err error
+			if id, err = NewRequestID(); err != nil {
+				logrus.WithError(err).Error("Failed to generate request ID")
+				http.Error(w, "Something happened", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, req.WithContext(WithRequestID(req.Context(), id)))
+	})
+}
@@ -1,15 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"os"
 
 	"github.com/sirupsen/logrus"
 	"github.com/tjgq/sane"
 
+	"github.com/babolivier/scanner/auth"
+	"github.com/babolivier/scanner/common"
 	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/email"
+	"github.com/babolivier/scanner/history"
 	"github.com/babolivier/scanner/http"
+	"github.com/babolivier/scanner/logging"
+	"github.com/babolivier/scanner/progress"
 	"github.com/babolivier/scanner/scanner"
+	"github.com/babolivier/scanner/spool"
 	"github.com/babolivier/scanner/webdav"
+	"github.com/babolivier/scanner/webhook"
 )
 
 var (
@@ -20,25 +32,79 @@ func main() {
 	// Parse the command-line arguments.
 	flag.Parse()
 
-	// Configure the logger to log the full date.
-	logrus.SetFormatter(
-		&logrus.TextFormatter{
-			TimestampFormat: "2006-02-01 15:04:05.999",
-			FullTimestamp:   true,
-		},
-	)
-
 	// Parse the configuration file.
 	cfg, err := config.NewConfig(*cfgPath)
 	if err != nil {
 		panic(err)
 	}
 
+	// Configure the level and format of the logs.
+	if err = logging.Configure(cfg.Log); err != nil {
+		panic(err)
+	}
+
+	// Run the tokens subcommand instead of the server if it's been requested.
+	if flag.Arg(0) == "tokens" {
+		err = runTokensCommand(cfg.Auth, flag.Args()[1:])
+		if errors.Is(err, errTokensUsage) {
+			fmt.Fprint(os.Stderr, tokensUsage)
+			os.Exit(2)
+		} else if err != nil {
+			logrus.WithError(err).Fatal("Failed to manage API tokens")
+		}
+		return
+	}
+
 	// Instantiate the WebDAV client.
-	webDAVClient := webdav.NewClient(cfg.WebDAV)
+	webDAVClient, err := webdav.NewClient(cfg.WebDAV, cfg.Presets)
+	if err != nil {
+		panic(err)
+	}
+
+	// Instantiate the email client if sending scans by email has been configured.
+	uploaders := spool.Uploaders{common.DestinationWebDAV: webDAVClient}
+	var emailClient *email.Client
+	if cfg.SMTP != nil {
+		if emailClient, err = email.NewClient(cfg.SMTP, webDAVClient.LocalName); err != nil {
+			panic(err)
+		}
+		uploaders[common.DestinationEmail] = emailClient
+	}
+
+	// Instantiate the spool.
+	sp, err := spool.NewSpool(cfg.Spool, uploaders)
+	if err != nil {
+		panic(err)
+	}
+
+	// Instantiate the notifier, and notify webhooks of the uploads the spool eventually
+	// completes or gives up on. Then start uploading the files left in the spool by a
+	// previous run, if any.
+	notifier, err := webhook.NewNotifier(cfg.Webhooks)
+	if err != nil {
+		panic(err)
+	}
+	sp.OnDone(notifier.NotifySpooled)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go sp.Run(ctx)
+
+	// Open the history of scans.
+	hist, err := history.NewStore(cfg.History)
+	if err != nil {
+		panic(err)
+	}
+	defer hist.Close()
+
+	// Instantiate the broker the progress of scans is published to, and the scanner.
+	broker := progress.NewBroker()
+	s, err := scanner.NewScanner(cfg.Scanner, sp, broker, hist, notifier)
+	if err != nil {
+		panic(err)
+	}
 
-	// Instantiate the scanner.
-	s, err := scanner.NewScanner(cfg.Scanner, webDAVClient)
+	// Instantiate the authenticator.
+	a, err := auth.NewAuthenticator(cfg.Auth)
 	if err != nil {
 		panic(err)
 	}
@@ -47,7 +113,18 @@ func main() {
 	defer sane.Exit()
 
 	// Start the HTTP server.
-	if err = http.ListenAndServe(cfg.HTTP, s, webDAVClient); err != nil {
+	if err = http.ListenAndServe(
+		cfg.HTTP,
+		cfg.Presets,
+		s,
+		webDAVClient,
+		emailClient,
+		sp,
+		broker,
+		hist,
+		notifier,
+		a,
+	); err != nil {
 		panic(err)
 	}
 }
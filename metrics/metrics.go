@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	namespace = "scanner"
+)
+
+// Results of previews, scans and connection attempts, as used in the "result" label.
+const (
+	ResultSuccess    = "success"
+	ResultFailed     = "failed"
+	ResultBusy       = "busy"
+	ResultUploaded   = "uploaded"
+	ResultQueued     = "queued"
+	ResultDownloaded = "downloaded"
+	ResultPartial    = "partial"
+)
+
+const (
+	// FormatUnsupported is the value of the "format" label of scans which format isn't
+	// supported, so clients can't create as many label values as they want.
+	FormatUnsupported = "unsupported"
+	// MethodOther is the value of the "method" label of HTTP requests which method isn't
+	// a standard one, for the same reason.
+	MethodOther = "other"
+)
+
+var (
+	// Previews counts the previews, by result.
+	Previews = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "previews_total",
+		Help:      "Number of previews, by result.",
+	}, []string{"result"})
+
+	// Scans counts the scans, by format and result.
+	Scans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scans_total",
+		Help:      "Number of scans, by format and result.",
+	}, []string{"format", "result"})
+
+	// Uploads counts the attempts at sending the file of a scan to one of its
+	// destinations made while the requester waits, by destination and result.
+	Uploads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_total",
+		Help:      "Number of uploads of scanned files, by destination and result.",
+	}, []string{"destination", "result"})
+
+	// WebhookDeliveries counts the notifications sent to webhooks, by result.
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Number of notifications sent to webhooks, by result.",
+	}, []string{"result"})
+
+	// ScanDuration measures how long reading an image from the device takes, by
+	// resolution.
+	ScanDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scan_duration_seconds",
+		Help:      "Time spent reading images from the device, by resolution in DPI.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 8),
+	}, []string{"resolution"})
+
+	// EncodeDuration measures how long encoding a scanned image into a file takes, by
+	// format.
+	EncodeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "encode_duration_seconds",
+		Help:      "Time spent encoding scanned images into files, by format.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 8),
+	}, []string{"format"})
+
+	// OutputSize measures the size of the files scanned images are encoded into, by
+	// format.
+	OutputSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "output_size_bytes",
+		Help:      "Size of the files scanned images are encoded into, by format.",
+		Buckets:   prometheus.ExponentialBuckets(64<<10, 2, 10),
+	}, []string{"format"})
+
+	// DeviceBusy counts the previews and scans rejected because the device was in use, by
+	// operation (either "preview" or "scan").
+	DeviceBusy = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "device_busy_total",
+		Help:      "Number of previews and scans rejected because the device was in use.",
+	}, []string{"operation"})
+
+	// DeviceConnections counts the attempts at opening a connection to the device, by
+	// result.
+	DeviceConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "device_connections_total",
+		Help:      "Number of attempts at connecting to the device, by result.",
+	}, []string{"result"})
+
+	// WebDAVRequestDuration measures the latency of the requests sent to the WebDAV
+	// server, by method and status code. The code is "error" if no response was received.
+	WebDAVRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "webdav_request_duration_seconds",
+		Help:      "Latency of the requests sent to the WebDAV server, by method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	// HTTPRequestDuration measures the time spent handling HTTP requests, by handler,
+	// method and status code.
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time spent handling HTTP requests, by handler, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler", "method", "code"})
+)
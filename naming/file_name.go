@@ -0,0 +1,130 @@
+package naming
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxFileNameLength is the maximum length of a file name, in bytes. Most file systems
+	// limit names to 255 bytes, so we keep some room for the extension and for a
+	// numbered suffix.
+	MaxFileNameLength = 200
+
+	// maxSegmentLength is the maximum length of a path segment, in bytes, including any
+	// extension or suffix.
+	maxSegmentLength = 255
+
+	// reservedChars are characters that can't be used in file names on some platforms
+	// files might eventually get synced to.
+	reservedChars = `<>:"|?*`
+)
+
+var (
+	// ErrInvalidFileName is the error wrapped by all errors returned when validating a
+	// file name.
+	ErrInvalidFileName = errors.New("invalid file name")
+
+	// reservedNames are names that can't be used as file names on Windows, regardless of
+	// their extension.
+	reservedNames = map[string]bool{
+		"CON": true, "PRN": true, "AUX": true, "NUL": true,
+		"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+		"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+		"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+		"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+	}
+)
+
+// FileName is a file name (without its extension) that has been normalized and
+// validated, and is therefore safe to use as a single path segment.
+type FileName string
+
+// NewFileName normalizes the given raw file name and checks that it's valid.
+// Normalizing a name means trimming the white spaces surrounding it, as well as any
+// trailing dot. A name is valid if it's not empty, doesn't exceed MaxFileNameLength,
+// is valid UTF-8, doesn't start with a dot, doesn't contain any path separator, control
+// or reserved character, and isn't a reserved name.
+// Returns an error wrapping ErrInvalidFileName if the name isn't valid.
+func NewFileName(raw string) (FileName, error) {
+	name := strings.TrimSpace(raw)
+	name = strings.TrimRight(name, ". ")
+
+	if err := checkSegment(name, MaxFileNameLength); err != nil {
+		return "", err
+	}
+
+	return FileName(name), nil
+}
+
+// CheckPath checks that every segment of the given slash-separated relative path is a
+// valid file name, without normalizing it. Segments can be up to 255 bytes long, so they
+// can include an extension and a suffix on top of a name. An empty path is valid.
+// Returns an error wrapping ErrInvalidFileName if the path isn't valid.
+func CheckPath(p string) error {
+	if p == "" {
+		return nil
+	}
+
+	for _, segment := range strings.Split(p, "/") {
+		if err := checkSegment(segment, maxSegmentLength); err != nil {
+			return err
+		}
+
+		// Normalization would change this segment, which means it has surrounding white
+		// spaces or trailing dots, so we consider it invalid.
+		if strings.TrimRight(strings.TrimSpace(segment), ". ") != segment {
+			return invalid("has surrounding spaces or trailing dots")
+		}
+	}
+
+	return nil
+}
+
+// checkSegment checks that the given string can be used as a single path segment, and
+// that it's no longer than the given length in bytes.
+func checkSegment(s string, maxLength int) error {
+	if s == "" {
+		return invalid("is empty")
+	}
+
+	if len(s) > maxLength {
+		return invalid("is too long")
+	}
+
+	if !utf8.ValidString(s) {
+		return invalid("isn't valid UTF-8")
+	}
+
+	// This also rejects "." and "..".
+	if strings.HasPrefix(s, ".") {
+		return invalid("starts with a dot")
+	}
+
+	for _, r := range s {
+		switch {
+		case r == '/' || r == '\\':
+			return invalid("contains a path separator")
+		case unicode.IsControl(r):
+			return invalid("contains a control character")
+		case strings.ContainsRune(reservedChars, r):
+			return invalid(fmt.Sprintf("contains the reserved character %q", r))
+		}
+	}
+
+	// Reserved names are also reserved when followed by an extension.
+	base := strings.ToUpper(strings.SplitN(s, ".", 2)[0])
+	if reservedNames[strings.TrimSpace(base)] {
+		return invalid("is a reserved name")
+	}
+
+	return nil
+}
+
+// invalid returns an error wrapping ErrInvalidFileName with the given reason.
+func invalid(reason string) error {
+	return fmt.Errorf("%w: name %s", ErrInvalidFileName, reason)
+}
@@ -0,0 +1,124 @@
+package naming
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNewFileName(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    FileName
+		wantErr bool
+	}{
+		{name: "simple", raw: "invoice", want: "invoice"},
+		{name: "spaces inside", raw: "tax return 2023", want: "tax return 2023"},
+		{name: "surrounding spaces", raw: "  invoice  ", want: "invoice"},
+		{name: "trailing dots", raw: "invoice...", want: "invoice"},
+		{name: "inner dot", raw: "invoice.v2", want: "invoice.v2"},
+		{name: "accents", raw: "relevé de compte", want: "relevé de compte"},
+		{name: "max length", raw: strings.Repeat("a", MaxFileNameLength), want: FileName(strings.Repeat("a", MaxFileNameLength))},
+
+		// Unicode lookalikes of separators and dots are plain characters to WebDAV
+		// servers, so they can't be used to escape the folder, and are kept as is.
+		{name: "division slash", raw: "a\u2215b", want: "a\u2215b"},
+		{name: "fullwidth solidus", raw: "a\uff0fb", want: "a\uff0fb"},
+		{name: "fullwidth reverse solidus", raw: "a\uff3cb", want: "a\uff3cb"},
+		{name: "one dot leader", raw: "\u2024\u2024", want: "\u2024\u2024"},
+		{name: "fullwidth full stops", raw: "\uff0e\uff0e", want: "\uff0e\uff0e"},
+
+		{name: "empty", raw: "", wantErr: true},
+		{name: "only spaces", raw: "   ", wantErr: true},
+		{name: "only dots", raw: "...", wantErr: true},
+		{name: "dot dot", raw: "..", wantErr: true},
+		{name: "dot dot slash", raw: "../invoice", wantErr: true},
+		{name: "hidden", raw: ".invoice", wantErr: true},
+		{name: "absolute", raw: "/etc/passwd", wantErr: true},
+		{name: "slash", raw: "a/b", wantErr: true},
+		{name: "backslash", raw: `a\b`, wantErr: true},
+		{name: "backslash dot dot", raw: `..\invoice`, wantErr: true},
+		{name: "windows absolute", raw: `C:\invoice`, wantErr: true},
+		{name: "less than", raw: "a<b", wantErr: true},
+		{name: "greater than", raw: "a>b", wantErr: true},
+		{name: "colon", raw: "a:b", wantErr: true},
+		{name: "double quote", raw: `a"b`, wantErr: true},
+		{name: "pipe", raw: "a|b", wantErr: true},
+		{name: "question mark", raw: "a?b", wantErr: true},
+		{name: "asterisk", raw: "a*b", wantErr: true},
+		{name: "null byte", raw: "a\x00b", wantErr: true},
+		{name: "new line", raw: "a\nb", wantErr: true},
+		{name: "tab", raw: "a\tb", wantErr: true},
+		{name: "delete", raw: "a\x7fb", wantErr: true},
+		{name: "C1 control", raw: "a\u0085b", wantErr: true},
+		{name: "invalid UTF-8", raw: "a\xffb", wantErr: true},
+		{name: "reserved name", raw: "CON", wantErr: true},
+		{name: "reserved name lower case", raw: "nul", wantErr: true},
+		{name: "reserved name with extension", raw: "com1.tar", wantErr: true},
+		{name: "too long", raw: strings.Repeat("a", MaxFileNameLength+1), wantErr: true},
+		{name: "too long multi-byte", raw: strings.Repeat("é", MaxFileNameLength/2+1), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewFileName(tt.raw)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidFileName) {
+					t.Fatalf("NewFileName(%q) = %q, %v; want an error wrapping ErrInvalidFileName", tt.raw, got, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("NewFileName(%q) returned an error: %v", tt.raw, err)
+			}
+			if got != tt.want {
+				t.Errorf("NewFileName(%q) = %q; want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "empty", path: ""},
+		{name: "single segment", path: "invoice.pdf"},
+		{name: "nested", path: "2023/bills/invoice.pdf"},
+		{name: "suffix", path: "bills/invoice (2).pdf"},
+		{name: "max segment length", path: strings.Repeat("a", maxSegmentLength)},
+		{name: "lookalike separator", path: "a\u2215..\u2215b.pdf"},
+
+		{name: "absolute", path: "/invoice.pdf", wantErr: true},
+		{name: "trailing slash", path: "bills/", wantErr: true},
+		{name: "empty segment", path: "bills//invoice.pdf", wantErr: true},
+		{name: "dot", path: "./invoice.pdf", wantErr: true},
+		{name: "dot dot", path: "..", wantErr: true},
+		{name: "dot dot prefix", path: "../invoice.pdf", wantErr: true},
+		{name: "dot dot inside", path: "bills/../../invoice.pdf", wantErr: true},
+		{name: "backslash", path: `bills\invoice.pdf`, wantErr: true},
+		{name: "backslash dot dot", path: `bills/..\..\invoice.pdf`, wantErr: true},
+		{name: "reserved character", path: "bills/15:04.pdf", wantErr: true},
+		{name: "control character", path: "bills/a\rb.pdf", wantErr: true},
+		{name: "reserved name", path: "aux/invoice.pdf", wantErr: true},
+		{name: "surrounding spaces", path: "bills/ invoice.pdf", wantErr: true},
+		{name: "trailing dot", path: "bills./invoice.pdf", wantErr: true},
+		{name: "segment too long", path: "bills/" + strings.Repeat("a", maxSegmentLength+1), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckPath(tt.path)
+			if tt.wantErr && !errors.Is(err, ErrInvalidFileName) {
+				t.Errorf("CheckPath(%q) = %v; want an error wrapping ErrInvalidFileName", tt.path, err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("CheckPath(%q) returned an error: %v", tt.path, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package naming
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Sanitize turns the given string into something that's safe to use as a single path
+// segment, by replacing path separators, control and reserved characters with
+// underscores, trimming leading and trailing dots and spaces, and truncating it so it
+// doesn't exceed MaxFileNameLength.
+func Sanitize(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) || strings.ContainsRune(reservedChars, r) {
+			return '_'
+		}
+		return r
+	}, s)
+
+	if len(s) > MaxFileNameLength {
+		// Don't leave a partial UTF-8 sequence at the end of the string.
+		s = strings.ToValidUTF8(s[:MaxFileNameLength], "")
+	}
+
+	// Trimming dots also takes care of "." and "..".
+	s = strings.Trim(s, ". ")
+	if s == "" {
+		return "_"
+	}
+
+	// Make sure the result doesn't start with a reserved name.
+	if reservedNames[strings.ToUpper(strings.SplitN(s, ".", 2)[0])] {
+		s = "_" + s
+	}
+
+	return s
+}
+
+// WithSuffix appends a numbered suffix to the given file name (without its extension),
+// e.g. "name" becomes "name (2)".
+func WithSuffix(name string, n int) string {
+	return fmt.Sprintf("%s (%d)", name, n)
+}
@@ -0,0 +1,155 @@
+package naming
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTemplate is the template used to name files when none has been configured.
+	// It names files using the time at which they've been uploaded.
+	DefaultTemplate = "{date:2006-01-02_15-04-05}"
+
+	defaultDateLayout = "2006-01-02_15-04-05"
+)
+
+var (
+	ErrUnclosedPlaceholder = errors.New("unclosed placeholder")
+	ErrUnknownPlaceholder  = errors.New("unknown placeholder")
+	ErrMalformedCounter    = errors.New("malformed counter width")
+)
+
+// Fields holds the values that can be substituted into a template's placeholders.
+type Fields struct {
+	Time   time.Time
+	Device string
+	Preset string
+	Pages  int
+	User   string
+}
+
+// part is a piece of a template. It's either a literal string, or a placeholder with an
+// optional argument.
+type part struct {
+	literal     string
+	placeholder string
+	arg         string
+}
+
+// Template is a parsed file name template. Templates are strings in which placeholders
+// such as {date:2006/01}, {device}, {preset}, {pages}, {user} or {counter:04} get
+// replaced with values from the scan being processed.
+type Template struct {
+	parts      []part
+	hasCounter bool
+}
+
+// NewTemplate parses the given raw template, and checks that it renders valid paths.
+// Returns ErrUnclosedPlaceholder if a placeholder isn't closed, ErrUnknownPlaceholder if
+// a placeholder isn't among the supported ones, ErrMalformedCounter if the width of a
+// counter isn't a positive number, or an error wrapping ErrInvalidFileName if rendering
+// the template doesn't produce a valid path, e.g. because the layout of a date includes
+// a reserved character.
+func NewTemplate(raw string) (*Template, error) {
+	t := new(Template)
+
+	for raw != "" {
+		// Everything until the next opening brace is a literal.
+		start := strings.IndexByte(raw, '{')
+		if start == -1 {
+			t.parts = append(t.parts, part{literal: raw})
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, part{literal: raw[:start]})
+		}
+
+		end := strings.IndexByte(raw[start:], '}')
+		if end == -1 {
+			return nil, ErrUnclosedPlaceholder
+		}
+
+		// Split the placeholder into its name and its argument, if any.
+		p := part{placeholder: raw[start+1 : start+end]}
+		if i := strings.IndexByte(p.placeholder, ':'); i != -1 {
+			p.arg = p.placeholder[i+1:]
+			p.placeholder = p.placeholder[:i]
+		}
+
+		switch p.placeholder {
+		case "date", "device", "preset", "pages", "user":
+		case "counter":
+			if p.arg != "" {
+				if width, err := strconv.Atoi(p.arg); err != nil || width <= 0 {
+					return nil, ErrMalformedCounter
+				}
+			}
+			t.hasCounter = true
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnknownPlaceholder, p.placeholder)
+		}
+
+		t.parts = append(t.parts, p)
+		raw = raw[start+end+1:]
+	}
+
+	// Values from fields are sanitized when rendering the template, so if a sample
+	// rendering is valid, every rendering is.
+	sample := t.Execute(&Fields{
+		Time:   time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC),
+		Device: "device",
+		Preset: "preset",
+		Pages:  1,
+		User:   "user",
+	}, 1)
+	if err := CheckPath(sample); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// HasCounter returns whether the template contains a {counter} placeholder, in which
+// case the caller is expected to look for the lowest counter value that doesn't clash
+// with an existing file.
+func (t *Template) HasCounter() bool {
+	return t.hasCounter
+}
+
+// Execute renders the template using the given fields and counter value. Values coming
+// from fields are sanitized so they can't introduce path separators or other unwanted
+// characters. The only separators that can appear in the result come from the template
+// itself or from the layout of a date placeholder.
+func (t *Template) Execute(f *Fields, counter int) string {
+	var b strings.Builder
+
+	for _, p := range t.parts {
+		switch p.placeholder {
+		case "":
+			b.WriteString(p.literal)
+		case "date":
+			layout := p.arg
+			if layout == "" {
+				layout = defaultDateLayout
+			}
+			b.WriteString(f.Time.Format(layout))
+		case "device":
+			b.WriteString(Sanitize(f.Device))
+		case "preset":
+			b.WriteString(Sanitize(f.Preset))
+		case "pages":
+			b.WriteString(strconv.Itoa(f.Pages))
+		case "user":
+			b.WriteString(Sanitize(f.User))
+		case "counter":
+			// The width has already been validated when parsing the template.
+			width, _ := strconv.Atoi(p.arg)
+			b.WriteString(fmt.Sprintf("%0*d", width, counter))
+		}
+	}
+
+	return b.String()
+}
@@ -55,36 +55,39 @@ func Encode(w io.Writer, img image.Image, jpegEncodeOptions *jpeg.Options) error
 // resizeImageForPage resizes the given image if this image is too large for the given
 // page size, while preserving its aspect ratio.
 func resizeImageForPage(img image.Image, pageSize *gopdf.Rect) image.Image {
+	// Calculate the dimensions of the page in pixels.
+	return FitImage(img, pageSize.W*ptToPx, pageSize.H*ptToPx)
+}
+
+// FitImage resizes the given image if it's larger than the given dimensions, in pixels,
+// so it fits within them while preserving its aspect ratio.
+func FitImage(img image.Image, maxWidth float64, maxHeight float64) image.Image {
 	// Get the dimensions of the current image.
 	width := float64(img.Bounds().Dx())
 	height := float64(img.Bounds().Dy())
 
-	// Calculate the dimensions of the page in pixels.
-	pageWidth := pageSize.W * ptToPx
-	pageHeight := pageSize.H * ptToPx
-
-	// Check if the image is too large for the page.
+	// Check if the image is too large.
 	var tooWide, tooHigh bool
-	if width > pageWidth {
+	if width > maxWidth {
 		tooWide = true
 	}
-	if height > pageHeight {
+	if height > maxHeight {
 		tooHigh = true
 	}
 
-	// If the image is both too wide and too high for the page, pick the largest
-	// dimension and use it as the reference when resizing, so the image takes as much
-	// space as possible in the document.
+	// If the image is both too wide and too high, use the dimension that needs to shrink
+	// the most as the reference when resizing, so the image takes as much space as
+	// possible while still fitting.
 	if tooWide && tooHigh {
-		tooWide = width > height
-		tooHigh = height > width
+		tooWide = width/maxWidth > height/maxHeight
+		tooHigh = !tooWide
 	}
 
 	// Resize the image if needed.
 	if tooWide {
-		return resize.Resize(uint(pageWidth), 0, img, resize.Lanczos3)
+		return resize.Resize(uint(maxWidth), 0, img, resize.Lanczos3)
 	} else if tooHigh {
-		return resize.Resize(0, uint(pageHeight), img, resize.Lanczos3)
+		return resize.Resize(0, uint(maxHeight), img, resize.Lanczos3)
 	}
 
 	// If no resize was needed, just return the original image.
@@ -0,0 +1,34 @@
+package pdf
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFitImage(t *testing.T) {
+	tests := []struct {
+		name                string
+		width, height       int
+		maxWidth, maxHeight float64
+		wantW, wantH        int
+	}{
+		{name: "fits", width: 100, height: 50, maxWidth: 200, maxHeight: 200, wantW: 100, wantH: 50},
+		{name: "too wide", width: 400, height: 100, maxWidth: 200, maxHeight: 200, wantW: 200, wantH: 50},
+		{name: "too high", width: 100, height: 400, maxWidth: 200, maxHeight: 200, wantW: 50, wantH: 200},
+		{name: "square", width: 400, height: 400, maxWidth: 200, maxHeight: 200, wantW: 200, wantH: 200},
+		// The image is higher than wide, but it's its width that needs to shrink the most
+		// to fit in a page of this shape.
+		{name: "portrait on a portrait page", width: 1300, height: 1800, maxWidth: 1240, maxHeight: 1754, wantW: 1240, wantH: 1717},
+		{name: "landscape in a wide box", width: 300, height: 200, maxWidth: 100, maxHeight: 50, wantW: 75, wantH: 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := FitImage(image.NewGray(image.Rect(0, 0, tt.width, tt.height)), tt.maxWidth, tt.maxHeight)
+
+			if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != tt.wantW || h != tt.wantH {
+				t.Errorf("got a %dx%d image; want %dx%d", w, h, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package progress
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// subscriberBuffer is the number of events a subscriber can lag behind before events
+	// start being dropped for it.
+	subscriberBuffer = 64
+)
+
+// Phase is a step in the processing of a scan.
+type Phase string
+
+const (
+	// PhaseWaiting means the scan is waiting for the device to be ready.
+	PhaseWaiting Phase = "waiting"
+	// PhaseScanning means the device is scanning the document.
+	PhaseScanning Phase = "scanning"
+	// PhaseEncoding means the scanned image is being encoded into a file.
+	PhaseEncoding Phase = "encoding"
+	// PhaseUploading means the file is being uploaded to the storage.
+	PhaseUploading Phase = "uploading"
+	// PhaseUploaded means the file has been uploaded, which ends the scan.
+	PhaseUploaded Phase = "uploaded"
+	// PhaseQueued means the file couldn't be uploaded, and will be uploaded later, which
+	// ends the scan.
+	PhaseQueued Phase = "queued"
+	// PhaseReady means the file is being sent back to the requester, which ends the scan
+	// if it isn't also uploaded.
+	PhaseReady Phase = "ready"
+	// PhaseFailed means the scan failed, which ends it.
+	PhaseFailed Phase = "failed"
+)
+
+// Event describes the progress of a scan.
+type Event struct {
+	// Job is the identifier of the scan.
+	Job   string `json:"job"`
+	Phase Phase  `json:"phase"`
+	// Destination is the destination the file is being uploaded to, as one of the
+	// common.Destination* constants. It's only set while uploading, since the file can be
+	// uploaded to several destinations at once.
+	Destination string `json:"destination,omitempty"`
+	// Percent is the progress of the current phase, if it's known. It's only set while
+	// scanning and uploading.
+	Percent int `json:"percent"`
+	// BytesSent and BytesTotal are the number of bytes of the file that have been
+	// uploaded, and its size. They're only set while uploading.
+	BytesSent  int64 `json:"bytes_sent,omitempty"`
+	BytesTotal int64 `json:"bytes_total,omitempty"`
+	// FileName is the path of the uploaded file, relative to the upload path. It's only
+	// set once the file has been uploaded.
+	FileName string `json:"file_name,omitempty"`
+	// Error describes why the scan failed.
+	Error string `json:"error,omitempty"`
+	// User is the user who requested the scan. Only their subscriptions receive the
+	// event.
+	User string `json:"-"`
+}
+
+// Broker dispatches the events published while processing scans to the subscribers
+// interested in them.
+type Broker struct {
+	// subscribers maps the channel of each subscriber to the user it's been opened for.
+	subscribers map[chan Event]string
+	mu          sync.Mutex
+}
+
+// NewBroker returns a new Broker with no subscribers.
+func NewBroker() *Broker {
+	return &Broker{
+		subscribers: make(map[chan Event]string),
+	}
+}
+
+// Subscribe returns a channel receiving the events of the scans requested by the given
+// user, along with a function to call once the events are no longer needed. Events are
+// dropped for subscribers that don't read them fast enough, rather than slowing down the
+// scans.
+func (b *Broker) Subscribe(user string) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subscribers[ch] = user
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, unsubscribe
+}
+
+// Publish sends the given event to the subscribers for the user who requested the scan.
+// It's a no-op if the Broker is nil, so callers don't need to check whether anyone could
+// be listening.
+func (b *Broker) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch, user := range b.subscribers {
+		if user != e.User {
+			continue
+		}
+
+		select {
+		case ch <- e:
+		default:
+			logrus.WithField("job", e.Job).Debug("Dropping progress event for slow subscriber")
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// The labels of the outcomes of scans.
+const outcomeLabels = {
+    uploaded: "Envoyée",
+    queued: "En attente d'envoi",
+    failed: "Échec",
+    downloaded: "Téléchargée",
+    partial: "Envoi partiel",
+};
+
+// The name of the cookie holding the CSRF token, which must be sent along with the
+// requests that have side effects.
+const csrfCookieName = "scanner_csrf";
+
+// The cursor to get the next page of the history with, if there's one.
+let nextCursor = "";
+
+function checkAuth(response) {
+    // If the session has expired, send the user back to the login page.
+    if (response.status === 401) {
+        window.location.href = "/login.html";
+    }
+
+    return response;
+}
+
+function csrfHeaders() {
+    // Read the CSRF token from its cookie, and return the headers to send it in.
+    const cookie = document.cookie
+        .split("; ")
+        .find(c => c.startsWith(`${csrfCookieName}=`));
+
+    if (!cookie) {
+        return {};
+    }
+
+    return {"X-CSRF-Token": decodeURIComponent(cookie.substring(csrfCookieName.length + 1))};
+}
+
+function retryUpload(record, button) {
+    // Upload the file of the given scan again, to the same destination, and reload the
+    // history to show how it went.
+    button.disabled = true;
+
+    fetch(`/api/v1/jobs/${encodeURIComponent(record.options.Job)}/retry-upload`, {
+        method: "POST",
+        headers: csrfHeaders(),
+    })
+        .then(checkAuth)
+        .then(response => {
+            if (response.status !== 201 && response.status !== 202) {
+                throw new Error(`Unexpected status ${response.status}`);
+            }
+
+            loadHistory(true);
+        })
+        .catch(err => {
+            button.disabled = false;
+            document.querySelector("#history-err").classList.remove("d-none");
+            console.error(err);
+        });
+}
+
+function formatBytes(n) {
+    // Format the given number of bytes in megabytes, the way French speakers do.
+    return `${(n / 1000000).toLocaleString("fr-FR", {maximumFractionDigits: 1})} Mo`;
+}
+
+function cell(row, content) {
+    // Append a cell with the given text or element to the given row.
+    const td = row.insertCell();
+    if (content instanceof Node) {
+        td.appendChild(content);
+    } else {
+        td.innerText = content;
+    }
+    return td;
+}
+
+function showRecord(record) {
+    const row = document.querySelector("#history-records").insertRow();
+
+    // Show the thumbnail of the scan if it hasn't been removed yet.
+    if (record.thumbnail_url) {
+        const thumbnail = document.createElement("img");
+        thumbnail.src = record.thumbnail_url;
+        thumbnail.alt = record.file_name || "";
+        thumbnail.loading = "lazy";
+        thumbnail.classList.add("history-thumbnail");
+        cell(row, thumbnail);
+    } else {
+        cell(row, "");
+    }
+
+    cell(row, new Date(record.started_at).toLocaleString("fr-FR"));
+    cell(row, record.options.User || "");
+
+    // Link to the file on the storage if it's been uploaded.
+    if (record.url) {
+        const link = document.createElement("a");
+        link.href = record.url;
+        link.target = "_blank";
+        link.rel = "noopener";
+        link.innerText = record.file_name;
+        cell(row, link);
+    } else {
+        cell(row, record.file_name || "");
+    }
+
+    cell(row, record.options.Format.toUpperCase());
+    cell(row, record.size ? formatBytes(record.size) : "");
+    cell(row, `${record.duration.toLocaleString("fr-FR", {maximumFractionDigits: 1})} s`);
+
+    const outcome = cell(row, outcomeLabels[record.outcome] || record.outcome);
+    if (record.error) {
+        outcome.title = record.error;
+        outcome.classList.add("err");
+    }
+    // If the file had several destinations, tell how sending it to each of them went.
+    if (record.uploads && record.uploads.length > 1) {
+        outcome.title = record.uploads
+            .map(u => `${u.destination} : ${outcomeLabels[u.outcome] || u.outcome}` + (u.error ? ` (${u.error})` : ""))
+            .join("\n");
+    }
+
+    // If the upload failed and the file is still kept, offer to download it or to upload
+    // it again.
+    if (record.download_url) {
+        const download = document.createElement("a");
+        download.href = record.download_url;
+        download.innerText = "Télécharger";
+        download.classList.add("btn", "btn-sm", "btn-secondary", "history-action");
+
+        const retry = document.createElement("button");
+        retry.innerText = "Réessayer";
+        retry.classList.add("btn", "btn-sm", "btn-primary", "history-action");
+        retry.onclick = () => retryUpload(record, retry);
+
+        outcome.append(download, retry);
+    }
+}
+
+function loadHistory(reset) {
+    const records = document.querySelector("#history-records");
+    const empty = document.querySelector("#history-empty");
+    const errMsg = document.querySelector("#history-err");
+    const more = document.querySelector("#history-more");
+
+    if (reset) {
+        records.innerHTML = "";
+        nextCursor = "";
+    }
+
+    errMsg.classList.add("d-none");
+    empty.classList.add("d-none");
+    more.classList.add("d-none");
+
+    const query = new URLSearchParams();
+    for (const [name, id] of [["outcome", "#history-outcome"], ["format", "#history-format"]]) {
+        const value = document.querySelector(id).value;
+        if (value) {
+            query.set(name, value);
+        }
+    }
+    if (nextCursor) {
+        query.set("before", nextCursor);
+    }
+
+    fetch(`/api/v1/history?${query}`)
+        .then(checkAuth)
+        .then(response => {
+            if (response.status !== 200) {
+                throw new Error(`Unexpected status ${response.status}`);
+            }
+
+            return response.json();
+        })
+        .then(page => {
+            page.records.forEach(showRecord);
+
+            if (records.rows.length === 0) {
+                empty.classList.remove("d-none");
+            }
+
+            // Offer to load the next page if there's one.
+            nextCursor = page.next || "";
+            if (nextCursor) {
+                more.classList.remove("d-none");
+            }
+        })
+        .catch(err => {
+            // Show an user-readable error and log what actually went wrong.
+            errMsg.classList.remove("d-none");
+            console.error(err);
+        });
+}
+
+// Register the event handlers.
+document.querySelector("#history-outcome").onchange = () => loadHistory(true);
+document.querySelector("#history-format").onchange = () => loadHistory(true);
+document.querySelector("#history-more").onclick = () => loadHistory(false);
+
+// Show the most recent scans.
+loadHistory(true);
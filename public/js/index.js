@@ -1,4 +1,87 @@
-const offlineMsg = "Pas de connexion";
+// The name of the cookie holding the CSRF token, which must be sent along with the
+// requests that have side effects.
+const csrfCookieName = "scanner_csrf";
+
+// The path of the folder to store scans in, relative to the upload path.
+let currentFolder = "";
+
+// The names of the destinations scans can be uploaded to, as shown to users.
+const destinationNames = {
+    webdav: "le stockage",
+    email: "l'e-mail",
+};
+
+function csrfToken() {
+    // Read the CSRF token from its cookie, if there's one.
+    const cookie = document.cookie
+        .split("; ")
+        .find(c => c.startsWith(`${csrfCookieName}=`));
+
+    if (!cookie) {
+        return "";
+    }
+
+    return decodeURIComponent(cookie.substring(csrfCookieName.length + 1));
+}
+
+function csrfHeaders() {
+    // Return the headers to send the CSRF token in.
+    const token = csrfToken();
+    return token ? {"X-CSRF-Token": token} : {};
+}
+
+function checkAuth(response) {
+    // If the session has expired, send the user back to the login page.
+    if (response.status === 401) {
+        window.location.href = "/login.html";
+    }
+
+    return response;
+}
+
+function logout() {
+    fetch("/auth/logout", {method: "POST", headers: csrfHeaders()})
+        .then(() => window.location.href = "/login.html")
+        .catch(console.error);
+}
+
+function showPreviewDate(date) {
+    // Show when the preview on the screen was taken, and offer to export it.
+    const container = document.querySelector("#preview-date");
+    container.querySelector("span").innerText = date.toLocaleString("fr-FR");
+    container.classList.remove("d-none");
+    document.querySelector("#scan-quick").classList.remove("d-none");
+}
+
+function getLastPreview() {
+    // Show the last preview that was taken, if any, so users don't need to take a new
+    // one if what's on the plate hasn't changed.
+    const img = document.querySelector("#preview-img");
+
+    fetch("/preview/last.jpg")
+        .then(checkAuth)
+        .then(response => {
+            if (response.status !== 200) {
+                return;
+            }
+
+            const takenAt = new Date(response.headers.get("Last-Modified"));
+            response.blob()
+                .then(dataURLForBlob)
+                .then(dataURL => {
+                    // Don't replace a preview that's been taken in the meantime.
+                    if (!img.classList.contains("d-none") || document.querySelector("#preview button").disabled) {
+                        return;
+                    }
+
+                    document.querySelector("#preview-tip").classList.add("d-none");
+                    img.setAttribute("src", dataURL);
+                    img.classList.remove("d-none");
+                    showPreviewDate(takenAt);
+                });
+        })
+        .catch(console.error);
+}
 
 function getPreview() {
     // Reset the preview rectangle so it doesn't stay on the screen while we get the
@@ -16,12 +99,14 @@ function getPreview() {
     const tip = document.querySelector("#preview-tip");
     const img = document.querySelector("#preview-img");
     const errMsg = document.querySelector("#preview-err");
+    const date = document.querySelector("#preview-date");
 
     // When waiting for a preview, only show the spinner, and don't allow asking for
     // another preview until the current one has been generated.
     btn.disabled = true;
     tip.classList.add("d-none");
     img.classList.add("d-none");
+    date.classList.add("d-none");
     errMsg.classList.add("d-none");
     spinner.classList.remove("d-none");
 
@@ -32,8 +117,56 @@ function getPreview() {
         errMsg.classList.remove("d-none");
     }
 
-    // Request the preview.
-    fetch("/preview.jpg")
+    function showImage(dataURL) {
+        // Hide the spinner, set the data URL as the source of the img element, and show
+        // it.
+        spinner.classList.add("d-none");
+        img.setAttribute("src", dataURL);
+        img.classList.remove("d-none");
+    }
+
+    // Stream the preview so it builds up while the device scans it. If that's not
+    // possible, fall back to waiting for the whole preview.
+    if (!window.EventSource) {
+        getWholePreview(showImage, showErr, btn);
+        return;
+    }
+
+    let received = false;
+    // EventSources can't send headers, so send the CSRF token in the query string.
+    const source = new EventSource(`/api/v1/preview/stream?csrf_token=${encodeURIComponent(csrfToken())}`);
+    source.addEventListener("partial", msg => {
+        received = true;
+        showImage(JSON.parse(msg.data).image);
+    });
+    source.addEventListener("done", msg => {
+        received = true;
+        source.close();
+        btn.disabled = false;
+        showImage(JSON.parse(msg.data).image);
+        showPreviewDate(new Date());
+    });
+    source.addEventListener("error", msg => {
+        // Connection errors are also reported as error events, but without data.
+        source.close();
+        if (msg.data) {
+            // Show an user-readable error and log what actually went wrong.
+            showErr();
+            console.error(JSON.parse(msg.data).error);
+        } else if (!received) {
+            // We couldn't open the stream (e.g. because the session has expired), so
+            // try the other way, which knows how to deal with that.
+            getWholePreview(showImage, showErr, btn);
+        } else {
+            showErr();
+        }
+    });
+}
+
+function getWholePreview(showImage, showErr, btn) {
+    // Request the whole preview at once.
+    fetch("/preview.jpg", {headers: csrfHeaders()})
+        .then(checkAuth)
         .then(response => {
             if (response.status === 200) {
                 // Otherwise, if the request was a success, turn the image bytes
@@ -41,13 +174,10 @@ function getPreview() {
                 response.blob()
                     .then(dataURLForBlob)
                     .then(dataURL => {
-                        // Hide the spinner and allow clicking the button again.
-                        spinner.classList.add("d-none");
+                        // Allow clicking the button again, and show the preview.
                         btn.disabled = false;
-                        // Set the data URL as the source of the img element, and
-                        // show it.
-                        img.setAttribute("src", dataURL);
-                        img.classList.remove("d-none");
+                        showImage(dataURL);
+                        showPreviewDate(new Date());
                     })
             } else {
                 // Show an user-readable error and log what actually went wrong.
@@ -62,36 +192,175 @@ function getPreview() {
         });
 }
 
-function scan() {
+function newJobID() {
+    // Generate a random identifier for a scan, so we can follow its progress.
+    const bytes = crypto.getRandomValues(new Uint8Array(8));
+    return Array.from(bytes, b => b.toString(16).padStart(2, "0")).join("");
+}
+
+function formatBytes(n) {
+    // Format the given number of bytes in megabytes, the way French speakers do.
+    return `${(n / 1000000).toLocaleString("fr-FR", {maximumFractionDigits: 1})} Mo`;
+}
+
+function followProgress(job, onReady) {
+    // Open a stream of the progress events for the scan with the given job ID, and
+    // update the progress bar as they come. onReady is called once the stream is open,
+    // or if it can't be, so we don't miss the first events.
+    const container = document.querySelector("#scan-progress");
+    const label = document.querySelector("#scan-progress-label");
+    const bar = document.querySelector("#scan-progress-bar");
+    const spinner = document.querySelector("#scan-spinner");
+
+    function setBar(percent, indeterminate) {
+        // Phases which progress we can't measure get a full, animated bar.
+        bar.classList.toggle("progress-bar-striped", indeterminate);
+        bar.classList.toggle("progress-bar-animated", indeterminate);
+        bar.style.width = `${indeterminate ? 100 : percent}%`;
+        bar.setAttribute("aria-valuenow", indeterminate ? 100 : percent);
+    }
+
+    // The file can be uploaded to several destinations at once, so add up the progress of
+    // each upload.
+    const uploads = {};
+
+    let ready = false;
+    function setReady() {
+        if (!ready) {
+            ready = true;
+            onReady();
+        }
+    }
+
+    const source = new EventSource(`/api/v1/events?job=${encodeURIComponent(job)}`);
+    source.onopen = setReady;
+    source.onerror = () => {
+        // The browser retries on its own, but don't hold the scan back for it.
+        setReady();
+    };
+    source.onmessage = msg => {
+        const e = JSON.parse(msg.data);
+
+        spinner.classList.add("d-none");
+        container.classList.remove("d-none");
+
+        switch (e.phase) {
+            case "waiting":
+                label.innerText = "En attente du scanner";
+                setBar(0, true);
+                break;
+            case "scanning":
+                label.innerText = `Numérisation en cours (${e.percent} %)`;
+                setBar(e.percent, false);
+                break;
+            case "encoding":
+                label.innerText = "Création du fichier";
+                setBar(0, true);
+                break;
+            case "ready":
+                label.innerText = "Téléchargement";
+                setBar(0, true);
+                break;
+            case "uploading": {
+                if (e.destination && e.bytes_total) {
+                    uploads[e.destination] = {sent: e.bytes_sent, total: e.bytes_total};
+                }
+                const sent = Object.values(uploads).reduce((sum, u) => sum + u.sent, 0);
+                const total = Object.values(uploads).reduce((sum, u) => sum + u.total, 0);
+                label.innerText = total
+                    ? `Envoi en cours (${formatBytes(sent)} sur ${formatBytes(total)})`
+                    : "Envoi en cours";
+                setBar(total ? Math.trunc(100 * sent / total) : 0, false);
+                break;
+            }
+        }
+    };
+
+    return () => {
+        // Stop following the scan and hide the progress bar.
+        source.close();
+        container.classList.add("d-none");
+        setBar(0, false);
+    };
+}
+
+function saveFile(blob, name) {
+    // Make the browser save the given blob as a file with the given name.
+    const url = URL.createObjectURL(blob);
+    const link = document.createElement("a");
+    link.href = url;
+    link.download = name;
+    document.body.appendChild(link);
+    link.click();
+    link.remove();
+
+    // Give the browser some time to start the download before releasing the blob.
+    setTimeout(() => URL.revokeObjectURL(url), 60000);
+}
+
+function scan(quick) {
     const btn = document.querySelector("#scan button");
+    const quickBtn = document.querySelector("#scan-quick");
 
-    // Don't do anything if we're already getting a preview.
+    // Don't do anything if we're already scanning.
     if (btn.disabled) {
         return;
     }
 
     const formatSelect = document.querySelector("#scan select");
+    const destinationSelect = document.querySelector("#scan-destination");
     const filenameInput = document.querySelector("#scan-name-input")
     const spinner = document.querySelector("#scan-spinner");
     const scanFormatErr = document.querySelector("#scan-format-err");
     const scanFilenameErr = document.querySelector("#scan-filename-err");
+    const scanFilenameInvalidErr = document.querySelector("#scan-filename-invalid-err");
+    const scanFolderForbiddenErr = document.querySelector("#scan-folder-forbidden-err");
+    const scanNoStorageErr = document.querySelector("#scan-no-storage-err");
+    const scanNoPreviewErr = document.querySelector("#scan-no-preview-err");
+    const scanNoEmailErr = document.querySelector("#scan-no-email-err");
+    const scanEmailInvalidErr = document.querySelector("#scan-email-invalid-err");
+    const scanTooLargeErr = document.querySelector("#scan-too-large-err");
     const scanErr = document.querySelector("#scan-err");
     const scanSuccess = document.querySelector("#scan-success");
+    const scanEmailed = document.querySelector("#scan-emailed");
+    const scanQueued = document.querySelector("#scan-queued");
     const scanFilename = document.querySelector("#scan-filename");
+    const scanDownloaded = document.querySelector("#scan-downloaded");
+    const scanDownloadName = document.querySelector("#scan-download-name");
+    const scanUploadFailed = document.querySelector("#scan-upload-failed");
+    const scanPartial = document.querySelector("#scan-partial");
+    const scanPartialDestinations = document.querySelector("#scan-partial-destinations");
 
     // When scanning, only show the spinner, and don't allow asking for another scan
     // until the current one has completed.
     btn.disabled = true;
+    quickBtn.disabled = true;
     spinner.classList.remove("d-none");
     scanFormatErr.classList.add("d-none");
     scanFilenameErr.classList.add("d-none");
+    scanFilenameInvalidErr.classList.add("d-none");
+    scanFolderForbiddenErr.classList.add("d-none");
+    scanNoStorageErr.classList.add("d-none");
+    scanNoPreviewErr.classList.add("d-none");
+    scanNoEmailErr.classList.add("d-none");
+    scanEmailInvalidErr.classList.add("d-none");
+    scanTooLargeErr.classList.add("d-none");
     scanErr.classList.add("d-none");
     scanSuccess.classList.add("d-none");
+    scanEmailed.classList.add("d-none");
+    scanQueued.classList.add("d-none");
+    scanDownloaded.classList.add("d-none");
+    scanUploadFailed.classList.add("d-none");
+    scanPartial.classList.add("d-none");
+
+    let stopProgress = () => {};
 
     function showElement(element) {
         // Show the given element and reset the button.
+        stopProgress();
         spinner.classList.add("d-none");
         btn.disabled = false;
+        quickBtn.disabled = false;
         element.classList.remove("d-none");
     }
 
@@ -103,56 +372,244 @@ function scan() {
     }
 
     // Trigger the scan with the desired format.
-    let url = `/scan?format=${format}`;
+    const body = {format: format};
 
     // If a rectangle has been drawn on top of the preview, only scan what's in it.
     const coords = rect.coords;
     if (coords !== null) {
-        url += `&x=${Math.trunc(coords.x)}&y=${Math.trunc(coords.y)}`;
-        url += `&width=${Math.trunc(coords.width)}&height=${Math.trunc(coords.height)}`;
+        body.rect = {
+            x: Math.trunc(coords.x),
+            y: Math.trunc(coords.y),
+            width: Math.trunc(coords.width),
+            height: Math.trunc(coords.height),
+        };
+    }
+
+    // If a folder has been selected, store the file in it.
+    if (currentFolder !== "") {
+        body.folder = currentFolder;
     }
 
     // If a file name has been set, use it.
     if (filenameInput.value) {
-        url += `&name=${filenameInput.value}`;
+        body.name = filenameInput.value;
     }
 
-    fetch(url).
-        then(response => {
-            if (response.status === 200) {
-                response.text()
-                    .then(text => {
-                        if (text === offlineMsg) {
-                            // If the text from the response is the one sent by the
-                            // service worker when the app is offline, show a
-                            // user-readable error.
-                            showElement(scanErr);
-                        } else {
-                            // Otherwise, if the request was a success, show the name of
-                            // the newly generated file.
-                            scanFilename.innerHTML = text;
-                            showElement(scanSuccess);
+    // If a low resolution is good enough, reuse the preview rather than scanning again.
+    if (quick) {
+        body.quick = true;
+    }
+
+    // Send the file to the storage, back to the browser, or both.
+    body.destinations = destinationSelect.value.split(",");
+
+    // If the file is sent by email, say who to send it to and what to write.
+    if (body.destinations.includes("email")) {
+        body.email = {
+            to: document.querySelector("#scan-email-to-input").value
+                .split(",")
+                .map(addr => addr.trim())
+                .filter(addr => addr !== ""),
+            subject: document.querySelector("#scan-email-subject-input").value,
+            body: document.querySelector("#scan-email-body-input").value,
+        };
+    }
+
+    // Pick an ID for the scan, so we can show its progress.
+    body.job = newJobID();
+
+    const headers = csrfHeaders();
+    headers["Content-Type"] = "application/json";
+
+    function sendRequest() {
+        fetch("/api/v1/scans", {method: "POST", headers: headers, body: JSON.stringify(body)})
+            .then(checkAuth)
+            .then(response => {
+                // If the file is sent back, save it, and tell how its upload went if it
+                // was also uploaded.
+                const disposition = response.headers.get("Content-Disposition");
+                if (response.ok && disposition) {
+                    return response.blob().then(blob => {
+                        const match = /filename="?([^";]+)"?/.exec(disposition);
+                        const name = match ? match[1] : "scan";
+                        saveFile(blob, name);
+
+                        switch (response.headers.get("X-Upload-Status")) {
+                            case "failed":
+                            case "partial":
+                                showElement(scanUploadFailed);
+                                break;
+                            case "queued":
+                                showElement(scanQueued);
+                                break;
+                            default:
+                                scanDownloadName.innerText = name;
+                                showElement(scanDownloaded);
                         }
-                    })
-            } else if (response.status === 400) {
-                // If the response has a 400 status code, it means the format is either
-                // missing or unsupported.
-                showElement(scanFormatErr);
-                response.text().then(console.error);
-            } else if (response.status === 409) {
-                // If the response has a 409 status code, it means the file name
-                // conflicts with an existing file.
-                showElement(scanFilenameErr);
+
+                        return null;
+                    });
+                }
+
+                return response.json();
+            })
+            .then(result => {
+                if (result === null) {
+                    return;
+                }
+
+                if (result.status === "partial") {
+                    // If the file couldn't be sent everywhere, say where it couldn't.
+                    scanPartialDestinations.innerText = result.uploads
+                        .filter(u => u.status === "failed")
+                        .map(u => destinationNames[u.destination] || u.destination)
+                        .join(", ");
+                    showElement(scanPartial);
+                    return;
+                } else if (result.status === "uploaded" && !body.destinations.includes("webdav")) {
+                    showElement(scanEmailed);
+                    return;
+                } else if (result.status === "uploaded") {
+                    // If the file has been uploaded, show its name.
+                    scanFilename.innerText = result.file_name;
+                    showElement(scanSuccess);
+                    return;
+                } else if (result.status === "queued") {
+                    // If the file has been scanned but will be uploaded later, say so.
+                    showElement(scanQueued);
+                    return;
+                }
+
+                // Otherwise, show the user-readable error matching the error code, and log
+                // what actually went wrong.
+                console.error(result.error);
+                switch (result.error.code) {
+                    case "invalid_name":
+                        showElement(scanFilenameInvalidErr);
+                        break;
+                    case "missing_format":
+                    case "unsupported_format":
+                        showElement(scanFormatErr);
+                        break;
+                    case "no_storage":
+                        showElement(scanNoStorageErr);
+                        break;
+                    case "no_preview":
+                        showElement(scanNoPreviewErr);
+                        break;
+                    case "no_email":
+                        showElement(scanNoEmailErr);
+                        break;
+                    case "invalid_email":
+                        showElement(scanEmailInvalidErr);
+                        break;
+                    case "forbidden":
+                        // Most likely a recipient that isn't allowed if sending by email.
+                        showElement(body.email ? scanEmailInvalidErr : scanErr);
+                        break;
+                    case "attachment_too_large":
+                        showElement(scanTooLargeErr);
+                        break;
+                    case "folder_forbidden":
+                        showElement(scanFolderForbiddenErr);
+                        break;
+                    case "name_conflict":
+                        showElement(scanFilenameErr);
+                        break;
+                    default:
+                        showElement(scanErr);
+                }
+            })
+            .catch((err) => {
+                // Show an user-readable error and log what actually went wrong.
+                showElement(scanErr);
+                console.error(err);
+            });
+    }
+
+    // Start following the progress of the scan, and only trigger it once we're sure
+    // we won't miss any event.
+    stopProgress = followProgress(body.job, sendRequest);
+}
+
+function loadFolders(folder) {
+    const select = document.querySelector("#folder-select");
+    const errMsg = document.querySelector("#folder-err");
+
+    errMsg.classList.add("d-none");
+
+    function showErr() {
+        // Show the error message and select the current folder again.
+        errMsg.classList.remove("d-none");
+        select.value = currentFolder;
+    }
+
+    fetch(`/folders?path=${encodeURIComponent(folder)}`)
+        .then(checkAuth)
+        .then(response => {
+            if (response.status !== 200) {
+                // Show an user-readable error and log what actually went wrong.
+                showErr();
                 response.text().then(console.error);
+                return;
+            }
+
+            response.json()
+                .then(body => {
+                    currentFolder = folder;
+
+                    // List the current folder first, then its parent if there's one,
+                    // then its subfolders.
+                    select.innerHTML = "";
+                    select.add(new Option(`/${folder}`, folder, true, true));
+                    if (folder !== "") {
+                        const parent = folder.split("/").slice(0, -1).join("/");
+                        select.add(new Option("..", parent));
+                    }
+                    body.folders.forEach(name => {
+                        const path = folder === "" ? name : `${folder}/${name}`;
+                        select.add(new Option(`/${path}`, path));
+                    });
+                })
+                .catch((err) => {
+                    // Show an user-readable error and log what actually went wrong.
+                    showErr();
+                    console.error(err);
+                });
+        })
+        .catch((err) => {
+            // Show an user-readable error and log what actually went wrong.
+            showErr();
+            console.error(err);
+        });
+}
+
+function createFolder() {
+    const name = prompt("Nom du nouveau dossier");
+    if (!name) {
+        return;
+    }
+
+    const errMsg = document.querySelector("#folder-err");
+    const path = currentFolder === "" ? name : `${currentFolder}/${name}`;
+
+    errMsg.classList.add("d-none");
+
+    fetch(`/folders?path=${encodeURIComponent(path)}`, {method: "POST", headers: csrfHeaders()})
+        .then(checkAuth)
+        .then(response => {
+            if (response.status === 201) {
+                // Go into the newly created folder.
+                loadFolders(path);
             } else {
-                // Otherwise, show a standard user-readable error.
-                showElement(scanErr);
+                // Show an user-readable error and log what actually went wrong.
+                errMsg.classList.remove("d-none");
                 response.text().then(console.error);
             }
         })
         .catch((err) => {
             // Show an user-readable error and log what actually went wrong.
-            showElement(scanErr);
+            errMsg.classList.remove("d-none");
             console.error(err);
         });
 }
@@ -169,7 +626,21 @@ function dataURLForBlob(blob){
 
 // Register the event handlers.
 document.querySelector("#preview button").onclick = getPreview;
-document.querySelector("#scan button").onclick = scan;
+document.querySelector("#scan button").onclick = () => scan(false);
+document.querySelector("#scan-quick").onclick = () => scan(true);
+document.querySelector("#folder button").onclick = createFolder;
+document.querySelector("#logout").onclick = logout;
+// Only offer to log out if the user is logged in, i.e. if authentication is enabled.
+if (document.cookie.includes(`${csrfCookieName}=`)) {
+    document.querySelector("#logout-container").classList.remove("d-none");
+}
+document.querySelector("#folder-select").onchange = e => loadFolders(e.target.value);
+
+// List the folders at the root of the upload path.
+loadFolders("");
+
+// Show the last preview, if there's one.
+getLastPreview();
 
 // Display the file extension when setting the file's format.
 function updateFileExtension(e) {
@@ -185,6 +656,12 @@ function updateFileExtension(e) {
 }
 document.querySelector("#scan select").onchange = updateFileExtension;
 
+// Only ask for the recipient and content of the email if the file is sent by email.
+document.querySelector("#scan-destination").onchange = e => {
+    const fields = document.getElementById("scan-email");
+    fields.classList.toggle("d-none", !e.target.value.split(",").includes("email"));
+};
+
 // Register the service worker if supported by the browser.
 if ('serviceWorker' in navigator) {
     navigator.serviceWorker.register('/sw.js', {scope: "."})
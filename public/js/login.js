@@ -0,0 +1,22 @@
+// Show the error matching the error code in the URL, if any.
+const error = new URLSearchParams(window.location.search).get("error");
+if (error) {
+    const errMsg = document.querySelector(`#login-${error}-err`);
+    if (errMsg) {
+        errMsg.classList.remove("d-none");
+    }
+}
+
+// Only show the ways to log in that are enabled on the server.
+fetch("/auth/methods")
+    .then(response => response.json())
+    .then(methods => {
+        if (methods.password) {
+            document.querySelector("#login-password").classList.remove("d-none");
+        }
+
+        if (methods.oidc) {
+            document.querySelector("#login-oidc").classList.remove("d-none");
+        }
+    })
+    .catch(console.error);
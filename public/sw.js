@@ -5,7 +5,9 @@ const cachedFiles = [
     "/js/bootstrap.bundle.min.js",
     "/js/jquery-3.6.0.min.js",
     "/js/index.js",
+    "/js/history.js",
     "/index.html",
+    "/history.html",
     "/misc/offline-msg.txt"
 ];
 
@@ -0,0 +1,76 @@
+package scanner
+
+import (
+	"image"
+	"time"
+
+	"github.com/babolivier/scanner/common"
+)
+
+// LastPreview is the last preview that was taken.
+type LastPreview struct {
+	Image image.Image
+	// Resolution is the resolution the preview was taken with, in DPI.
+	Resolution int
+	TakenAt    time.Time
+}
+
+// LastPreview returns the last preview that was taken by the given user, or nil if they
+// haven't taken any since the process started.
+func (s *Scanner) LastPreview(user string) *LastPreview {
+	s.lastPreviewMu.Lock()
+	defer s.lastPreviewMu.Unlock()
+
+	return s.lastPreviews[user]
+}
+
+// storeLastPreview keeps the given preview, taken by the given user with the given
+// resolution, so it can be retrieved with LastPreview and used for their quick exports.
+func (s *Scanner) storeLastPreview(user string, img image.Image, resolution int) {
+	s.lastPreviewMu.Lock()
+	defer s.lastPreviewMu.Unlock()
+
+	s.lastPreviews[user] = &LastPreview{
+		Image:      img,
+		Resolution: resolution,
+		TakenAt:    time.Now(),
+	}
+}
+
+// croppedPreview returns the last preview taken by the user from the given options,
+// cropped to the scan area of the options if there's one, and sets the resolution of the
+// options to the preview's.
+// Returns ErrNoPreview if the user hasn't taken any preview yet, or ErrOutsidePreview if
+// the scan area doesn't overlap with the preview.
+func (s *Scanner) croppedPreview(options *common.ScanOptions) (image.Image, error) {
+	preview := s.LastPreview(options.User)
+	if preview == nil {
+		return nil, ErrNoPreview
+	}
+
+	options.Resolution = preview.Resolution
+
+	if options.ScanArea == nil {
+		return preview.Image, nil
+	}
+
+	// The coordinates of the scan area are in pixels on a preview, so they can be used
+	// as they are.
+	rect := image.Rect(
+		options.ScanArea.TLX.(int),
+		options.ScanArea.TLY.(int),
+		options.ScanArea.BRX.(int),
+		options.ScanArea.BRY.(int),
+	).Intersect(preview.Image.Bounds())
+	if rect.Empty() {
+		return nil, ErrOutsidePreview
+	}
+
+	// All of the images we build from what the device sends can be cropped without
+	// copying them.
+	cropped := preview.Image.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}).SubImage(rect)
+
+	return cropped, nil
+}
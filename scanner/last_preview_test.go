@@ -0,0 +1,36 @@
+package scanner
+
+import (
+	"image"
+	"testing"
+
+	"github.com/babolivier/scanner/common"
+)
+
+func TestLastPreviewIsPerUser(t *testing.T) {
+	s := &Scanner{lastPreviews: make(map[string]*LastPreview)}
+	s.storeLastPreview("alice", image.NewGray(image.Rect(0, 0, 10, 10)), 75)
+
+	if preview := s.LastPreview("alice"); preview == nil || preview.Resolution != 75 {
+		t.Errorf("got %+v for alice; want her preview", preview)
+	}
+	if preview := s.LastPreview("bob"); preview != nil {
+		t.Errorf("got %+v for bob; want none", preview)
+	}
+	if preview := s.LastPreview(""); preview != nil {
+		t.Errorf("got %+v without a user; want none", preview)
+	}
+
+	if _, err := s.croppedPreview(&common.ScanOptions{User: "bob"}); err != ErrNoPreview {
+		t.Errorf("quick export for bob returned %v; want ErrNoPreview", err)
+	}
+
+	options := &common.ScanOptions{User: "alice"}
+	img, err := s.croppedPreview(options)
+	if err != nil {
+		t.Fatalf("quick export for alice returned an error: %v", err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 10, 10) || options.Resolution != 75 {
+		t.Errorf("quick export for alice got a %v image at %d DPI; want her preview", img.Bounds(), options.Resolution)
+	}
+}
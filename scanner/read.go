@@ -0,0 +1,343 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"time"
+
+	"github.com/tjgq/sane"
+)
+
+const (
+	// readBufferSize is the number of bytes to read from the device at once.
+	readBufferSize = 32 << 10
+	// partialInterval is how often partial images are built while reading an image, for
+	// progressive previews.
+	partialInterval = 500 * time.Millisecond
+)
+
+var (
+	// errNoLines is the error returned when building a partial image before any line has
+	// been read.
+	errNoLines = errors.New("no line read yet")
+)
+
+// frame is a frame read from the device, i.e. one or more channels of an image.
+type frame struct {
+	params sane.Params
+	data   []byte
+}
+
+// readImage reads an image from the device, calling report with the percentage of the
+// image that has been read whenever it changes. If partial isn't nil, it's also called
+// regularly with the part of the image read so far, on a white background. It does the
+// same thing as sane.Conn.ReadImage, which doesn't let us know how far along it is, but
+// returns an image from the standard library.
+// If the given context is done before the whole image has been read, the scan is
+// cancelled and the context's error is returned.
+func (s *Scanner) readImage(
+	ctx context.Context,
+	report func(percent int),
+	partial func(img image.Image),
+) (image.Image, error) {
+	// Cancelling is needed to end the scan even when it went well. It also makes sure the
+	// device is ready for the next scan if the read was interrupted, since SANE requires a
+	// synchronous call to sane_cancel after cancelling asynchronously.
+	defer s.conn.Cancel()
+
+	// Interrupt the read if the context is done before the scan is over. Wait for the
+	// watcher to stop before returning, so it can't cancel the next scan.
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			s.conn.Cancel()
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	// Most devices send the whole image in a single frame, but some send each colour in
+	// its own frame, in which case each of them accounts for a third of the progress.
+	var frames [3]*frame
+	expected := 1
+	read := 0
+	lastPercent := -1
+	lastPartial := time.Now()
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		f, err := s.readFrame(func(f *frame) {
+			// Figure out how many frames to expect from the first one, before it's been
+			// read entirely, so the progress doesn't go back down once it has.
+			expected = expectedFrames(f.params.Format)
+			percent := int(100 * (float64(read) + f.done()) / float64(expected))
+			if percent != lastPercent {
+				lastPercent = percent
+				report(percent)
+			}
+
+			// Partial images can only be built from frames holding every colour.
+			isComplete := f.params.Format == sane.FrameGray || f.params.Format == sane.FrameRgb
+			if partial != nil && isComplete && time.Since(lastPartial) >= partialInterval {
+				lastPartial = time.Now()
+				if img, err := f.partialImage(); err == nil {
+					partial(img)
+				}
+			}
+		})
+		if err != nil {
+			// The read fails with sane.ErrCancelled if it's been interrupted because the
+			// context is done, in which case the context's error is more helpful.
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, err
+		}
+
+		switch f.params.Format {
+		case sane.FrameGray, sane.FrameRgb:
+			frames[0] = f
+		case sane.FrameRed:
+			frames[0] = f
+		case sane.FrameGreen:
+			frames[1] = f
+		case sane.FrameBlue:
+			frames[2] = f
+		default:
+			return nil, fmt.Errorf("unknown frame type %d", f.params.Format)
+		}
+
+		read++
+		if f.params.IsLast {
+			break
+		}
+	}
+
+	return toImage(frames)
+}
+
+// expectedFrames returns how many frames make up an image which frames are in the given
+// format.
+func expectedFrames(format sane.Format) int {
+	switch format {
+	case sane.FrameRed, sane.FrameGreen, sane.FrameBlue:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// readFrame reads a whole frame from the device, calling report with the part of the
+// frame read so far once the scan has started, and after every read.
+func (s *Scanner) readFrame(report func(f *frame)) (*frame, error) {
+	if err := s.conn.Start(); err != nil {
+		return nil, err
+	}
+
+	p, err := s.conn.Params()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Depth != 1 && p.Depth != 8 && p.Depth != 16 {
+		return nil, fmt.Errorf("unsupported bit depth: %d", p.Depth)
+	}
+
+	// The number of lines is -1 if the device doesn't know it in advance (e.g. hand
+	// held scanners).
+	f := &frame{params: p}
+	if p.Lines > 0 {
+		f.data = make([]byte, 0, p.Lines*p.BytesPerLine)
+	}
+	report(f)
+
+	buf := make([]byte, readBufferSize)
+	for {
+		n, err := s.conn.Read(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		f.data = append(f.data, buf[:n]...)
+		report(f)
+	}
+
+	return f, nil
+}
+
+// done returns the share of the frame's lines that have been read, or 0 if the number of
+// lines isn't known.
+func (f *frame) done() float64 {
+	if f.params.Lines <= 0 {
+		return 0
+	}
+
+	lines := f.height()
+	if lines > f.params.Lines {
+		lines = f.params.Lines
+	}
+
+	return float64(lines) / float64(f.params.Lines)
+}
+
+// partialImage returns the image made of the lines of the frame, which must hold every
+// colour, that have been read so far. If the number of lines is known, the image has its
+// final size, and the lines that haven't been read yet are white.
+func (f *frame) partialImage() (image.Image, error) {
+	if f.height() == 0 {
+		return nil, errNoLines
+	}
+
+	img, err := toImage([3]*frame{f})
+	if err != nil {
+		return nil, err
+	}
+
+	if f.params.Lines <= f.height() {
+		return img, nil
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, f.params.PixelsPerLine, f.params.Lines))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(canvas, img.Bounds(), img, image.Point{}, draw.Src)
+
+	return canvas, nil
+}
+
+// height returns the number of lines in the frame. The number of lines announced by the
+// device can't be relied upon, so it's computed from the amount of data read.
+func (f *frame) height() int {
+	return len(f.data) / f.params.BytesPerLine
+}
+
+// sample returns the sample at the given coordinates for the given channel, relative to
+// the frame's depth.
+func (f *frame) sample(x int, y int, ch int) uint16 {
+	channels := 1
+	if f.params.Format == sane.FrameRgb {
+		channels = 3
+	}
+
+	switch f.params.Depth {
+	case 1:
+		i := f.params.BytesPerLine*y + channels*(x/8) + ch
+		s := (f.data[i] >> uint8(x%8)) & 0x01
+		if f.params.Format == sane.FrameGray {
+			// For black and white lineart, 0 is white and 1 is black.
+			return uint16(s ^ 0x1)
+		}
+		return uint16(s)
+	case 8:
+		i := f.params.BytesPerLine*y + channels*x + ch
+		return uint16(f.data[i])
+	case 16:
+		i := f.params.BytesPerLine*y + 2*(channels*x+ch)
+		return uint16(f.data[i+1])<<8 + uint16(f.data[i])
+	}
+
+	return 0
+}
+
+// toImage assembles the given frames, which must be in RGB order if there are several
+// of them, into an image.
+func toImage(frames [3]*frame) (image.Image, error) {
+	f := frames[0]
+	if f == nil {
+		return nil, fmt.Errorf("no frame read from the device")
+	}
+
+	bounds := image.Rect(0, 0, f.params.PixelsPerLine, f.height())
+	depth := f.params.Depth
+
+	if f.params.Format == sane.FrameGray {
+		if depth == 16 {
+			img := image.NewGray16(bounds)
+			for y := 0; y < bounds.Dy(); y++ {
+				for x := 0; x < bounds.Dx(); x++ {
+					img.SetGray16(x, y, color.Gray16{Y: f.sample(x, y, 0)})
+				}
+			}
+			return img, nil
+		}
+
+		img := image.NewGray(bounds)
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				img.SetGray(x, y, color.Gray{Y: to8Bits(f.sample(x, y, 0), depth)})
+			}
+		}
+		return img, nil
+	}
+
+	// Colours are either interleaved in a single frame, or sent in one frame each.
+	rgb := func(x, y int) (uint16, uint16, uint16) {
+		return f.sample(x, y, 0), f.sample(x, y, 1), f.sample(x, y, 2)
+	}
+	if f.params.Format != sane.FrameRgb {
+		if frames[1] == nil || frames[2] == nil {
+			return nil, fmt.Errorf("missing colour frames")
+		}
+
+		// Frames for different colours might not have the same number of lines, so only
+		// keep the lines they all have.
+		for _, other := range frames[1:] {
+			if other.height() < bounds.Dy() {
+				bounds.Max.Y = other.height()
+			}
+		}
+
+		rgb = func(x, y int) (uint16, uint16, uint16) {
+			return f.sample(x, y, 0), frames[1].sample(x, y, 0), frames[2].sample(x, y, 0)
+		}
+	}
+
+	if depth == 16 {
+		img := image.NewRGBA64(bounds)
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				r, g, b := rgb(x, y)
+				img.SetRGBA64(x, y, color.RGBA64{R: r, G: g, B: b, A: 0xffff})
+			}
+		}
+		return img, nil
+	}
+
+	img := image.NewRGBA(bounds)
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b := rgb(x, y)
+			img.SetRGBA(x, y, color.RGBA{
+				R: to8Bits(r, depth),
+				G: to8Bits(g, depth),
+				B: to8Bits(b, depth),
+				A: 0xff,
+			})
+		}
+	}
+	return img, nil
+}
+
+// to8Bits converts the given sample of the given depth, which is either 1 or 8, to an
+// 8-bit value.
+func to8Bits(s uint16, depth int) uint8 {
+	if depth == 1 {
+		return uint8(0xff * s)
+	}
+
+	return uint8(s)
+}
@@ -2,44 +2,131 @@ package scanner
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"image"
 	"image/jpeg"
 	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/tjgq/sane"
 
 	"github.com/babolivier/scanner/common"
 	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/history"
+	"github.com/babolivier/scanner/logging"
+	"github.com/babolivier/scanner/metrics"
 	"github.com/babolivier/scanner/pdf"
-	"github.com/babolivier/scanner/webdav"
+	"github.com/babolivier/scanner/progress"
+	"github.com/babolivier/scanner/spool"
+	"github.com/babolivier/scanner/webhook"
 )
 
 var (
 	// ErrUnsupportedFormat is the error returned by ScanAndUpload if the format isn't
 	// among the supported ones.
 	ErrUnsupportedFormat = errors.New("Unsupported format")
+	// ErrDeviceBusy is the error returned by Preview and ScanAndUpload if the scanning
+	// device is already in use.
+	ErrDeviceBusy = errors.New("Device busy")
+	// ErrNoPreview is the error returned by ScanAndUpload for quick exports if the
+	// requester hasn't taken any preview yet.
+	ErrNoPreview = errors.New("No preview to export")
+	// ErrOutsidePreview is the error returned by ScanAndUpload for quick exports if the
+	// scan area doesn't overlap with the last preview.
+	ErrOutsidePreview = errors.New("Scan area outside of the preview")
 )
 
+// UploadError is the error returned by ScanAndUpload if the document has been scanned
+// but couldn't be uploaded to at least one of its destinations. It wraps the error
+// returned by the spool for the first of them, which can be spool.ErrQueued if the
+// upload will be retried later. Uploads that failed for good take precedence over queued
+// ones, so it only wraps spool.ErrQueued if none did.
+type UploadError struct {
+	Err error
+}
+
+func (e *UploadError) Error() string {
+	return "upload failed: " + e.Err.Error()
+}
+
+// Unwrap returns the error returned by the spool.
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// Upload describes how sending the file of a scan to one of its destinations went.
+type Upload struct {
+	// Destination is one of the common.Destination* constants.
+	Destination string
+	// FileName is the name the file has been uploaded under, if it has.
+	FileName string
+	// Err is the error returned by the spool if the upload failed, which wraps
+	// spool.ErrQueued if it will be retried later.
+	Err error
+}
+
+// Result is the result of a scan.
+type Result struct {
+	// FileName is the name the file has been uploaded under, e.g. its path relative to
+	// the upload path on the WebDAV server. If it's been sent to several destinations,
+	// it's the name from the first one it's been uploaded to. It's only set if the file
+	// has been uploaded.
+	FileName string
+	// Uploads describes how sending the file to each of its destinations, other than
+	// common.DestinationDownload, went, in the order of the destinations.
+	Uploads []*Upload
+	// File is the encoded file, open for reading, if it must be sent back to the
+	// requester. The caller must close it.
+	File *os.File
+}
+
 // Scanner interacts with SANE to control the scanner.
 type Scanner struct {
 	cfg             *config.ScannerConfig
 	conn            *sane.Conn
-	webDAVClient    *webdav.Client
+	spool           *spool.Spool
+	progress        *progress.Broker
+	history         *history.Store
+	webhooks        *webhook.Notifier
 	defaultScanArea *common.ScanArea
+	// busy holds a value while the device is in use.
+	busy chan struct{}
+	// lastPreviews are the last previews taken by each user. Previews show what's on the
+	// plate, which might be confidential, so users only get to see their own.
+	lastPreviews  map[string]*LastPreview
+	lastPreviewMu sync.Mutex
 }
 
 // NewScanner returns a new Scanner. It also opens the SANE connection to the scanning
-// device, and sets the mode.
-func NewScanner(cfg *config.ScannerConfig, client *webdav.Client) (s *Scanner, err error) {
+// device, and sets the mode. The progress of scans is published to the given broker,
+// every scan is recorded in the given history, and the given notifier notifies webhooks
+// of it.
+func NewScanner(
+	cfg *config.ScannerConfig,
+	sp *spool.Spool,
+	broker *progress.Broker,
+	hist *history.Store,
+	notifier *webhook.Notifier,
+) (s *Scanner, err error) {
 	s = &Scanner{
-		cfg:          cfg,
-		webDAVClient: client,
+		cfg:      cfg,
+		spool:    sp,
+		progress: broker,
+		history:  hist,
+		webhooks: notifier,
+		busy:     make(chan struct{}, 1),
+
+		lastPreviews: make(map[string]*LastPreview),
 	}
 
 	// Try to open a connection with the device.
-	if err = s.openConn(); err != nil {
+	if err = s.openConn(context.Background()); err != nil {
 		// If that didn't work, we'll try again when trying to get an image.
 		logrus.
 			WithField("name", s.cfg.DeviceName).
@@ -51,7 +138,15 @@ func NewScanner(cfg *config.ScannerConfig, client *webdav.Client) (s *Scanner, e
 }
 
 // openConn opens a SANE connection to the scanning device and sets the mode.
-func (s *Scanner) openConn() (err error) {
+func (s *Scanner) openConn(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			metrics.DeviceConnections.WithLabelValues(metrics.ResultFailed).Inc()
+		} else {
+			metrics.DeviceConnections.WithLabelValues(metrics.ResultSuccess).Inc()
+		}
+	}()
+
 	if s.conn, err = sane.Open(s.cfg.DeviceName); err != nil {
 		return err
 	}
@@ -64,26 +159,82 @@ func (s *Scanner) openConn() (err error) {
 		return err
 	}
 
-	logrus.WithField("name", s.cfg.DeviceName).Info("Connected to device")
+	logging.Entry(ctx).WithField("name", s.cfg.DeviceName).Info("Connected to device")
 
 	return nil
 }
 
-// Preview triggers a low-resolution scan on the scanning device and returns the
-// resulting image.
-func (s *Scanner) Preview() (*sane.Image, error) {
-	logrus.Info("Getting preview")
+// Preview triggers a low-resolution scan on the scanning device on behalf of the given
+// user and returns the resulting image. The scan is cancelled if the given context is
+// done before it's over.
+// Returns ErrDeviceBusy if the device is already in use, or the context's error if the
+// scan has been cancelled.
+func (s *Scanner) Preview(ctx context.Context, user string) (image.Image, error) {
+	logging.Entry(ctx).Info("Getting preview")
+	return s.preview(ctx, user, nil)
+}
 
+// PreviewProgressively does the same thing as Preview, but also regularly calls partial
+// with the part of the preview that has been scanned so far while the scan is running,
+// so it can be shown before the scan is over. The parts that haven't been scanned yet
+// are white.
+// Returns ErrDeviceBusy if the device is already in use.
+func (s *Scanner) PreviewProgressively(
+	ctx context.Context,
+	user string,
+	partial func(img image.Image),
+) (image.Image, error) {
+	logging.Entry(ctx).Info("Getting progressive preview")
+	return s.preview(ctx, user, partial)
+}
+
+// preview triggers a low-resolution scan on behalf of the given user, calling partial
+// with the part of the image scanned so far if it isn't nil, and keeps the resulting
+// image as the user's last preview.
+// Returns ErrDeviceBusy if the device is already in use.
+func (s *Scanner) preview(
+	ctx context.Context,
+	user string,
+	partial func(img image.Image),
+) (image.Image, error) {
 	options := &common.ScanOptions{
 		Resolution: s.cfg.PreviewRes,
+		User:       user,
 	}
-	return s.getImage(options)
+	img, err := s.getImage(ctx, options, partial)
+	switch {
+	case err == ErrDeviceBusy:
+		metrics.DeviceBusy.WithLabelValues("preview").Inc()
+		metrics.Previews.WithLabelValues(metrics.ResultBusy).Inc()
+		return nil, err
+	case err != nil:
+		metrics.Previews.WithLabelValues(metrics.ResultFailed).Inc()
+		return nil, err
+	}
+
+	metrics.Previews.WithLabelValues(metrics.ResultSuccess).Inc()
+	s.storeLastPreview(user, img, options.Resolution)
+
+	return img, nil
 }
 
 // ScanAndUpload triggers a high-resolution scan on the scanning device and uploads the
-// resulting image to the WebDAV server.
-func (s *Scanner) ScanAndUpload(options *common.ScanOptions) (fileName string, err error) {
-	entry := logrus.WithField("format", options.Format)
+// resulting image to all of the destinations in the options at once, and/or returns it
+// so it can be sent back to the requester. The progress of each phase is published with
+// the job ID from the options. If the options ask for a quick export, the last preview,
+// cropped to the scan area, is used instead of a new scan.
+// Returns ErrDeviceBusy if the device is already in use, ErrNoPreview or
+// ErrOutsidePreview if a quick export isn't possible, the context's error if it's done
+// before the upload starts, or an UploadError if the upload to at least one destination
+// failed, which wraps spool.ErrQueued if it has been queued to be retried later (e.g.
+// because the context was done while uploading). The result is returned along with the
+// UploadError, so the requester can tell how each upload went and the file to send back
+// isn't lost.
+func (s *Scanner) ScanAndUpload(
+	ctx context.Context,
+	options *common.ScanOptions,
+) (result *Result, err error) {
+	entry := logging.Entry(ctx).WithField("format", options.Format)
 	if options.ScanArea != nil {
 		entry = entry.WithFields(logrus.Fields{
 			"tlx_px": options.ScanArea.TLX,
@@ -95,8 +246,71 @@ func (s *Scanner) ScanAndUpload(options *common.ScanOptions) (fileName string, e
 	if options.FileName != "" {
 		entry = entry.WithField("file_name", options.FileName)
 	}
+	if options.Quick {
+		entry = entry.WithField("quick", true)
+	}
 	entry.Info("Triggering scan")
 
+	// Let the requester know how it all ended, keep count, and remember the scan.
+	upload := options.UploadDestination() != ""
+	record := &history.Record{
+		Options:     options,
+		Destination: strings.Join(options.Destinations, ","),
+		StartedAt:   time.Now(),
+	}
+	if record.Destination == "" {
+		record.Destination = common.DestinationWebDAV
+	}
+	var thumbnail []byte
+	defer func() {
+		var uploadErr *UploadError
+		metricsResult := metrics.ResultFailed
+		switch {
+		case err == nil && !upload:
+			metricsResult = metrics.ResultDownloaded
+			record.Outcome = history.OutcomeDownloaded
+			s.publish(options, progress.Event{Phase: progress.PhaseReady})
+		case err == nil:
+			metricsResult = metrics.ResultUploaded
+			record.Outcome = history.OutcomeUploaded
+			s.publish(options, progress.Event{Phase: progress.PhaseUploaded, FileName: result.FileName})
+		case errors.Is(err, spool.ErrQueued):
+			metricsResult = metrics.ResultQueued
+			record.Outcome = history.OutcomeQueued
+			s.publish(options, progress.Event{Phase: progress.PhaseQueued})
+		case errors.As(err, &uploadErr) && result.delivered():
+			metricsResult = metrics.ResultPartial
+			record.Outcome = history.OutcomePartial
+			s.publish(options, progress.Event{Phase: progress.PhaseFailed, Error: err.Error()})
+		default:
+			if err == ErrDeviceBusy {
+				metricsResult = metrics.ResultBusy
+				metrics.DeviceBusy.WithLabelValues("scan").Inc()
+			}
+			record.Outcome = history.OutcomeFailed
+			thumbnail = nil
+			s.publish(options, progress.Event{Phase: progress.PhaseFailed, Error: err.Error()})
+		}
+		format := options.Format
+		if err == ErrUnsupportedFormat {
+			format = metrics.FormatUnsupported
+		}
+		metrics.Scans.WithLabelValues(format, metricsResult).Inc()
+
+		if err != nil {
+			record.Error = err.Error()
+		}
+		if result != nil {
+			record.FileName = result.FileName
+			record.Uploads = result.historyUploads()
+		}
+		record.Duration = time.Since(record.StartedAt).Seconds()
+		if histErr := s.history.Add(record, thumbnail); histErr != nil {
+			entry.WithError(histErr).Error("Failed to add scan to the history")
+		}
+		s.webhooks.Notify(ctx, webhook.NewPayload(record))
+	}()
+
 	// Select the encoding function to run the resulting image through, and at the same
 	// time make sure the format is a supported one. We do this early because the scan
 	// can take some time to complete, and we don't want to wait that long to tell the
@@ -108,36 +322,274 @@ func (s *Scanner) ScanAndUpload(options *common.ScanOptions) (fileName string, e
 	case "pdf":
 		encode = pdf.Encode
 	default:
-		return "", ErrUnsupportedFormat
+		return nil, ErrUnsupportedFormat
 	}
 
-	// Trigger the scan and get the resulting image.
-	options.Resolution = s.cfg.ScanRes
-	img, err := s.getImage(options)
+	// Trigger the scan and get the resulting image, or reuse the last preview if a low
+	// resolution is good enough.
+	var img image.Image
+	if options.Quick {
+		img, err = s.croppedPreview(options)
+	} else {
+		options.Resolution = s.cfg.ScanRes
+		img, err = s.getImage(ctx, options, nil)
+	}
 	if err != nil {
 		return
 	}
 
-	// Encode the resulting image.
+	// Don't bother encoding and uploading the image if the requester has given up.
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	// Encode the resulting image into a file in the spool, so we don't need to hold the
+	// whole encoded file in memory, and so it doesn't get lost if it can't be uploaded
+	// right away.
+	s.publish(options, progress.Event{Phase: progress.PhaseEncoding})
+
+	options.Device = s.cfg.DeviceName
+	options.ScannedAt = time.Now()
+	spoolEntry, f, err := s.spool.Create(options)
+	if err != nil {
+		return nil, err
+	}
+
+	encodeStart := time.Now()
+	err = encode(f, img, nil)
+	if err == nil {
+		metrics.EncodeDuration.WithLabelValues(options.Format).Observe(time.Since(encodeStart).Seconds())
+		if info, statErr := f.Stat(); statErr == nil {
+			record.Size = info.Size()
+			metrics.OutputSize.WithLabelValues(options.Format).Observe(float64(record.Size))
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.spool.Abort(spoolEntry)
+		return nil, err
+	}
+
+	// Generate a thumbnail for the history. Not having one isn't worth failing the scan
+	// over.
+	var thumbErr error
+	if thumbnail, thumbErr = s.thumbnail(img); thumbErr != nil {
+		entry.WithError(thumbErr).Warn("Failed to generate thumbnail")
+	}
+
+	// If the file must be sent back, open it before handing it to the spool, which
+	// removes it once it's uploaded.
+	result = new(Result)
+	if options.HasDestination(common.DestinationDownload) {
+		if result.File, err = os.Open(f.Name()); err != nil {
+			s.spool.Abort(spoolEntry)
+			return nil, err
+		}
+	}
+
+	if !upload {
+		// The open file is enough to send it back, so there's no need to keep it around.
+		s.spool.Abort(spoolEntry)
+		return result, nil
+	}
+
+	// Give each destination its own spool entry, so a failed upload can be retried
+	// without sending the file again to the destinations it's already been sent to. This
+	// must be done before submitting any of them, since the spool removes the file of an
+	// entry once it's been uploaded.
+	destinations := options.UploadDestinations()
+	entries := make([]*spool.Entry, 0, len(destinations))
+	for i, d := range destinations {
+		entryOptions := *options
+		entryOptions.Destinations = []string{d}
+
+		e := spoolEntry
+		if i == 0 {
+			e.Options = &entryOptions
+		} else if e, err = s.spool.Duplicate(spoolEntry, &entryOptions); err != nil {
+			for _, created := range entries {
+				s.spool.Abort(created)
+			}
+			if result.File != nil {
+				result.File.Close()
+			}
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	// Upload the encoded bytes to all of the destinations at once, or queue them for later
+	// if that's not possible right now.
+	s.publish(options, progress.Event{Phase: progress.PhaseUploading})
+	result.Uploads = make([]*Upload, len(entries))
+	var wg sync.WaitGroup
+	for i, e := range entries {
+		u := &Upload{Destination: destinations[i]}
+		result.Uploads[i] = u
+		e.Options.UploadProgress = s.uploadProgress(options, u.Destination)
+
+		wg.Add(1)
+		go func(e *spool.Entry) {
+			defer wg.Done()
+			u.FileName, u.Err = s.spool.Submit(ctx, e)
+		}(e)
+	}
+	wg.Wait()
+
+	var failed, queued error
+	for _, u := range result.Uploads {
+		uploadEntry := entry.WithField("destination", u.Destination)
+		switch {
+		case u.Err == nil:
+			metrics.Uploads.WithLabelValues(u.Destination, metrics.ResultUploaded).Inc()
+			if result.FileName == "" {
+				result.FileName = u.FileName
+			}
+		case errors.Is(u.Err, spool.ErrQueued):
+			metrics.Uploads.WithLabelValues(u.Destination, metrics.ResultQueued).Inc()
+			uploadEntry.WithError(u.Err).Warn("Upload failed, file has been queued")
+			if queued == nil {
+				queued = u.Err
+			}
+		default:
+			metrics.Uploads.WithLabelValues(u.Destination, metrics.ResultFailed).Inc()
+			uploadEntry.WithError(u.Err).Error("Upload failed")
+			if failed == nil {
+				failed = u.Err
+			}
+		}
+	}
+
+	switch {
+	case failed != nil:
+		return result, &UploadError{Err: failed}
+	case queued != nil:
+		return result, &UploadError{Err: queued}
+	default:
+		return result, nil
+	}
+}
+
+// uploadProgress returns a function publishing the progress of the upload of the file
+// of the scan with the given options to the given destination.
+func (s *Scanner) uploadProgress(
+	options *common.ScanOptions,
+	destination string,
+) func(sent int64, total int64) {
+	lastPercent := 0
+	return func(sent int64, total int64) {
+		if total <= 0 {
+			return
+		}
+
+		// Only publish an event when the percentage changes, so we don't flood
+		// subscribers with an event for every read.
+		if percent := int(100 * sent / total); percent != lastPercent {
+			lastPercent = percent
+			s.publish(options, progress.Event{
+				Phase:       progress.PhaseUploading,
+				Destination: destination,
+				Percent:     percent,
+				BytesSent:   sent,
+				BytesTotal:  total,
+			})
+		}
+	}
+}
+
+// delivered returns whether the file has been, or will be, uploaded to at least one of
+// its destinations.
+func (r *Result) delivered() bool {
+	if r == nil {
+		return false
+	}
+
+	for _, u := range r.Uploads {
+		if u.Err == nil || errors.Is(u.Err, spool.ErrQueued) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// historyUploads returns the uploads of the result, as recorded in the history.
+func (r *Result) historyUploads() []*history.Upload {
+	uploads := make([]*history.Upload, 0, len(r.Uploads))
+	for _, u := range r.Uploads {
+		hu := &history.Upload{
+			Destination: u.Destination,
+			FileName:    u.FileName,
+			Outcome:     history.OutcomeUploaded,
+		}
+		switch {
+		case errors.Is(u.Err, spool.ErrQueued):
+			hu.Outcome = history.OutcomeQueued
+			hu.Error = u.Err.Error()
+		case u.Err != nil:
+			hu.Outcome = history.OutcomeFailed
+			hu.Error = u.Err.Error()
+		}
+		uploads = append(uploads, hu)
+	}
+
+	return uploads
+}
+
+// thumbnail returns a JPEG-encoded copy of the given image, resized to fit within the
+// configured thumbnail size.
+func (s *Scanner) thumbnail(img image.Image) ([]byte, error) {
+	size := float64(s.history.ThumbnailSize())
 	buf := new(bytes.Buffer)
-	if err = encode(buf, img, nil); err != nil {
-		return "", err
+	if err := jpeg.Encode(buf, pdf.FitImage(img, size, size), nil); err != nil {
+		return nil, err
 	}
 
-	// Upload the encoded bytes to the WebDAV server.
-	return s.webDAVClient.Upload(options, buf)
+	return buf.Bytes(), nil
 }
 
-// getImage triggers a scan with the provided resolution on the scanning device.
-func (s *Scanner) getImage(options *common.ScanOptions) (*sane.Image, error) {
-	logrus.WithFields(logrus.Fields{
+// getImage triggers a scan with the provided resolution on the scanning device. If
+// partial isn't nil, it's regularly called with the part of the image scanned so far.
+// The scan is cancelled if the given context is done, or if it takes longer than the
+// configured timeout.
+// Returns ErrDeviceBusy if the device is already in use, or the context's error if the
+// scan has been cancelled.
+func (s *Scanner) getImage(
+	ctx context.Context,
+	options *common.ScanOptions,
+	partial func(img image.Image),
+) (image.Image, error) {
+	// Only use the device for one scan at a time, and don't make requests wait for it to
+	// be available, since scans can take a long time.
+	select {
+	case s.busy <- struct{}{}:
+		defer func() { <-s.busy }()
+	default:
+		return nil, ErrDeviceBusy
+	}
+
+	// Don't keep the device busy forever if something goes wrong with it.
+	if s.cfg.ScanTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.ScanTimeout)
+		defer cancel()
+	}
+
+	logging.Entry(ctx).WithFields(logrus.Fields{
 		"resolution": options.Resolution,
 		"with_rect":  options.ScanArea != nil,
 	}).Info("Reading image")
 
+	s.publish(options, progress.Event{Phase: progress.PhaseWaiting})
+
+	start := time.Now()
+
 	// If the SANE connection hasn't already been established, try to do it now.
 	if s.conn == nil {
-		if err := s.openConn(); err != nil {
+		if err := s.openConn(ctx); err != nil {
 			// If that didn't work, return the error, and try again next time.
 			return nil, err
 		}
@@ -172,7 +624,7 @@ func (s *Scanner) getImage(options *common.ScanOptions) (*sane.Image, error) {
 			return nil, err
 		}
 
-		logrus.WithFields(logrus.Fields{
+		logging.Entry(ctx).WithFields(logrus.Fields{
 			"tlx_mm": mmArea.TLX,
 			"tly_mm": mmArea.TLY,
 			"brx_mm": mmArea.BRX,
@@ -186,5 +638,31 @@ func (s *Scanner) getImage(options *common.ScanOptions) (*sane.Image, error) {
 		}
 	}
 
-	return s.conn.ReadImage()
+	img, err := s.readImage(ctx, func(percent int) {
+		s.publish(options, progress.Event{Phase: progress.PhaseScanning, Percent: percent})
+	}, partial)
+	if err == sane.ErrBusy {
+		// Another program is using the device.
+		return nil, ErrDeviceBusy
+	} else if err != nil {
+		return nil, err
+	}
+
+	metrics.ScanDuration.
+		WithLabelValues(strconv.Itoa(options.Resolution)).
+		Observe(time.Since(start).Seconds())
+
+	return img, nil
+}
+
+// publish publishes the given progress event for the scan with the given options.
+// Previews aren't identified by a job ID, so no event is published for them.
+func (s *Scanner) publish(options *common.ScanOptions, e progress.Event) {
+	if options.Job == "" {
+		return
+	}
+
+	e.Job = options.Job
+	e.User = options.User
+	s.progress.Publish(e)
 }
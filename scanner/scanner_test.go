@@ -0,0 +1,65 @@
+package scanner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/history"
+	"github.com/babolivier/scanner/metrics"
+	"github.com/babolivier/scanner/progress"
+	"github.com/babolivier/scanner/webhook"
+)
+
+func TestUnsupportedFormatsAreCountedTogether(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	hist, err := history.NewStore(&config.HistoryConfig{
+		Path:          filepath.Join(dir, "history.db"),
+		ThumbnailSize: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hist.Close() })
+
+	notifier, err := webhook.NewNotifier(&config.WebhooksConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scanner{
+		cfg:      &config.ScannerConfig{},
+		progress: progress.NewBroker(),
+		history:  hist,
+		webhooks: notifier,
+		busy:     make(chan struct{}, 1),
+	}
+
+	unsupported := metrics.Scans.WithLabelValues(metrics.FormatUnsupported, metrics.ResultFailed)
+	before := testutil.ToFloat64(unsupported)
+
+	for _, format := range []string{"gif", "tiff"} {
+		_, err = s.ScanAndUpload(context.Background(), &common.ScanOptions{Format: format})
+		if err != ErrUnsupportedFormat {
+			t.Fatalf("ScanAndUpload returned %v for %s; want ErrUnsupportedFormat", err, format)
+		}
+	}
+
+	if got := testutil.ToFloat64(unsupported) - before; got != 2 {
+		t.Errorf("counted %v scans with an unsupported format; want 2", got)
+	}
+	if n := testutil.CollectAndCount(metrics.Scans); n != 1 {
+		t.Errorf("got %d label sets for scans; want 1", n)
+	}
+}
@@ -0,0 +1,725 @@
+package spool
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/logging"
+)
+
+const (
+	dataExt     = ".data"
+	metadataExt = ".json"
+	// tmpExt is the extension of the metadata being written, before it replaces the
+	// previous version.
+	tmpExt = ".tmp"
+)
+
+var (
+	// ErrQueued is the error returned by Submit if the file couldn't be uploaded right
+	// away, and has been queued to be uploaded later.
+	ErrQueued = errors.New("upload queued")
+	// ErrNotFound is the error returned if no entry matches the given ID.
+	ErrNotFound = errors.New("entry not found")
+	// ErrBusy is the error returned when trying to alter an entry which file is
+	// currently being uploaded.
+	ErrBusy = errors.New("entry is being uploaded")
+	// ErrNoUploader is the error returned by Uploaders if there's no uploader for the
+	// destination of a file.
+	ErrNoUploader = errors.New("no uploader for this destination")
+)
+
+// Status is the status of an entry in the spool.
+type Status string
+
+const (
+	// StatusPending means the file is waiting to be uploaded.
+	StatusPending Status = "pending"
+	// StatusFailed means the file couldn't be uploaded after the maximum number of
+	// attempts, and won't be retried unless asked to.
+	StatusFailed Status = "failed"
+)
+
+// Uploader uploads the content of a file somewhere, and returns the name it's been
+// uploaded under.
+type Uploader interface {
+	Upload(ctx context.Context, options *common.ScanOptions, body io.Reader) (string, error)
+	// IsPermanent returns whether the given error, returned by Upload, means retrying
+	// the upload is pointless until someone does something about it.
+	IsPermanent(err error) bool
+}
+
+// Uploaders is an Uploader sending each file to the uploader of its destination, as
+// returned by common.ScanOptions.UploadDestination.
+type Uploaders map[string]Uploader
+
+// Upload uploads the given content with the uploader of the destination from the given
+// options.
+// Returns ErrNoUploader if there's no uploader for this destination.
+func (u Uploaders) Upload(
+	ctx context.Context,
+	options *common.ScanOptions,
+	body io.Reader,
+) (string, error) {
+	up, ok := u[options.UploadDestination()]
+	if !ok {
+		return "", ErrNoUploader
+	}
+
+	return up.Upload(ctx, options, body)
+}
+
+// IsPermanent returns whether one of the uploaders considers the given error means
+// retrying the upload is pointless.
+func (u Uploaders) IsPermanent(err error) bool {
+	if err == ErrNoUploader {
+		return true
+	}
+
+	for _, up := range u {
+		if up.IsPermanent(err) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Entry describes a file stored in the spool.
+type Entry struct {
+	ID          string              `json:"id"`
+	Options     *common.ScanOptions `json:"options"`
+	Status      Status              `json:"status"`
+	Attempts    int                 `json:"attempts"`
+	LastError   string              `json:"last_error,omitempty"`
+	CreatedAt   time.Time           `json:"created_at"`
+	NextAttempt time.Time           `json:"next_attempt"`
+	// Size is the size of the entry's file in bytes.
+	Size int64 `json:"size,omitempty"`
+	// FailedAt is the time at which the entry was marked as failed, from which its
+	// retention period starts.
+	FailedAt time.Time `json:"failed_at,omitempty"`
+	// RequestID is the ID of the request the entry was submitted by, so the logs of the
+	// later attempts can be correlated with it.
+	RequestID string `json:"request_id,omitempty"`
+
+	// busy is true while the entry's file is being uploaded.
+	busy bool
+}
+
+// Spool stores encoded files on disk until they've been uploaded, so they aren't lost if
+// the storage is unavailable, or if the process restarts. Files that couldn't be
+// uploaded are retried by a background worker.
+type Spool struct {
+	cfg      *config.SpoolConfig
+	uploader Uploader
+
+	entries map[string]*Entry
+	mu      sync.Mutex
+	wake    chan struct{}
+	// onDone is called once the background worker is done with an entry, if it isn't nil.
+	onDone func(e Entry, fileName string, err error)
+}
+
+// NewSpool returns a new Spool storing files in the configured directory and uploading
+// them with the given uploader. It creates the directory if it doesn't exist, and loads
+// the entries left in it by a previous run.
+func NewSpool(cfg *config.SpoolConfig, uploader Uploader) (*Spool, error) {
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		cfg:      cfg,
+		uploader: uploader,
+		entries:  make(map[string]*Entry),
+		wake:     make(chan struct{}, 1),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load reads the entries stored in the spool's directory. Data files without metadata
+// come from encodings that were interrupted, so they're removed.
+func (s *Spool) load() error {
+	files, err := ioutil.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		switch filepath.Ext(name) {
+		case metadataExt:
+			raw, err := ioutil.ReadFile(filepath.Join(s.cfg.Dir, name))
+			if err != nil {
+				return err
+			}
+
+			e := new(Entry)
+			if err = json.Unmarshal(raw, e); err != nil {
+				logrus.WithError(err).WithField("file", name).Warn("Ignoring malformed spool entry")
+				continue
+			}
+
+			s.entries[e.ID] = e
+		case dataExt:
+			id := strings.TrimSuffix(name, dataExt)
+			if _, err := os.Stat(s.metadataPath(id)); os.IsNotExist(err) {
+				logrus.WithField("file", name).Info("Removing incomplete spool file")
+				if err = os.Remove(filepath.Join(s.cfg.Dir, name)); err != nil {
+					return err
+				}
+			}
+		case tmpExt:
+			// We crashed while updating the metadata of an entry, which previous version
+			// is still there.
+			logrus.WithField("file", name).Info("Removing incomplete spool metadata")
+			if err = os.Remove(filepath.Join(s.cfg.Dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	logrus.WithField("entries", len(s.entries)).Info("Loaded spool")
+
+	return nil
+}
+
+// Create creates a new entry for the file described by the given options, and returns
+// it along with the file to write its content into. The entry isn't persisted until
+// it's been submitted with Submit.
+func (s *Spool) Create(options *common.ScanOptions) (*Entry, *os.File, error) {
+	e, err := newEntry(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.OpenFile(s.dataPath(e.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return e, f, nil
+}
+
+// Duplicate creates a new entry for the file of the given one, which must have been
+// written and closed but not submitted yet, so it can be uploaded with the given options
+// (e.g. to another destination) independently from it. The entry isn't persisted until
+// it's been submitted with Submit.
+func (s *Spool) Duplicate(e *Entry, options *common.ScanOptions) (*Entry, error) {
+	dup, err := newEntry(options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Share the content of the file rather than copying it if the file system allows it.
+	if err = os.Link(s.dataPath(e.ID), s.dataPath(dup.ID)); err == nil {
+		return dup, nil
+	}
+
+	if err = s.copyData(e.ID, dup.ID); err != nil {
+		s.Abort(dup)
+		return nil, err
+	}
+
+	return dup, nil
+}
+
+// newEntry returns a new pending entry with a random ID for the file described by the
+// given options.
+func newEntry(options *common.ScanOptions) (*Entry, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return &Entry{
+		ID:        hex.EncodeToString(b),
+		Options:   options,
+		Status:    StatusPending,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// copyData copies the file of the entry with the given ID into a new file for the entry
+// with the other given ID.
+func (s *Spool) copyData(fromID string, toID string) error {
+	src, err := os.Open(s.dataPath(fromID))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(s.dataPath(toID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Abort removes the file of the given entry, which hasn't been submitted. This is used
+// when writing the file failed.
+func (s *Spool) Abort(e *Entry) {
+	if err := os.Remove(s.dataPath(e.ID)); err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).WithField("spool_id", e.ID).Error("Failed to remove spool file")
+	}
+}
+
+// Submit persists the given entry, which file must have been written and closed, and
+// tries to upload its file right away. If the upload succeeds, the entry is removed
+// from the spool and the name the file has been uploaded under is returned. If the
+// upload failed in a way that retrying might fix, the entry is kept for the background
+// worker to retry, and an error wrapping ErrQueued is returned. This includes uploads
+// interrupted because the given context is done, so the file isn't lost. Otherwise, the
+// entry is kept as failed, and the error from the uploader is returned.
+func (s *Spool) Submit(ctx context.Context, e *Entry) (string, error) {
+	if info, err := os.Stat(s.dataPath(e.ID)); err == nil {
+		e.Size = info.Size()
+	}
+
+	s.mu.Lock()
+	e.busy = true
+	e.RequestID = logging.RequestID(ctx)
+	s.entries[e.ID] = e
+	err := s.save(e)
+	s.mu.Unlock()
+
+	if err != nil {
+		s.mu.Lock()
+		if rmErr := s.remove(e.ID); rmErr != nil {
+			logging.Entry(ctx).WithError(rmErr).Error("Failed to remove spool entry")
+		}
+		s.mu.Unlock()
+		return "", err
+	}
+
+	return s.attemptNow(ctx, e)
+}
+
+// RetryNow tries to upload the file of the entry with the given ID right away,
+// regardless of how many times it's been attempted before, after letting the given
+// function change the options it's uploaded with (e.g. to send it somewhere else) if
+// it isn't nil. The outcome is the same as with Submit.
+// Returns ErrNotFound if there's no entry with this ID, or ErrBusy if the entry's file is
+// currently being uploaded.
+func (s *Spool) RetryNow(
+	ctx context.Context,
+	id string,
+	update func(options *common.ScanOptions),
+) (string, error) {
+	s.mu.Lock()
+	e, ok := s.entries[id]
+	if !ok {
+		s.mu.Unlock()
+		return "", ErrNotFound
+	}
+	if e.busy {
+		s.mu.Unlock()
+		return "", ErrBusy
+	}
+
+	e.busy = true
+	e.Status = StatusPending
+	e.Attempts = 0
+	e.FailedAt = time.Time{}
+	e.RequestID = logging.RequestID(ctx)
+	if update != nil {
+		update(e.Options)
+	}
+	err := s.save(e)
+	s.mu.Unlock()
+
+	if err != nil {
+		s.mu.Lock()
+		e.busy = false
+		s.mu.Unlock()
+		return "", err
+	}
+
+	return s.attemptNow(ctx, e)
+}
+
+// attemptNow tries to upload the file of the given entry, which must have been saved and
+// marked as busy, on behalf of a requester waiting for the outcome. See Submit for what
+// it returns.
+func (s *Spool) attemptNow(ctx context.Context, e *Entry) (string, error) {
+	fileName, err := s.attempt(ctx, e)
+	if err != nil {
+		if s.uploader.IsPermanent(err) {
+			return "", err
+		}
+
+		// Let the worker know there's a new entry to take care of.
+		s.wakeWorker()
+		return "", fmt.Errorf("%w: %s", ErrQueued, err)
+	}
+
+	return fileName, nil
+}
+
+// EntryForJob returns a copy of the most recent entry created for the scan with the
+// given job ID, to upload its file to the given destination, or to any destination if
+// it's empty.
+// Returns ErrNotFound if there's no such entry.
+func (s *Spool) EntryForJob(job string, destination string) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found *Entry
+	for _, e := range s.entries {
+		if e.Options.Job != job ||
+			(destination != "" && e.Options.UploadDestination() != destination) {
+			continue
+		}
+
+		if found == nil || e.CreatedAt.After(found.CreatedAt) {
+			found = e
+		}
+	}
+	if found == nil {
+		return Entry{}, ErrNotFound
+	}
+
+	return *found, nil
+}
+
+// Open opens the file of the entry with the given ID for reading.
+// Returns ErrNotFound if there's no entry with this ID.
+func (s *Spool) Open(id string) (*os.File, error) {
+	s.mu.Lock()
+	_, ok := s.entries[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	f, err := os.Open(s.dataPath(id))
+	if os.IsNotExist(err) {
+		// The entry has been removed in the meantime.
+		return nil, ErrNotFound
+	}
+
+	return f, err
+}
+
+// Entries returns a copy of all of the entries in the spool, sorted by creation date.
+func (s *Spool) Entries() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, *e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+
+	return entries
+}
+
+// Retry marks the entry with the given ID as pending and schedules it to be uploaded
+// right away, regardless of how many times it's been attempted before.
+// Returns ErrNotFound if there's no entry with this ID, or ErrBusy if the entry's file is
+// currently being uploaded.
+func (s *Spool) Retry(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if e.busy {
+		return ErrBusy
+	}
+
+	e.Status = StatusPending
+	e.Attempts = 0
+	e.FailedAt = time.Time{}
+	e.NextAttempt = time.Now()
+	if err := s.save(e); err != nil {
+		return err
+	}
+
+	s.wakeWorker()
+
+	return nil
+}
+
+// Discard removes the entry with the given ID from the spool, along with its file.
+// Returns ErrNotFound if there's no entry with this ID, or ErrBusy if the entry's file is
+// currently being uploaded.
+func (s *Spool) Discard(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if e.busy {
+		return ErrBusy
+	}
+
+	return s.remove(e.ID)
+}
+
+// OnDone registers a function to call once the background worker has uploaded the file
+// of an entry, with the name it's been uploaded under, or has given up on uploading it,
+// with the error from the last attempt. It isn't called for the uploads attempted on
+// behalf of a requester waiting for the outcome, e.g. by Submit or RetryNow. It must be
+// called before Run.
+func (s *Spool) OnDone(fn func(e Entry, fileName string, err error)) {
+	s.onDone = fn
+}
+
+// Run starts the background worker, which uploads pending files when they're due, and
+// removes failed ones once their retention period is over, until the given context is
+// done. Uploads in progress when that happens are interrupted, and their files are kept
+// for the next run.
+func (s *Spool) Run(ctx context.Context) {
+	// Check the spool regularly, in case the clock jumps or we miss a wake-up.
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for ctx.Err() == nil {
+		s.removeExpired()
+		next := s.uploadDue(ctx)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-ticker.C:
+		case <-s.wake:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+	}
+}
+
+// uploadDue tries to upload the files of all of the pending entries which next attempt
+// is due, and returns the time at which the next attempt is due. Uploads are
+// interrupted if the given context is done.
+func (s *Spool) uploadDue(ctx context.Context) time.Time {
+	now := time.Now()
+	next := now.Add(time.Hour)
+
+	s.mu.Lock()
+	due := make([]*Entry, 0)
+	for _, e := range s.entries {
+		if e.Status != StatusPending || e.busy {
+			continue
+		}
+
+		if !e.NextAttempt.After(now) {
+			e.busy = true
+			due = append(due, e)
+		} else if e.NextAttempt.Before(next) {
+			next = e.NextAttempt
+		}
+	}
+	s.mu.Unlock()
+
+	for _, e := range due {
+		// Attach the ID of the request that submitted the entry to the logs of this
+		// attempt.
+		fileName, err := s.attempt(logging.WithRequestID(ctx, e.RequestID), e)
+
+		s.mu.Lock()
+		done := err == nil || e.Status == StatusFailed
+		if e.Status == StatusPending && err != nil && e.NextAttempt.Before(next) {
+			next = e.NextAttempt
+		}
+		snapshot := *e
+		s.mu.Unlock()
+
+		if done && s.onDone != nil {
+			s.onDone(snapshot, fileName, err)
+		}
+	}
+
+	return next
+}
+
+// removeExpired removes the failed entries which have been kept for longer than the
+// configured retention period, along with their files.
+func (s *Spool) removeExpired() {
+	if s.cfg.FailedRetention <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-s.cfg.FailedRetention)
+	for _, e := range s.entries {
+		// Entries which failed before the failure time was recorded don't have one.
+		failedAt := e.FailedAt
+		if failedAt.IsZero() {
+			failedAt = e.CreatedAt
+		}
+
+		if e.Status != StatusFailed || e.busy || failedAt.After(cutoff) {
+			continue
+		}
+
+		entry := logrus.WithField("spool_id", e.ID)
+		entry.Info("Removing expired failed spool entry")
+		if err := s.remove(e.ID); err != nil {
+			entry.WithError(err).Error("Failed to remove spool entry")
+		}
+	}
+}
+
+// attempt tries to upload the file of the given entry, which must have been marked as
+// busy, and updates the entry according to the outcome. If the upload succeeded, the
+// entry is removed from the spool and the name the file has been uploaded under is
+// returned.
+func (s *Spool) attempt(ctx context.Context, e *Entry) (string, error) {
+	entry := logging.Entry(ctx).WithField("spool_id", e.ID)
+
+	fileName, err := s.upload(ctx, e)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.busy = false
+
+	if err == nil {
+		entry.WithField("file_name", fileName).Info("Uploaded spooled file")
+		if err := s.remove(e.ID); err != nil {
+			entry.WithError(err).Error("Failed to remove uploaded file from the spool")
+		}
+		return fileName, nil
+	}
+
+	e.LastError = err.Error()
+
+	// If the upload has been interrupted because the requester went away, it doesn't say
+	// anything about the storage, so let the worker try again right away.
+	if ctx.Err() != nil {
+		e.NextAttempt = time.Now()
+		entry.WithError(err).Info("Spooled file upload interrupted, leaving it to the worker")
+		if saveErr := s.save(e); saveErr != nil {
+			entry.WithError(saveErr).Error("Failed to update spool entry")
+		}
+		return "", err
+	}
+
+	// Schedule the next attempt, waiting exponentially longer after each failure, or give
+	// up if we've reached the maximum number of attempts or if retrying won't help.
+	e.Attempts++
+	if e.Attempts >= s.cfg.MaxAttempts || s.uploader.IsPermanent(err) {
+		e.Status = StatusFailed
+		e.FailedAt = time.Now()
+	} else {
+		backoff := s.cfg.RetryBackoff << uint(e.Attempts-1)
+		if backoff > s.cfg.MaxBackoff || backoff <= 0 {
+			backoff = s.cfg.MaxBackoff
+		}
+		e.NextAttempt = time.Now().Add(backoff)
+	}
+
+	entry.WithError(err).WithFields(logrus.Fields{
+		"attempts":     e.Attempts,
+		"status":       e.Status,
+		"next_attempt": e.NextAttempt,
+	}).Warn("Failed to upload spooled file")
+
+	if saveErr := s.save(e); saveErr != nil {
+		entry.WithError(saveErr).Error("Failed to update spool entry")
+	}
+
+	return "", err
+}
+
+// upload uploads the file of the given entry.
+func (s *Spool) upload(ctx context.Context, e *Entry) (string, error) {
+	f, err := os.Open(s.dataPath(e.ID))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return s.uploader.Upload(ctx, e.Options, f)
+}
+
+// save writes the metadata of the given entry to disk. It writes to a temporary file
+// first so a crash can't leave a partially written entry behind. Must be called with
+// the lock held.
+func (s *Spool) save(e *Entry) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.metadataPath(e.ID) + tmpExt
+	if err = ioutil.WriteFile(tmpPath, raw, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.metadataPath(e.ID))
+}
+
+// remove removes the entry with the given ID from the spool, along with its file. Must be
+// called with the lock held.
+func (s *Spool) remove(id string) error {
+	delete(s.entries, id)
+
+	if err := os.Remove(s.metadataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Remove(s.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// wakeWorker tells the background worker to check the spool for due uploads.
+func (s *Spool) wakeWorker() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dataPath returns the path to the file of the entry with the given ID.
+func (s *Spool) dataPath(id string) string {
+	return filepath.Join(s.cfg.Dir, id+dataExt)
+}
+
+// metadataPath returns the path to the metadata of the entry with the given ID.
+func (s *Spool) metadataPath(id string) string {
+	return filepath.Join(s.cfg.Dir, id+metadataExt)
+}
@@ -0,0 +1,390 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+)
+
+// errPermanent is the error fakeUploader considers permanent.
+var errPermanent = errors.New("permanent failure")
+
+// errTransient is an error fakeUploader doesn't consider permanent.
+var errTransient = errors.New("transient failure")
+
+// fakeUploader records the files it's asked to upload, failing with the errors it's
+// given in order before succeeding.
+type fakeUploader struct {
+	mu   sync.Mutex
+	errs []error
+	// block, if not nil, is waited on by Upload before it returns.
+	block   chan struct{}
+	uploads []string
+	options []common.ScanOptions
+}
+
+func (u *fakeUploader) Upload(
+	ctx context.Context,
+	options *common.ScanOptions,
+	body io.Reader,
+) (string, error) {
+	if u.block != nil {
+		<-u.block
+	}
+
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.uploads = append(u.uploads, string(content))
+	u.options = append(u.options, *options)
+	if len(u.errs) > 0 {
+		err, u.errs = u.errs[0], u.errs[1:]
+		return "", err
+	}
+
+	return string(options.FileName) + "." + options.Format, nil
+}
+
+func (u *fakeUploader) IsPermanent(err error) bool {
+	return err == errPermanent
+}
+
+// attempts returns the number of times Upload has been called.
+func (u *fakeUploader) attempts() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return len(u.uploads)
+}
+
+// tempDir returns a new temporary directory, which is removed at the end of the test.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+// newTestSpool returns a new Spool storing files in the given directory, retrying
+// failed uploads right away up to 3 times.
+func newTestSpool(t *testing.T, dir string, up Uploader) *Spool {
+	s, err := NewSpool(&config.SpoolConfig{
+		Dir:          dir,
+		MaxAttempts:  3,
+		RetryBackoff: time.Millisecond,
+		MaxBackoff:   time.Millisecond,
+	}, up)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// createEntry creates a new entry for a PDF file named scan with the given content, and
+// writes the file, but doesn't submit it.
+func createEntry(t *testing.T, s *Spool, content string) *Entry {
+	e, f, err := s.Create(&common.ScanOptions{Format: "pdf", FileName: "scan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+// files returns the names of the files in the given directory.
+func files(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+
+	return names
+}
+
+func TestSubmit(t *testing.T) {
+	tests := []struct {
+		name string
+		errs []error
+		// wantErr is the error Submit should return, or wrap if it's ErrQueued.
+		wantErr    error
+		wantStatus Status
+	}{
+		{name: "uploaded"},
+		{name: "transient failure", errs: []error{errTransient}, wantErr: ErrQueued, wantStatus: StatusPending},
+		{name: "permanent failure", errs: []error{errPermanent}, wantErr: errPermanent, wantStatus: StatusFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			up := &fakeUploader{errs: tt.errs}
+			s := newTestSpool(t, dir, up)
+
+			e := createEntry(t, s, "%PDF-1.4\n")
+			name, err := s.Submit(context.Background(), e)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Submit returned %v; want %v", err, tt.wantErr)
+			}
+			if len(up.uploads) != 1 || up.uploads[0] != "%PDF-1.4\n" {
+				t.Errorf("uploaded %q; want the file once", up.uploads)
+			}
+
+			if tt.wantErr == nil {
+				if name != "scan.pdf" {
+					t.Errorf("got name %q; want scan.pdf", name)
+				}
+				if len(s.Entries()) != 0 || len(files(t, dir)) != 0 {
+					t.Errorf("the entry is still in the spool once uploaded: %v", files(t, dir))
+				}
+				return
+			}
+
+			// The entry must be kept, including after a restart.
+			for _, s := range []*Spool{s, newTestSpool(t, dir, up)} {
+				entries := s.Entries()
+				if len(entries) != 1 {
+					t.Fatalf("got %d entries; want 1", len(entries))
+				}
+				got := entries[0]
+				if got.ID != e.ID || got.Status != tt.wantStatus || got.Attempts != 1 ||
+					got.LastError != tt.errs[0].Error() || got.Size != int64(len("%PDF-1.4\n")) {
+					t.Errorf("got entry %+v", got)
+				}
+				if (tt.wantStatus == StatusFailed) == got.FailedAt.IsZero() {
+					t.Errorf("got FailedAt %v for a %s entry", got.FailedAt, got.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestWorkerRetriesUntilUploaded(t *testing.T) {
+	tests := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantStatus   Status
+	}{
+		{name: "uploaded", errs: []error{errTransient, errTransient}, wantAttempts: 3},
+		{name: "out of attempts", errs: []error{errTransient, errTransient, errTransient}, wantAttempts: 3, wantStatus: StatusFailed},
+		{name: "permanent failure", errs: []error{errTransient, errPermanent}, wantAttempts: 2, wantStatus: StatusFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			up := &fakeUploader{errs: tt.errs}
+
+			// Queue the file, then restart before the worker gets to it.
+			s := newTestSpool(t, dir, up)
+			e := createEntry(t, s, "%PDF-1.4\n")
+			if _, err := s.Submit(context.Background(), e); !errors.Is(err, ErrQueued) {
+				t.Fatalf("Submit returned %v; want ErrQueued", err)
+			}
+			s = newTestSpool(t, dir, up)
+
+			type outcome struct {
+				e        Entry
+				fileName string
+				err      error
+			}
+			done := make(chan outcome, 1)
+			s.OnDone(func(e Entry, fileName string, err error) {
+				done <- outcome{e, fileName, err}
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := make(chan struct{})
+			go func() {
+				s.Run(ctx)
+				close(stopped)
+			}()
+			defer func() {
+				cancel()
+				<-stopped
+			}()
+
+			var got outcome
+			select {
+			case got = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the worker didn't finish uploading the file")
+			}
+
+			if up.attempts() != tt.wantAttempts {
+				t.Errorf("got %d attempts; want %d", up.attempts(), tt.wantAttempts)
+			}
+			if got.e.ID != e.ID {
+				t.Errorf("got done entry %s; want %s", got.e.ID, e.ID)
+			}
+
+			if tt.wantStatus == "" {
+				if got.err != nil || got.fileName != "scan.pdf" {
+					t.Errorf("got %q, %v; want scan.pdf", got.fileName, got.err)
+				}
+				if len(s.Entries()) != 0 || len(files(t, dir)) != 0 {
+					t.Errorf("the entry is still in the spool once uploaded: %v", files(t, dir))
+				}
+				return
+			}
+
+			if got.err != tt.errs[tt.wantAttempts-1] || got.e.Status != tt.wantStatus {
+				t.Errorf("got %s entry with %v; want %s", got.e.Status, got.err, tt.wantStatus)
+			}
+			if entries := s.Entries(); len(entries) != 1 || entries[0].Status != tt.wantStatus {
+				t.Errorf("got entries %+v; want the %s entry", entries, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRetryNow(t *testing.T) {
+	dir := tempDir(t)
+	up := &fakeUploader{errs: []error{errPermanent}}
+	s := newTestSpool(t, dir, up)
+
+	e := createEntry(t, s, "%PDF-1.4\n")
+	if _, err := s.Submit(context.Background(), e); err != errPermanent {
+		t.Fatalf("Submit returned %v; want errPermanent", err)
+	}
+
+	name, err := s.RetryNow(context.Background(), e.ID, func(options *common.ScanOptions) {
+		options.FileName = "invoice"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "invoice.pdf" || up.options[1].FileName != "invoice" {
+		t.Errorf("got name %q; want the file uploaded with the updated options", name)
+	}
+	if len(s.Entries()) != 0 || len(files(t, dir)) != 0 {
+		t.Errorf("the entry is still in the spool once uploaded: %v", files(t, dir))
+	}
+
+	if _, err = s.RetryNow(context.Background(), e.ID, nil); err != ErrNotFound {
+		t.Errorf("RetryNow returned %v for an uploaded entry; want ErrNotFound", err)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	dir := tempDir(t)
+	up := &fakeUploader{errs: []error{errPermanent}}
+	s := newTestSpool(t, dir, up)
+
+	e := createEntry(t, s, "%PDF-1.4\n")
+	if _, err := s.Submit(context.Background(), e); err != errPermanent {
+		t.Fatalf("Submit returned %v; want errPermanent", err)
+	}
+
+	// Entries can't be altered while their file is being uploaded.
+	up.errs = []error{errPermanent}
+	up.block = make(chan struct{})
+	retried := make(chan error)
+	go func() {
+		_, err := s.RetryNow(context.Background(), e.ID, nil)
+		retried <- err
+	}()
+	for busy := false; !busy; {
+		s.mu.Lock()
+		busy = s.entries[e.ID].busy
+		s.mu.Unlock()
+	}
+	if err := s.Discard(e.ID); err != ErrBusy {
+		t.Errorf("Discard returned %v for a busy entry; want ErrBusy", err)
+	}
+	if _, err := s.RetryNow(context.Background(), e.ID, nil); err != ErrBusy {
+		t.Errorf("RetryNow returned %v for a busy entry; want ErrBusy", err)
+	}
+	close(up.block)
+	if err := <-retried; err != errPermanent {
+		t.Fatalf("RetryNow returned %v; want errPermanent", err)
+	}
+
+	if err := s.Discard(e.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Entries()) != 0 || len(files(t, dir)) != 0 {
+		t.Errorf("the entry is still in the spool once discarded: %v", files(t, dir))
+	}
+	if _, err := s.Open(e.ID); err != ErrNotFound {
+		t.Errorf("Open returned %v for a discarded entry; want ErrNotFound", err)
+	}
+	if err := s.Discard(e.ID); err != ErrNotFound {
+		t.Errorf("Discard returned %v for a discarded entry; want ErrNotFound", err)
+	}
+}
+
+func TestLoadCleansUpInterruptedWrites(t *testing.T) {
+	dir := tempDir(t)
+	up := &fakeUploader{errs: []error{errTransient}}
+	s := newTestSpool(t, dir, up)
+
+	e := createEntry(t, s, "%PDF-1.4\n")
+	if _, err := s.Submit(context.Background(), e); !errors.Is(err, ErrQueued) {
+		t.Fatalf("Submit returned %v; want ErrQueued", err)
+	}
+
+	// Saving an entry doesn't leave its temporary file behind.
+	if got := files(t, dir); len(got) != 2 {
+		t.Fatalf("got files %v; want the entry's file and metadata", got)
+	}
+
+	// Simulate a crash while writing a new file, and while updating the metadata of the
+	// entry.
+	if err := ioutil.WriteFile(filepath.Join(dir, "interrupted"+dataExt), []byte("%PDF"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.metadataPath(e.ID)+tmpExt, []byte(`{"id":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestSpool(t, dir, up)
+	entries := s.Entries()
+	if len(entries) != 1 || entries[0].ID != e.ID || entries[0].Attempts != 1 {
+		t.Fatalf("got entries %+v; want the previous version of the entry", entries)
+	}
+	if got := files(t, dir); len(got) != 2 {
+		t.Errorf("got files %v; want the incomplete ones removed", got)
+	}
+
+	f, err := s.Open(e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if content, err := ioutil.ReadAll(f); err != nil || string(content) != "%PDF-1.4\n" {
+		t.Errorf("got content %q (%v)", content, err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "interrupted"+dataExt)); !os.IsNotExist(err) {
+		t.Errorf("the incomplete file is still there: %v", err)
+	}
+}
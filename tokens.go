@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/babolivier/scanner/auth"
+	"github.com/babolivier/scanner/config"
+)
+
+const tokensUsage = `Usage:
+  scanner [-c config.yaml] tokens create -name NAME -scopes SCOPES [-user USER] [-presets PRESETS] [-destinations FOLDERS]
+  scanner [-c config.yaml] tokens list
+  scanner [-c config.yaml] tokens revoke ID
+
+Scopes are among preview, scan, admin and metrics. Lists are comma-separated.
+`
+
+// errTokensUsage is the error returned by runTokensCommand if the subcommand has been
+// called with invalid arguments.
+var errTokensUsage = errors.New("invalid arguments")
+
+// runTokensCommand runs the tokens subcommand with the given arguments, which lets
+// administrators manage API tokens from the command line.
+// Returns errTokensUsage if the arguments are invalid.
+func runTokensCommand(cfg *config.AuthConfig, args []string) error {
+	if len(args) == 0 {
+		return errTokensUsage
+	}
+
+	store, err := auth.NewTokenStore(cfg.TokensFile)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("tokens create", flag.ContinueOnError)
+		// The usage of the whole subcommand is printed by main.
+		fs.Usage = func() {}
+		name := fs.String("name", "", "Name of the token, to tell it apart from the others")
+		user := fs.String(
+			"user", "", "User the token acts on behalf of (required to see the history without the admin scope)",
+		)
+		scopes := fs.String("scopes", "", "Scopes to grant the token")
+		presets := fs.String("presets", "", "Presets the token can use (default: all)")
+		destinations := fs.String(
+			"destinations", "", "Folders the token can store files in, and nowhere else (default: all)",
+		)
+		if err = fs.Parse(args[1:]); err != nil {
+			return errTokensUsage
+		}
+
+		if *name == "" || *scopes == "" || fs.NArg() != 0 {
+			return errTokensUsage
+		}
+
+		var tokenScopes []auth.Scope
+		for _, scope := range splitList(*scopes) {
+			tokenScopes = append(tokenScopes, auth.Scope(scope))
+		}
+
+		_, value, err := store.Create(
+			*name,
+			*user,
+			tokenScopes,
+			splitList(*presets),
+			splitList(*destinations),
+		)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(value)
+	case "list":
+		if len(args) != 1 {
+			return errTokensUsage
+		}
+
+		tokens, err := store.Tokens()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tUSER\tSCOPES\tPRESETS\tDESTINATIONS\tCREATED\tLAST USED")
+		for _, t := range tokens {
+			var scopes []string
+			for _, scope := range t.Scopes {
+				scopes = append(scopes, string(scope))
+			}
+
+			lastUsed := "never"
+			if t.LastUsedAt != nil {
+				lastUsed = t.LastUsedAt.Local().Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(
+				w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				t.ID, t.Name, t.User,
+				strings.Join(scopes, ","),
+				strings.Join(t.Presets, ","),
+				strings.Join(t.Destinations, ","),
+				t.CreatedAt.Local().Format(time.RFC3339),
+				lastUsed,
+			)
+		}
+
+		return w.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return errTokensUsage
+		}
+
+		return store.Revoke(args[1])
+	default:
+		return errTokensUsage
+	}
+
+	return nil
+}
+
+// splitList splits the given comma-separated list, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
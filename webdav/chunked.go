@@ -0,0 +1,304 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/logging"
+)
+
+const (
+	// chunkNameFormat is the format of the name of each chunk. Nextcloud requires chunk
+	// names to be numbers between 1 and 10000, and zero-padding them ensures servers
+	// that sort chunks by name (as the first version of the protocol did) assemble them
+	// in the right order.
+	chunkNameFormat = "%05d"
+
+	// minChunkSize is the minimum size of the chunks Nextcloud accepts, except for the
+	// last one.
+	minChunkSize = 5 << 20
+)
+
+var (
+	// errChunkingUnsupported is the error returned by putChunked if the WebDAV server
+	// doesn't support chunked uploads.
+	errChunkingUnsupported = errors.New("chunked uploads not supported")
+)
+
+// putChunked uploads the content read from the given reader, which is of the given size,
+// to the given path, relative to the upload path, using Nextcloud's chunked upload
+// protocol. Like a PUT, it returns a 201 Created status once the file has been created,
+// and a 412 Precondition Failed status if a file already exists at this path. See
+// https://docs.nextcloud.com/server/latest/developer_manual/client_apis/WebDAV/chunking.html
+//
+// If a chunk fails to upload even after retrying it, the upload resumes from the last
+// chunk the server has acknowledged, up to the configured number of retries.
+// Returns errChunkingUnsupported if the server doesn't seem to support chunked uploads,
+// in which case nothing has been read from the body.
+func (c *Client) putChunked(
+	ctx context.Context,
+	acc *config.WebDAVAccount,
+	fileName string,
+	body io.Reader,
+	size int64,
+) (int, error) {
+	uploadsURL, ok := c.chunkedUploadsURL(acc)
+	if !ok {
+		return 0, errChunkingUnsupported
+	}
+
+	destination, err := c.fileURL(acc, fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	// Resuming requires being able to go back to an arbitrary offset in the body, which
+	// we should always be able to do since we know the size of the body.
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return 0, errChunkingUnsupported
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	// Create the collection the chunks will be uploaded into.
+	transferID, err := newTransferID()
+	if err != nil {
+		return 0, err
+	}
+
+	uploadDir := strings.TrimSuffix(uploadsURL, "/") + "/" + transferID
+
+	header := make(http.Header)
+	header.Set("Destination", destination)
+	header.Set("OC-Total-Length", strconv.FormatInt(size, 10))
+
+	resp, err := c.do(ctx, acc, "MKCOL", uploadDir, nil, header)
+	if err != nil {
+		return 0, err
+	}
+	closeBody(resp)
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+	case http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return 0, errChunkingUnsupported
+	default:
+		return 0, fmt.Errorf("WebDAV server responded with status %d when starting chunked upload", resp.StatusCode)
+	}
+
+	entry := logging.Entry(ctx).WithFields(logrus.Fields{
+		"filename":    fileName,
+		"transfer_id": transferID,
+		"size":        size,
+	})
+	entry.Info("Started chunked upload")
+
+	// Try to clean up the chunks we've uploaded so far if the file can't be assembled.
+	abort := func() {
+		if resp, err := c.do(ctx, acc, http.MethodDelete, uploadDir, nil, nil); err == nil {
+			closeBody(resp)
+		}
+	}
+
+	if err = c.putChunks(ctx, acc, uploadDir, header, body, seeker, start, size); err != nil {
+		abort()
+		return 0, err
+	}
+
+	// Ask the server to assemble the chunks into the destination file, without replacing
+	// a file that's been created there since we checked its name was available.
+	moveHeader := header.Clone()
+	moveHeader.Set("Overwrite", "F")
+
+	resp, err = c.do(ctx, acc, "MOVE", uploadDir+"/.file", nil, moveHeader)
+	if err != nil {
+		abort()
+		return 0, err
+	}
+	closeBody(resp)
+
+	entry.WithField("status_code", resp.StatusCode).Info("Assembled chunks")
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent:
+		// Some servers respond with 204 No Content even though there was nothing to
+		// replace, either way the file has been created.
+		return http.StatusCreated, nil
+	default:
+		// This includes 412 Precondition Failed if the destination file already exists,
+		// which is what PUT responds with in this case too.
+		abort()
+		return resp.StatusCode, nil
+	}
+}
+
+// putChunks reads the given body, which is of the given size and starts at the given
+// offset, and uploads it in chunks into the given upload collection, sending the given
+// headers along with each chunk. If a chunk fails to upload, it lists the chunks the
+// server has acknowledged, and resumes from the first missing one.
+func (c *Client) putChunks(
+	ctx context.Context,
+	acc *config.WebDAVAccount,
+	uploadDir string,
+	header http.Header,
+	body io.Reader,
+	seeker io.Seeker,
+	start int64,
+	size int64,
+) error {
+	buf := make([]byte, c.cfg.ChunkSize)
+	chunks := int((size + c.cfg.ChunkSize - 1) / c.cfg.ChunkSize)
+
+	resumes := 0
+	for n := 1; n <= chunks; n++ {
+		// Read the chunk into memory, so it can be retried if needed.
+		chunkLen := c.cfg.ChunkSize
+		if remaining := size - int64(n-1)*c.cfg.ChunkSize; remaining < chunkLen {
+			chunkLen = remaining
+		}
+
+		if _, err := io.ReadFull(body, buf[:chunkLen]); err != nil {
+			return err
+		}
+
+		chunkURL := uploadDir + "/" + fmt.Sprintf(chunkNameFormat, n)
+		resp, err := c.do(ctx, acc, http.MethodPut, chunkURL, bytes.NewReader(buf[:chunkLen]), header)
+		if err == nil {
+			closeBody(resp)
+			if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusNoContent {
+				continue
+			}
+			err = fmt.Errorf("WebDAV server responded with status %d when uploading chunk %d", resp.StatusCode, n)
+		}
+
+		// The chunk couldn't be uploaded, so figure out where to resume from, if we're
+		// allowed to.
+		resumes++
+		if resumes > c.cfg.MaxRetries {
+			return err
+		}
+
+		logging.Entry(ctx).WithError(err).WithField("chunk", n).Warn("Failed to upload chunk, resuming")
+
+		acked, listErr := c.acknowledgedChunks(ctx, acc, uploadDir)
+		if listErr != nil {
+			return listErr
+		}
+
+		// Find the first chunk the server doesn't have, and go back to it.
+		n = 1
+		for n < chunks && acked[n] {
+			n++
+		}
+
+		if _, err = seeker.Seek(start+int64(n-1)*c.cfg.ChunkSize, io.SeekStart); err != nil {
+			return err
+		}
+
+		// Cancel out the increment at the end of this iteration.
+		n--
+	}
+
+	return nil
+}
+
+// acknowledgedChunks lists the chunks that have been uploaded to the given upload
+// collection, and returns their numbers.
+func (c *Client) acknowledgedChunks(
+	ctx context.Context,
+	acc *config.WebDAVAccount,
+	uploadDir string,
+) (map[int]bool, error) {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	header.Set("Depth", "1")
+
+	resp, err := c.do(ctx, acc, "PROPFIND", uploadDir, strings.NewReader(propfindBody), header)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("WebDAV server responded with status %d when listing chunks", resp.StatusCode)
+	}
+
+	var ms multistatus
+	if err = xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+
+	acked := make(map[int]bool)
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, err
+		}
+
+		// Ignore anything that's not a chunk, including the collection itself.
+		if n, err := strconv.Atoi(path.Base(href.Path)); err == nil {
+			acked[n] = true
+		}
+	}
+
+	return acked, nil
+}
+
+// chunkedUploadsURL returns the URL of the collection to create upload collections in,
+// and whether chunked uploads can be used. If no such URL has been configured, it tries
+// to derive it from the root URL, which works if the root URL is a Nextcloud WebDAV
+// URL.
+func (c *Client) chunkedUploadsURL(acc *config.WebDAVAccount) (string, bool) {
+	if acc.ChunkedUploadsURL != "" {
+		return acc.ChunkedUploadsURL, true
+	}
+
+	u, err := url.Parse(acc.RootURL)
+	if err != nil {
+		return "", false
+	}
+
+	// The root URL can either be the URL to the files of a given user (e.g.
+	// https://cloud.example.com/remote.php/dav/files/alice), or the legacy WebDAV URL
+	// (https://cloud.example.com/remote.php/webdav), in which case we assume the user ID
+	// is the same as the login name.
+	p := strings.TrimSuffix(u.Path, "/")
+	if i := strings.Index(p, "/remote.php/dav/files/"); i != -1 {
+		user := strings.SplitN(p[i+len("/remote.php/dav/files/"):], "/", 2)[0]
+		u.Path = p[:i] + "/remote.php/dav/uploads/" + user
+	} else if i = strings.Index(p, "/remote.php/webdav"); i != -1 && acc.User != "" {
+		u.Path = p[:i] + "/remote.php/dav/uploads/" + acc.User
+	} else {
+		return "", false
+	}
+
+	return u.String(), true
+}
+
+// newTransferID generates a random identifier for a chunked upload.
+func newTransferID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return "scanner-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,203 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+)
+
+// nextcloud is a stand-in Nextcloud server, storing files under /files and accepting
+// chunked uploads into collections under /uploads.
+type nextcloud struct {
+	mu     sync.Mutex
+	files  map[string]string
+	chunks map[string]map[string]string
+	// taken lists the paths another upload creates right before the chunks of a file are
+	// assembled there.
+	taken map[string]bool
+	// moveStatus, if not zero, is the status to respond to MOVE requests with, without
+	// assembling anything.
+	moveStatus int
+	moves      []http.Header
+	deleted    []string
+}
+
+func newNextcloud() *nextcloud {
+	return &nextcloud{
+		files:  make(map[string]string),
+		chunks: make(map[string]map[string]string),
+		taken:  make(map[string]bool),
+	}
+}
+
+func (nc *nextcloud) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	p := req.URL.Path
+	body, _ := ioutil.ReadAll(req.Body)
+	inUploads := strings.HasPrefix(p, "/uploads/")
+
+	switch {
+	case req.Method == "MKCOL" && inUploads:
+		nc.chunks[p] = make(map[string]string)
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == "MKCOL":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	case req.Method == http.MethodHead:
+		if _, ok := nc.files[p]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case req.Method == http.MethodPut && inUploads:
+		nc.chunks[path.Dir(p)][path.Base(p)] = string(body)
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == "MOVE":
+		nc.moves = append(nc.moves, req.Header)
+		if nc.moveStatus != 0 {
+			w.WriteHeader(nc.moveStatus)
+			return
+		}
+
+		u, _ := url.Parse(req.Header.Get("Destination"))
+		if nc.taken[u.Path] {
+			nc.files[u.Path] = "concurrent"
+			delete(nc.taken, u.Path)
+		}
+		if _, ok := nc.files[u.Path]; ok && req.Header.Get("Overwrite") == "F" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		dir := path.Dir(p)
+		names := make([]string, 0, len(nc.chunks[dir]))
+		for name := range nc.chunks[dir] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var assembled strings.Builder
+		for _, name := range names {
+			assembled.WriteString(nc.chunks[dir][name])
+		}
+		nc.files[u.Path] = assembled.String()
+		delete(nc.chunks, dir)
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodDelete:
+		nc.deleted = append(nc.deleted, p)
+		delete(nc.chunks, p)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		// Files must only be uploaded in chunks.
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestUploadInChunks(t *testing.T) {
+	const content = "0123456789"
+
+	tests := []struct {
+		name       string
+		onConflict string
+		taken      []string
+		moveStatus int
+		// wantName is the name the file should be uploaded under, if it should be.
+		wantName string
+		// wantErr is the error the upload should fail with, if it should.
+		wantErr error
+		// wantAborted is the number of upload collections that should have been deleted.
+		wantAborted int
+	}{
+		{name: "assembled", onConflict: config.ConflictSuffix, wantName: "scan.pdf"},
+		{name: "no content", onConflict: config.ConflictSuffix, moveStatus: http.StatusNoContent, wantName: "scan.pdf"},
+		{
+			name:        "suffix taken concurrently",
+			onConflict:  config.ConflictSuffix,
+			taken:       []string{"/files/scan.pdf"},
+			wantName:    "scan (2).pdf",
+			wantAborted: 1,
+		},
+		{
+			name:        "reject taken concurrently",
+			onConflict:  config.ConflictReject,
+			taken:       []string{"/files/scan.pdf"},
+			wantErr:     ErrNoAvailableName,
+			wantAborted: 1,
+		},
+		{
+			name:        "move failed",
+			onConflict:  config.ConflictSuffix,
+			moveStatus:  http.StatusInternalServerError,
+			wantErr:     &StatusError{StatusCode: http.StatusInternalServerError},
+			wantAborted: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := newNextcloud()
+			nc.moveStatus = tt.moveStatus
+			for _, p := range tt.taken {
+				nc.taken[p] = true
+			}
+			s := newTestServer(t, nc.ServeHTTP)
+			c := newTestClient(t, s, "", "files")
+			c.cfg.OnConflict = tt.onConflict
+			c.cfg.ChunkedUploadsURL = s.URL + "/uploads/alice"
+			c.cfg.ChunkedUploadThreshold = 1
+			c.cfg.ChunkSize = 4
+
+			options := &common.ScanOptions{Format: "pdf", FileName: "scan"}
+			name, err := c.Upload(context.Background(), options, bytes.NewReader([]byte(content)))
+
+			var statusErr *StatusError
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("Upload returned an error: %v", err)
+			case errors.As(tt.wantErr, &statusErr):
+				var gotErr *StatusError
+				if !errors.As(err, &gotErr) || gotErr.StatusCode != statusErr.StatusCode {
+					t.Fatalf("Upload returned %v; want %v", err, tt.wantErr)
+				}
+			case tt.wantErr != nil && err != tt.wantErr:
+				t.Fatalf("Upload returned %v; want %v", err, tt.wantErr)
+			}
+
+			if tt.wantName != "" {
+				if name != tt.wantName {
+					t.Errorf("got name %q; want %q", name, tt.wantName)
+				}
+				if got := nc.files["/files/"+name]; tt.moveStatus == 0 && got != content {
+					t.Errorf("got content %q; want %q", got, content)
+				}
+			}
+
+			for _, header := range nc.moves {
+				if header.Get("Overwrite") != "F" {
+					t.Errorf("MOVE sent with Overwrite %q; want F", header.Get("Overwrite"))
+				}
+			}
+			for _, p := range tt.taken {
+				if nc.files[p] != "concurrent" {
+					t.Errorf("%s has been overwritten", p)
+				}
+			}
+
+			if len(nc.deleted) != tt.wantAborted {
+				t.Errorf("deleted %v; want %d upload collections", nc.deleted, tt.wantAborted)
+			}
+			if len(nc.chunks) != 0 && tt.moveStatus == 0 {
+				t.Errorf("left chunks behind: %v", nc.chunks)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/logging"
+	"github.com/babolivier/scanner/naming"
+)
+
+const (
+	// propfindBody is the body of the PROPFIND requests used to list folders. We only
+	// need to know the type of each resource.
+	propfindBody = `<?xml version="1.0" encoding="utf-8"?>` +
+		`<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/></d:prop></d:propfind>`
+)
+
+var (
+	// ErrFolderNotFound is the error returned by ListFolders if the folder doesn't exist.
+	ErrFolderNotFound = errors.New("folder not found")
+	// ErrFolderExists is the error returned by CreateFolder if something already exists
+	// at the given path.
+	ErrFolderExists = errors.New("folder already exists")
+	// ErrFolderForbidden is the error wrapped by the error returned by Upload if one of
+	// the folders the file is going into is missing, and the WebDAV server doesn't allow
+	// us to create it. This usually means the credentials in use don't have write access
+	// to the upload path or one of its parents.
+	ErrFolderForbidden = errors.New("not allowed to create folder")
+)
+
+// multistatus is the body of a 207 Multi-Status response to a PROPFIND request, as
+// defined by RFC4918.
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Collection *struct{} `xml:"DAV: prop>resourcetype>collection"`
+			Status     string    `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// ListFolders returns the names of the folders directly within the folder at the given
+// path, relative to the upload path of the given user's WebDAV account, sorted
+// alphabetically.
+// Returns an error wrapping naming.ErrInvalidFileName if the path isn't valid,
+// ErrFolderNotFound if the folder doesn't exist, or ErrNoAccount if there's no account
+// to use for this user.
+func (c *Client) ListFolders(ctx context.Context, user string, p string) ([]string, error) {
+	if err := naming.CheckPath(p); err != nil {
+		return nil, err
+	}
+
+	acc, err := c.account(user)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	// Only list the direct children of the folder.
+	header.Set("Depth", "1")
+
+	resp, err := c.request(ctx, acc, "PROPFIND", p, strings.NewReader(propfindBody), header)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+
+	logging.Entry(ctx).WithField("status_code", resp.StatusCode).Info("Listed folder")
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrFolderNotFound
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("WebDAV server responded with status %d", resp.StatusCode)
+	}
+
+	var ms multistatus
+	if err = xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+
+	// The response includes the folder itself, which we recognise by its path.
+	self := strings.TrimSuffix(resp.Request.URL.Path, "/")
+
+	folders := make([]string, 0)
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, err
+		}
+
+		hrefPath := strings.TrimSuffix(href.Path, "/")
+		if hrefPath == self {
+			continue
+		}
+
+		for _, ps := range r.Propstat {
+			if ps.Collection != nil && strings.Contains(ps.Status, " 200 ") {
+				folders = append(folders, path.Base(hrefPath))
+				break
+			}
+		}
+	}
+
+	sort.Strings(folders)
+
+	return folders, nil
+}
+
+// CreateFolder creates a folder at the given path, relative to the upload path of the
+// given user's WebDAV account. The parent folder must already exist.
+// Returns an error wrapping naming.ErrInvalidFileName if the path isn't valid,
+// ErrFolderExists if something already exists at this path, ErrFolderNotFound if the
+// parent folder doesn't exist, an error wrapping ErrFolderForbidden if the WebDAV
+// server doesn't allow creating the folder, or ErrNoAccount if there's no account to
+// use for this user.
+func (c *Client) CreateFolder(ctx context.Context, user string, p string) error {
+	if p == "" {
+		return ErrFolderExists
+	}
+
+	if err := naming.CheckPath(p); err != nil {
+		return err
+	}
+
+	acc, err := c.account(user)
+	if err != nil {
+		return err
+	}
+
+	status, err := c.mkcol(ctx, acc, path.Join(acc.UploadPath, p))
+	if err != nil {
+		return err
+	}
+
+	// See RFC4918 section 9.3.1 for the meaning of these status codes.
+	switch status {
+	case http.StatusCreated:
+		return nil
+	case http.StatusMethodNotAllowed:
+		return ErrFolderExists
+	case http.StatusConflict:
+		return ErrFolderNotFound
+	case http.StatusForbidden:
+		return fmt.Errorf("%w: %s", ErrFolderForbidden, p)
+	default:
+		return fmt.Errorf("WebDAV server responded with status %d", status)
+	}
+}
+
+// ensureFolder makes sure the folder at the given path, relative to the upload path,
+// exists on the WebDAV server, along with all of its parents up to and including the
+// upload path, and creates the ones that don't. It remembers which folders exist so it
+// doesn't have to check them again next time.
+// Returns an error wrapping ErrFolderForbidden if a folder is missing and the WebDAV
+// server doesn't allow us to create it.
+func (c *Client) ensureFolder(ctx context.Context, acc *config.WebDAVAccount, dir string) error {
+	fullPath := strings.Trim(path.Join(acc.UploadPath, dir), "/")
+	if fullPath == "." || fullPath == "" {
+		return nil
+	}
+
+	// Walk the path from its top-most folder, so that each folder's parent exists by the
+	// time we get to it.
+	segments := strings.Split(fullPath, "/")
+	for i := range segments {
+		p := strings.Join(segments[:i+1], "/")
+		// Folders are identified by their URL, since the folders of different accounts
+		// can have the same path.
+		u, err := c.rootURL(acc, p)
+		if err != nil {
+			return err
+		}
+
+		if c.isKnownFolder(u) {
+			continue
+		}
+
+		status, err := c.mkcol(ctx, acc, p)
+		if err != nil {
+			return err
+		}
+
+		switch status {
+		case http.StatusCreated:
+			logging.Entry(ctx).WithField("path", p).Info("Created missing folder")
+		case http.StatusMethodNotAllowed:
+			// The folder already exists.
+		case http.StatusForbidden:
+			// Some servers respond with a 403 Forbidden status to a MKCOL request on an
+			// existing folder we don't have write access to, so check whether the
+			// folder exists before giving up.
+			exists, err := c.folderExists(ctx, acc, p)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("%w: %s", ErrFolderForbidden, p)
+			}
+		default:
+			return fmt.Errorf("WebDAV server responded with status %d when creating folder %s", status, p)
+		}
+
+		c.knownFoldersMu.Lock()
+		c.knownFolders[u] = true
+		c.knownFoldersMu.Unlock()
+	}
+
+	return nil
+}
+
+// mkcol sends a MKCOL request to create a folder at the given path, relative to the root
+// URL, and returns the status code of the response.
+func (c *Client) mkcol(ctx context.Context, acc *config.WebDAVAccount, p string) (int, error) {
+	resp, err := c.requestFromRoot(ctx, acc, "MKCOL", p, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer closeBody(resp)
+
+	logging.Entry(ctx).WithFields(logrus.Fields{
+		"path":        p,
+		"status_code": resp.StatusCode,
+	}).Info("Sent MKCOL request")
+
+	return resp.StatusCode, nil
+}
+
+// folderExists checks whether a folder exists at the given path, relative to the root
+// URL.
+func (c *Client) folderExists(ctx context.Context, acc *config.WebDAVAccount, p string) (bool, error) {
+	header := make(http.Header)
+	header.Set("Depth", "0")
+
+	resp, err := c.requestFromRoot(ctx, acc, "PROPFIND", p, strings.NewReader(propfindBody), header)
+	if err != nil {
+		return false, err
+	}
+	defer closeBody(resp)
+
+	return resp.StatusCode == http.StatusMultiStatus, nil
+}
+
+// isKnownFolder returns whether we already know the folder at the given URL exists.
+func (c *Client) isKnownFolder(u string) bool {
+	c.knownFoldersMu.Lock()
+	defer c.knownFoldersMu.Unlock()
+
+	return c.knownFolders[u]
+}
+
+// forgetFolders forgets about all of the folders we know exist.
+func (c *Client) forgetFolders() {
+	c.knownFoldersMu.Lock()
+	defer c.knownFoldersMu.Unlock()
+
+	c.knownFolders = make(map[string]bool)
+}
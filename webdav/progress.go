@@ -0,0 +1,70 @@
+package webdav
+
+import (
+	"io"
+)
+
+// progressReader wraps the body of an upload, and reports how much of it has been read,
+// i.e. sent to the WebDAV server.
+type progressReader struct {
+	r      io.Reader
+	report func(sent int64, total int64)
+	// start is the position the body started at, if it can be seeked.
+	start int64
+	sent  int64
+	total int64
+}
+
+// seekingProgressReader is a progressReader which body can be seeked, so uploads can be
+// retried and resumed. Seeking also moves the reported progress.
+type seekingProgressReader struct {
+	*progressReader
+	seeker io.Seeker
+}
+
+// withProgress wraps the given body so the given function is called with the number of
+// bytes read from it and its total size (or -1 if it's unknown) whenever it's read. The
+// returned reader implements io.Seeker if the body does.
+func withProgress(body io.Reader, report func(sent int64, total int64)) (io.Reader, error) {
+	total, err := bodySize(body)
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &progressReader{
+		r:      body,
+		report: report,
+		total:  total,
+	}
+
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return pr, nil
+	}
+
+	if pr.start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+		return nil, err
+	}
+
+	return &seekingProgressReader{progressReader: pr, seeker: seeker}, nil
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	if n > 0 {
+		pr.sent += int64(n)
+		pr.report(pr.sent, pr.total)
+	}
+
+	return n, err
+}
+
+func (spr *seekingProgressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := spr.seeker.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+
+	spr.sent = pos - spr.start
+	return pos, nil
+}
@@ -0,0 +1,198 @@
+package webdav
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/logging"
+	"github.com/babolivier/scanner/metrics"
+)
+
+const (
+	// maxDrainedBytes is the maximum number of bytes we read from the body of a response
+	// we're not interested in before closing it. Reading the whole body allows the
+	// underlying connection to be reused, but there's no point reading huge bodies.
+	maxDrainedBytes = 64 << 10
+)
+
+var (
+	// idempotentMethods are the methods of the requests that can be retried, because
+	// sending them several times has the same effect as sending them once. That's not
+	// the case of MKCOL and MOVE, which fail if a previous attempt succeeded without us
+	// knowing about it.
+	idempotentMethods = map[string]bool{
+		http.MethodHead:   true,
+		http.MethodPut:    true,
+		http.MethodDelete: true,
+		"PROPFIND":        true,
+	}
+)
+
+// do sends a HTTP request with the given method, URL, body and headers, and returns the
+// response. If sending the request results in a network error or a 5xx response, the
+// request is retried up to the configured number of times, waiting longer after each
+// attempt, as long as its method is idempotent and its body is either nil or implements
+// io.Seeker (so it can be sent again). The request is aborted, and isn't retried, if the
+// given context is done.
+func (c *Client) do(
+	ctx context.Context,
+	acc *config.WebDAVAccount,
+	method string,
+	u string,
+	body io.Reader,
+	header http.Header,
+) (*http.Response, error) {
+	// Figure out whether the request can be retried and, if so, how big the body is, so
+	// we can tell the server (some servers don't play well with chunked uploads).
+	rewind, canRetry := rewinder(body)
+	canRetry = canRetry && idempotentMethods[method]
+	size, err := bodySize(body)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := c.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+
+			if err = rewind(); err != nil {
+				return nil, err
+			}
+		}
+
+		// Create the request. We don't want the HTTP client to close the body once it's
+		// sent, since we might need to send it again.
+		var reqBody io.Reader = http.NoBody
+		if body != nil && size != 0 {
+			reqBody = ioutil.NopCloser(body)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+		if err != nil {
+			return nil, err
+		}
+
+		if size > 0 {
+			req.ContentLength = size
+		}
+
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		// Add basic auth to the request.
+		req.SetBasicAuth(acc.User, acc.Password)
+
+		// Pass the ID of the request we're handling on, so the WebDAV server's logs can
+		// be correlated with ours.
+		if id := logging.RequestID(ctx); id != "" {
+			req.Header.Set(logging.RequestIDHeader, id)
+		}
+
+		logging.Entry(ctx).WithFields(logrus.Fields{
+			"url":     u,
+			"method":  method,
+			"attempt": attempt + 1,
+		}).Info("Sending WebDAV request")
+
+		// Send the request, and measure how long the server takes to respond.
+		start := time.Now()
+		resp, err := c.client.Do(req)
+
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		metrics.WebDAVRequestDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+
+		// Stop here if the request succeeded, or if it failed in a way that retrying it
+		// won't help with.
+		transient := (err != nil && ctx.Err() == nil) || (err == nil && resp.StatusCode >= 500)
+		if !transient || !canRetry || attempt >= c.cfg.MaxRetries {
+			return resp, err
+		}
+
+		entry := logging.Entry(ctx).WithField("retry_in", backoff)
+		if err != nil {
+			entry = entry.WithError(err)
+		} else {
+			entry = entry.WithField("status_code", resp.StatusCode)
+			closeBody(resp)
+		}
+		entry.Warn("WebDAV request failed, retrying")
+	}
+}
+
+// closeBody reads what's left of the body of the given response, up to a limit, and
+// closes it, so the underlying connection can be reused.
+func closeBody(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrainedBytes))
+	_ = resp.Body.Close()
+}
+
+// rewinder returns a function that rewinds the given body to its current position, and
+// whether the body can be rewound at all. A nil body can always be rewound.
+func rewinder(body io.Reader) (func() error, bool) {
+	if body == nil {
+		return func() error { return nil }, true
+	}
+
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return nil, false
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false
+	}
+
+	return func() error {
+		_, err := seeker.Seek(start, io.SeekStart)
+		return err
+	}, true
+}
+
+// bodySize returns the number of bytes left to read from the given body, or -1 if it
+// can't be known without reading it.
+func bodySize(body io.Reader) (int64, error) {
+	if body == nil {
+		return 0, nil
+	}
+
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return -1, nil
+	}
+
+	current, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1, nil
+	}
+
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = seeker.Seek(current, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return end - current, nil
+}
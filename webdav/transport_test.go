@@ -0,0 +1,199 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statusSequence returns a handler responding with the given statuses in order, and
+// with the last one once they've all been used.
+func statusSequence(statuses ...int) http.HandlerFunc {
+	i := 0
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(statuses[i])
+		if i < len(statuses)-1 {
+			i++
+		}
+	}
+}
+
+// newRetryingClient returns a client for the given server retrying requests up to the
+// given number of times, without waiting long between attempts.
+func newRetryingClient(t *testing.T, s *testServer, maxRetries int) *Client {
+	c := newTestClient(t, s, "", "")
+	c.cfg.MaxRetries = maxRetries
+	c.cfg.RetryBackoff = time.Millisecond
+	return c
+}
+
+func TestDoRetriesServerErrors(t *testing.T) {
+	s := newTestServer(t, statusSequence(http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusCreated))
+	c := newRetryingClient(t, s, 3)
+
+	resp, err := c.do(context.Background(), &c.cfg.WebDAVAccount, http.MethodPut, s.URL+"/a.pdf", strings.NewReader("content"), nil)
+	if err != nil {
+		t.Fatalf("do returned an error: %v", err)
+	}
+	closeBody(resp)
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("got status %d; want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if len(s.requests) != 3 {
+		t.Fatalf("server received %d requests; want 3", len(s.requests))
+	}
+	for i, body := range s.bodies {
+		if string(body) != "content" {
+			t.Errorf("attempt %d sent body %q; want %q", i+1, body, "content")
+		}
+	}
+}
+
+func TestDoGivesUpAfterMaxRetries(t *testing.T) {
+	s := newTestServer(t, statusSequence(http.StatusInternalServerError))
+	c := newRetryingClient(t, s, 2)
+
+	resp, err := c.do(context.Background(), &c.cfg.WebDAVAccount, http.MethodDelete, s.URL+"/a.pdf", nil, nil)
+	if err != nil {
+		t.Fatalf("do returned an error: %v", err)
+	}
+	closeBody(resp)
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got status %d; want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+	if len(s.requests) != 3 {
+		t.Errorf("server received %d requests; want 3", len(s.requests))
+	}
+}
+
+func TestDoDoesNotRetryClientErrors(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict} {
+		s := newTestServer(t, statusSequence(status, http.StatusCreated))
+		c := newRetryingClient(t, s, 3)
+
+		resp, err := c.do(context.Background(), &c.cfg.WebDAVAccount, http.MethodPut, s.URL+"/a.pdf", strings.NewReader("content"), nil)
+		if err != nil {
+			t.Fatalf("do returned an error: %v", err)
+		}
+		closeBody(resp)
+
+		if resp.StatusCode != status {
+			t.Errorf("got status %d; want %d", resp.StatusCode, status)
+		}
+		if len(s.requests) != 1 {
+			t.Errorf("server received %d requests after a %d; want 1", len(s.requests), status)
+		}
+	}
+}
+
+func TestDoDoesNotRetryNonIdempotentMethods(t *testing.T) {
+	for _, method := range []string{"MKCOL", "MOVE"} {
+		s := newTestServer(t, statusSequence(http.StatusServiceUnavailable, http.StatusCreated))
+		c := newRetryingClient(t, s, 3)
+
+		resp, err := c.do(context.Background(), &c.cfg.WebDAVAccount, method, s.URL+"/folder", nil, nil)
+		if err != nil {
+			t.Fatalf("do returned an error: %v", err)
+		}
+		closeBody(resp)
+
+		if len(s.requests) != 1 {
+			t.Errorf("server received %d %s requests; want 1", len(s.requests), method)
+		}
+	}
+}
+
+func TestDoDoesNotRetryUnseekableBodies(t *testing.T) {
+	s := newTestServer(t, statusSequence(http.StatusServiceUnavailable, http.StatusCreated))
+	c := newRetryingClient(t, s, 3)
+
+	// Hide the Seek method of the reader.
+	body := struct{ io.Reader }{strings.NewReader("content")}
+	resp, err := c.do(context.Background(), &c.cfg.WebDAVAccount, http.MethodPut, s.URL+"/a.pdf", body, nil)
+	if err != nil {
+		t.Fatalf("do returned an error: %v", err)
+	}
+	closeBody(resp)
+
+	if len(s.requests) != 1 {
+		t.Errorf("server received %d requests; want 1", len(s.requests))
+	}
+	if s.requests[0].ContentLength != -1 {
+		t.Errorf("request has a Content-Length of %d; want none", s.requests[0].ContentLength)
+	}
+}
+
+func TestDoRewindsBodyToItsStart(t *testing.T) {
+	s := newTestServer(t, statusSequence(http.StatusServiceUnavailable, http.StatusCreated))
+	c := newRetryingClient(t, s, 3)
+
+	// Only what's left to read from the body must be sent, including when retrying.
+	body := bytes.NewReader([]byte("headercontent"))
+	if _, err := body.Seek(int64(len("header")), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.do(context.Background(), &c.cfg.WebDAVAccount, http.MethodPut, s.URL+"/a.pdf", body, nil)
+	if err != nil {
+		t.Fatalf("do returned an error: %v", err)
+	}
+	closeBody(resp)
+
+	if len(s.requests) != 2 {
+		t.Fatalf("server received %d requests; want 2", len(s.requests))
+	}
+	for i, req := range s.requests {
+		if string(s.bodies[i]) != "content" {
+			t.Errorf("attempt %d sent body %q; want %q", i+1, s.bodies[i], "content")
+		}
+		if req.ContentLength != int64(len("content")) {
+			t.Errorf("attempt %d has a Content-Length of %d; want %d", i+1, req.ContentLength, len("content"))
+		}
+		if len(req.TransferEncoding) != 0 {
+			t.Errorf("attempt %d has a transfer encoding of %v; want none", i+1, req.TransferEncoding)
+		}
+	}
+}
+
+func TestDoStopsWaitingWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel the context once the first attempt has failed, while the client waits to
+	// retry.
+	s := newTestServer(t, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+	})
+	c := newTestClient(t, s, "", "")
+	c.cfg.MaxRetries = 3
+	c.cfg.RetryBackoff = time.Hour
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.do(ctx, &c.cfg.WebDAVAccount, http.MethodPut, s.URL+"/a.pdf", strings.NewReader("content"), nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("do returned %v; want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("do didn't return after the context was cancelled")
+	}
+
+	if len(s.requests) != 1 {
+		t.Errorf("server received %d requests; want 1", len(s.requests))
+	}
+}
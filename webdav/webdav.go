@@ -1,81 +1,447 @@
 package webdav
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/sirupsen/logrus"
-
 	"github.com/babolivier/scanner/common"
 	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/logging"
+	"github.com/babolivier/scanner/naming"
+)
+
+const (
+	// maxSuffix is the highest suffix or counter value we'll try before giving up on
+	// finding a file name that's not already in use.
+	maxSuffix = 1000
+)
+
+var (
+	// ErrNoAvailableName is the error returned by Upload if all of the candidate names
+	// for the file are already in use, or if its name is already in use and the client
+	// is configured to reject conflicts.
+	ErrNoAvailableName = errors.New("no available file name")
+	// ErrOutsideRoot is the error returned if a request would target a path outside of
+	// the configured upload path.
+	ErrOutsideRoot = errors.New("path is outside of the upload path")
+	// ErrNoAccount is the error returned if the user who requested the scan doesn't have
+	// a WebDAV account of their own, and no default account has been configured.
+	ErrNoAccount = errors.New("no WebDAV account for this user")
 )
 
+// StatusError is the error returned by Upload if the WebDAV server responded with an
+// unexpected status code.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("WebDAV server responded with status %d", e.StatusCode)
+}
+
 // Client is a WebDAV client that can upload file contents to a WebDAV server.
 type Client struct {
-	client *http.Client
-	cfg    *config.WebDAVConfig
+	client          *http.Client
+	cfg             *config.WebDAVConfig
+	template        *naming.Template
+	presetTemplates map[string]*naming.Template
+
+	// knownFolders contains the URLs of the folders we know exist on the WebDAV servers.
+	knownFolders   map[string]bool
+	knownFoldersMu sync.Mutex
 }
 
-// NewClient returns a new Client.
-func NewClient(cfg *config.WebDAVConfig) *Client {
+// NewClient returns a new Client. It also parses the file name templates from the
+// configuration and the presets, and returns an error if one of them is invalid, or if
+// chunked uploads are enabled with chunks smaller than what Nextcloud accepts.
+func NewClient(cfg *config.WebDAVConfig, presets map[string]*config.PresetConfig) (*Client, error) {
+	if cfg.OnConflict != config.ConflictReject && cfg.OnConflict != config.ConflictSuffix {
+		return nil, fmt.Errorf("invalid conflict policy %q", cfg.OnConflict)
+	}
+
+	if cfg.ChunkedUploadThreshold > 0 && cfg.ChunkSize < minChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d, must be at least %d bytes", cfg.ChunkSize, minChunkSize)
+	}
+
+	rawTemplate := cfg.FileNameTemplate
+	if rawTemplate == "" {
+		rawTemplate = naming.DefaultTemplate
+	}
+
+	template, err := naming.NewTemplate(rawTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file name template: %w", err)
+	}
+
+	presetTemplates := make(map[string]*naming.Template)
+	for name, preset := range presets {
+		if preset.FileNameTemplate == "" {
+			continue
+		}
+
+		if presetTemplates[name], err = naming.NewTemplate(preset.FileNameTemplate); err != nil {
+			return nil, fmt.Errorf("invalid file name template for preset %s: %w", name, err)
+		}
+	}
+
+	// Start from the default transport so we keep its sensible defaults (e.g. proxy
+	// support, idle connections management), and set the configured timeouts on top.
+	// Fall back to a bare transport if the default one has been replaced with something
+	// else.
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if ok {
+		transport = transport.Clone()
+	} else {
+		transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+	}
+	transport.DialContext = (&net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = cfg.ConnectTimeout
+	transport.ResponseHeaderTimeout = cfg.ResponseTimeout
+
 	return &Client{
-		client: new(http.Client),
-		cfg:    cfg,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.RequestTimeout,
+		},
+		cfg:             cfg,
+		template:        template,
+		presetTemplates: presetTemplates,
+		knownFolders:    make(map[string]bool),
+	}, nil
+}
+
+// RejectsConflicts returns whether the client is configured to reject files which name
+// is already in use, rather than finding another name for them.
+func (c *Client) RejectsConflicts() bool {
+	return c.cfg.OnConflict == config.ConflictReject
+}
+
+// IsPermanent returns whether the given error, returned by Upload, is caused by something
+// retrying the upload later won't fix on its own, e.g. a missing permission or a file
+// name that's not available.
+func (c *Client) IsPermanent(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		// 4xx statuses mean there's something wrong with our request, except for a few
+		// which are about timing.
+		return statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 &&
+			statusErr.StatusCode != http.StatusRequestTimeout &&
+			statusErr.StatusCode != http.StatusConflict &&
+			statusErr.StatusCode != http.StatusTooManyRequests
 	}
+
+	return err == ErrNoAvailableName ||
+		err == ErrOutsideRoot ||
+		err == ErrNoAccount ||
+		errors.Is(err, ErrFolderForbidden) ||
+		errors.Is(err, naming.ErrInvalidFileName)
 }
 
-// Upload creates a file with the given content on the WebDAV server. It names this file
-// using the current time and the given file type, and returns the generated name.
-func (c *Client) Upload(options *common.ScanOptions, body *bytes.Buffer) (string, error) {
-	// Determine the file's name.
-	fileNameNoExt := time.Now().Format("2006-01-02_15-04-05")
-	if options.FileName != "" {
-		fileNameNoExt = options.FileName
+// Upload creates a file with the content read from the given reader on the WebDAV
+// account of the user who requested the scan, or on the default account if they don't
+// have one. It names this file using either the name provided by the user or the relevant
+// file name template, and the given file type, and returns the generated name.
+// The content is streamed to the WebDAV server. If the reader also implements io.Seeker,
+// the upload is retried in case of a transient failure. The upload is aborted if the
+// given context is done. An existing file is never overwritten.
+func (c *Client) Upload(
+	ctx context.Context,
+	options *common.ScanOptions,
+	body io.Reader,
+) (string, error) {
+	acc, err := c.account(options.User)
+	if err != nil {
+		return "", err
 	}
 
-	// Add the format extension to the file's name.
-	fileName := fmt.Sprintf("%s.%s", fileNameNoExt, options.Format)
+	// Report how much of the file has been sent, if the caller wants to know.
+	if options.UploadProgress != nil {
+		if body, err = withProgress(body, options.UploadProgress); err != nil {
+			return "", err
+		}
+	}
 
-	logrus.
+	// Remember where the body starts, so we can go back there if we need to send it
+	// again.
+	rewind, canRewind := rewinder(body)
+
+	// Upload the file under the first candidate name that's not already in use. Another
+	// upload can take this name between the moment we check it and the moment we create
+	// the file, in which case the server refuses to overwrite it, and we move on to the
+	// next candidate.
+	for n := 1; ; n++ {
+		fileName, ok := c.candidateName(options, n)
+		if !ok {
+			return "", ErrNoAvailableName
+		}
+
+		exists, err := c.fileExists(ctx, acc, fileName)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			continue
+		}
+
+		status, err := c.create(ctx, acc, fileName, body, rewind, canRewind)
+		if err != nil {
+			return "", err
+		}
+
+		if status == http.StatusPreconditionFailed {
+			logging.Entry(ctx).WithField("filename", fileName).Warn("File name taken by another upload")
+
+			if !canRewind {
+				return "", ErrNoAvailableName
+			}
+			if err = rewind(); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		logging.Entry(ctx).WithField("status_code", status).Info("Upload finished")
+
+		// According to RFC4918, the creation of a resource must be indicated by use of a
+		// 201 Created response code, so return an error if that's not what we got back.
+		if status != http.StatusCreated {
+			err = &StatusError{StatusCode: status}
+		}
+
+		// Return the file name so we can pass it on to the user.
+		return fileName, err
+	}
+}
+
+// create uploads the content read from the given reader to a new file at the given path,
+// relative to the upload path, after making sure the folder it's going into exists, and
+// returns the status code of the response. The server responds with a 412 Precondition
+// Failed status if the file already exists.
+func (c *Client) create(
+	ctx context.Context,
+	acc *config.WebDAVAccount,
+	fileName string,
+	body io.Reader,
+	rewind func() error,
+	canRewind bool,
+) (int, error) {
+	// Make sure the folder the file is going into exists.
+	if err := c.ensureFolder(ctx, acc, path.Dir(fileName)); err != nil {
+		return 0, err
+	}
+
+	logging.Entry(ctx).
 		WithField("filename", fileName).
 		Info("Uploading file to the WebDAV server")
 
-	// Upload the file.
-	status, err := c.requestFile(http.MethodPut, fileName, body)
+	status, err := c.put(ctx, acc, fileName, body)
+	if err != nil {
+		return 0, err
+	}
+
+	// A 409 Conflict status means one of the parent folders doesn't exist. If we got
+	// one, it means a folder we thought existed has been removed since we last checked,
+	// so forget what we know about the folders on the way and try again.
+	if status == http.StatusConflict && canRewind {
+		logging.Entry(ctx).WithField("filename", fileName).Warn("Destination folder is missing, retrying")
+
+		c.forgetFolders()
+		if err = c.ensureFolder(ctx, acc, path.Dir(fileName)); err != nil {
+			return 0, err
+		}
+
+		if err = rewind(); err != nil {
+			return 0, err
+		}
+
+		return c.put(ctx, acc, fileName, body)
+	}
+
+	return status, nil
+}
+
+// HasAccount returns whether there's a WebDAV account to upload the files scanned by the
+// given user to.
+func (c *Client) HasAccount(user string) bool {
+	_, err := c.account(user)
+	return err == nil
+}
+
+// FileURL returns the URL of the file at the given path, relative to the upload path of
+// the given user's WebDAV account.
+// Returns ErrNoAccount if there's no account to use for this user, or ErrOutsideRoot if
+// the path would escape the upload path.
+func (c *Client) FileURL(user string, fileName string) (string, error) {
+	acc, err := c.account(user)
 	if err != nil {
 		return "", err
 	}
 
-	logrus.WithField("status_code", status).Info("Upload finished")
+	return c.fileURL(acc, fileName)
+}
+
+// account returns the WebDAV account to use for the given user, i.e. either their own
+// account or the default one if they don't have one.
+// Returns ErrNoAccount if the user doesn't have an account and there's no default one.
+func (c *Client) account(user string) (*config.WebDAVAccount, error) {
+	if acc, ok := c.cfg.Accounts[user]; ok {
+		return acc, nil
+	}
 
-	// According to RFC4918, the creation of a resource must be indicated by use of a
-	// 201 Created response code, so return an error if that's not what we got back.
-	if status != http.StatusCreated {
-		err = fmt.Errorf("WebDAV server responded with status %d", status)
+	if c.cfg.RootURL == "" {
+		return nil, ErrNoAccount
 	}
 
-	// Return the file name so we can pass it on to the user.
-	return fileName, err
+	return &c.cfg.WebDAVAccount, nil
 }
 
-// FileExists checks if a file already exists with the given name.
-func (c *Client) FileExists(options *common.ScanOptions) (bool, error) {
+// put uploads the content read from the given reader to the given path, relative to the
+// upload path, and returns the status code of the response. If the size of the content
+// can be known and is above the configured threshold, and the WebDAV server supports it,
+// the content is uploaded in chunks. Otherwise, it's uploaded with a single request.
+func (c *Client) put(ctx context.Context, acc *config.WebDAVAccount, fileName string, body io.Reader) (int, error) {
+	size, err := bodySize(body)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.cfg.ChunkedUploadThreshold > 0 && size > c.cfg.ChunkedUploadThreshold {
+		status, err := c.putChunked(ctx, acc, fileName, body, size)
+		if err != errChunkingUnsupported {
+			return status, err
+		}
+
+		logging.Entry(ctx).Info("WebDAV server doesn't support chunked uploads, falling back to a single request")
+	}
+
+	// Don't overwrite a file that's been created since we checked its name was available.
+	header := make(http.Header)
+	header.Set("If-None-Match", "*")
+
+	resp, err := c.request(ctx, acc, http.MethodPut, fileName, body, header)
+	if err != nil {
+		return 0, err
+	}
+	closeBody(resp)
+
+	return resp.StatusCode, nil
+}
+
+// candidateName returns the n-th path (including the folder and the extension),
+// starting from 1, to try giving to the file described by the given options, relative to
+// the upload path, or false if there's no candidate left. If the name comes from a
+// template with a counter, candidates use increasing counter values. Otherwise, the first
+// candidate is the name itself and, unless the client is configured to reject conflicts,
+// the next ones have increasing numbered suffixes appended to it.
+func (c *Client) candidateName(options *common.ScanOptions, n int) (string, bool) {
+	if n > maxSuffix {
+		return "", false
+	}
+
+	// If the user provided a name, use it as is.
+	nameNoExt := string(options.FileName)
+	if nameNoExt == "" {
+		template := c.template
+		if t, ok := c.presetTemplates[options.Preset]; ok {
+			template = t
+		}
+
+		fields := &naming.Fields{
+			Time:   options.NamingTime(),
+			Device: options.Device,
+			Preset: options.Preset,
+			// Scans are currently always made of a single page.
+			Pages: 1,
+			User:  options.User,
+		}
+
+		if template.HasCounter() {
+			return fmt.Sprintf("%s.%s", path.Join(options.Folder, template.Execute(fields, n)), options.Format), true
+		}
+
+		nameNoExt = template.Execute(fields, 0)
+	}
+
+	nameNoExt = path.Join(options.Folder, nameNoExt)
+	if n > 1 {
+		// Never touch a file which name is already in use if we're not allowed to find
+		// another name for it, so an existing file (e.g. one named from a template
+		// which date only includes the day) is never overwritten.
+		if c.RejectsConflicts() {
+			return "", false
+		}
+
+		nameNoExt = naming.WithSuffix(nameNoExt, n)
+	}
+
+	return fmt.Sprintf("%s.%s", nameNoExt, options.Format), true
+}
+
+// LocalName returns the name (including the extension, but not the folder) to give to
+// the file described by the given options, created at the given time, when it's sent
+// somewhere else than the WebDAV server, e.g. when it's downloaded. Since there's no
+// existing file to clash with, a template's counter is always 1.
+func (c *Client) LocalName(options *common.ScanOptions, t time.Time) string {
+	if options.FileName != "" {
+		return fmt.Sprintf("%s.%s", options.FileName, options.Format)
+	}
+
+	template := c.template
+	if tpl, ok := c.presetTemplates[options.Preset]; ok {
+		template = tpl
+	}
+
+	fields := &naming.Fields{
+		Time:   t,
+		Device: options.Device,
+		Preset: options.Preset,
+		Pages:  1,
+		User:   options.User,
+	}
+
+	return fmt.Sprintf("%s.%s", path.Base(template.Execute(fields, 1)), options.Format)
+}
+
+// FileExists checks if a file already exists with the name provided by the user, in the
+// folder provided by the user, on the WebDAV account the file would be uploaded to.
+func (c *Client) FileExists(ctx context.Context, options *common.ScanOptions) (bool, error) {
+	acc, err := c.account(options.User)
+	if err != nil {
+		return false, err
+	}
+
 	// Append the format extension to the file name.
 	fullName := fmt.Sprintf("%s.%s", options.FileName, options.Format)
+	return c.fileExists(ctx, acc, path.Join(options.Folder, fullName))
+}
 
+// fileExists checks if a file already exists with the given full name.
+func (c *Client) fileExists(ctx context.Context, acc *config.WebDAVAccount, fullName string) (bool, error) {
+	// Make sure the name can't escape the upload path or contain any surprise, whether
+	// it's been provided by the user or generated from a template.
+	if err := naming.CheckPath(fullName); err != nil {
+		return false, err
+	}
 	// Send a HEAD request with the file name, if the server responds with a 200 status
 	// then a file with this name exists, if the status is 404 then it doesn't.
-	status, err := c.requestFile(http.MethodHead, fullName, nil)
+	status, err := c.requestFile(ctx, acc, http.MethodHead, fullName, nil)
 	if err != nil {
 		return false, err
 	}
 
-	logrus.WithField("status_code", status).Info("Checked file existence")
+	logging.Entry(ctx).WithField("status_code", status).Info("Checked file existence")
 
 	// Make sure we don't accidentally understand an error as the file not existing.
 	if status != http.StatusOK && status != http.StatusNotFound {
@@ -86,38 +452,86 @@ func (c *Client) FileExists(options *common.ScanOptions) (bool, error) {
 }
 
 // requestFile sends a HTTP request to the WebDAV server for the given path with the given
-// method and body.
-func (c *Client) requestFile(method string, fileName string, body io.Reader) (int, error) {
-	// Parse the root URL. Ideally we'd do this in NewClient, but we need to change the
-	// path of this URL with the file's name, and we don't want this change to persist
-	// on the client.
-	u, err := url.Parse(c.cfg.RootURL)
+// method and body, and returns the status code of the response.
+func (c *Client) requestFile(
+	ctx context.Context,
+	acc *config.WebDAVAccount,
+	method string,
+	fileName string,
+	body io.Reader,
+) (int, error) {
+	resp, err := c.request(ctx, acc, method, fileName, body, nil)
 	if err != nil {
 		return 0, err
 	}
 
-	// Build a path that includes the full path for this file on the WebDAV server.
-	u.Path = path.Join(u.Path, c.cfg.UploadPath, fileName)
+	closeBody(resp)
 
-	logrus.WithFields(logrus.Fields{
-		"url":    u,
-		"method": method,
-	}).Info("Sending WebDAV request")
+	return resp.StatusCode, nil
+}
 
-	// Create the request.
-	req, err := http.NewRequest(method, u.String(), body)
+// request sends a HTTP request to the WebDAV server for the given path, relative to the
+// upload path, with the given method, body and headers, and returns the response.
+// Returns ErrOutsideRoot if the path would escape the upload path.
+func (c *Client) request(
+	ctx context.Context,
+	acc *config.WebDAVAccount,
+	method string,
+	p string,
+	body io.Reader,
+	header http.Header,
+) (*http.Response, error) {
+	u, err := c.fileURL(acc, p)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	return c.do(ctx, acc, method, u, body, header)
+}
+
+// requestFromRoot sends a HTTP request to the WebDAV server for the given path, relative
+// to the root URL, with the given method, body and headers, and returns the response.
+func (c *Client) requestFromRoot(
+	ctx context.Context,
+	acc *config.WebDAVAccount,
+	method string,
+	p string,
+	body io.Reader,
+	header http.Header,
+) (*http.Response, error) {
+	u, err := c.rootURL(acc, p)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(ctx, acc, method, u, body, header)
+}
+
+// fileURL returns the full URL for the given path, relative to the upload path.
+// Returns ErrOutsideRoot if the path would escape the upload path.
+func (c *Client) fileURL(acc *config.WebDAVAccount, p string) (string, error) {
+	// Build a path that includes the full path for this file on the WebDAV server, and
+	// make sure it's within the upload path.
+	root := path.Join("/", acc.UploadPath)
+	fullPath := path.Join(root, p)
+	if fullPath != root && !strings.HasPrefix(fullPath, strings.TrimSuffix(root, "/")+"/") {
+		return "", ErrOutsideRoot
 	}
 
-	// Add basic auth to the request.
-	req.SetBasicAuth(c.cfg.User, c.cfg.Password)
+	return c.rootURL(acc, fullPath)
+}
 
-	// Send the request.
-	resp, err := c.client.Do(req)
+// rootURL returns the full URL for the given path, relative to the root URL.
+func (c *Client) rootURL(acc *config.WebDAVAccount, p string) (string, error) {
+	// Parse the root URL. Ideally we'd do this in NewClient, but we need to change the
+	// path of this URL with the file's name, and we don't want this change to persist
+	// on the client.
+	u, err := url.Parse(acc.RootURL)
 	if err != nil {
-		return 0, err
+		return "", err
 	}
 
-	return resp.StatusCode, nil
+	u.Path = path.Join("/", u.Path, p)
+
+	return u.String(), nil
 }
@@ -0,0 +1,236 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/babolivier/scanner/common"
+	"github.com/babolivier/scanner/config"
+)
+
+// testServer is a stand-in WebDAV server recording the requests it receives, and
+// responding to them with the given handler, or with a 201 status if it's nil.
+type testServer struct {
+	*httptest.Server
+
+	handler  http.HandlerFunc
+	requests []*http.Request
+	bodies   [][]byte
+	mu       sync.Mutex
+}
+
+func newTestServer(t *testing.T, handler http.HandlerFunc) *testServer {
+	s := &testServer{handler: handler}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		s.bodies = append(s.bodies, body)
+		s.mu.Unlock()
+
+		if s.handler != nil {
+			s.handler(w, req)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// paths returns the paths of the requests the server received so far.
+func (s *testServer) paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths := make([]string, 0, len(s.requests))
+	for _, req := range s.requests {
+		paths = append(paths, req.URL.Path)
+	}
+
+	return paths
+}
+
+// newTestClient returns a client for the given server, uploading to the given path.
+func newTestClient(t *testing.T, s *testServer, rootPath string, uploadPath string) *Client {
+	c, err := NewClient(&config.WebDAVConfig{
+		WebDAVAccount: config.WebDAVAccount{
+			RootURL:    s.URL + rootPath,
+			UploadPath: uploadPath,
+		},
+		OnConflict: config.ConflictReject,
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewClient returned an error: %v", err)
+	}
+
+	return c
+}
+
+func TestRequestFileStaysWithinRoot(t *testing.T) {
+	tests := []struct {
+		name       string
+		rootPath   string
+		uploadPath string
+		fileName   string
+		// wantPath is the path the request should be sent to, or empty if it should be
+		// refused.
+		wantPath string
+	}{
+		{name: "file", uploadPath: "scans", fileName: "a.pdf", wantPath: "/scans/a.pdf"},
+		{name: "nested", uploadPath: "/scans/", fileName: "2023/a.pdf", wantPath: "/scans/2023/a.pdf"},
+		{name: "upload path itself", uploadPath: "scans", fileName: "", wantPath: "/scans"},
+		{name: "dot dot inside", uploadPath: "scans", fileName: "2023/../a.pdf", wantPath: "/scans/a.pdf"},
+		{name: "root URL with a path", rootPath: "/dav/files/alice", uploadPath: "scans", fileName: "a.pdf", wantPath: "/dav/files/alice/scans/a.pdf"},
+		{name: "lookalike separator", uploadPath: "scans", fileName: "..∕a.pdf", wantPath: "/scans/..∕a.pdf"},
+		{name: "root upload path", uploadPath: "/", fileName: "a.pdf", wantPath: "/a.pdf"},
+		{name: "empty upload path", uploadPath: "", fileName: "2023/a.pdf", wantPath: "/2023/a.pdf"},
+		{name: "root upload path with dot dot", uploadPath: "/", fileName: "../a.pdf", wantPath: "/a.pdf"},
+
+		{name: "dot dot", uploadPath: "scans", fileName: "..", wantPath: ""},
+		{name: "dot dot prefix", uploadPath: "scans", fileName: "../a.pdf", wantPath: ""},
+		{name: "dot dot nested", uploadPath: "scans/2023", fileName: "../../a.pdf", wantPath: ""},
+		{name: "sibling with a common prefix", uploadPath: "scans", fileName: "../scans-other/a.pdf", wantPath: ""},
+		{name: "absolute", uploadPath: "scans", fileName: "/../etc/a.pdf", wantPath: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			c := newTestClient(t, s, tt.rootPath, tt.uploadPath)
+
+			_, err := c.requestFile(context.Background(), &c.cfg.WebDAVAccount, http.MethodHead, tt.fileName, nil)
+
+			paths := s.paths()
+			if tt.wantPath == "" {
+				if err != ErrOutsideRoot {
+					t.Errorf("requestFile(%q) returned %v; want ErrOutsideRoot", tt.fileName, err)
+				}
+				if len(paths) != 0 {
+					t.Errorf("requestFile(%q) sent requests to %v; want none", tt.fileName, paths)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("requestFile(%q) returned an error: %v", tt.fileName, err)
+			}
+			if len(paths) != 1 || paths[0] != tt.wantPath {
+				t.Errorf("requestFile(%q) sent requests to %v; want [%s]", tt.fileName, paths, tt.wantPath)
+			}
+		})
+	}
+}
+
+// fileStore is a stand-in WebDAV server keeping track of the files it has, and refusing
+// to overwrite them when asked to with If-None-Match.
+type fileStore struct {
+	mu    sync.Mutex
+	files map[string]string
+	// taken lists the paths another upload creates right before we upload a file there,
+	// i.e. after we've checked whether they're in use.
+	taken map[string]bool
+}
+
+func newFileStore(files ...string) *fileStore {
+	fs := &fileStore{files: make(map[string]string), taken: make(map[string]bool)}
+	for _, p := range files {
+		fs.files[p] = "existing"
+	}
+	return fs
+}
+
+func (fs *fileStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	p := req.URL.Path
+	switch req.Method {
+	case http.MethodHead:
+		if _, ok := fs.files[p]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case "MKCOL":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	case http.MethodPut:
+		if fs.taken[p] {
+			fs.files[p] = "concurrent"
+			delete(fs.taken, p)
+		}
+		if _, ok := fs.files[p]; ok && req.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		// The test server has already read the body.
+		fs.files[p] = "uploaded"
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestUploadNeverOverwritesFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		onConflict string
+		existing   []string
+		taken      []string
+		// wantName is the name the file should be uploaded under, or empty if the upload
+		// should fail with ErrNoAvailableName.
+		wantName string
+	}{
+		{name: "available", onConflict: config.ConflictSuffix, wantName: "scan.pdf"},
+		{name: "suffix", onConflict: config.ConflictSuffix, existing: []string{"/scans/scan.pdf"}, wantName: "scan (2).pdf"},
+		{
+			name:       "suffix taken concurrently",
+			onConflict: config.ConflictSuffix,
+			existing:   []string{"/scans/scan.pdf"},
+			taken:      []string{"/scans/scan (2).pdf"},
+			wantName:   "scan (3).pdf",
+		},
+		{name: "reject", onConflict: config.ConflictReject, existing: []string{"/scans/scan.pdf"}},
+		{name: "reject taken concurrently", onConflict: config.ConflictReject, taken: []string{"/scans/scan.pdf"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newFileStore(tt.existing...)
+			for _, p := range tt.taken {
+				fs.taken[p] = true
+			}
+			s := newTestServer(t, fs.ServeHTTP)
+			c := newTestClient(t, s, "", "scans")
+			c.cfg.OnConflict = tt.onConflict
+
+			options := &common.ScanOptions{Format: "pdf", FileName: "scan"}
+			name, err := c.Upload(context.Background(), options, bytes.NewReader([]byte("content")))
+
+			if tt.wantName == "" {
+				if err != ErrNoAvailableName {
+					t.Fatalf("Upload returned %q, %v; want ErrNoAvailableName", name, err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Upload returned an error: %v", err)
+				}
+				if name != tt.wantName {
+					t.Errorf("got name %q; want %q", name, tt.wantName)
+				}
+			}
+
+			for p, content := range fs.files {
+				if content == "uploaded" && p != "/scans/"+tt.wantName {
+					t.Errorf("%s has been overwritten", p)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,425 @@
+// Package webhook notifies the configured webhooks when scans complete or fail.
+//
+// Notifications are sent as POST requests with a JSON Payload as their body. Each request
+// carries the following headers:
+//
+//	X-Scanner-Event: the event, e.g. "scan.completed"
+//	X-Scanner-Delivery: the ID of the delivery, which is the same across retries
+//	X-Scanner-Timestamp: the time the request was sent at, as a Unix timestamp
+//	X-Scanner-Signature: "sha256=" followed by the hex-encoded HMAC-SHA256, keyed with the
+//	  webhook's secret, of the timestamp, a dot, and the body
+//
+// Receivers should check the signature, and reject requests which timestamp is too old
+// so they can't be replayed.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/babolivier/scanner/config"
+	"github.com/babolivier/scanner/history"
+	"github.com/babolivier/scanner/logging"
+	"github.com/babolivier/scanner/metrics"
+	"github.com/babolivier/scanner/spool"
+)
+
+// Events webhooks can be notified of.
+const (
+	// EventCompleted is sent once a scan is over and its file has been sent to, or
+	// queued for, its destinations, and once a queued upload eventually succeeds.
+	EventCompleted = "scan.completed"
+	// EventFailed is sent if a scan, or the upload of its file, failed for good.
+	EventFailed = "scan.failed"
+)
+
+const (
+	eventHeader     = "X-Scanner-Event"
+	deliveryHeader  = "X-Scanner-Delivery"
+	timestampHeader = "X-Scanner-Timestamp"
+	signatureHeader = "X-Scanner-Signature"
+)
+
+// Status is the status of a delivery.
+type Status string
+
+const (
+	// StatusPending means the notification hasn't been delivered yet, and will be tried
+	// again.
+	StatusPending Status = "pending"
+	// StatusDelivered means the webhook responded with a 2xx status.
+	StatusDelivered Status = "delivered"
+	// StatusFailed means the notification couldn't be delivered, and won't be tried
+	// again.
+	StatusFailed Status = "failed"
+)
+
+// Payload is the body of the requests sent to webhooks.
+type Payload struct {
+	Event string `json:"event"`
+	Job   string `json:"job,omitempty"`
+	// User is the user who requested the scan, if authentication is enabled.
+	User string `json:"user,omitempty"`
+	// Outcome is one of the history.Outcome* constants.
+	Outcome history.Outcome `json:"outcome"`
+	// FileName is the name the file has been uploaded under, if it has.
+	FileName string `json:"file_name,omitempty"`
+	// Destination lists the destinations of the file, separated by commas.
+	Destination string `json:"destination"`
+	// Uploads describes how sending the file to each of its destinations went.
+	Uploads []*history.Upload `json:"uploads,omitempty"`
+	Format  string            `json:"format,omitempty"`
+	// Size is the size of the file in bytes, or 0 if the scan failed before it was
+	// encoded.
+	Size       int64     `json:"size,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Duration is the time between StartedAt and FinishedAt, in seconds.
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// NewPayload returns the payload describing the scan recorded in the given history
+// record, which has just been added.
+func NewPayload(r *history.Record) *Payload {
+	event := EventCompleted
+	if r.Outcome == history.OutcomeFailed {
+		event = EventFailed
+	}
+
+	return &Payload{
+		Event:       event,
+		Job:         r.Options.Job,
+		User:        r.Options.User,
+		Outcome:     r.Outcome,
+		FileName:    r.FileName,
+		Destination: r.Destination,
+		Uploads:     r.Uploads,
+		Format:      r.Options.Format,
+		Size:        r.Size,
+		StartedAt:   r.StartedAt,
+		FinishedAt:  r.StartedAt.Add(time.Duration(r.Duration * float64(time.Second))),
+		Duration:    r.Duration,
+		Error:       r.Error,
+	}
+}
+
+// newSpoolPayload returns the payload describing the background upload of the file of
+// the given spool entry, under the given name or with the given error.
+func newSpoolPayload(e spool.Entry, fileName string, err error) *Payload {
+	upload := &history.Upload{
+		Destination: e.Options.UploadDestination(),
+		FileName:    fileName,
+		Outcome:     history.OutcomeUploaded,
+	}
+	p := &Payload{
+		Event:       EventCompleted,
+		Job:         e.Options.Job,
+		User:        e.Options.User,
+		Outcome:     history.OutcomeUploaded,
+		FileName:    fileName,
+		Destination: upload.Destination,
+		Uploads:     []*history.Upload{upload},
+		Format:      e.Options.Format,
+		Size:        e.Size,
+		StartedAt:   e.CreatedAt,
+		FinishedAt:  time.Now(),
+	}
+	if err != nil {
+		p.Event = EventFailed
+		p.Outcome = history.OutcomeFailed
+		p.Error = err.Error()
+		upload.Outcome = history.OutcomeFailed
+		upload.Error = p.Error
+	}
+	p.Duration = p.FinishedAt.Sub(p.StartedAt).Seconds()
+
+	return p
+}
+
+// Delivery describes the delivery of a notification to a webhook.
+type Delivery struct {
+	ID string `json:"id"`
+	// Webhook is the name of the webhook.
+	Webhook string `json:"webhook"`
+	Event   string `json:"event"`
+	Job     string `json:"job,omitempty"`
+	Status  Status `json:"status"`
+	// Attempts is the number of delivery attempts made so far.
+	Attempts int `json:"attempts"`
+	// ResponseStatus is the HTTP status the webhook responded to the last attempt with,
+	// or 0 if it couldn't be reached.
+	ResponseStatus int       `json:"response_status,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	// UpdatedAt is the time of the last attempt.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Filter selects the deliveries to return from the log. Fields with a zero value don't
+// filter anything.
+type Filter struct {
+	Webhook string
+	Job     string
+	Status  Status
+}
+
+// Notifier sends notifications to the configured webhooks, retries the deliveries that
+// fail, and keeps a log of the most recent deliveries in memory.
+type Notifier struct {
+	cfg        *config.WebhooksConfig
+	httpClient *http.Client
+
+	// log holds the most recent deliveries, oldest first.
+	log []*Delivery
+	mu  sync.Mutex
+}
+
+// NewNotifier returns a new Notifier for the configured webhooks.
+// Returns an error if the URL of a webhook isn't an absolute HTTP(S) URL, or if it
+// subscribes to an unknown event.
+func NewNotifier(cfg *config.WebhooksConfig) (*Notifier, error) {
+	for _, hook := range cfg.Hooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL for webhook %s", hook.Name)
+		}
+
+		for _, event := range hook.Events {
+			if event != EventCompleted && event != EventFailed {
+				return nil, fmt.Errorf("unknown event %q for webhook %s", event, hook.Name)
+			}
+		}
+	}
+
+	return &Notifier{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+// Notify sends the given payload to the webhooks subscribed to its event, in the
+// background. The logs of the deliveries are attached to the ID of the request from the
+// given context, if any.
+func (n *Notifier) Notify(ctx context.Context, p *Payload) {
+	hooks := n.subscribers(p.Event)
+	if len(hooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		logging.Entry(ctx).WithError(err).Error("Failed to serialise webhook payload")
+		return
+	}
+
+	// Don't let the deliveries be cancelled along with the request.
+	ctx = logging.WithRequestID(context.Background(), logging.RequestID(ctx))
+	for _, hook := range hooks {
+		d, err := n.newDelivery(hook, p)
+		if err != nil {
+			logging.Entry(ctx).WithError(err).Error("Failed to create webhook delivery")
+			continue
+		}
+
+		go n.deliver(ctx, hook, d, body)
+	}
+}
+
+// NotifySpooled notifies the webhooks that the background upload of the file of the
+// given spool entry is over. It's meant to be registered with spool.Spool.OnDone.
+func (n *Notifier) NotifySpooled(e spool.Entry, fileName string, err error) {
+	ctx := logging.WithRequestID(context.Background(), e.RequestID)
+	n.Notify(ctx, newSpoolPayload(e, fileName, err))
+}
+
+// Deliveries returns a copy of the deliveries in the log matching the given filter, most
+// recent first.
+func (n *Notifier) Deliveries(f *Filter) []Delivery {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	deliveries := make([]Delivery, 0, len(n.log))
+	for i := len(n.log) - 1; i >= 0; i-- {
+		d := n.log[i]
+		if (f.Webhook != "" && d.Webhook != f.Webhook) ||
+			(f.Job != "" && d.Job != f.Job) ||
+			(f.Status != "" && d.Status != f.Status) {
+			continue
+		}
+
+		deliveries = append(deliveries, *d)
+	}
+
+	return deliveries
+}
+
+// subscribers returns the webhooks subscribed to the given event.
+func (n *Notifier) subscribers(event string) []*config.WebhookConfig {
+	hooks := make([]*config.WebhookConfig, 0, len(n.cfg.Hooks))
+	for _, hook := range n.cfg.Hooks {
+		if len(hook.Events) == 0 {
+			hooks = append(hooks, hook)
+			continue
+		}
+
+		for _, e := range hook.Events {
+			if e == event {
+				hooks = append(hooks, hook)
+				break
+			}
+		}
+	}
+
+	return hooks
+}
+
+// newDelivery adds a new pending delivery of the given payload to the given webhook to
+// the log, and forgets the oldest one if the log is full.
+func (n *Notifier) newDelivery(hook *config.WebhookConfig, p *Payload) (*Delivery, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	d := &Delivery{
+		ID:        hex.EncodeToString(b),
+		Webhook:   hook.Name,
+		Event:     p.Event,
+		Job:       p.Job,
+		Status:    StatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.log = append(n.log, d)
+	if len(n.log) > n.cfg.LogSize {
+		n.log = n.log[len(n.log)-n.cfg.LogSize:]
+	}
+
+	return d, nil
+}
+
+// deliver sends the given body to the given webhook, and tries again, waiting
+// exponentially longer after each failure, until it's been delivered, the webhook
+// rejected it, or the maximum number of attempts has been reached.
+func (n *Notifier) deliver(
+	ctx context.Context,
+	hook *config.WebhookConfig,
+	d *Delivery,
+	body []byte,
+) {
+	entry := logging.Entry(ctx).WithField("webhook", hook.Name).WithField("delivery", d.ID)
+
+	backoff := n.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		status, err := n.send(ctx, hook, d, body)
+
+		final := err == nil || attempt >= n.cfg.MaxAttempts || isPermanent(status)
+		n.mu.Lock()
+		d.Attempts = attempt
+		d.ResponseStatus = status
+		d.UpdatedAt = time.Now()
+		d.LastError = ""
+		switch {
+		case err == nil:
+			d.Status = StatusDelivered
+		case final:
+			d.Status = StatusFailed
+			d.LastError = err.Error()
+		default:
+			d.LastError = err.Error()
+		}
+		n.mu.Unlock()
+
+		if err == nil {
+			metrics.WebhookDeliveries.WithLabelValues(metrics.ResultSuccess).Inc()
+			entry.WithField("attempts", attempt).Info("Delivered webhook notification")
+			return
+		}
+
+		if final {
+			metrics.WebhookDeliveries.WithLabelValues(metrics.ResultFailed).Inc()
+			entry.WithError(err).WithField("attempts", attempt).Error("Giving up on webhook notification")
+			return
+		}
+
+		entry.WithError(err).WithField("attempts", attempt).Warn("Failed to deliver webhook notification")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// send sends the given body to the given webhook once, and returns the status it
+// responded with, or 0 if it couldn't be reached.
+// Returns an error if the webhook couldn't be reached, or didn't respond with a 2xx
+// status.
+func (n *Notifier) send(
+	ctx context.Context,
+	hook *config.WebhookConfig,
+	d *Delivery,
+	body []byte,
+) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(eventHeader, d.Event)
+	req.Header.Set(deliveryHeader, d.ID)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, "sha256="+sign(hook.Secret, timestamp, body))
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read some of the body so the connection can be reused, but don't let a webhook make
+	// us read forever.
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// sign returns the hex-encoded HMAC-SHA256 of the given timestamp and body, keyed with
+// the given secret.
+func sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isPermanent returns whether the given status, which a webhook responded with, means
+// retrying is pointless, i.e. it's a client error other than a timeout or rate limiting.
+func isPermanent(status int) bool {
+	return status >= 400 && status < 500 &&
+		status != http.StatusRequestTimeout &&
+		status != http.StatusTooManyRequests
+}
@@ -0,0 +1,299 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/babolivier/scanner/config"
+)
+
+// receiver is a webhook receiving notifications, and responding to them with the given
+// statuses in order, then with 204 No Content.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+
+	status := http.StatusNoContent
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+// newTestNotifier returns a new Notifier for a webhook named test, which URL is the one
+// of a server serving the given receiver, attempting deliveries up to 3 times and
+// keeping up to 3 of them in its log.
+func newTestNotifier(t *testing.T, r *receiver) (*Notifier, *config.WebhookConfig) {
+	s := httptest.NewServer(r)
+	t.Cleanup(s.Close)
+
+	hook := &config.WebhookConfig{Name: "test", URL: s.URL, Secret: "secret"}
+	n, err := NewNotifier(&config.WebhooksConfig{
+		Hooks:        []*config.WebhookConfig{hook},
+		MaxAttempts:  3,
+		RetryBackoff: time.Millisecond,
+		Timeout:      5 * time.Second,
+		LogSize:      3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n, hook
+}
+
+func TestSign(t *testing.T) {
+	// Computed with:
+	// printf '%s' '1700000000.{"event":"scan.completed"}' | openssl dgst -sha256 -hmac secret
+	const want = "08fe8fbd4300cd88957f665d813da7b90d892a939f725536807fbe96e6e32d90"
+
+	if got := sign("secret", "1700000000", []byte(`{"event":"scan.completed"}`)); got != want {
+		t.Errorf("got signature %s; want %s", got, want)
+	}
+}
+
+func TestNotifySignsRequests(t *testing.T) {
+	r := new(receiver)
+	n, _ := newTestNotifier(t, r)
+
+	n.Notify(context.Background(), &Payload{Event: EventCompleted, Job: "job"})
+
+	// Deliveries happen in the background.
+	var deliveries []Delivery
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		deliveries = n.Deliveries(&Filter{})
+		if len(deliveries) == 1 && deliveries[0].Status != StatusPending {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the notification hasn't been delivered: %+v", deliveries)
+		}
+	}
+	if d := deliveries[0]; d.Status != StatusDelivered || d.Attempts != 1 || d.Job != "job" {
+		t.Errorf("got delivery %+v", d)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.requests) != 1 {
+		t.Fatalf("got %d requests; want 1", len(r.requests))
+	}
+	req, body := r.requests[0], r.bodies[0]
+
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got a %s request with Content-Type %q", req.Method, req.Header.Get("Content-Type"))
+	}
+	// Receivers rely on the names of the headers, so don't use the constants.
+	event, delivery := req.Header.Get("X-Scanner-Event"), req.Header.Get("X-Scanner-Delivery")
+	if event != EventCompleted || delivery != deliveries[0].ID {
+		t.Errorf("got event %q and delivery %q", event, delivery)
+	}
+
+	timestamp := req.Header.Get("X-Scanner-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Errorf("got timestamp %q; want the current Unix time", timestamp)
+	}
+
+	// Check the signature the way a receiver would.
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.Header.Get("X-Scanner-Signature"); got != want {
+		t.Errorf("got signature %q; want %q", got, want)
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		// wantAttempts is the number of requests that should be sent.
+		wantAttempts int
+		wantStatus   Status
+		// wantResponseStatus is the status of the last response.
+		wantResponseStatus int
+	}{
+		{name: "delivered", wantAttempts: 1, wantStatus: StatusDelivered, wantResponseStatus: http.StatusNoContent},
+		{
+			name:               "server error",
+			statuses:           []int{http.StatusInternalServerError, http.StatusBadGateway},
+			wantAttempts:       3,
+			wantStatus:         StatusDelivered,
+			wantResponseStatus: http.StatusNoContent,
+		},
+		{
+			name:               "rate limited",
+			statuses:           []int{http.StatusTooManyRequests},
+			wantAttempts:       2,
+			wantStatus:         StatusDelivered,
+			wantResponseStatus: http.StatusNoContent,
+		},
+		{
+			name:               "timeout",
+			statuses:           []int{http.StatusRequestTimeout},
+			wantAttempts:       2,
+			wantStatus:         StatusDelivered,
+			wantResponseStatus: http.StatusNoContent,
+		},
+		{
+			name:               "rejected",
+			statuses:           []int{http.StatusNotFound},
+			wantAttempts:       1,
+			wantStatus:         StatusFailed,
+			wantResponseStatus: http.StatusNotFound,
+		},
+		{
+			name:               "rejected after a server error",
+			statuses:           []int{http.StatusServiceUnavailable, http.StatusBadRequest},
+			wantAttempts:       2,
+			wantStatus:         StatusFailed,
+			wantResponseStatus: http.StatusBadRequest,
+		},
+		{
+			name: "out of attempts",
+			statuses: []int{
+				http.StatusInternalServerError,
+				http.StatusInternalServerError,
+				http.StatusInternalServerError,
+				http.StatusInternalServerError,
+			},
+			wantAttempts:       3,
+			wantStatus:         StatusFailed,
+			wantResponseStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &receiver{statuses: tt.statuses}
+			n, hook := newTestNotifier(t, r)
+
+			d, err := n.newDelivery(hook, &Payload{Event: EventFailed})
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.deliver(context.Background(), hook, d, []byte(`{"event":"scan.failed"}`))
+
+			if len(r.requests) != tt.wantAttempts {
+				t.Errorf("got %d requests; want %d", len(r.requests), tt.wantAttempts)
+			}
+			if d.Attempts != tt.wantAttempts || d.Status != tt.wantStatus || d.ResponseStatus != tt.wantResponseStatus {
+				t.Errorf(
+					"got %d attempts, status %s and response status %d; want %d, %s and %d",
+					d.Attempts, d.Status, d.ResponseStatus, tt.wantAttempts, tt.wantStatus, tt.wantResponseStatus,
+				)
+			}
+			if (d.LastError == "") != (tt.wantStatus == StatusDelivered) {
+				t.Errorf("got last error %q for a %s delivery", d.LastError, d.Status)
+			}
+		})
+	}
+}
+
+func TestDeliveries(t *testing.T) {
+	n, _ := newTestNotifier(t, new(receiver))
+
+	// Add more deliveries than the log can hold.
+	hooks := []*config.WebhookConfig{{Name: "a"}, {Name: "b"}}
+	for i, job := range []string{"1", "2", "3", "4", "5"} {
+		d, err := n.newDelivery(hooks[i%2], &Payload{Event: EventCompleted, Job: job})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job == "4" {
+			d.Status = StatusFailed
+		}
+	}
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		wantJobs []string
+	}{
+		{name: "all", wantJobs: []string{"5", "4", "3"}},
+		{name: "webhook", filter: Filter{Webhook: "a"}, wantJobs: []string{"5", "3"}},
+		{name: "job", filter: Filter{Job: "4"}, wantJobs: []string{"4"}},
+		{name: "forgotten job", filter: Filter{Job: "1"}, wantJobs: []string{}},
+		{name: "status", filter: Filter{Status: StatusPending}, wantJobs: []string{"5", "3"}},
+		{name: "everything", filter: Filter{Webhook: "b", Job: "4", Status: StatusFailed}, wantJobs: []string{"4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deliveries := n.Deliveries(&tt.filter)
+
+			jobs := make([]string, len(deliveries))
+			for i, d := range deliveries {
+				jobs[i] = d.Job
+			}
+			if len(jobs) != len(tt.wantJobs) {
+				t.Fatalf("got the deliveries for jobs %q; want %q", jobs, tt.wantJobs)
+			}
+			for i := range jobs {
+				if jobs[i] != tt.wantJobs[i] {
+					t.Fatalf("got the deliveries for jobs %q; want %q", jobs, tt.wantJobs)
+				}
+			}
+		})
+	}
+}
+
+func TestSubscribers(t *testing.T) {
+	n, err := NewNotifier(&config.WebhooksConfig{
+		Hooks: []*config.WebhookConfig{
+			{Name: "all", URL: "https://example.com/all"},
+			{Name: "completed", URL: "https://example.com/completed", Events: []string{EventCompleted}},
+			{Name: "failed", URL: "https://example.com/failed", Events: []string{EventFailed}},
+			{Name: "both", URL: "https://example.com/both", Events: []string{EventFailed, EventCompleted}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for event, want := range map[string][]string{
+		EventCompleted: {"all", "completed", "both"},
+		EventFailed:    {"all", "failed", "both"},
+	} {
+		hooks := n.subscribers(event)
+
+		names := make([]string, len(hooks))
+		for i, hook := range hooks {
+			names[i] = hook.Name
+		}
+		if len(names) != len(want) {
+			t.Errorf("got subscribers %q to %s; want %q", names, event, want)
+			continue
+		}
+		for i := range names {
+			if names[i] != want[i] {
+				t.Errorf("got subscribers %q to %s; want %q", names, event, want)
+				break
+			}
+		}
+	}
+}